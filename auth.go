@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errUnauthenticated  = errors.New("missing or invalid credentials")
+	errPermissionDenied = errors.New("operation requires the operator role")
+)
+
+// apiToken is an APITokenConfig whose token has been loaded.
+type apiToken struct {
+	token []byte
+	role  pmuxlib.APIRole
+}
+
+// apiAuth authenticates clients of the control socket and gRPC API, and
+// authorizes the operations they perform, as described by an APIAuthConfig.
+type apiAuth struct {
+	enabled     bool
+	tokens      []apiToken
+	clientRoles map[string]pmuxlib.APIRole
+}
+
+// newAPIAuth loads the tokens of the APIAuthConfig, which is expected to have
+// been validated.
+func newAPIAuth(cfg pmuxlib.APIAuthConfig) (*apiAuth, error) {
+
+	a := &apiAuth{enabled: cfg.Enabled()}
+
+	for _, tokenCfg := range cfg.Tokens {
+
+		token := tokenCfg.Token
+		if tokenCfg.TokenFile != "" {
+			b, err := os.ReadFile(tokenCfg.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading tokenFile: %w", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+
+		if token == "" {
+			return nil, fmt.Errorf("tokenFile %q is empty", tokenCfg.TokenFile)
+		}
+
+		a.tokens = append(a.tokens, apiToken{
+			token: []byte(token), role: tokenCfg.Role,
+		})
+	}
+
+	if cfg.TLS != nil {
+		a.clientRoles = cfg.TLS.ClientRoles
+	}
+
+	return a, nil
+}
+
+// authorize returns nil if a client, which presented the given bearer token
+// (which may be empty) and verified client certificate chains, may perform an
+// operation requiring the given role.
+func (a *apiAuth) authorize(
+	token string, verifiedChains [][]*x509.Certificate, required pmuxlib.APIRole,
+) error {
+
+	if !a.enabled {
+		return nil
+	}
+
+	var (
+		role          pmuxlib.APIRole
+		authenticated bool
+	)
+
+	grant := func(r pmuxlib.APIRole) {
+		if !authenticated || r.Allows(role) {
+			role, authenticated = r, true
+		}
+	}
+
+	if token != "" {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), t.token) == 1 {
+				grant(t.role)
+			}
+		}
+	}
+
+	for _, chain := range verifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		if r, ok := a.clientRoles[chain[0].Subject.CommonName]; ok {
+			grant(r)
+		}
+	}
+
+	if !authenticated {
+		return errUnauthenticated
+	} else if !role.Allows(required) {
+		return errPermissionDenied
+	}
+
+	return nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>"
+// header value, or the empty string.
+func bearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) < len(prefix) ||
+		!strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// httpMiddleware wraps the handler so that each request must be authorized
+// for the role which pathRoles gives for its path, or APIRoleOperator if the
+// path isn't in pathRoles.
+func (a *apiAuth) httpMiddleware(
+	h http.Handler, pathRoles map[string]pmuxlib.APIRole,
+) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+
+		required, ok := pathRoles[r.URL.Path]
+		if !ok {
+			required = pmuxlib.APIRoleOperator
+		}
+
+		var verifiedChains [][]*x509.Certificate
+		if r.TLS != nil {
+			verifiedChains = r.TLS.VerifiedChains
+		}
+
+		token := bearerToken(r.Header.Get("Authorization"))
+
+		switch err := a.authorize(token, verifiedChains, required); {
+		case errors.Is(err, errUnauthenticated):
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+		case err != nil:
+			http.Error(rw, err.Error(), http.StatusForbidden)
+		default:
+			h.ServeHTTP(rw, r)
+		}
+	})
+}
+
+// authorizeGRPC authorizes the gRPC call described by the context for the
+// role which methodRoles gives for the method, or APIRoleOperator if the
+// method isn't in methodRoles.
+func (a *apiAuth) authorizeGRPC(
+	ctx context.Context, method string, methodRoles map[string]pmuxlib.APIRole,
+) error {
+
+	required, ok := methodRoles[method]
+	if !ok {
+		required = pmuxlib.APIRoleOperator
+	}
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get("authorization"); len(vals) > 0 {
+			token = bearerToken(vals[0])
+		}
+	}
+
+	var (
+		verifiedChains [][]*x509.Certificate
+		secure         bool
+	)
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			verifiedChains = tlsInfo.State.VerifiedChains
+			secure = true
+		} else if p.Addr != nil && p.Addr.Network() == "unix" {
+			secure = true
+		}
+	}
+
+	// a token sent in plaintext over TCP could have been read by anyone on
+	// the network, so it isn't accepted.
+	if token != "" && !secure {
+		return status.Error(
+			codes.Unauthenticated, "bearer tokens are only accepted over TLS",
+		)
+	}
+
+	switch err := a.authorize(token, verifiedChains, required); {
+	case errors.Is(err, errUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return nil
+	}
+}
+
+// grpcServerOptions returns the options which configure a gRPC server to
+// authorize every call using methodRoles (see authorizeGRPC), and to serve over
+// TLS if the APITLSConfig is given.
+func (a *apiAuth) grpcServerOptions(
+	tlsCfg *pmuxlib.APITLSConfig, methodRoles map[string]pmuxlib.APIRole,
+) (
+	[]grpc.ServerOption, error,
+) {
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (
+			interface{}, error,
+		) {
+			err := a.authorizeGRPC(ctx, info.FullMethod, methodRoles)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(
+			srv interface{},
+			ss grpc.ServerStream,
+			info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			err := a.authorizeGRPC(ss.Context(), info.FullMethod, methodRoles)
+			if err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+
+	if tlsCfg == nil {
+		return opts, nil
+	}
+
+	serverTLS, err := serverTLSConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts, grpc.Creds(credentials.NewTLS(serverTLS))), nil
+}
+
+// serverTLSConfig returns the tls.Config which the gRPC API and dashboard are
+// served over, as described by the APITLSConfig.
+func serverTLSConfig(tlsCfg *pmuxlib.APITLSConfig) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsCfg.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(tlsCfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading clientCAFile: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf(
+				"clientCAFile %q contains no certificates", tlsCfg.ClientCAFile,
+			)
+		}
+
+		// clients without a certificate may still authenticate using a
+		// token, so certificates are verified but not required.
+		serverTLS.ClientCAs = pool
+		serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return serverTLS, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// checkProcessEnv checks that the command and directory of the given process
+// exist on this machine, returning a description of each problem found.
+func checkProcessEnv(procCfg pmuxlib.ProcessConfig) []string {
+
+	var problems []string
+
+	if procCfg.Chroot != "" {
+		if _, err := os.Stat(procCfg.Chroot); err != nil {
+			problems = append(problems, fmt.Sprintf("chroot: %v", err))
+		}
+
+		// The remaining checks would need to be performed relative to the
+		// chroot, and PATH lookups can't be, so don't bother.
+		return problems
+	}
+
+	// a dir which pmux creates needn't exist yet.
+	if procCfg.Dir != "" && !procCfg.CreateDir {
+		if stat, err := os.Stat(procCfg.Dir); err != nil {
+			problems = append(problems, fmt.Sprintf("dir: %v", err))
+		} else if !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf(
+				"dir: %q is not a directory", procCfg.Dir,
+			))
+		}
+	}
+
+	if _, err := procCfg.ResolveCmd(); err != nil {
+		problems = append(problems, fmt.Sprintf("cmd: %v", err))
+	}
+
+	return problems
+}
+
+// checkConfig performs checks against the current environment on an already
+// validated Config, returning the expanded Config if they all pass.
+func checkConfig(cfg pmuxlib.Config) (pmuxlib.Config, error) {
+
+	cfg, err := cfg.ExpandTemplates()
+	if err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	var problems []string
+	for _, procCfg := range cfg.Processes {
+		for _, problem := range checkProcessEnv(procCfg) {
+			problems = append(problems, fmt.Sprintf(
+				"process %q: %s", procCfg.Name, problem,
+			))
+		}
+	}
+
+	if len(problems) > 0 {
+		return pmuxlib.Config{}, &pmuxlib.ValidationError{Problems: problems}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+
+	"gopkg.in/yaml.v2"
+)
+
+// `pmux import compose` converts the services of a docker-compose file into a
+// pmux config. Only the fields which make sense outside of a container are
+// converted, the rest are listed in comments so that they can be dealt with
+// by hand.
+
+// composeService is the subset of a docker-compose service which is
+// converted. Fields which may be given in more than one form are left as
+// interface{} values.
+type composeService struct {
+	Command         interface{}            `yaml:"command"`
+	Entrypoint      interface{}            `yaml:"entrypoint"`
+	Environment     interface{}            `yaml:"environment"`
+	DependsOn       interface{}            `yaml:"depends_on"`
+	Restart         string                 `yaml:"restart"`
+	WorkingDir      string                 `yaml:"working_dir"`
+	User            string                 `yaml:"user"`
+	Labels          interface{}            `yaml:"labels"`
+	Profiles        []string               `yaml:"profiles"`
+	StopGracePeriod string                 `yaml:"stop_grace_period"`
+	Healthcheck     *composeHealthcheck    `yaml:"healthcheck"`
+	Other           map[string]interface{} `yaml:",inline"`
+}
+
+type composeHealthcheck struct {
+	Test     interface{} `yaml:"test"`
+	Interval string      `yaml:"interval"`
+	Disable  bool        `yaml:"disable"`
+}
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+// composeStrings returns the value of a field which may be given as either a
+// string or a list of strings. If it's a string then split determines whether
+// it's split into words like a shell would.
+func composeStrings(v interface{}, split bool) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if !split {
+			return []string{v}, nil
+		}
+		return pmuxlib.SplitArgs(v)
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i := range v {
+			strs[i] = fmt.Sprint(v[i])
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("unexpected value %v", v)
+	}
+}
+
+// composeMap returns the value of a field which may be given as either a map
+// or a list of "key=value" strings. Keys without a value are given an empty
+// one, unless skipUnset is set, in which case they're omitted.
+func composeMap(v interface{}, skipUnset bool) (map[string]string, error) {
+	m := map[string]string{}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			if val == nil && skipUnset {
+				continue
+			} else if val == nil {
+				val = ""
+			}
+			m[fmt.Sprint(k)] = fmt.Sprint(val)
+		}
+	case []interface{}:
+		for _, kv := range v {
+			k, val, ok := strings.Cut(fmt.Sprint(kv), "=")
+			if ok || !skipUnset {
+				m[k] = val
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected value %v", v)
+	}
+	return m, nil
+}
+
+// composeDependsOn returns the names of the services which a service depends
+// on, which may be given as a list or a map.
+func composeDependsOn(v interface{}) ([]string, error) {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, fmt.Sprint(name))
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	return composeStrings(v, false)
+}
+
+// composePort returns the first TCP port which the service listens on, as
+// given by its ports or else its expose field, or false if it has none. This
+// is the port within the container, rather than any it's published on, as
+// that's what the converted process will listen on.
+func composePort(svc composeService) (string, bool) {
+	for _, key := range []string{"ports", "expose"} {
+		ports, _ := svc.Other[key].([]interface{})
+		for _, port := range ports {
+			var target, protocol string
+
+			// ports may be given in the long form, e.g. {target: 80}, or the
+			// short form, e.g. "127.0.0.1:8080:80/tcp".
+			if m, ok := port.(map[interface{}]interface{}); ok {
+				target = fmt.Sprint(m["target"])
+				if p, ok := m["protocol"]; ok {
+					protocol = fmt.Sprint(p)
+				}
+			} else {
+				target, protocol, _ = strings.Cut(fmt.Sprint(port), "/")
+				target = target[strings.LastIndexByte(target, ':')+1:]
+			}
+
+			// only the first port of a range is waited for.
+			target, _, _ = strings.Cut(target, "-")
+
+			if protocol != "" && protocol != "tcp" {
+				continue
+			} else if _, err := strconv.ParseUint(target, 10, 16); err == nil {
+				return target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// orderComposeServices returns the names of the services ordered so that
+// each comes after those it depends on, and otherwise by name. pmux starts all
+// processes at once, so this only makes the dependencies easier to follow in
+// the converted config; they're enforced by waitFor where possible, see
+// importCompose.
+func orderComposeServices(deps map[string][]string) ([]string, error) {
+
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		ordered  []string
+		visited  = map[string]bool{}
+		visiting = map[string]bool{}
+		visit    func(string) error
+	)
+
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		} else if visiting[name] {
+			return fmt.Errorf("services depend on each other in a cycle, including %q", name)
+		}
+
+		visiting[name] = true
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok {
+				return fmt.Errorf("service %q depends on unknown service %q", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+
+		visited[name] = true
+		ordered = append(ordered, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// convertComposeService converts the service into a ProcessConfig, returning
+// notes describing anything which couldn't be converted.
+func convertComposeService(
+	name string, svc composeService,
+) (
+	pmuxlib.ProcessConfig, []string, error,
+) {
+
+	var notes []string
+	notef := func(str string, args ...interface{}) {
+		notes = append(notes, fmt.Sprintf(str, args...))
+	}
+
+	procCfg := pmuxlib.ProcessConfig{
+		Name:     name,
+		Dir:      svc.WorkingDir,
+		Profiles: svc.Profiles,
+	}
+
+	entrypoint, err := composeStrings(svc.Entrypoint, true)
+	if err != nil {
+		return procCfg, nil, fmt.Errorf("entrypoint: %w", err)
+	}
+
+	command, err := composeStrings(svc.Command, true)
+	if err != nil {
+		return procCfg, nil, fmt.Errorf("command: %w", err)
+	}
+
+	if cmd := append(entrypoint, command...); len(cmd) > 0 {
+		procCfg.Cmd, procCfg.Args = cmd[0], cmd[1:]
+	} else {
+		notef("no command or entrypoint, so cmd must be filled in from the image")
+	}
+
+	// variables without a value are taken from the environment of compose,
+	// and processes inherit pmux's environment anyway.
+	env, err := composeMap(svc.Environment, true)
+	if err != nil {
+		return procCfg, nil, fmt.Errorf("environment: %w", err)
+	}
+	if len(env) > 0 {
+		procCfg.Env = env
+	}
+
+	labels, err := composeMap(svc.Labels, false)
+	if err != nil {
+		return procCfg, nil, fmt.Errorf("labels: %w", err)
+	}
+	procCfg.Labels = labels
+
+	if svc.User != "" {
+		procCfg.User, procCfg.Group, _ = strings.Cut(svc.User, ":")
+	}
+
+	switch restart := svc.Restart; {
+	case restart == "", restart == "no":
+		// compose doesn't restart services by default, unlike pmux.
+		procCfg.NoRestartOnExit = []pmuxlib.ExitMatcher{"any"}
+	case restart == "always", restart == "unless-stopped":
+	case strings.HasPrefix(restart, "on-failure"):
+		procCfg.OneShot = true
+		if _, max, ok := strings.Cut(restart, ":"); ok {
+			notef("restart %q: the limit of %s restarts wasn't converted", restart, max)
+		}
+	default:
+		notef("restart %q wasn't recognized", restart)
+	}
+
+	if svc.StopGracePeriod != "" {
+		if procCfg.SigKillWait, err = time.ParseDuration(svc.StopGracePeriod); err != nil {
+			notef("stop_grace_period %q couldn't be parsed", svc.StopGracePeriod)
+		}
+	}
+
+	if hc := svc.Healthcheck; hc != nil && !hc.Disable {
+		test, err := composeStrings(hc.Test, false)
+		if err != nil {
+			return procCfg, nil, fmt.Errorf("healthcheck.test: %w", err)
+		}
+
+		switch {
+		case len(test) == 1:
+			procCfg.ReadyCheck.Cmd = test[0]
+		case len(test) > 1 && test[0] == "CMD-SHELL":
+			procCfg.ReadyCheck.Cmd = strings.Join(test[1:], " ")
+		case len(test) > 1 && test[0] == "CMD":
+			procCfg.ReadyCheck.Cmd = strings.Join(test[1:], " ")
+			notef("healthcheck.test was converted into a shell command, check its quoting")
+		}
+
+		if hc.Interval != "" {
+			if procCfg.ReadyCheck.Interval, err = time.ParseDuration(hc.Interval); err != nil {
+				notef("healthcheck.interval %q couldn't be parsed", hc.Interval)
+			}
+		}
+	}
+
+	otherKeys := make([]string, 0, len(svc.Other))
+	for k := range svc.Other {
+		otherKeys = append(otherKeys, k)
+	}
+	sort.Strings(otherKeys)
+
+	if len(otherKeys) > 0 {
+		notef("not converted: %s", strings.Join(otherKeys, ", "))
+	}
+
+	return procCfg, notes, nil
+}
+
+// importCompose converts the docker-compose file read from r into a pmux
+// config, which is written to w as YAML.
+func importCompose(w io.Writer, r io.Reader, path string) error {
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	var file composeFile
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("parsing %q: %w", path, err)
+	} else if len(file.Services) == 0 {
+		return fmt.Errorf("%q has no services", path)
+	}
+
+	deps := map[string][]string{}
+	for name, svc := range file.Services {
+		if deps[name], err = composeDependsOn(svc.DependsOn); err != nil {
+			return fmt.Errorf("service %q: depends_on: %w", name, err)
+		}
+	}
+
+	names, err := orderComposeServices(deps)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cfg   pmuxlib.Config
+		notes []string
+	)
+
+	for _, name := range names {
+		procCfg, procNotes, err := convertComposeService(name, file.Services[name])
+		if err != nil {
+			return fmt.Errorf("service %q: %w", name, err)
+		}
+
+		// pmux has no equivalent of depends_on, as it starts all processes at
+		// once, so instead the process waits for the port of each service it
+		// depends on to accept connections. Dependencies without a known port
+		// are left to be dealt with by hand.
+		for _, dep := range deps[name] {
+			if port, ok := composePort(file.Services[dep]); ok {
+				procCfg.WaitFor = append(procCfg.WaitFor, pmuxlib.WaitForConfig{
+					TCP: "localhost:" + port,
+				})
+				continue
+			}
+
+			procNotes = append(procNotes, fmt.Sprintf(
+				"depends_on %q wasn't converted, as it has no TCP port to waitFor and pmux starts processes concurrently",
+				dep,
+			))
+		}
+
+		for _, note := range procNotes {
+			notes = append(notes, fmt.Sprintf("%s: %s", name, note))
+		}
+
+		cfg.Processes = append(cfg.Processes, procCfg)
+	}
+
+	cfgB, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+
+	fmt.Fprintf(w, "# Generated by `pmux import compose` from %s.\n", path)
+	fmt.Fprintln(w, "# Processes are ordered so that each comes after those it depends on,")
+	fmt.Fprintln(w, "# but are still started concurrently. Each waits for the TCP port of the")
+	fmt.Fprintln(w, "# services it depends on, where one is known.")
+	if len(notes) > 0 {
+		fmt.Fprintln(w, "#\n# These need to be dealt with by hand:")
+		for _, note := range notes {
+			fmt.Fprintf(w, "#  - %s\n", note)
+		}
+	}
+	fmt.Fprintln(w)
+
+	_, err = w.Write(cfgB)
+	return err
+}
+
+// runImportCommand runs `pmux import compose <file>`, which doesn't need a
+// pmux config.
+func runImportCommand(args []string) error {
+
+	const usage = "usage: pmux import compose [-o <file>] <docker-compose.yml>"
+
+	if len(args) < 2 || args[1] != "compose" {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("import compose", flag.ContinueOnError)
+	outPath := flags.String(
+		"o", "-", "File to write the pmux config to, or - for stdout.",
+	)
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	} else if flags.NArg() != 1 {
+		return errors.New(usage)
+	}
+
+	path := flags.Arg(0)
+
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer in.Close()
+
+	buf := new(bytes.Buffer)
+	if err := importCompose(buf, in, path); err != nil {
+		return err
+	}
+
+	if *outPath == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	if err := os.WriteFile(*outPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("writing %q: %w", *outPath, err)
+	}
+
+	return nil
+}
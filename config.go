@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// supported config formats.
+const (
+	configFormatYAML = "yaml"
+	configFormatJSON = "json"
+	configFormatTOML = "toml"
+)
+
+// configFormatByExt returns the config format implied by the extension of the
+// given file name, or empty string if the extension isn't recognized.
+func configFormatByExt(name string) string {
+	switch filepath.Ext(name) {
+	case ".yml", ".yaml":
+		return configFormatYAML
+	case ".json":
+		return configFormatJSON
+	case ".toml":
+		return configFormatTOML
+	default:
+		return ""
+	}
+}
+
+// decodeConfig decodes a Config from the given bytes, which are in the given
+// format. Decoding is strict, in that unknown fields result in an error.
+//
+// JSON and TOML are decoded generically and then re-encoded as YAML, so that
+// all formats are decoded into the Config by the same YAML decoder and behave
+// the same. A consequence of this is that line numbers in decoding errors only
+// correspond to the original file when it is YAML.
+func decodeConfig(b []byte, format string) (pmuxlib.Config, error) {
+
+	var (
+		generic interface{}
+		err     error
+	)
+
+	switch format {
+	case configFormatYAML:
+	case configFormatJSON:
+		err = json.Unmarshal(b, &generic)
+	case configFormatTOML:
+		var m map[string]interface{}
+		err = toml.Unmarshal(b, &m)
+		generic = m
+	default:
+		return pmuxlib.Config{}, fmt.Errorf("unknown config format %q", format)
+	}
+
+	if err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	if generic != nil {
+		if b, err = yaml.Marshal(generic); err != nil {
+			return pmuxlib.Config{}, fmt.Errorf("re-encoding as yaml: %w", err)
+		}
+	}
+
+	var cfg pmuxlib.Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// stdinConfigPath is the config path which indicates that the config should be
+// read from stdin.
+const stdinConfigPath = "-"
+
+// configLoader loads config files, keeping track of which files have already
+// been loaded so that include cycles can be detected.
+type configLoader struct {
+
+	// format, if set, is used as the format of all loaded files, rather than
+	// the format being determined by file extension.
+	format string
+
+	loading map[string]bool
+
+	// bodies holds the contents of URLs which have already been fetched, which
+	// are used rather than fetching them again.
+	bodies map[string]remoteBody
+
+	// versions records the version (see fetchURL) of the contents of each URL
+	// which was loaded.
+	versions map[string]string
+}
+
+func newConfigLoader(format string) *configLoader {
+	return &configLoader{
+		format:   format,
+		loading:  map[string]bool{},
+		bodies:   map[string]remoteBody{},
+		versions: map[string]string{},
+	}
+}
+
+func (l *configLoader) fileFormat(path string) string {
+
+	name := path
+	if isURL(path) {
+		name = urlPath(path)
+	}
+
+	if l.format != "" {
+		return l.format
+	} else if format := configFormatByExt(name); format != "" {
+		return format
+	}
+	return configFormatYAML
+}
+
+func (l *configLoader) read(path string) ([]byte, error) {
+	if path == stdinConfigPath {
+		return ioutil.ReadAll(os.Stdin)
+	} else if isURL(path) {
+		if body, ok := l.bodies[path]; ok {
+			l.versions[path] = body.version
+			return body.body, nil
+		}
+
+		b, version, err := fetchURL(context.Background(), path, "")
+		if err != nil {
+			return nil, err
+		}
+
+		l.versions[path] = version
+		return b, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// includePaths returns the paths which are matched by an include pattern
+// found in the file at the given path.
+func includePaths(path, pattern string) ([]string, error) {
+
+	if isURL(pattern) {
+		return []string{pattern}, nil
+
+	} else if isURL(path) {
+		// globs can't be performed over HTTP, so the pattern is treated as a
+		// plain URL reference.
+		includeURL, err := resolveURL(path, pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []string{includeURL}, nil
+	}
+
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (l *configLoader) loadFile(path string) (pmuxlib.Config, error) {
+
+	absPath := path
+	if !isURL(path) {
+		var err error
+		if absPath, err = filepath.Abs(path); err != nil {
+			return pmuxlib.Config{}, fmt.Errorf(
+				"resolving path %q: %w", path, err,
+			)
+		}
+	}
+
+	if l.loading[absPath] {
+		return pmuxlib.Config{}, fmt.Errorf("%q is included recursively", path)
+	}
+
+	l.loading[absPath] = true
+	defer delete(l.loading, absPath)
+
+	cfgB, err := l.read(path)
+	if err != nil {
+		return pmuxlib.Config{}, fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	return l.loadBytes(path, cfgB)
+}
+
+// loadBytes decodes the given config file contents, which were read from the
+// given path, and loads any files it includes.
+func (l *configLoader) loadBytes(
+	path string, cfgB []byte,
+) (
+	pmuxlib.Config, error,
+) {
+
+	cfg, err := decodeConfig(cfgB, l.fileFormat(path))
+	if err != nil {
+		return pmuxlib.Config{}, fmt.Errorf("parsing %q: %w", path, err)
+	}
+
+	include := cfg.Include
+	cfg.Include = nil
+
+	for _, pattern := range include {
+
+		paths, err := includePaths(path, pattern)
+		if err != nil {
+			return pmuxlib.Config{}, fmt.Errorf(
+				"invalid include pattern %q in %q: %w", pattern, path, err,
+			)
+		}
+
+		for _, includePath := range paths {
+			includeCfg, err := l.load(includePath)
+			if err != nil {
+				return pmuxlib.Config{}, err
+			}
+			cfg = cfg.Merge(includeCfg)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (l *configLoader) loadDir(path string) (pmuxlib.Config, error) {
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return pmuxlib.Config{}, fmt.Errorf("reading dir %q: %w", path, err)
+	}
+
+	var cfg pmuxlib.Config
+	for _, entry := range entries {
+
+		if entry.IsDir() || configFormatByExt(entry.Name()) == "" {
+			continue
+		}
+
+		entryCfg, err := l.loadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return pmuxlib.Config{}, err
+		}
+
+		cfg = cfg.Merge(entryCfg)
+	}
+
+	return cfg, nil
+}
+
+func (l *configLoader) load(path string) (pmuxlib.Config, error) {
+
+	if path == stdinConfigPath || isURL(path) {
+		return l.loadFile(path)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	if stat.IsDir() {
+		return l.loadDir(path)
+	}
+
+	return l.loadFile(path)
+}
+
+// loadConfig loads the Config at the given path, which may be either a single
+// file, a directory, an HTTP(S) URL, or "-" to indicate stdin. If it is a directory then all config files directly
+// within it are loaded and merged, in lexical order. Any files referenced by
+// the Include field of a loaded file are loaded and merged into it as well.
+//
+// If format is empty then the format of each file is determined by its
+// extension, defaulting to yaml.
+//
+// The version (see fetchURL) of the contents of each URL which was loaded,
+// whether it was path itself or an include, is returned as well. The contents
+// of any URL in bodies are taken from there, rather than being fetched.
+func loadConfig(
+	path, format string, bodies map[string]remoteBody,
+) (
+	pmuxlib.Config, map[string]string, error,
+) {
+	l := newConfigLoader(format)
+	for url, body := range bodies {
+		l.bodies[url] = body
+	}
+
+	cfg, err := l.load(path)
+	return cfg, l.versions, err
+}
+
+// loadInlineConfig loads a Config from the given config file contents, which
+// were taken from the environment variable of the given name. Includes are
+// resolved relative to the current working directory.
+func loadInlineConfig(envVar, cfgStr, format string) (pmuxlib.Config, error) {
+	return newConfigLoader(format).loadBytes(envVar, []byte(cfgStr))
+}
+
+// configSource describes where the Config should be loaded from, and how it
+// should be processed once loaded.
+type configSource struct {
+
+	// path and format are passed to loadConfig, unless inline is set in which
+	// case it is used as the config contents (see loadInlineConfig).
+	path, format string
+	inline       string
+
+	// bodies, if set, are used as the contents of the URLs they're keyed by,
+	// rather than them being fetched. They're used when the contents have
+	// already been fetched while polling for changes.
+	bodies map[string]remoteBody
+
+	// only, except, and profiles are passed to filterProcesses.
+	only, except, profiles []string
+
+	// verbosity, if set, overrides the Verbosity of the Config.
+	verbosity pmuxlib.Verbosity
+
+	// raw, if set, enables the Raw option of the Config.
+	raw bool
+}
+
+// load loads, validates, and filters the Config. If the Config fails
+// validation then a *pmuxlib.ValidationError is returned.
+func (src configSource) load() (pmuxlib.Config, error) {
+	cfg, _, err := src.loadVersions()
+	return cfg, err
+}
+
+// loadVersions is like load, but also returns the version of each URL which
+// the config was loaded from, see loadConfig.
+func (src configSource) loadVersions() (
+	pmuxlib.Config, map[string]string, error,
+) {
+
+	var (
+		cfg      pmuxlib.Config
+		versions map[string]string
+		err      error
+	)
+
+	if src.inline != "" {
+		cfg, err = loadInlineConfig(inlineConfigEnvVar, src.inline, src.format)
+		if err != nil {
+			return pmuxlib.Config{}, nil, fmt.Errorf(
+				"loading config from %s: %w", inlineConfigEnvVar, err,
+			)
+		}
+
+	} else if cfg, versions, err = loadConfig(
+		src.path, src.format, src.bodies,
+	); err != nil {
+		return pmuxlib.Config{}, nil, fmt.Errorf(
+			"loading config at %q: %w", src.path, err,
+		)
+	}
+
+	if src.verbosity != "" {
+		cfg.Verbosity = src.verbosity
+	}
+
+	if src.raw {
+		cfg.Raw = &src.raw
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return pmuxlib.Config{}, nil, err
+	}
+
+	// plugins are given the config as it was loaded, prior to filtering, and
+	// any output they have is written to stderr as pmux isn't running yet.
+	if cfg, err = cfg.RunConfigPlugins(
+		context.Background(), pmuxlib.PlainLogger{Writer: os.Stderr},
+	); err != nil {
+		return pmuxlib.Config{}, nil, fmt.Errorf("running configLoad plugins: %w", err)
+	}
+
+	if cfg, err = filterProcesses(
+		cfg, src.only, src.except, src.profiles,
+	); err != nil {
+		return pmuxlib.Config{}, nil, fmt.Errorf("filtering processes: %w", err)
+	}
+
+	return cfg, versions, nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// The control socket serves a simple HTTP API, which the pmux binary itself
+// uses as a client when given a command like `pmux start <name>`.
+
+// versionHeader is the header of /status responses which holds the version of
+// the running pmux.
+const versionHeader = "Pmux-Version"
+
+// controlErrStatus returns the HTTP status code which should be used in a
+// response for the given error.
+func controlErrStatus(err error) int {
+	if errors.Is(err, pmuxlib.ErrNotRunning) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// forSelectedProcesses calls fn with the given process name or, if name is
+// empty, with the name of each process matching the given label selector.
+func forSelectedProcesses(
+	p *pmuxlib.Pmux, name, selector string, fn func(name string) error,
+) error {
+
+	switch {
+	case name != "" && selector != "":
+		return errors.New("only one of name or selector may be given")
+	case name != "":
+		return fn(name)
+	case selector == "":
+		return errors.New("name or selector is required")
+	}
+
+	sel, err := pmuxlib.ParseLabelSelector(selector)
+	if err != nil {
+		return err
+	}
+
+	names, err := p.SelectProcesses(sel)
+	if err != nil {
+		return err
+	} else if len(names) == 0 {
+		return fmt.Errorf("no processes match selector %q", selector)
+	}
+
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// controlHandler returns a handler for a control API endpoint which performs
+// an action on a single process, identified by the "name" query parameter, or
+// on each process matching the label selector in the "selector" query
+// parameter.
+func controlHandler(
+	p *pmuxlib.Pmux, fn func(name string) error,
+) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name, selector := r.FormValue("name"), r.FormValue("selector")
+
+		if err := forSelectedProcesses(p, name, selector, fn); err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+
+		fmt.Fprintln(rw, "ok")
+	}
+}
+
+// forAllProcesses wraps a function which acts on a single process so that, if
+// it's given the name "all", it acts on every process instead.
+func forAllProcesses(
+	p *pmuxlib.Pmux, fn func(name string) error,
+) func(
+	name string,
+) error {
+	return func(name string) error {
+
+		if name != "all" {
+			return fn(name)
+		}
+
+		for _, name := range p.ProcessNames() {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// streamJSON writes each value received on the channel to the response as a
+// line of JSON, flushing after each, until the channel is closed. Values for
+// which match returns false are skipped.
+func streamJSON[T any](
+	rw http.ResponseWriter, ch <-chan T, match func(T) bool,
+) {
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+
+	flusher, _ := rw.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(rw)
+	for v := range ch {
+		if !match(v) {
+			continue
+		}
+
+		if err := enc.Encode(v); err != nil {
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func newControlHandler(p *pmuxlib.Pmux) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/start", controlHandler(p, p.StartProcess))
+	mux.Handle("/stop", controlHandler(p, p.StopProcess))
+	mux.Handle("/pause", controlHandler(p, forAllProcesses(p, p.PauseRestarts)))
+	mux.Handle("/resume", controlHandler(p, forAllProcesses(p, p.ResumeRestarts)))
+	mux.Handle("/freeze", controlHandler(p, p.FreezeProcess))
+	mux.Handle("/thaw", controlHandler(p, p.ThawProcess))
+	mux.Handle("/restart", controlHandler(p, p.RestartProcess))
+	mux.HandleFunc("/reopen-logs", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := p.ReopenLogs(); err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		statuses, err := p.Status()
+		if err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set(versionHeader, pmuxlib.GetBuildInfo().Version)
+		_ = json.NewEncoder(rw).Encode(statuses)
+	})
+	mux.HandleFunc("/startup", func(rw http.ResponseWriter, r *http.Request) {
+		summary, err := p.StartupSummary()
+		if err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(summary)
+	})
+	mux.HandleFunc("/logs", func(rw http.ResponseWriter, r *http.Request) {
+		match := nameFilter(r.URL.Query()["name"])
+		streamJSON(rw, p.SubscribeLogs(r.Context()), func(l pmuxlib.LogLine) bool {
+			return match(l.Process)
+		})
+	})
+	mux.HandleFunc("/events", func(rw http.ResponseWriter, r *http.Request) {
+		match := nameFilter(r.URL.Query()["name"])
+		streamJSON(rw, p.SubscribeEvents(r.Context()), func(e pmuxlib.Event) bool {
+			return match(e.Process)
+		})
+	})
+	mux.HandleFunc("/rolling-restart", func(rw http.ResponseWriter, r *http.Request) {
+		controlHandler(p, func(name string) error {
+			return p.RollingRestart(r.Context(), name)
+		}).ServeHTTP(rw, r)
+	})
+	return mux
+}
+
+// newStreamingServer returns an http.Server for the handler whose requests'
+// contexts are canceled when it is shut down, so that streaming responses
+// (e.g. of /logs) don't prevent it from shutting down.
+func newStreamingServer(h http.Handler) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     h,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	srv.RegisterOnShutdown(cancel)
+	return srv
+}
+
+// controlPathRoles gives the APIRole required by each control API endpoint
+// which doesn't require pmuxlib.APIRoleOperator.
+var controlPathRoles = map[string]pmuxlib.APIRole{
+	"/status":  pmuxlib.APIRoleReadOnly,
+	"/startup": pmuxlib.APIRoleReadOnly,
+	"/logs":    pmuxlib.APIRoleReadOnly,
+	"/events":  pmuxlib.APIRoleReadOnly,
+}
+
+// controlConnKey is the context key under which the net.Conn of each control
+// API request is stored, so that the credentials of the client can be checked.
+type controlConnKey struct{}
+
+// serveControl listens on the unix socket at the given path and serves the
+// control API for the given Pmux on it, in the background, authorizing
+// requests using the apiAuth. The returned function stops the server and
+// removes the socket.
+//
+// The control API can also be used to hand off the Pmux's processes to a new
+// pmux (see handoffHandler), after which onHandoff is called.
+func serveControl(
+	socketPath string, p *pmuxlib.Pmux, auth *apiAuth, onHandoff func(),
+) (
+	func(), error,
+) {
+
+	// a socket file left over by a previous pmux which didn't exit cleanly
+	// would prevent listening.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("removing old socket %q: %w", socketPath, err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", socketPath, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", newControlHandler(p))
+	mux.Handle("/handoff", handoffHandler(p, onHandoff))
+
+	srv := newStreamingServer(auth.httpMiddleware(mux, controlPathRoles))
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, controlConnKey{}, c)
+	}
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "control socket: %v\n", err)
+		}
+	}()
+
+	return func() {
+		_ = srv.Shutdown(context.Background())
+		_ = os.Remove(socketPath)
+	}, nil
+}
+
+// controlRequest performs a request against the control API listening on the
+// given socket path, returning the response body.
+func controlRequest(
+	socketPath, method, path string, query url.Values,
+) (
+	[]byte, error,
+) {
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(
+				ctx context.Context, _, _ string,
+			) (
+				net.Conn, error,
+			) {
+				return new(net.Dialer).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	// the host is ignored, since the dialer always connects to the socket.
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "pmux",
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("PMUX_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// controlCommands are the command-line commands which are sent to a running
+// pmux via the control socket.
+var controlCommands = map[string]bool{
+	"start":           true,
+	"stop":            true,
+	"pause":           true,
+	"resume":          true,
+	"freeze":          true,
+	"thaw":            true,
+	"restart":         true,
+	"rolling-restart": true,
+	"status":          true,
+	"startup":         true,
+	"top":             true,
+	"ps":              true,
+	"reopen-logs":     true,
+}
+
+// runControlCommand runs a command-line command (e.g. `start <name>`) against a
+// running pmux using the control socket configured in the Config.
+func runControlCommand(cfg pmuxlib.Config, args []string) error {
+
+	if cfg.ControlSocket == "" {
+		return errors.New("controlSocket is not set in the config")
+	}
+
+	switch args[0] {
+	case "status":
+		return runStatusCommand(cfg, os.Stdout)
+	case "startup":
+		return runStartupCommand(cfg, os.Stdout)
+	case "top":
+		return runTopCommand(cfg, os.Stdout)
+	case "ps":
+		return runPsCommand(cfg, args[1:], os.Stdout)
+	case "reopen-logs":
+		_, err := controlRequest(
+			cfg.ControlSocket, http.MethodPost, "/reopen-logs", nil,
+		)
+		return err
+	}
+
+	var query url.Values
+	switch {
+	case len(args) == 2:
+		query = url.Values{"name": {args[1]}}
+	case len(args) == 3 && args[1] == "-l":
+		query = url.Values{"selector": {args[2]}}
+	default:
+		return fmt.Errorf("usage: %s <name> | %s -l <selector>", args[0], args[0])
+	}
+
+	_, err := controlRequest(
+		cfg.ControlSocket, http.MethodPost, "/"+args[0], query,
+	)
+
+	return err
+}
+
+// getStatuses returns the status of each process in the running pmux.
+func getStatuses(cfg pmuxlib.Config) ([]pmuxlib.ProcessStatus, error) {
+
+	body, err := controlRequest(
+		cfg.ControlSocket, http.MethodGet, "/status", nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []pmuxlib.ProcessStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		return nil, fmt.Errorf("decoding status: %w", err)
+	}
+
+	return statuses, nil
+}
+
+// runStatusCommand prints a table describing the status of each process in the
+// running pmux.
+func runStatusCommand(cfg pmuxlib.Config, w io.Writer) error {
+
+	statuses, err := getStatuses(cfg)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tLAST EXIT\tLAST USAGE")
+
+	for _, status := range statuses {
+
+		state := string(status.State)
+		if status.RestartsPaused {
+			state += " (paused)"
+		}
+
+		pid, exit, usage := "-", "-", "-"
+		if status.Running {
+			pid = strconv.Itoa(status.PID)
+		}
+		if status.LastExit != nil {
+			exit = status.LastExit.String()
+		}
+		if status.LastUsage != nil {
+			usage = status.LastUsage.String()
+		}
+
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\n",
+			status.Name, state, pid, exit, usage,
+		)
+	}
+
+	return tw.Flush()
+}
+
+// runStartupCommand prints a table describing how the starting of each process
+// turned out when the running pmux began.
+func runStartupCommand(cfg pmuxlib.Config, w io.Writer) error {
+
+	body, err := controlRequest(
+		cfg.ControlSocket, http.MethodGet, "/startup", nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	var summary pmuxlib.StartupSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return fmt.Errorf("decoding startup summary: %w", err)
+	}
+
+	if summary == nil {
+		return errors.New("processes are still starting")
+	}
+
+	return summary.WriteTable(w)
+}
+
+// runPmux runs the given Config until the context is canceled, serving the
+// control socket and the health and debug endpoints if they are configured. Log
+// files are reopened whenever pmux receives SIGUSR1. If a Handoff is given then
+// the processes it describes are taken over, see `pmux upgrade`.
+func runPmux(
+	ctx context.Context, cfg pmuxlib.Config, handoff *pmuxlib.Handoff,
+) *pmuxlib.Shutdown {
+
+	p := pmuxlib.NewPmux(cfg)
+	if handoff != nil {
+		p.TakeOver(*handoff)
+	}
+
+	runningPmux.Store(p)
+	defer runningPmux.CompareAndSwap(p, nil)
+
+	// if the auth config can't be loaded then the control socket and gRPC API
+	// aren't served at all, rather than being served without auth.
+	auth, err := newAPIAuth(cfg.APIAuth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apiAuth: %v\n", err)
+	}
+
+	if cfg.ControlSocket != "" && auth != nil {
+		// once the processes have been handed off this pmux must exit
+		// without stopping them, nor removing the control socket, which the
+		// new pmux will take over.
+		stopControl, err := serveControl(
+			cfg.ControlSocket, p, auth, func() { os.Exit(0) },
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "control socket: %v\n", err)
+		} else {
+			defer stopControl()
+		}
+	}
+
+	if cfg.HealthAddr != "" {
+		stopHealth, err := serveHealth(cfg.HealthAddr, p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "health endpoint: %v\n", err)
+		} else {
+			defer stopHealth()
+		}
+	}
+
+	if cfg.DebugAddr != "" {
+		stopDebug, err := serveDebug(cfg.DebugAddr, p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "debug endpoint: %v\n", err)
+		} else {
+			defer stopDebug()
+		}
+	}
+
+	if cfg.GRPCAddr != "" && auth != nil {
+		stopGRPC, err := serveGRPC(cfg.GRPCAddr, p, auth, cfg.APIAuth.TLS)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grpc endpoint: %v\n", err)
+		} else {
+			defer stopGRPC()
+		}
+	}
+
+	if cfg.DashboardAddr != "" && auth != nil {
+		stopDashboard, err := serveDashboard(
+			cfg.DashboardAddr, cfg.DashboardHosts, p, auth, cfg.APIAuth.TLS,
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dashboard: %v\n", err)
+		} else {
+			defer stopDashboard()
+		}
+	}
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGUSR1)
+		defer signal.Stop(sigCh)
+
+		for {
+			select {
+			case <-sigCh:
+				if err := p.ReopenLogs(); err != nil {
+					fmt.Fprintf(os.Stderr, "reopening logs: %v\n", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	p.Run(ctx)
+	return p.LastShutdown()
+}
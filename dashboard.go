@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// dashboardHistorySize is the number of most recent events which the dashboard
+// keeps, for showing the restart history of each process.
+const dashboardHistorySize = 1000
+
+// eventHistory holds the most recent events emitted by a Pmux.
+type eventHistory struct {
+	l      sync.Mutex
+	events []pmuxlib.Event
+}
+
+func (h *eventHistory) run(ch <-chan pmuxlib.Event) {
+	for event := range ch {
+		h.l.Lock()
+		h.events = append(h.events, event)
+		if len(h.events) > dashboardHistorySize {
+			h.events = h.events[len(h.events)-dashboardHistorySize:]
+		}
+		h.l.Unlock()
+	}
+}
+
+func (h *eventHistory) get() []pmuxlib.Event {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return append([]pmuxlib.Event{}, h.events...)
+}
+
+// dashboardPathRoles gives the APIRole required by each API endpoint of the
+// dashboard which doesn't require pmuxlib.APIRoleOperator.
+var dashboardPathRoles = func() map[string]pmuxlib.APIRole {
+	m := map[string]pmuxlib.APIRole{"/history": pmuxlib.APIRoleReadOnly}
+	for path, role := range controlPathRoles {
+		m[path] = role
+	}
+	return m
+}()
+
+// sameOrigin wraps the handler so that requests which change state must come
+// from the dashboard itself, rather than from some other site open in the same
+// browser.
+func sameOrigin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					http.Error(rw, "cross-origin request", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// allowedHosts wraps the handler so that only requests whose Host header names
+// one of the given hosts, an IP address, or localhost are served. Otherwise a
+// site whose DNS name has been rebound to the dashboard's address would be
+// able to read from it as if it were the same origin.
+func allowedHosts(hosts []string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+		allowed := host == "localhost" || net.ParseIP(host) != nil
+		for _, allowedHost := range hosts {
+			allowed = allowed || strings.EqualFold(host, allowedHost)
+		}
+
+		if !allowed {
+			http.Error(rw, "host not allowed", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// serveDashboard listens on the given TCP address and serves the web dashboard
+// for the given Pmux on it, in the background, authorizing its API requests
+// using the apiAuth and serving over TLS if tlsCfg is given. Only requests for
+// the host of addr, or one of the given hosts, are served, see allowedHosts.
+// The returned function stops the server.
+func serveDashboard(
+	addr string,
+	hosts []string,
+	p *pmuxlib.Pmux,
+	auth *apiAuth,
+	tlsCfg *pmuxlib.APITLSConfig,
+) (
+	func(), error,
+) {
+
+	var serverTLS *tls.Config
+	if tlsCfg != nil {
+		var err error
+		if serverTLS, err = serverTLSConfig(tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", addr, err)
+	}
+
+	if serverTLS != nil {
+		l = tls.NewListener(l, serverTLS)
+	}
+
+	historyCtx, cancelHistory := context.WithCancel(context.Background())
+	history := new(eventHistory)
+	go history.run(p.SubscribeEvents(historyCtx))
+
+	apiMux := http.NewServeMux()
+	apiMux.Handle("/", newControlHandler(p))
+	apiMux.HandleFunc("/history", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(history.get())
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(rw, r)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write(dashboardHTML)
+	})
+	mux.Handle("/api/", http.StripPrefix("/api", sameOrigin(
+		auth.httpMiddleware(apiMux, dashboardPathRoles),
+	)))
+
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		hosts = append([]string{host}, hosts...)
+	}
+
+	srv := newStreamingServer(allowedHosts(hosts, mux))
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "dashboard: %v\n", err)
+		}
+	}()
+
+	return func() {
+		_ = srv.Shutdown(context.Background())
+		cancelHistory()
+	}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// debugPmux holds the *pmuxlib.Pmux which is currently running, whose stats
+// are published via expvar. It's a package variable because expvar vars can
+// only be published once, but runPmux may be called multiple times.
+var debugPmux atomic.Value
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+
+	expvar.Publish("pmux", expvar.Func(func() interface{} {
+
+		p, _ := debugPmux.Load().(*pmuxlib.Pmux)
+		if p == nil {
+			return nil
+		}
+
+		restarts := map[string]int{}
+		var totalRestarts int
+
+		statuses, _ := p.Status()
+		for _, status := range statuses {
+			restarts[status.Name] = status.Restarts
+			totalRestarts += status.Restarts
+		}
+
+		return map[string]interface{}{
+			"logLines":        p.LogLines(),
+			"logWriteErrors":  p.LogWriteErrors(),
+			"restarts":        totalRestarts,
+			"processRestarts": restarts,
+		}
+	}))
+}
+
+// serveDebug listens on the given TCP address and serves expvar and pprof
+// endpoints for the given Pmux on it, in the background. The returned function
+// stops the server.
+func serveDebug(addr string, p *pmuxlib.Pmux) (func(), error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", addr, err)
+	}
+
+	debugPmux.Store(p)
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "debug endpoint: %v\n", err)
+		}
+	}()
+
+	return func() {
+		_ = srv.Shutdown(context.Background())
+	}, nil
+}
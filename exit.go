@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// failure is a class of error which causes pmux to exit. Each has a distinct
+// exit code, following sysexits.h where one applies, so that wrappers can
+// tell them apart.
+type failure struct {
+	class    string
+	exitCode int
+}
+
+var (
+	failureRuntime        = failure{"runtime", 1}
+	failureUsage          = failure{"usage", 64}
+	failureConfigParse    = failure{"config-parse", 65}
+	failureConfigNotFound = failure{"config-not-found", 66}
+
+	// failureProcessFailed is used when pmux exits because all processes
+	// have stopped, and it gave up on restarting at least one of them.
+	failureProcessFailed = failure{"process-failed", 3}
+)
+
+// configFailure returns the failure of an error encountered while loading or
+// checking the config.
+func configFailure(err error) failure {
+	if errors.Is(err, fs.ErrNotExist) &&
+		!errors.As(err, new(*pmuxlib.ValidationError)) {
+		return failureConfigNotFound
+	}
+	return failureConfigParse
+}
+
+// errOutput determines how fatal prints errors, and is set from the -q (or
+// -silent-errors) and -json-errors flags.
+var errOutput struct {
+	quiet, json bool
+}
+
+// fatal prints the error to stderr, according to errOutput, and exits with the
+// failure's exit code.
+func fatal(f failure, err error) {
+
+	switch {
+	case errOutput.quiet:
+
+	case errOutput.json:
+		b, _ := json.Marshal(struct {
+			Error    string `json:"error"`
+			Class    string `json:"class"`
+			ExitCode int    `json:"exitCode"`
+		}{
+			err.Error(), f.class, f.exitCode,
+		})
+		fmt.Fprintln(os.Stderr, string(b))
+
+	default:
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	os.Exit(f.exitCode)
+}
+
+// exitShutdown exits with the failure corresponding to why pmux stopped
+// running processes, if it stopped unsuccessfully, and returns otherwise.
+func exitShutdown(shutdown *pmuxlib.Shutdown) {
+
+	var f failure
+	switch {
+	case shutdown == nil:
+		return
+	case shutdown.Reason == pmuxlib.ShutdownReasonConfigError:
+		f = failureConfigParse
+	case shutdown.Reason == pmuxlib.ShutdownReasonFailed:
+		f = failureProcessFailed
+	default:
+		return
+	}
+
+	// the reason has already been logged by pmuxlib, so it's only printed
+	// again if errors are being output as JSON.
+	if !errOutput.json {
+		os.Exit(f.exitCode)
+	}
+
+	fatal(f, errors.New(shutdown.String()))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// splitNames splits a comma separated list of process names, as given on the
+// command-line.
+func splitNames(str string) []string {
+	var names []string
+	for _, name := range strings.Split(str, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// hasActiveProfile returns true if the process should be run given the set of
+// active profiles. Processes without any profiles are always run.
+func hasActiveProfile(procCfg pmuxlib.ProcessConfig, profiles []string) bool {
+
+	if len(procCfg.Profiles) == 0 {
+		return true
+	}
+
+	for _, procProfile := range procCfg.Profiles {
+		for _, profile := range profiles {
+			if procProfile == profile {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// filterProcesses returns a copy of the Config containing only those processes
+// which are named in only (if it is not empty) and not named in except. It is
+// an error for either to contain the name of a process which doesn't exist.
+//
+// If only is empty then processes which have profiles, none of which are in
+// the given list of active profiles, are filtered out as well. Processes named
+// in only are always run, regardless of their profiles.
+func filterProcesses(
+	cfg pmuxlib.Config, only, except, profiles []string,
+) (
+	pmuxlib.Config, error,
+) {
+
+	exists := map[string]bool{}
+	for _, procCfg := range cfg.Processes {
+		exists[procCfg.Name] = true
+	}
+
+	toSet := func(names []string) (map[string]bool, error) {
+		set := map[string]bool{}
+		for _, name := range names {
+			if !exists[name] {
+				return nil, fmt.Errorf("no process named %q", name)
+			}
+			set[name] = true
+		}
+		return set, nil
+	}
+
+	onlySet, err := toSet(only)
+	if err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	exceptSet, err := toSet(except)
+	if err != nil {
+		return pmuxlib.Config{}, err
+	}
+
+	var procs []pmuxlib.ProcessConfig
+	for _, procCfg := range cfg.Processes {
+		if len(onlySet) > 0 && !onlySet[procCfg.Name] {
+			continue
+		} else if len(onlySet) == 0 && !hasActiveProfile(procCfg, profiles) {
+			continue
+		} else if exceptSet[procCfg.Name] {
+			continue
+		}
+		procs = append(procs, procCfg)
+	}
+
+	if len(procs) == 0 {
+		return pmuxlib.Config{}, fmt.Errorf("no processes left to run")
+	}
+
+	cfg.Processes = procs
+	return cfg, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+	"github.com/cryptic-io/pmux/pmuxpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcErr converts an error returned by the Pmux into a gRPC status error.
+func grpcErr(err error) error {
+	if err == nil {
+		return nil
+	} else if errors.Is(err, pmuxlib.ErrNotRunning) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func durationProto(d time.Duration) *durationpb.Duration {
+	if d == 0 {
+		return nil
+	}
+	return durationpb.New(d)
+}
+
+func usageProto(u *pmuxlib.ResourceUsage) *pmuxpb.ResourceUsage {
+	if u == nil {
+		return nil
+	}
+	return &pmuxpb.ResourceUsage{
+		UserTime:   durationpb.New(u.UserTime),
+		SystemTime: durationpb.New(u.SystemTime),
+		MaxRss:     u.MaxRSS,
+		Rss:        u.RSS,
+	}
+}
+
+func exitProto(e *pmuxlib.ExitStatus) *pmuxpb.ExitStatus {
+	if e == nil {
+		return nil
+	}
+	return &pmuxpb.ExitStatus{
+		Code:       int32(e.Code),
+		Signal:     e.Signal,
+		CoreDumped: e.CoreDumped,
+		StopReason: e.StopReason,
+	}
+}
+
+// nameFilter returns a function which returns whether a process of the given
+// name is one of names, or true for all names if names is empty.
+func nameFilter(names []string) func(string) bool {
+	set := map[string]bool{}
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(name string) bool {
+		return len(set) == 0 || set[name]
+	}
+}
+
+// grpcServer implements the pmuxpb.PmuxServer interface using a Pmux, mirroring
+// the control API.
+type grpcServer struct {
+	pmuxpb.UnimplementedPmuxServer
+	p *pmuxlib.Pmux
+}
+
+func (s grpcServer) Status(
+	context.Context, *pmuxpb.StatusRequest,
+) (
+	*pmuxpb.StatusResponse, error,
+) {
+
+	statuses, err := s.p.Status()
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+
+	res := &pmuxpb.StatusResponse{Version: pmuxlib.GetBuildInfo().Version}
+	for _, st := range statuses {
+		res.Processes = append(res.Processes, &pmuxpb.ProcessStatus{
+			Name:           st.Name,
+			Labels:         st.Labels,
+			Running:        st.Running,
+			Pid:            int32(st.PID),
+			Uptime:         durationProto(st.Uptime),
+			Restarts:       int32(st.Restarts),
+			Backoff:        durationProto(st.Backoff),
+			Ready:          st.Ready,
+			Frozen:         st.Frozen,
+			RestartsPaused: st.RestartsPaused,
+			Restarting:     st.Restarting,
+			Failed:         st.Failed,
+			TimeToReady:    durationProto(st.TimeToReady),
+			Usage:          usageProto(st.Usage),
+			LastUsage:      usageProto(st.LastUsage),
+			LastExit:       exitProto(st.LastExit),
+		})
+	}
+
+	return res, nil
+}
+
+func (s grpcServer) StartupSummary(
+	context.Context, *pmuxpb.StartupSummaryRequest,
+) (
+	*pmuxpb.StartupSummaryResponse, error,
+) {
+
+	summary, err := s.p.StartupSummary()
+	if err != nil {
+		return nil, grpcErr(err)
+	} else if summary == nil {
+		return nil, status.Error(
+			codes.Unavailable, "processes are still starting",
+		)
+	}
+
+	res := new(pmuxpb.StartupSummaryResponse)
+	for _, st := range summary {
+		res.Processes = append(res.Processes, &pmuxpb.StartupStatus{
+			Name:        st.Name,
+			State:       string(st.State),
+			Pid:         int32(st.PID),
+			TimeToReady: durationProto(st.TimeToReady),
+			LastExit:    exitProto(st.LastExit),
+		})
+	}
+
+	return res, nil
+}
+
+// processAction handles a request which performs an action on a single
+// process, or on each process matching the request's label selector.
+func (s grpcServer) processAction(
+	req *pmuxpb.ProcessRequest, fn func(name string) error,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	err := forSelectedProcesses(s.p, req.Name, req.Selector, fn)
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+
+	return new(pmuxpb.ProcessResponse), nil
+}
+
+func (s grpcServer) Start(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, s.p.StartProcess)
+}
+
+func (s grpcServer) Stop(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, s.p.StopProcess)
+}
+
+func (s grpcServer) Pause(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, forAllProcesses(s.p, s.p.PauseRestarts))
+}
+
+func (s grpcServer) Resume(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, forAllProcesses(s.p, s.p.ResumeRestarts))
+}
+
+func (s grpcServer) Freeze(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, s.p.FreezeProcess)
+}
+
+func (s grpcServer) Thaw(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, s.p.ThawProcess)
+}
+
+func (s grpcServer) Restart(
+	_ context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, s.p.RestartProcess)
+}
+
+func (s grpcServer) RollingRestart(
+	ctx context.Context, req *pmuxpb.ProcessRequest,
+) (
+	*pmuxpb.ProcessResponse, error,
+) {
+	return s.processAction(req, func(name string) error {
+		return s.p.RollingRestart(ctx, name)
+	})
+}
+
+func (s grpcServer) ReopenLogs(
+	context.Context, *pmuxpb.ReopenLogsRequest,
+) (
+	*pmuxpb.ReopenLogsResponse, error,
+) {
+	if err := s.p.ReopenLogs(); err != nil {
+		return nil, grpcErr(err)
+	}
+	return new(pmuxpb.ReopenLogsResponse), nil
+}
+
+func (s grpcServer) TailLogs(
+	req *pmuxpb.TailLogsRequest, stream pmuxpb.Pmux_TailLogsServer,
+) error {
+
+	match := nameFilter(req.Processes)
+
+	for line := range s.p.SubscribeLogs(stream.Context()) {
+		if !match(line.Process) {
+			continue
+		}
+
+		err := stream.Send(&pmuxpb.LogLine{
+			Time:    timestamppb.New(line.Time),
+			Process: line.Process,
+			Stream:  line.Stream,
+			Level:   string(line.Level),
+			Line:    line.Line,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return stream.Context().Err()
+}
+
+func (s grpcServer) SubscribeEvents(
+	req *pmuxpb.SubscribeEventsRequest, stream pmuxpb.Pmux_SubscribeEventsServer,
+) error {
+
+	match := nameFilter(req.Processes)
+
+	for event := range s.p.SubscribeEvents(stream.Context()) {
+		if !match(event.Process) {
+			continue
+		}
+
+		err := stream.Send(&pmuxpb.Event{
+			Time:     timestamppb.New(event.Time),
+			Event:    event.Event,
+			Process:  event.Process,
+			Pid:      int32(event.PID),
+			Exit:     exitProto(event.Exit),
+			Restarts: int32(event.Restarts),
+			Path:     event.Path,
+			Error:    event.Error,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return stream.Context().Err()
+}
+
+// grpcMethodRoles gives the APIRole required by each gRPC method which doesn't
+// require pmuxlib.APIRoleOperator.
+var grpcMethodRoles = map[string]pmuxlib.APIRole{
+	pmuxpb.Pmux_Status_FullMethodName:          pmuxlib.APIRoleReadOnly,
+	pmuxpb.Pmux_StartupSummary_FullMethodName:  pmuxlib.APIRoleReadOnly,
+	pmuxpb.Pmux_TailLogs_FullMethodName:        pmuxlib.APIRoleReadOnly,
+	pmuxpb.Pmux_SubscribeEvents_FullMethodName: pmuxlib.APIRoleReadOnly,
+}
+
+// serveGRPC listens on the given TCP address and serves the gRPC API for the
+// given Pmux on it, in the background, authorizing calls using the apiAuth and
+// serving over TLS if tlsCfg is given. The returned function stops the server.
+func serveGRPC(
+	addr string,
+	p *pmuxlib.Pmux,
+	auth *apiAuth,
+	tlsCfg *pmuxlib.APITLSConfig,
+) (
+	func(), error,
+) {
+
+	opts, err := auth.grpcServerOptions(tlsCfg, grpcMethodRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", addr, err)
+	}
+
+	srv := grpc.NewServer(opts...)
+	pmuxpb.RegisterPmuxServer(srv, grpcServer{p: p})
+
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			fmt.Fprintf(os.Stderr, "grpc endpoint: %v\n", err)
+		}
+	}()
+
+	// streams only end once their clients cancel them, so rather than waiting
+	// on them the server is stopped forcefully.
+	return srv.Stop, nil
+}
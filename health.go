@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// newHealthHandler returns a handler serving the health of each individual
+// process:
+//
+//	/procs/<name>/healthz  200 if the process is running and ready, else 503
+//	/procs/<name>/livez    200 if the process is running, else 503
+//
+// The body of each response is the JSON status of the process.
+func newHealthHandler(p *pmuxlib.Pmux) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+
+		path := strings.TrimPrefix(r.URL.Path, "/procs/")
+		if path == r.URL.Path {
+			http.NotFound(rw, r)
+			return
+		}
+
+		name, check, ok := strings.Cut(path, "/")
+		if !ok || (check != "healthz" && check != "livez") {
+			http.NotFound(rw, r)
+			return
+		}
+
+		statuses, err := p.Status()
+		if err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+
+		for _, status := range statuses {
+			if status.Name != name {
+				continue
+			}
+
+			healthy := status.Running && !status.Frozen
+			if check == "healthz" {
+				healthy = healthy && status.Ready
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			if !healthy {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+
+			_ = json.NewEncoder(rw).Encode(status)
+			return
+		}
+
+		http.Error(
+			rw, fmt.Sprintf("no process named %q", name), http.StatusNotFound,
+		)
+	})
+}
+
+// serveHealth listens on the given TCP address and serves the health of each
+// process of the given Pmux on it, in the background. The returned function
+// stops the server.
+func serveHealth(addr string, p *pmuxlib.Pmux) (func(), error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", addr, err)
+	}
+
+	srv := &http.Server{Handler: newHealthHandler(p)}
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "health endpoint: %v\n", err)
+		}
+	}()
+
+	return func() {
+		_ = srv.Shutdown(context.Background())
+	}, nil
+}
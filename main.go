@@ -2,46 +2,245 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cryptic-io/pmux/pmuxlib"
-
-	"gopkg.in/yaml.v2"
+	"golang.org/x/sys/unix"
 )
 
+// inlineConfigEnvVar is the environment variable which may contain the contents
+// of a config file, to be used if -c isn't given.
+const inlineConfigEnvVar = "PMUX_CONFIG"
+
+// forceExitLogTimeout is the longest that pmux will wait for lines which are
+// being logged to be written when it's forcefully exiting.
+const forceExitLogTimeout = 2 * time.Second
+
+// runningPmux is the Pmux which is currently being run by runPmux, if any.
+var runningPmux atomic.Pointer[pmuxlib.Pmux]
+
 func main() {
 
-	cfgPath := flag.String("c", "./pmux.yml", "Path to config yaml file")
+	cfgPath := flag.String(
+		"c", "./pmux.yml",
+		"Path to config file, to a directory of config files, to an HTTP(S) URL of a config file, or - for stdin. If not given, and the "+inlineConfigEnvVar+" environment variable is set, then its value is used as the config.",
+	)
+
+	pollInterval := flag.Duration(
+		"poll-interval", 0,
+		"If -c is, or includes, a URL, how often to poll the URLs for changes, which cause the config to be reloaded and all processes to be restarted with it. 0 disables polling.",
+	)
+
+	cfgFormat := flag.String(
+		"format", "",
+		"Format of config files (yaml, json, or toml). Determined by file extension if not given.",
+	)
+
+	check := flag.Bool(
+		"check", false,
+		"Check the config for problems and print it, then exit without running any processes.",
+	)
+
+	flag.BoolVar(check, "dry-run", false, "Alias of -check.")
+
+	only := flag.String(
+		"only", "",
+		"Comma separated list of process names. If given, only these processes will be run.",
+	)
+
+	except := flag.String(
+		"except", "",
+		"Comma separated list of process names which will not be run.",
+	)
+
+	profile := flag.String(
+		"profile", "",
+		"Comma separated list of profiles to activate. Processes which have profiles are only run if one of their profiles is active.",
+	)
+
+	quiet := flag.Bool(
+		"quiet", false,
+		"Only log unexpected events about processes, e.g. crashes and errors. Overrides the verbosity in the config.",
+	)
+
+	verbose := flag.Bool(
+		"verbose", false,
+		"Also log debugging detail about processes, e.g. signals being sent. Overrides the verbosity in the config.",
+	)
+
+	raw := flag.Bool(
+		"raw", false,
+		"Write the output of processes as-is, without prefixing it with their names, and don't log pmux's own banners. This is the default when only one process is configured.",
+	)
+
+	flag.BoolVar(
+		&errOutput.quiet, "q", false,
+		"Don't print errors which cause pmux to exit, only exit with a code indicating their class: 1 for runtime failures, 3 if a process failed and pmux gave up restarting it, 64 for usage errors, 65 for invalid configs, and 66 if the config wasn't found.",
+	)
+	flag.BoolVar(&errOutput.quiet, "silent-errors", false, "Alias of -q.")
+
+	flag.BoolVar(
+		&errOutput.json, "json-errors", false,
+		`Print errors which cause pmux to exit as a JSON object, with "error", "class", and "exitCode" fields.`,
+	)
+
+	version := flag.Bool(
+		"version", false,
+		"Print the version of pmux, how it was built, and which platform specific features it supports, then exit.",
+	)
+
 	flag.Parse()
 
-	cfgB, err := ioutil.ReadFile(*cfgPath)
+	if *version {
+		printVersion(os.Stdout, pmuxlib.GetBuildInfo())
+		return
+	}
+
+	cfgSrc := configSource{
+		path:     *cfgPath,
+		format:   *cfgFormat,
+		only:     splitNames(*only),
+		except:   splitNames(*except),
+		profiles: splitNames(*profile),
+		raw:      *raw,
+	}
+
+	switch {
+	case *quiet && *verbose:
+		fatal(failureUsage, errors.New("-quiet and -verbose can't both be given"))
+	case *quiet:
+		cfgSrc.verbosity = pmuxlib.VerbosityQuiet
+	case *verbose:
+		cfgSrc.verbosity = pmuxlib.VerbosityVerbose
+	}
+
+	// importing doesn't involve the pmux config, which may not exist yet.
+	if flag.NArg() > 0 && flag.Arg(0) == "import" {
+		if err := runImportCommand(flag.Args()); err != nil {
+			fatal(failureRuntime, err)
+		}
+		return
+	}
+
+	var cfgPathGiven bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			cfgPathGiven = true
+		}
+	})
+
+	if !cfgPathGiven {
+		cfgSrc.inline = os.Getenv(inlineConfigEnvVar)
+	}
+
+	// the config may contain secrets, which the processes would otherwise
+	// inherit.
+	os.Unsetenv(inlineConfigEnvVar)
+
+	cfg, cfgVersions, err := cfgSrc.loadVersions()
 	if err != nil {
-		panic(fmt.Sprintf("couldn't read cfg file at %q: %v", *cfgPath, err))
+		fatal(configFailure(err), err)
 	}
 
-	var cfg pmuxlib.Config
-	if err := yaml.Unmarshal(cfgB, &cfg); err != nil {
-		panic(fmt.Sprintf("couldn't parse cfg file: %v", err))
+	switch {
+	case *check:
+		checkedCfg, err := checkConfig(cfg)
+		if err != nil {
+			fatal(configFailure(err), err)
+		}
+
+		if err := printConfig(os.Stdout, checkedCfg); err != nil {
+			fatal(failureRuntime, fmt.Errorf("printing config: %w", err))
+		}
+
+		fmt.Fprintln(os.Stderr, "config OK")
+		return
+
+	case flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "print":
+		expandedCfg, err := cfg.ExpandTemplates()
+		if err != nil {
+			fatal(configFailure(err), err)
+		}
+
+		if err := printConfig(os.Stdout, expandedCfg); err != nil {
+			fatal(failureRuntime, fmt.Errorf("printing config: %w", err))
+		}
+
+		return
+
+	case flag.NArg() > 0 && controlCommands[flag.Arg(0)]:
+		if err := runControlCommand(cfg, flag.Args()); err != nil {
+			fatal(failureRuntime, err)
+		}
+		return
+
+	case flag.NArg() > 0 && flag.Arg(0) == "export":
+		if err := runExportCommand(cfg, flag.Args()); err != nil {
+			fatal(failureRuntime, err)
+		}
+		return
+
+	case flag.NArg() == 1 && flag.Arg(0) == "upgrade":
+		// handled below, once signals are being handled.
+
+	case flag.NArg() > 0:
+		fatal(failureUsage, fmt.Errorf("unknown command %q", flag.Args()))
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
 	go func() {
 		sigCh := make(chan os.Signal, 2)
 		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-		<-sigCh
-		cancel()
+		sig := <-sigCh
+		cancel(&pmuxlib.StopError{
+			Reason: "pmux received " + unix.SignalName(sig.(syscall.Signal)),
+		})
 
 		<-sigCh
+
+		// the output of processes is flushed first, so that this message isn't
+		// interleaved with a partially written line.
+		if p := runningPmux.Load(); p != nil {
+			p.CloseLogs(forceExitLogTimeout)
+		}
+
 		fmt.Fprintln(os.Stderr, "forcefully exiting pmux process, there may be zombie child processes being left behind, good luck!")
 		os.Stderr.Sync()
 		os.Exit(1)
 	}()
 
-	pmuxlib.Run(ctx, cfg)
+	// the config may be a local file which includes URLs, in which case the
+	// URLs are polled all the same.
+	remote := len(cfgVersions) > 0 && *pollInterval > 0
+
+	var handoff *pmuxlib.Handoff
+	if flag.Arg(0) == "upgrade" {
+		if remote {
+			fatal(
+				failureUsage,
+				errors.New("upgrade can't be used with -poll-interval"),
+			)
+		}
+
+		h, err := requestHandoff(cfg)
+		if err != nil {
+			fatal(failureRuntime, fmt.Errorf("upgrade: %w", err))
+		}
+		handoff = &h
+	}
+
+	if remote {
+		exitShutdown(runRemoteConfig(ctx, cfg, cfgVersions, cfgSrc, *pollInterval))
+		return
+	}
+
+	exitShutdown(runPmux(ctx, cfg, handoff))
 }
@@ -0,0 +1,31 @@
+package main
+
+import "syscall"
+
+// peerUID returns the uid of the process at the other end of the unix socket
+// connection, as of when the connection was established.
+func peerUID(conn syscall.Conn) (int, error) {
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		)
+	})
+	if err != nil {
+		return -1, err
+	} else if credErr != nil {
+		return -1, credErr
+	}
+
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// peerUID returns the uid of the process at the other end of the unix socket
+// connection, which isn't supported on this platform.
+func peerUID(conn syscall.Conn) (int, error) {
+	return -1, errors.New("peer credentials are not supported on this platform")
+}
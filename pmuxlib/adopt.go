@@ -0,0 +1,215 @@
+package pmuxlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// adoptPollInterval is how often an adopted process is checked for having
+// exited. As it isn't a child of pmux it can't be waited on.
+const adoptPollInterval = 500 * time.Millisecond
+
+// errAdoptedExited is returned by runAdopted when the adopted process exits of
+// its own accord.
+var errAdoptedExited = errors.New("adopted process exited, exit status unknown")
+
+// processAlive returns whether a process with the given PID exists and hasn't
+// exited.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return (err == nil || errors.Is(err, syscall.EPERM)) && !isZombie(pid)
+}
+
+// adoptStartTolerance is how long after its pidfile was last written a process
+// may have been started, and still be adopted, allowing for the imprecision
+// of process start times.
+const adoptStartTolerance = time.Second
+
+// readPIDFile returns the PID in the pidfile at the given path, or 0 if the
+// file doesn't exist or the process it names isn't running.
+//
+// An error is returned if the process was started after the pidfile was last
+// written, as the process which wrote it must have exited, and its PID been
+// reused by an unrelated process. This can't be checked on all platforms.
+func readPIDFile(path string) (int, error) {
+
+	stat, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("reading pidfile: %w", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("reading pidfile: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pidfile %q doesn't contain a valid pid", path)
+	}
+
+	if !processAlive(pid) {
+		return 0, nil
+	}
+
+	if started, ok := processStartTime(pid); ok &&
+		started.After(stat.ModTime().Add(adoptStartTolerance)) {
+		return 0, fmt.Errorf(
+			"process %d was started after pidfile %q was written, "+
+				"so its pid has likely been reused",
+			pid, path,
+		)
+	}
+
+	return pid, nil
+}
+
+// sigAdopted sends a signal to an adopted process, or to its process group if
+// it leads one. As with sigProcessGroup, errors other than the process no
+// longer existing are logged and returned.
+func sigAdopted(sysLogger Logger, pid int, sig syscall.Signal) error {
+	debugf(sysLogger, "sending %v signal", sig)
+
+	target := pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		target = -pid
+	}
+
+	err := syscall.Kill(target, sig)
+	if err == nil || errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+
+	err = fmt.Errorf("sending %v signal to %d: %w", sig, target, err)
+	sysLogger.Printf("failed %v", err)
+	return err
+}
+
+// waitAdoptedExit blocks until the process of the given PID no longer exists,
+// returning true, or until the channel is closed, returning false.
+func waitAdoptedExit(pid int, ch <-chan struct{}) bool {
+	ticker := time.NewTicker(adoptPollInterval)
+	defer ticker.Stop()
+
+	for processAlive(pid) {
+		select {
+		case <-ticker.C:
+		case <-ch:
+			return false
+		}
+	}
+	return true
+}
+
+// runAdopted is the equivalent of runProcessOnce for the already running
+// process given by opts.adoptPID, which was not started by this pmux. Its
+// output is only logged if opts.adoptFiles are given.
+func runAdopted(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+	opts runProcessOpts,
+) (
+	int, error,
+) {
+
+	pid := opts.adoptPID
+
+	// FindProcess always succeeds on unix systems.
+	osProc, _ := os.FindProcess(pid)
+
+	if len(opts.adoptFiles) == 0 {
+		infof(
+			sysLogger,
+			"adopted running process %d, its output won't be logged", pid,
+		)
+	} else {
+		infof(sysLogger, "adopted running process %d", pid)
+	}
+
+	// the output is logged until every writer of it has exited.
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		for _, f := range opts.adoptFiles {
+			f.Close()
+		}
+	}()
+
+	for name, f := range opts.adoptFiles {
+		logger := opts.streamLoggers[name]
+		switch {
+		case name == "stdout":
+			logger = outputStreamLogger(stdoutLogger, stderrLogger, cfg.StdoutTo)
+		case name == "stderr":
+			logger = outputStreamLogger(stdoutLogger, stderrLogger, cfg.StderrTo)
+		case logger == nil:
+			logger = stdoutLogger
+			for _, stream := range cfg.Streams {
+				if stream.Name == name {
+					logger = outputStreamLogger(
+						stdoutLogger, stderrLogger, stream.withDefaults().To,
+					)
+				}
+			}
+		}
+
+		forwardOutput(&wg, sysLogger, name, logger, f)
+	}
+
+	if opts.onStart != nil {
+		opts.onStart(osProc, opts.adoptFiles)
+	}
+
+	if opts.onExit != nil {
+		defer func() { opts.onExit(osProc, nil, context.Cause(ctx)) }()
+	}
+
+	if waitAdoptedExit(pid, ctx.Done()) {
+		return -1, errAdoptedExited
+	}
+
+	signal := func(sig syscall.Signal) {
+		err := sigAdopted(sysLogger, pid, sig)
+		if err != nil && opts.onSignalErr != nil {
+			opts.onSignalErr(osProc, err)
+		}
+	}
+
+	runPreStopHook(sysLogger, cfg, pid, nil)
+
+	signal(syscall.SIGINT)
+	_ = sigAdopted(sysLogger, pid, syscall.SIGCONT)
+
+	timer := cfg.clock().NewTimer(cfg.SigKillWait)
+	defer timer.Stop()
+
+	timeoutCh, returnedCh := make(chan struct{}), make(chan struct{})
+	defer close(returnedCh)
+
+	go func() {
+		select {
+		case <-timer.C():
+			close(timeoutCh)
+		case <-returnedCh:
+		}
+	}()
+
+	if !waitAdoptedExit(pid, timeoutCh) {
+		signal(syscall.SIGKILL)
+		waitAdoptedExit(pid, nil)
+	}
+
+	return -1, ctxErr(ctx)
+}
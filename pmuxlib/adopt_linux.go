@@ -0,0 +1,48 @@
+package pmuxlib
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isZombie returns whether the process of the given PID has exited but not
+// yet been reaped by its parent.
+func isZombie(pid int) bool {
+	stat, err := readProcStat(pid)
+	return err == nil && stat.state == 'Z'
+}
+
+// processStartTime returns when the process of the given PID was started,
+// or false if it can't be determined.
+func processStartTime(pid int) (time.Time, bool) {
+
+	now := time.Now()
+
+	uptimeB, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	uptimeFields := strings.Fields(string(uptimeB))
+	if len(uptimeFields) == 0 {
+		return time.Time{}, false
+	}
+
+	uptime, err := strconv.ParseFloat(uptimeFields[0], 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	age := time.Duration(
+		(uptime - float64(stat.start)/clockTicks) * float64(time.Second),
+	)
+
+	return now.Add(-age), true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+import "time"
+
+// isZombie always returns false, as there's no portable way to tell.
+func isZombie(pid int) bool { return false }
+
+// processStartTime always returns false, as there's no portable way to tell.
+func processStartTime(pid int) (time.Time, bool) { return time.Time{}, false }
@@ -0,0 +1,49 @@
+package pmuxlib
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadPIDFile(t *testing.T) {
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	pid := cmd.Process.Pid
+	path := filepath.Join(t.TempDir(), "test.pid")
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := readPIDFile(path); err != nil {
+		t.Fatal(err)
+	} else if got != pid {
+		t.Fatalf("expected pid %d, got %d", pid, got)
+	}
+
+	if _, ok := processStartTime(pid); !ok {
+		t.Skip("process start times aren't supported on this platform")
+	}
+
+	// a pidfile written before the process started names a reused pid.
+	written := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, written, written); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := readPIDFile(path); err == nil {
+		t.Fatalf("expected an error for a reused pid, got pid %d", got)
+	}
+}
@@ -0,0 +1,132 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// APIRole determines which operations a client of the control socket, gRPC
+// API, or dashboard may perform.
+type APIRole string
+
+// Enumeration of APIRole values.
+const (
+	// APIRoleReadOnly may only query the status of processes, and stream
+	// their output and events.
+	APIRoleReadOnly APIRole = "read-only"
+
+	// APIRoleOperator may additionally start, stop, restart, pause, and
+	// otherwise control processes.
+	APIRoleOperator APIRole = "operator"
+)
+
+func (r APIRole) valid() bool {
+	return r == APIRoleReadOnly || r == APIRoleOperator
+}
+
+// Allows returns whether a client with this APIRole may perform operations
+// which require the given APIRole.
+func (r APIRole) Allows(required APIRole) bool {
+	return r == APIRoleOperator || r == required
+}
+
+// APITokenConfig describes a bearer token which clients may authenticate
+// with.
+type APITokenConfig struct {
+
+	// Token is the token itself. Alternatively, TokenFile is the path of a
+	// file containing the token, so that it needn't be in the config.
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"tokenFile,omitempty"`
+
+	Role APIRole `yaml:"role"`
+}
+
+// APITLSConfig describes how the gRPC API and dashboard are served over TLS.
+type APITLSConfig struct {
+
+	// CertFile and KeyFile are the paths of the PEM encoded certificate and
+	// private key which the server presents.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// ClientCAFile is the path of a PEM encoded CA certificate. If set then
+	// clients which present a certificate signed by it are given the role in
+	// ClientRoles of the certificate's common name. Clients which don't
+	// present a certificate may still authenticate using a token.
+	ClientCAFile string             `yaml:"clientCAFile,omitempty"`
+	ClientRoles  map[string]APIRole `yaml:"clientRoles,omitempty"`
+}
+
+// APIAuthConfig describes how clients of the control socket, gRPC API, and
+// dashboard are authenticated, and what each may do. If neither Tokens nor TLS.ClientRoles
+// are given then all clients are allowed to do everything.
+type APIAuthConfig struct {
+
+	// Tokens lists the bearer tokens which clients may authenticate with,
+	// using an "Authorization: Bearer <token>" header (or "authorization"
+	// metadata for gRPC). The pmux binary uses the PMUX_TOKEN environment
+	// variable as its token when sending commands to the control socket. The
+	// gRPC API only accepts tokens over TLS, so if it's served then TLS must
+	// also be given.
+	Tokens []APITokenConfig `yaml:"tokens,omitempty"`
+
+	// TLS, if set, causes the gRPC API and dashboard to be served over TLS,
+	// optionally authenticating clients using their certificates.
+	TLS *APITLSConfig `yaml:"tls,omitempty"`
+}
+
+// Enabled returns whether clients are required to authenticate.
+func (cfg APIAuthConfig) Enabled() bool {
+	return len(cfg.Tokens) > 0 ||
+		(cfg.TLS != nil && len(cfg.TLS.ClientRoles) > 0)
+}
+
+func (cfg APIAuthConfig) validate() []string {
+
+	var problems []string
+
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, "apiAuth."+fmt.Sprintf(str, args...))
+	}
+
+	for i, token := range cfg.Tokens {
+		if (token.Token == "") == (token.TokenFile == "") {
+			problemf("tokens[%d]: exactly one of token or tokenFile must be set", i)
+		}
+
+		if !token.Role.valid() {
+			problemf(
+				"tokens[%d]: role %q is not one of %q or %q",
+				i, token.Role, APIRoleReadOnly, APIRoleOperator,
+			)
+		}
+	}
+
+	if tls := cfg.TLS; tls != nil {
+		if tls.CertFile == "" || tls.KeyFile == "" {
+			problemf("tls: certFile and keyFile are required")
+		}
+
+		if len(tls.ClientRoles) > 0 && tls.ClientCAFile == "" {
+			problemf("tls: clientRoles requires clientCAFile to be set")
+		}
+
+		cns := make([]string, 0, len(tls.ClientRoles))
+		for cn := range tls.ClientRoles {
+			cns = append(cns, cn)
+		}
+		sort.Strings(cns)
+
+		for _, cn := range cns {
+			if role := tls.ClientRoles[cn]; !role.valid() {
+				problemf(
+					"tls.clientRoles.%s: role %q is not one of %q or %q",
+					cn, role, APIRoleReadOnly, APIRoleOperator,
+				)
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,108 @@
+package pmuxlib
+
+import (
+	"errors"
+	"strings"
+)
+
+// Args describes the arguments to a process. When unmarshaled from YAML it may
+// be given either as a list of strings or as a single string, in which case
+// the string is split into arguments using the quoting rules of a POSIX shell
+// (see SplitArgs).
+type Args []string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Args) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var str string
+	if err := unmarshal(&str); err == nil {
+		args, err := SplitArgs(str)
+		if err != nil {
+			return err
+		}
+		*a = args
+		return nil
+	}
+
+	var strs []string
+	if err := unmarshal(&strs); err != nil {
+		return err
+	}
+
+	*a = strs
+	return nil
+}
+
+// SplitArgs splits the given string into separate arguments in the same way a
+// POSIX shell would, respecting single quotes, double quotes, and backslash
+// escapes. No expansion of any kind is performed.
+func SplitArgs(str string) ([]string, error) {
+
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		escaped bool
+		quote   rune
+	)
+
+	for _, r := range str {
+
+		switch {
+
+		case escaped:
+			// within double quotes a backslash only escapes certain characters,
+			// otherwise it is kept as-is.
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				arg.WriteRune('\\')
+			}
+			if r != '\n' {
+				arg.WriteRune(r)
+			}
+			escaped = false
+
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+
+		case r == '\\':
+			escaped, inArg = true, true
+
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("unterminated backslash escape")
+	} else if quote != 0 {
+		return nil, errors.New("unterminated quoted string")
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,49 @@
+package pmuxlib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+
+	tests := []struct {
+		str    string
+		exp    []string
+		expErr bool
+	}{
+		{str: "", exp: nil},
+		{str: "  \t ", exp: nil},
+		{str: "a b  c", exp: []string{"a", "b", "c"}},
+		{str: `a 'b c' "d e"`, exp: []string{"a", "b c", "d e"}},
+		{str: `''`, exp: []string{""}},
+		{str: `a"b"'c'`, exp: []string{"abc"}},
+		{str: `a\ b`, exp: []string{"a b"}},
+		{str: `'a\b'`, exp: []string{`a\b`}},
+		{str: `"a\b"`, exp: []string{`a\b`}},
+		{str: `"a\"b\\c\$d"`, exp: []string{`a"b\c$d`}},
+		{str: "a\\\nb", exp: []string{"ab"}},
+		{str: `$HOME *`, exp: []string{"$HOME", "*"}},
+		{str: `'a`, expErr: true},
+		{str: `"a`, expErr: true},
+		{str: `a\`, expErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			got, err := SplitArgs(test.str)
+			if test.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Fatalf("expected %q, got %q", test.exp, got)
+			}
+		})
+	}
+}
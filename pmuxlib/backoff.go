@@ -0,0 +1,125 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// ExitClass classifies why a process exited, so that each class of exit may
+// be backed off differently, see ProcessConfig.Backoff.
+type ExitClass string
+
+// Enumeration of ExitClass values.
+const (
+	// ExitClassClean is an exit with exit code 0.
+	ExitClassClean ExitClass = "clean"
+
+	// ExitClassError is an exit with a non-zero exit code, or a failure to
+	// start the process at all.
+	ExitClassError ExitClass = "error"
+
+	// ExitClassCrash is termination by a signal other than SIGKILL, e.g.
+	// SIGSEGV or SIGABRT.
+	ExitClassCrash ExitClass = "crash"
+
+	// ExitClassKilled is termination by SIGKILL, which is typically sent by the
+	// OOM killer or a watchdog.
+	ExitClassKilled ExitClass = "killed"
+)
+
+func (c ExitClass) valid() bool {
+	switch c {
+	case ExitClassClean, ExitClassError, ExitClassCrash, ExitClassKilled:
+		return true
+	}
+	return false
+}
+
+// classifyExit returns the ExitClass of an exit with the given exit code, or by
+// the given signal if it's not zero.
+func classifyExit(exitCode int, sig syscall.Signal) ExitClass {
+	switch {
+	case sig == syscall.SIGKILL:
+		return ExitClassKilled
+	case sig != 0:
+		return ExitClassCrash
+	case exitCode == 0:
+		return ExitClassClean
+	default:
+		return ExitClassError
+	}
+}
+
+// BackoffConfig overrides the restart backoff parameters of a process for a
+// particular ExitClass. Fields which aren't set are inherited from the
+// ProcessConfig.
+type BackoffConfig struct {
+	MinWait *time.Duration `yaml:"minWait,omitempty"`
+	MaxWait *time.Duration `yaml:"maxWait,omitempty"`
+}
+
+// backoffKey returns the key of the backoff wait time which is used after an
+// exit of the given class. Classes which aren't overridden in the Backoff
+// field share a single wait time, keyed by the empty string.
+func (cfg ProcessConfig) backoffKey(class ExitClass) ExitClass {
+	if _, ok := cfg.Backoff[class]; ok {
+		return class
+	}
+	return ""
+}
+
+// backoffLimits returns the minimum and maximum wait time between restarts
+// after an exit of the given class.
+func (cfg ProcessConfig) backoffLimits(class ExitClass) (time.Duration, time.Duration) {
+	minWait, maxWait := cfg.MinWait, cfg.MaxWait
+	if override, ok := cfg.Backoff[class]; ok {
+		if override.MinWait != nil {
+			minWait = *override.MinWait
+		}
+		if override.MaxWait != nil {
+			maxWait = *override.MaxWait
+		}
+	}
+	return minWait, maxWait
+}
+
+func validateBackoff(backoff map[ExitClass]BackoffConfig) []string {
+
+	classes := make([]string, 0, len(backoff))
+	for class := range backoff {
+		classes = append(classes, string(class))
+	}
+	sort.Strings(classes)
+
+	var problems []string
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, "backoff."+fmt.Sprintf(str, args...))
+	}
+
+	for _, classStr := range classes {
+		class := ExitClass(classStr)
+		if !class.valid() {
+			problemf(
+				"%s: not one of %q, %q, %q, or %q", class,
+				ExitClassClean, ExitClassError, ExitClassCrash, ExitClassKilled,
+			)
+			continue
+		}
+
+		cfg := backoff[class]
+		if cfg.MinWait != nil && *cfg.MinWait < 0 {
+			problemf("%s.minWait cannot be negative", class)
+		}
+		if cfg.MaxWait != nil && *cfg.MaxWait < 0 {
+			problemf("%s.maxWait cannot be negative", class)
+		}
+		if cfg.MinWait != nil && cfg.MaxWait != nil &&
+			*cfg.MinWait > *cfg.MaxWait {
+			problemf("%s.minWait cannot be greater than maxWait", class)
+		}
+	}
+
+	return problems
+}
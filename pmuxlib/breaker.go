@@ -0,0 +1,123 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CircuitBreakerConfig is used to configure a circuit breaker on a process,
+// which stops the process from being restarted for a while if it is caught in
+// a crash loop.
+type CircuitBreakerConfig struct {
+
+	// Failures and Window define what is considered a crash loop: if the
+	// process crashes Failures times within Window then the breaker is
+	// tripped. Only exits with a non-zero exit code or due to a signal are
+	// counted, not clean exits or the process being stopped by pmux. The
+	// breaker is disabled if Failures is not set.
+	//
+	// Window defaults to 1 minute.
+	Failures int           `yaml:"failures,omitempty"`
+	Window   time.Duration `yaml:"window,omitempty"`
+
+	// Cooldown is how long to wait before restarting the process after the
+	// breaker has been tripped.
+	//
+	// Defaults to 10 minutes.
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+
+	// Webhook, if set, is a URL which will be sent a POST request with a JSON
+	// body describing the event whenever the breaker is tripped.
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+func (cfg CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+
+	if cfg.Window == 0 {
+		cfg.Window = 1 * time.Minute
+	}
+
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = 10 * time.Minute
+	}
+
+	return cfg
+}
+
+type circuitBreaker struct {
+	cfg      CircuitBreakerConfig
+	failures []time.Time
+}
+
+// recordFailure records that the process crashed at the given time, and
+// returns true if this trips the breaker. Once tripped the breaker is reset.
+func (b *circuitBreaker) recordFailure(now time.Time) bool {
+
+	if b.cfg.Failures <= 0 {
+		return false
+	}
+
+	failures := b.failures[:0]
+	for _, t := range b.failures {
+		if now.Sub(t) < b.cfg.Window {
+			failures = append(failures, t)
+		}
+	}
+	b.failures = append(failures, now)
+
+	if len(b.failures) < b.cfg.Failures {
+		return false
+	}
+
+	b.failures = b.failures[:0]
+	return true
+}
+
+// breakerWebhookBody is the JSON body sent to CircuitBreakerConfig.Webhook.
+type breakerWebhookBody struct {
+	Process  string `json:"process"`
+	Event    string `json:"event"`
+	Failures int    `json:"failures"`
+	Window   string `json:"window"`
+	Cooldown string `json:"cooldown"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify sends the configured webhook, if any, for the tripping of the breaker
+// for the given process. It is expected to be called in a goroutine.
+func (b *circuitBreaker) notify(sysLogger Logger, procName string) {
+
+	if b.cfg.Webhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(breakerWebhookBody{
+		Process:  procName,
+		Event:    "circuit-breaker-tripped",
+		Failures: b.cfg.Failures,
+		Window:   b.cfg.Window.String(),
+		Cooldown: b.cfg.Cooldown.String(),
+	})
+	if err != nil {
+		panic(fmt.Sprintf("encoding webhook body: %v", err))
+	}
+
+	res, err := webhookClient.Post(
+		b.cfg.Webhook, "application/json", bytes.NewReader(body),
+	)
+	if err != nil {
+		sysLogger.Printf("sending circuit breaker webhook: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		sysLogger.Printf(
+			"circuit breaker webhook returned unexpected status %q", res.Status,
+		)
+	}
+}
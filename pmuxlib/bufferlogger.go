@@ -0,0 +1,148 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BufferLine is a single line recorded by a BufferLogger.
+type BufferLine struct {
+	Time time.Time
+	Line string
+}
+
+// BufferLogger implements Logger by recording every line logged to it in
+// memory, e.g. so that tests can check what a process output. The zero value
+// is ready to use.
+type BufferLogger struct {
+
+	// Clock, if set, is used to timestamp each line, rather than the system
+	// clock.
+	Clock Clock
+
+	l     sync.Mutex
+	lines []BufferLine
+
+	// lineCh is closed, and replaced, whenever a line is logged.
+	lineCh chan struct{}
+}
+
+// Println implements the Logger interface.
+func (l *BufferLogger) Println(line string) {
+
+	clock := l.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	l.lines = append(l.lines, BufferLine{Time: clock.Now(), Line: line})
+
+	if l.lineCh != nil {
+		close(l.lineCh)
+		l.lineCh = nil
+	}
+}
+
+// Printf implements the Logger interface. A trailing newline is not included
+// in the recorded line.
+func (l *BufferLogger) Printf(str string, args ...interface{}) {
+	l.Println(strings.TrimSuffix(fmt.Sprintf(str, args...), "\n"))
+}
+
+// Lines returns every line which has been logged so far, in order.
+func (l *BufferLogger) Lines() []BufferLine {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return append([]BufferLine(nil), l.lines...)
+}
+
+// String returns every line which has been logged so far, each followed by a
+// newline.
+func (l *BufferLogger) String() string {
+	var b strings.Builder
+	for _, line := range l.Lines() {
+		b.WriteString(line.Line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Reset discards all lines which have been logged so far.
+func (l *BufferLogger) Reset() {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.lines = nil
+}
+
+// Contains returns whether any line logged so far contains the given string.
+func (l *BufferLogger) Contains(substr string) bool {
+	_, ok := l.find(substr, 0)
+	return ok
+}
+
+// find returns the first line, from the given index onwards, which contains
+// the given string.
+func (l *BufferLogger) find(substr string, from int) (BufferLine, bool) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	for _, line := range l.lines[minInt(from, len(l.lines)):] {
+		if strings.Contains(line.Line, substr) {
+			return line, true
+		}
+	}
+	return BufferLine{}, false
+}
+
+// WaitForLine blocks until a line containing the given string has been
+// logged, returning the first such line, which may have been logged before
+// WaitForLine was called. An error is returned if no such line is logged
+// within the timeout.
+//
+// The timeout is measured using the system clock, even if a Clock is set.
+func (l *BufferLogger) WaitForLine(
+	substr string, timeout time.Duration,
+) (
+	BufferLine, error,
+) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var from int
+
+	for {
+		l.l.Lock()
+		n := len(l.lines)
+		if l.lineCh == nil {
+			l.lineCh = make(chan struct{})
+		}
+		lineCh := l.lineCh
+		l.l.Unlock()
+
+		if line, ok := l.find(substr, from); ok {
+			return line, nil
+		}
+		from = n
+
+		select {
+		case <-lineCh:
+		case <-timer.C:
+			return BufferLine{}, fmt.Errorf(
+				"no line containing %q was logged within %v", substr, timeout,
+			)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
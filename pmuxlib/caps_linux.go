@@ -0,0 +1,124 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// capsByName maps linux capability names, without their CAP_ prefix, to their
+// numeric values, as defined in linux/capability.h.
+var capsByName = map[string]uintptr{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// parseCaps returns the numeric values of the named capabilities, which may
+// or may not have a CAP_ prefix.
+func parseCaps(capNames []string) ([]uintptr, error) {
+
+	caps := make([]uintptr, 0, len(capNames))
+	for _, capName := range capNames {
+
+		normName := strings.TrimPrefix(strings.ToUpper(capName), "CAP_")
+
+		c, ok := capsByName[normName]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", capName)
+		}
+
+		caps = append(caps, c)
+	}
+
+	return caps, nil
+}
+
+func setAmbientCaps(attr *syscall.SysProcAttr, capNames []string) error {
+
+	caps, err := parseCaps(capNames)
+	if err != nil {
+		return err
+	}
+
+	attr.AmbientCaps = caps
+	return nil
+}
+
+// startCmd starts the command with the named capabilities dropped from its
+// bounding set, so that it can't hold them even if it's run as root.
+//
+// SysProcAttr has no way of doing this, but the bounding set is per-thread and
+// inherited by processes started from that thread, so the capabilities are
+// dropped from a locked thread which the command is then started from. That
+// thread is never unlocked, so the runtime terminates it once the goroutine
+// returns, rather than reusing it.
+func startCmd(cmd *exec.Cmd, dropCapNames []string) error {
+
+	if len(dropCapNames) == 0 {
+		return cmd.Start()
+	}
+
+	caps, err := parseCaps(dropCapNames)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		for _, c := range caps {
+			if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil {
+				errCh <- fmt.Errorf("dropping capability %d: %w", c, err)
+				return
+			}
+		}
+
+		errCh <- cmd.Start()
+	}()
+
+	return <-errCh
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+func setAmbientCaps(attr *syscall.SysProcAttr, capNames []string) error {
+	if len(capNames) > 0 {
+		return errors.New("ambient capabilities are only supported on linux")
+	}
+	return nil
+}
+
+func startCmd(cmd *exec.Cmd, dropCapNames []string) error {
+	if len(dropCapNames) > 0 {
+		return errors.New("dropping capabilities is only supported on linux")
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,53 @@
+package pmuxlib
+
+import "time"
+
+// Clock is the source of the current time, and of timers, which pmux uses for
+// timing the processes it runs, e.g. for backoff waits, SigKillWait, and
+// MaxRunTime. It allows tests to control the passing of time, see the pmuxtest
+// package.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer returns a Timer which sends the current time on its channel
+	// once the given duration has passed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event created by a Clock, see time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock implements Clock using the system clock.
+type RealClock struct{}
+
+// Now implements the Clock interface.
+func (RealClock) Now() time.Time { return time.Now() }
+
+// NewTimer implements the Clock interface.
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clock returns the Clock of the process, or RealClock if it doesn't have one.
+func (cfg ProcessConfig) clock() Clock {
+	if cfg.Clock == nil {
+		return RealClock{}
+	}
+	return cfg.Clock
+}
+
+// after is like time.After, but using the given Clock. The returned function
+// stops the timer, and should be called once the channel is no longer needed.
+func after(clock Clock, d time.Duration) (<-chan time.Time, func()) {
+	timer := clock.NewTimer(d)
+	return timer.C(), func() { timer.Stop() }
+}
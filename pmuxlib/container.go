@@ -0,0 +1,278 @@
+package pmuxlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProcessType describes what kind of process a ProcessConfig runs.
+type ProcessType string
+
+// Enumeration of possible ProcessType values.
+const (
+	// ProcessTypeExec processes are run by executing Cmd directly. This is
+	// the default.
+	ProcessTypeExec ProcessType = "exec"
+
+	// ProcessTypeContainer processes are run within an OCI container using
+	// docker or podman, see ContainerConfig.
+	ProcessTypeContainer ProcessType = "container"
+
+	// ProcessTypePipeline processes run a sequence of commands, one after
+	// another, see PipelineConfig.
+	ProcessTypePipeline ProcessType = "pipeline"
+)
+
+// containerRemoveTimeout is the longest that removing a leftover container may
+// take.
+const containerRemoveTimeout = 30 * time.Second
+
+// containerNameRegexp matches the container names accepted by docker and
+// podman.
+var containerNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ContainerConfig describes the container which a ProcessTypeContainer process
+// is run within. The process is run using "<runtime> run", so that its output,
+// exit status and signals pass through the runtime's client as they would for
+// any other process, and it's supervised in the same way. Cmd and Args, if
+// given, override the command of the image.
+//
+// Env and PassEnv are passed into the container, while the rest of pmux's
+// environment is only given to the runtime's client. Dir, User and Group also
+// apply to the client, rather than to the container.
+type ContainerConfig struct {
+
+	// Image is the image to run, e.g. "redis:7".
+	Image string `yaml:"image,omitempty"`
+
+	// Runtime is the command used to run the container, e.g. "docker" or
+	// "podman". Defaults to whichever of those is found in the PATH, docker
+	// being preferred.
+	Runtime string `yaml:"runtime,omitempty"`
+
+	// Name is the name given to the container. Any container of the same name
+	// which was left behind, e.g. because the runtime's client was killed, is
+	// removed before the process is started.
+	//
+	// Defaults to "pmux-<instance tag>-<process name>", so that pmux instances
+	// on the same host don't remove each other's containers. Characters of the
+	// instance tag which aren't allowed in container names are replaced with
+	// '-'.
+	Name string `yaml:"name,omitempty"`
+
+	// Workdir is the directory within the container to run the process in.
+	Workdir string `yaml:"workdir,omitempty"`
+
+	// Volumes and Ports are passed to the runtime as "--volume" and
+	// "--publish" options respectively, e.g. "./data:/data" and "8080:80".
+	Volumes []string `yaml:"volumes,omitempty"`
+	Ports   []string `yaml:"ports,omitempty"`
+
+	// Network is the network to connect the container to.
+	Network string `yaml:"network,omitempty"`
+
+	// RunArgs are further arguments which are given to "<runtime> run", before
+	// the image.
+	RunArgs []string `yaml:"runArgs,omitempty"`
+}
+
+// containerNameInvalidRegexp matches the characters which aren't allowed
+// within container names.
+var containerNameInvalidRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func (cfg ContainerConfig) withDefaults(procName, instance string) ContainerConfig {
+	if cfg.Name == "" {
+		cfg.Name = "pmux-" + procName
+		if instance != "" {
+			instance = containerNameInvalidRegexp.ReplaceAllString(instance, "-")
+			cfg.Name = "pmux-" + instance + "-" + procName
+		}
+	}
+	return cfg
+}
+
+func (cfg ProcessConfig) validateContainer() []string {
+
+	var problems []string
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(str, args...))
+	}
+
+	switch cfg.Type {
+	case "", ProcessTypeExec, ProcessTypePipeline:
+		if cfg.Container.Image != "" {
+			problemf("container is only used when type is %q", ProcessTypeContainer)
+		}
+		return problems
+	case ProcessTypeContainer:
+	default:
+		problemf(
+			"type %q is not one of %q, %q or %q",
+			cfg.Type, ProcessTypeExec, ProcessTypeContainer, ProcessTypePipeline,
+		)
+		return problems
+	}
+
+	if cfg.Container.Image == "" {
+		problemf("container.image is required")
+	}
+
+	// templates haven't necessarily been expanded yet.
+	name := cfg.Container.withDefaults(cfg.Name, cfg.instance).Name
+	if !containerNameRegexp.MatchString(name) && !strings.Contains(name, "{{") {
+		problemf(
+			"container name %q must consist of letters, digits, '_', '.' and "+
+				"'-', and not start with '_', '.' or '-'",
+			name,
+		)
+	}
+
+	for _, unsupported := range []struct {
+		field string
+		set   bool
+	}{
+		{"shell", cfg.Shell},
+		{"chroot", cfg.Chroot != ""},
+		{"ambientCaps", len(cfg.AmbientCaps) > 0},
+		{"dropCaps", len(cfg.DropCaps) > 0},
+		{"listen", len(cfg.Listen) > 0},
+		{"streams", len(cfg.Streams) > 0},
+		{"adoptPIDFile", cfg.AdoptPIDFile != ""},
+		{"path", len(cfg.Path) > 0},
+		{"umask", cfg.Umask != ""},
+	} {
+		if unsupported.set {
+			problemf(
+				"%s cannot be used when type is %q",
+				unsupported.field, ProcessTypeContainer,
+			)
+		}
+	}
+
+	// two instances of the process would need two containers of the same
+	// name.
+	if cfg.RestartStrategy == RestartStrategyBlueGreen {
+		problemf(
+			"restartStrategy %q cannot be used when type is %q",
+			RestartStrategyBlueGreen, ProcessTypeContainer,
+		)
+	}
+
+	return problems
+}
+
+// containerRuntime returns the command which should be used to run the
+// process's container.
+func (cfg ContainerConfig) containerRuntime() (string, error) {
+
+	if cfg.Runtime != "" {
+		return cfg.Runtime, nil
+	}
+
+	for _, runtime := range []string{"docker", "podman"} {
+		if _, err := exec.LookPath(runtime); err == nil {
+			return runtime, nil
+		}
+	}
+
+	return "", errors.New("neither docker nor podman were found in the PATH, set container.runtime")
+}
+
+// containerCommand returns the executable, i.e. the runtime, and arguments
+// which should be used to run a ProcessTypeContainer process.
+func (cfg ProcessConfig) containerCommand() (string, []string, error) {
+
+	containerCfg := cfg.Container.withDefaults(cfg.Name, cfg.instance)
+
+	runtime, err := containerCfg.containerRuntime()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// --sig-proxy causes the signals which pmux sends to the client to be
+	// passed on to the container, which is removed once it exits.
+	args := []string{"run", "--rm", "--sig-proxy=true", "--name", containerCfg.Name}
+
+	// the values of these are given to the client, which passes them on. By
+	// this point Env also holds the resolved EnvFrom values, and those of the
+	// process's Secrets and of plugins.
+	envKeys := make([]string, 0, len(cfg.Env)+len(cfg.PassEnv))
+	for k := range cfg.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+
+	// metadataEnv is given to every process.
+	envKeys = append(envKeys, "PMUX_NAME", "PMUX_RESTART_COUNT", "PMUX_START_TIME")
+	if cfg.Replicas > 1 {
+		envKeys = append(envKeys, "PMUX_REPLICA_INDEX")
+	}
+
+	if cfg.TZ != "" {
+		envKeys = append(envKeys, "TZ")
+	}
+
+	if cfg.Lang != "" {
+		envKeys = append(envKeys, "LANG")
+	}
+
+	for _, k := range append(envKeys, cfg.PassEnv...) {
+		args = append(args, "--env", k)
+	}
+
+	if containerCfg.Workdir != "" {
+		args = append(args, "--workdir", containerCfg.Workdir)
+	}
+
+	for _, volume := range containerCfg.Volumes {
+		args = append(args, "--volume", volume)
+	}
+
+	for _, port := range containerCfg.Ports {
+		args = append(args, "--publish", port)
+	}
+
+	if containerCfg.Network != "" {
+		args = append(args, "--network", containerCfg.Network)
+	}
+
+	args = append(args, containerCfg.RunArgs...)
+	args = append(args, containerCfg.Image)
+
+	if cfg.Cmd != "" {
+		args = append(args, cfg.Cmd)
+	}
+	args = append(args, cfg.Args...)
+
+	return runtime, args, nil
+}
+
+// removeContainer forcibly removes the process's container, if there is one.
+// Errors are only logged, as the container not existing is the usual case.
+func (cfg ProcessConfig) removeContainer(sysLogger Logger) {
+
+	containerCfg := cfg.Container.withDefaults(cfg.Name, cfg.instance)
+
+	runtime, err := containerCfg.containerRuntime()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), containerRemoveTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, runtime, "rm", "--force", containerCfg.Name).
+		CombinedOutput()
+	if err != nil {
+		debugf(
+			sysLogger, "removing container %q: %v: %s",
+			containerCfg.Name, err, out,
+		)
+	}
+}
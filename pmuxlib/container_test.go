@@ -0,0 +1,83 @@
+package pmuxlib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainerCommand(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		cfg     ProcessConfig
+		expArgs []string
+	}{
+		{
+			name: "default name",
+			cfg: ProcessConfig{
+				Name:      "redis",
+				Container: ContainerConfig{Image: "redis:7"},
+			},
+			expArgs: []string{
+				"run", "--rm", "--sig-proxy=true", "--name", "pmux-redis",
+				"--env", "PMUX_NAME",
+				"--env", "PMUX_RESTART_COUNT",
+				"--env", "PMUX_START_TIME",
+				"redis:7",
+			},
+		},
+		{
+			name: "instance",
+			cfg: ProcessConfig{
+				Name:      "redis",
+				Container: ContainerConfig{Image: "redis:7"},
+				instance:  "host 1.example",
+			},
+			expArgs: []string{
+				"run", "--rm", "--sig-proxy=true", "--name", "pmux-host-1.example-redis",
+				"--env", "PMUX_NAME",
+				"--env", "PMUX_RESTART_COUNT",
+				"--env", "PMUX_START_TIME",
+				"redis:7",
+			},
+		},
+		{
+			name: "explicit name and env",
+			cfg: ProcessConfig{
+				Name: "redis",
+				Env:  map[string]string{"B": "b", "A": "a"},
+				Container: ContainerConfig{
+					Image: "redis:7",
+					Name:  "cache",
+				},
+				Cmd:      "redis-server",
+				Args:     []string{"--port", "6380"},
+				instance: "host",
+			},
+			expArgs: []string{
+				"run", "--rm", "--sig-proxy=true", "--name", "cache",
+				"--env", "A",
+				"--env", "B",
+				"--env", "PMUX_NAME",
+				"--env", "PMUX_RESTART_COUNT",
+				"--env", "PMUX_START_TIME",
+				"redis:7", "redis-server", "--port", "6380",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cfg.Container.Runtime = "docker"
+
+			runtime, args, err := test.cfg.containerCommand()
+			if err != nil {
+				t.Fatal(err)
+			} else if runtime != "docker" {
+				t.Fatalf("expected runtime %q, got %q", "docker", runtime)
+			} else if !reflect.DeepEqual(args, test.expArgs) {
+				t.Fatalf("expected args:\n%q\ngot:\n%q", test.expArgs, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CrashReportConfig is used to configure the writing of crash reports for a
+// process. A crash report is written each time the process exits of its own
+// accord with a non-zero exit code or due to a signal.
+type CrashReportConfig struct {
+
+	// Dir is the directory crash reports are written to, which will be created
+	// if needed. Each report is named after the process and the time of the
+	// crash. If not set then crash reports are not written.
+	Dir string `yaml:"dir,omitempty"`
+
+	// Lines is the number of lines of the process's most recent stdout and
+	// stderr output which are included in each report.
+	//
+	// Defaults to 100.
+	Lines int `yaml:"lines,omitempty"`
+}
+
+func (cfg CrashReportConfig) withDefaults() CrashReportConfig {
+	if cfg.Lines == 0 {
+		cfg.Lines = 100
+	}
+	return cfg
+}
+
+// writeCrashReport writes a crash report for the given instance, if it crashed
+// and crash reports are enabled, and returns the path of the report.
+func writeCrashReport(
+	cfg ProcessConfig, inst *instance, restarts int,
+) (
+	string, error,
+) {
+
+	if cfg.CrashReport.Dir == "" || !inst.crashed() {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(cfg.CrashReport.Dir, 0755); err != nil {
+		return "", fmt.Errorf("creating crash report dir: %w", err)
+	}
+
+	exitCode, sig := inst.exitStatus()
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "process:    %s\n", cfg.Name)
+	fmt.Fprintf(b, "started:    %s\n", inst.start.Format(time.RFC3339Nano))
+	fmt.Fprintf(b, "exited:     %s\n", inst.end.Format(time.RFC3339Nano))
+	fmt.Fprintf(b, "uptime:     %v\n", inst.end.Sub(inst.start))
+	fmt.Fprintf(b, "exit code:  %d\n", exitCode)
+
+	if sig != 0 {
+		fmt.Fprintf(b, "signal:     %s\n", signalName(sig))
+	}
+
+	fmt.Fprintf(b, "restarts:   %d\n", restarts)
+
+	if state := inst.state; state != nil {
+		fmt.Fprintf(b, "usage:      %v\n", newResourceUsage(state))
+	}
+
+	lines := inst.output.get()
+	if len(lines) > cfg.CrashReport.Lines {
+		lines = lines[len(lines)-cfg.CrashReport.Lines:]
+	}
+
+	fmt.Fprintf(b, "\nlast %d lines of output:\n", len(lines))
+	for _, line := range lines {
+		fmt.Fprintln(b, line)
+	}
+
+	path := filepath.Join(
+		cfg.CrashReport.Dir,
+		fmt.Sprintf(
+			"%s-%s.crash",
+			cfg.Name, inst.end.UTC().Format("20060102T150405.000Z"),
+		),
+	)
+
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return "", fmt.Errorf("writing crash report: %w", err)
+	}
+
+	return path, nil
+}
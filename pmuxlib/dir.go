@@ -0,0 +1,145 @@
+package pmuxlib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultDirMode is the mode which Dir is created with when CreateDir is set,
+// if DirMode isn't.
+const defaultDirMode = 0755
+
+// dirPath returns the path of the process's Dir as seen by pmux, i.e. taking
+// Chroot into account.
+func (cfg ProcessConfig) dirPath() string {
+	if cfg.Chroot != "" {
+		return filepath.Join(cfg.Chroot, cfg.Dir)
+	}
+	return cfg.Dir
+}
+
+func (cfg ProcessConfig) validateDir() []string {
+
+	var problems []string
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(str, args...))
+	}
+
+	if !cfg.CreateDir {
+		if cfg.DirMode != "" || cfg.DirOwner != "" {
+			problemf("dirMode and dirOwner have no effect unless createDir is set")
+		}
+		return problems
+	}
+
+	if cfg.Dir == "" {
+		problemf("createDir requires dir to be set")
+	}
+
+	if cfg.DirMode != "" {
+		if mode, err := strconv.ParseUint(cfg.DirMode, 8, 32); err != nil ||
+			mode&^uint64(fs.ModePerm) != 0 {
+			problemf("dirMode %q is not a valid octal permission mode", cfg.DirMode)
+		}
+	}
+
+	if cfg.DirOwner == ":" || strings.Count(cfg.DirOwner, ":") > 1 {
+		problemf("dirOwner %q must be of the form \"user[:group]\"", cfg.DirOwner)
+	}
+
+	return problems
+}
+
+// ensureDir creates the process's Dir, and any of its parents, if CreateDir
+// is set and they don't already exist. Each created directory is given
+// DirMode and owned by DirOwner, or else the process's User and Group.
+//
+// If CreateDir isn't set then the Dir is checked to exist instead, as
+// otherwise starting the process fails with an error which appears to be
+// about Cmd.
+func (cfg ProcessConfig) ensureDir(sysLogger Logger) error {
+
+	if cfg.Dir == "" {
+		return nil
+	}
+
+	path := cfg.dirPath()
+
+	if !cfg.CreateDir {
+		if info, err := os.Stat(path); err != nil {
+			return fmt.Errorf("checking dir: %w", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("dir %q is not a directory", path)
+		}
+		return nil
+	}
+
+	// find the directories which need creating, from the top down.
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("checking dir %q: %w", dir, err)
+		}
+
+		missing = append([]string{dir}, missing...)
+
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	mode := fs.FileMode(defaultDirMode)
+	if cfg.DirMode != "" {
+		m, err := strconv.ParseUint(cfg.DirMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parsing dirMode %q: %w", cfg.DirMode, err)
+		}
+		mode = fs.FileMode(m)
+	}
+
+	userName, groupName := cfg.User, cfg.Group
+	if cfg.DirOwner != "" {
+		userName, groupName, _ = strings.Cut(cfg.DirOwner, ":")
+	}
+
+	uid, gid := -1, -1
+	if userName != "" || groupName != "" {
+		cred, err := lookupCredential(userName, groupName)
+		if err != nil {
+			return err
+		}
+		uid, gid = int(cred.Uid), int(cred.Gid)
+	}
+
+	for _, dir := range missing {
+
+		if err := os.Mkdir(dir, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("creating dir %q: %w", dir, err)
+		}
+
+		// the mode given to Mkdir is subject to the umask.
+		if err := os.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("setting mode of dir %q: %w", dir, err)
+		}
+
+		if uid != -1 {
+			if err := os.Chown(dir, uid, gid); err != nil {
+				return fmt.Errorf("setting owner of dir %q: %w", dir, err)
+			}
+		}
+	}
+
+	infof(sysLogger, "created dir %q", path)
+	return nil
+}
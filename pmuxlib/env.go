@@ -0,0 +1,139 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// envCommandTimeout is how long an EnvValue's FromCommand may run for.
+const envCommandTimeout = 30 * time.Second
+
+// EnvValue describes where the value of an environment variable in a
+// ProcessConfig's EnvFrom is sourced from, each time the process is started.
+// Exactly one of its fields must be set.
+type EnvValue struct {
+
+	// FromFile is the path of a file whose contents are used as the value,
+	// with any trailing newline removed.
+	FromFile string `yaml:"fromFile,omitempty"`
+
+	// FromCommand is a shell command, run using "/bin/sh -c", whose stdout is
+	// used as the value, with any trailing newline removed. It is run in the
+	// same directory and Chroot, and as the same User and Group, as the
+	// process, with the process's Env.
+	FromCommand string `yaml:"fromCommand,omitempty"`
+
+	// Secret references a secret in a cloud secret manager, whose value is
+	// used as the value. It has the form "<scheme>://<name>[#<key>]", where
+	// key, if given, selects a field of a secret whose value is a JSON object.
+	// Supported schemes are:
+	//
+	//	aws-sm  AWS Secrets Manager, name is the secret's name or ARN.
+	//	gcp-sm  GCP Secret Manager, name is of the form
+	//	        projects/<project>/secrets/<secret>[/versions/<version>],
+	//	        or <project>/<secret>[/<version>].
+	//
+	// Credentials are found in a subset of the places which the official SDKs
+	// of each cloud look, see getAWSCredentials and getGCPAccessToken.
+	Secret string `yaml:"secret,omitempty"`
+}
+
+func (v EnvValue) validate() error {
+
+	var n int
+	for _, field := range []string{v.FromFile, v.FromCommand, v.Secret} {
+		if field != "" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return fmt.Errorf("exactly one of fromFile, fromCommand, and secret must be given")
+	}
+
+	if v.Secret != "" {
+		if _, err := parseSecretRef(v.Secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the value of the EnvValue, reading its file, running its
+// command, or fetching its secret as needed. The command is run on behalf of
+// the process described by the ProcessConfig, and secrets is used to cache
+// fetched secrets.
+func (v EnvValue) resolve(
+	ctx context.Context, cfg ProcessConfig, secrets map[string]string,
+) (
+	string, error,
+) {
+
+	switch {
+	case v.FromFile != "":
+		b, err := os.ReadFile(v.FromFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(b), "\n"), nil
+
+	case v.FromCommand != "":
+		ctx, cancel := context.WithTimeout(ctx, envCommandTimeout)
+		defer cancel()
+
+		stderr := new(bytes.Buffer)
+
+		sysProcAttr, err := cfg.commandSysProcAttr()
+		if err != nil {
+			return "", err
+		}
+
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", v.FromCommand)
+		cmd.Dir = cfg.Dir
+		cmd.Env = cfg.environ()
+		cmd.Stderr = stderr
+		cmd.SysProcAttr = sysProcAttr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf(
+				"running command: %w (stderr: %q)",
+				err, strings.TrimSpace(stderr.String()),
+			)
+		}
+
+		return strings.TrimSuffix(string(out), "\n"), nil
+
+	default:
+		return fetchSecret(ctx, v.Secret, secrets)
+	}
+}
+
+// resolveEnv returns a copy of the ProcessConfig with the current value of
+// each of its EnvFrom added to its Env, which is itself copied.
+func (cfg ProcessConfig) resolveEnv(ctx context.Context) (ProcessConfig, error) {
+
+	secrets := map[string]string{}
+
+	env := make(map[string]string, len(cfg.Env)+len(cfg.EnvFrom))
+	for k, v := range cfg.Env {
+		env[k] = v
+	}
+
+	for k, v := range cfg.EnvFrom {
+		val, err := v.resolve(ctx, cfg, secrets)
+		if err != nil {
+			return ProcessConfig{}, fmt.Errorf("resolving envFrom %q: %w", k, err)
+		}
+		env[k] = val
+	}
+
+	cfg.Env, cfg.EnvFrom = env, nil
+	return cfg, nil
+}
@@ -0,0 +1,158 @@
+package pmuxlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The kinds of Event which may be emitted.
+const (
+	EventStart   = "start"
+	EventReady   = "ready"
+	EventExit    = "exit"
+	EventRestart = "restart"
+	EventGiveUp  = "give-up"
+	EventStop    = "stop"
+
+	// EventSignalFailed is emitted when sending a signal to a process in order
+	// to stop it fails, other than because it has already exited. pmux keeps
+	// trying to kill the process, and so this may be emitted repeatedly.
+	EventSignalFailed = "signal-failed"
+
+	// EventLogFailing and EventLogRecovered are emitted when writing to a log
+	// file starts failing, and once it succeeds again, respectively. They have
+	// no Process.
+	EventLogFailing   = "log-failing"
+	EventLogRecovered = "log-recovered"
+
+	// EventShutdown is emitted once all processes have stopped and Run is
+	// about to return, or if Run couldn't start any processes at all. It has
+	// no Process.
+	EventShutdown = "shutdown"
+)
+
+// Event describes a change in the lifecycle of a process. Events are written
+// as newline-delimited JSON to the Config's Events destination.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Process string    `json:"process,omitempty"`
+
+	// Instance is the Config's InstanceTag.
+	Instance string `json:"instance,omitempty"`
+
+	// PID is set for start, ready, exit and signal-failed events.
+	PID int `json:"pid,omitempty"`
+
+	// Exit is set for exit events.
+	Exit *ExitStatus `json:"exit,omitempty"`
+
+	// Restarts is set for restart events, and is the number of times the
+	// process has been restarted, including this one.
+	Restarts int `json:"restarts,omitempty"`
+
+	// Path and Error are set for log-failing and log-recovered events, to
+	// the path of the log file and the error writing to it. Error is also set
+	// for signal-failed events.
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Reason is set for shutdown events, and describes why pmux is exiting,
+	// see Shutdown.
+	Reason string `json:"reason,omitempty"`
+}
+
+// eventQueueSize is the number of events which may be waiting to be written
+// before further events are dropped.
+const eventQueueSize = 1024
+
+// eventWriter writes Events in the background, so that a slow reader can't
+// hold up pmux. Events are dropped if the reader falls too far behind.
+type eventWriter struct {
+	f       *os.File
+	ch      chan Event
+	doneCh  chan struct{}
+	dropped int
+}
+
+// openEventWriter opens the given events destination, which is either
+// "fd:<n>", for an already open file descriptor, or the path of a file or
+// named pipe.
+func openEventWriter(dest string) (*eventWriter, error) {
+
+	var f *os.File
+
+	if fdStr := strings.TrimPrefix(dest, "fd:"); fdStr != dest {
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor %q", fdStr)
+		}
+
+		// the descriptor was inherited by pmux, and so would otherwise also be
+		// inherited by every process which pmux starts.
+		unix.CloseOnExec(fd)
+		f = os.NewFile(uintptr(fd), dest)
+
+	} else {
+		// O_RDWR is used so that opening a named pipe doesn't block until
+		// there's a reader.
+		var err error
+		f, err = os.OpenFile(dest, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := &eventWriter{
+		f:      f,
+		ch:     make(chan Event, eventQueueSize),
+		doneCh: make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+func (w *eventWriter) run() {
+	defer close(w.doneCh)
+
+	enc := json.NewEncoder(w.f)
+	for event := range w.ch {
+		if err := enc.Encode(event); err != nil {
+			// there's nowhere sensible to report this, and subsequent writes
+			// will likely fail too.
+			continue
+		}
+	}
+}
+
+// emit queues the Event to be written. It is a no-op on a nil eventWriter. It
+// must not be called concurrently, or after close.
+func (w *eventWriter) emit(event Event) {
+
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.ch <- event:
+	default:
+		w.dropped++
+	}
+}
+
+// close writes all queued events and then closes the destination, returning
+// the number of events which were dropped.
+func (w *eventWriter) close() int {
+	close(w.ch)
+	<-w.doneCh
+	_ = w.f.Close()
+	return w.dropped
+}
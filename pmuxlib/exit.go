@@ -0,0 +1,154 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SignalError is returned by RunProcessOnce when the process was terminated by
+// a signal. The same is described by the Signal and CoreDumped fields of
+// ExitInfo.
+type SignalError struct {
+	Signal     syscall.Signal
+	CoreDumped bool
+}
+
+func (e *SignalError) Error() string {
+	msg := "terminated by " + signalName(e.Signal)
+	if e.CoreDumped {
+		msg += " (core dumped)"
+	}
+	return msg
+}
+
+// signalName returns the name of the signal (e.g. "SIGSEGV"), or its number if
+// it has no name.
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// ExitMatcher matches the exit of a process. It may be any of:
+//
+//   - An exit code, e.g. "78".
+//   - An inclusive range of exit codes, e.g. "100-120".
+//   - The name of a signal which terminated the process, e.g. "SIGSEGV".
+//   - "nonzero", matching any non-zero exit code, but not signals.
+//   - "signal", matching termination by any signal.
+//   - "any", matching every exit.
+type ExitMatcher string
+
+// parse returns a function which returns true if the exit with the given exit
+// code, or by the given signal if it's not zero, is matched.
+func (m ExitMatcher) parse() (func(int, syscall.Signal) bool, error) {
+
+	switch str := string(m); str {
+	case "any":
+		return func(int, syscall.Signal) bool { return true }, nil
+
+	case "nonzero":
+		return func(code int, sig syscall.Signal) bool {
+			return sig == 0 && code != 0
+		}, nil
+
+	case "signal":
+		return func(_ int, sig syscall.Signal) bool { return sig != 0 }, nil
+	}
+
+	if code, err := strconv.Atoi(string(m)); err == nil {
+		return func(c int, sig syscall.Signal) bool {
+			return sig == 0 && c == code
+		}, nil
+	}
+
+	if signum := unix.SignalNum(string(m)); signum != 0 {
+		return func(_ int, sig syscall.Signal) bool { return sig == signum }, nil
+	}
+
+	if minStr, maxStr, ok := strings.Cut(string(m), "-"); ok {
+		min, minErr := strconv.Atoi(minStr)
+		max, maxErr := strconv.Atoi(maxStr)
+
+		if minErr == nil && maxErr == nil && min <= max {
+			return func(c int, sig syscall.Signal) bool {
+				return sig == 0 && c >= min && c <= max
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf(
+		"%q is not an exit code, range, signal name, or keyword", string(m),
+	)
+}
+
+func (m ExitMatcher) validate() error {
+	_, err := m.parse()
+	return err
+}
+
+// matches returns true if an exit with the given exit code, or by the given
+// signal if it's not zero, is matched. Invalid ExitMatchers match nothing.
+func (m ExitMatcher) matches(exitCode int, sig syscall.Signal) bool {
+	fn, err := m.parse()
+	return err == nil && fn(exitCode, sig)
+}
+
+// ExitInfo describes a single run of a process, as returned by
+// RunProcessOnceInfo, or an exit of a process which RunProcess would otherwise
+// restart, see RestartDecider.
+type ExitInfo struct {
+	Name string
+
+	// ExitCode is the exit code of the process, or -1 if it was terminated by
+	// Signal. Err is the error which ended the run, if any, e.g. because the
+	// process couldn't be started at all.
+	ExitCode   int
+	Signal     syscall.Signal
+	CoreDumped bool
+	Err        error
+	Class      ExitClass
+
+	// Stopped is set if the process was stopped by pmux, because the context
+	// of the run was canceled or its deadline passed, rather than having
+	// exited of its own accord. Err then includes the context's cause, see
+	// StopError.
+	Stopped bool
+
+	// Started and Ended are when the run began and completed, and Ran is how
+	// long the process ran for.
+	Started, Ended time.Time
+	Ran            time.Duration
+
+	// Usage describes the resources used by the process, if it was started
+	// and waited on.
+	Usage *ResourceUsage
+
+	// Restarts is the number of times the process has been restarted so far,
+	// and FailedStarts the number of consecutive failed starts, see
+	// ProcessConfig.StartSecs. These, Restart and Wait are only set by
+	// RunProcess.
+	Restarts     int
+	FailedStarts int
+
+	// Restart and Wait are the decision of the built-in restart policy, i.e.
+	// whether the process would be restarted, and if so how long RunProcess
+	// would wait before restarting it.
+	Restart bool
+	Wait    time.Duration
+}
+
+// RestartDecider is called by RunProcess whenever the process exits, and
+// decides whether the process is restarted and how long to wait before doing
+// so, overriding the built-in restart policy (NoRestartOn, MaxRestarts,
+// backoff, and CircuitBreaker), whose decision is given in the ExitInfo.
+//
+// It is called from the goroutine which is running the process, so restarts
+// are delayed until it returns.
+type RestartDecider func(ExitInfo) (restart bool, wait time.Duration)
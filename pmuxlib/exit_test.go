@@ -0,0 +1,66 @@
+package pmuxlib
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestExitMatcher(t *testing.T) {
+
+	type exit struct {
+		code int
+		sig  syscall.Signal
+	}
+
+	var (
+		clean    = exit{0, 0}
+		code1    = exit{1, 0}
+		code78   = exit{78, 0}
+		code110  = exit{110, 0}
+		sigkill  = exit{-1, syscall.SIGKILL}
+		sigsegv  = exit{-1, syscall.SIGSEGV}
+		allExits = []exit{clean, code1, code78, code110, sigkill, sigsegv}
+	)
+
+	tests := []struct {
+		matcher ExitMatcher
+		invalid bool
+		matches []exit
+	}{
+		{matcher: "any", matches: allExits},
+		{matcher: "nonzero", matches: []exit{code1, code78, code110}},
+		{matcher: "signal", matches: []exit{sigkill, sigsegv}},
+		{matcher: "0", matches: []exit{clean}},
+		{matcher: "78", matches: []exit{code78}},
+		{matcher: "100-120", matches: []exit{code110}},
+		{matcher: "0-1", matches: []exit{clean, code1}},
+		{matcher: "SIGKILL", matches: []exit{sigkill}},
+		{matcher: "SIGSEGV", matches: []exit{sigsegv}},
+		{matcher: "120-100", invalid: true},
+		{matcher: "SIGNOPE", invalid: true},
+		{matcher: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.matcher), func(t *testing.T) {
+
+			if err := test.matcher.validate(); (err != nil) != test.invalid {
+				t.Fatalf("expected invalid %v, got error %v", test.invalid, err)
+			}
+
+			for _, e := range allExits {
+				var exp bool
+				for _, m := range test.matches {
+					exp = exp || m == e
+				}
+
+				if got := test.matcher.matches(e.code, e.sig); got != exp {
+					t.Errorf(
+						"exit code %d, signal %v: expected match %v, got %v",
+						e.code, e.sig, exp, got,
+					)
+				}
+			}
+		})
+	}
+}
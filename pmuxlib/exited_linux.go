@@ -0,0 +1,27 @@
+package pmuxlib
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// exitedCh returns a channel which is closed once the child process of the
+// given PID has exited. The process is not reaped, so that it can still be
+// waited on as usual.
+func exitedCh(pid int) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			var info unix.Siginfo
+			err := unix.Waitid(
+				unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil,
+			)
+			if !errors.Is(err, unix.EINTR) {
+				return
+			}
+		}
+	}()
+	return ch
+}
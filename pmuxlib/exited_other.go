@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+// exitedCh returns a channel which is never closed, as there's no portable way
+// to tell that a child process has exited without reaping it.
+func exitedCh(pid int) <-chan struct{} { return nil }
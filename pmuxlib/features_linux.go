@@ -0,0 +1,5 @@
+package pmuxlib
+
+// platformFeatures lists the features which are only supported on some
+// platforms, see BuildInfo.Features.
+var platformFeatures = []string{"adopt", "ambient-caps", "kill-tree", "live-usage"}
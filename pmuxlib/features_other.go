@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+// platformFeatures lists the features which are only supported on some
+// platforms, see BuildInfo.Features.
+var platformFeatures = []string{}
@@ -0,0 +1,438 @@
+package pmuxlib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogRotationConfig is used to configure the rotation of log files written by
+// pmux. When a log file is rotated it is renamed, with the time of rotation
+// appended to its name, and a new file is created in its place.
+type LogRotationConfig struct {
+
+	// MaxSizeMB is the size, in megabytes, which a log file may reach before
+	// it is rotated. If not set then files are not rotated due to size.
+	MaxSizeMB int `yaml:"maxSizeMB,omitempty"`
+
+	// MaxAge is how long a log file may be written to before it is rotated. If
+	// not set then files are not rotated due to age.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+
+	// Compress causes rotated files to be compressed using gzip.
+	Compress bool `yaml:"compress,omitempty"`
+
+	// Keep is the number of rotated files which are kept for each log file,
+	// older ones are deleted. If not set then all rotated files are kept.
+	Keep int `yaml:"keep,omitempty"`
+}
+
+// rotatedTimeFormat is appended to the path of a log file when it's rotated.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// fileSinkRetryInterval is how often a fileSink which is failing to write to
+// its file will try again.
+const fileSinkRetryInterval = 10 * time.Second
+
+// fileSink is an io.Writer which appends to a file, and which can reopen that
+// file on request, e.g. after it has been rotated away by logrotate. It can
+// also rotate the file itself.
+//
+// If writing to the file fails (e.g. because the disk is full) then the
+// fileSink writes to its fallback instead, if it has one, retrying the file
+// periodically. Writes to a fileSink never fail, so that logging problems
+// don't affect processes.
+type fileSink struct {
+	path     string
+	rotation LogRotationConfig
+	fallback io.Writer
+
+	// onFailing and onRecovered, if set, are called in their own goroutine
+	// when writes to the file start failing, and once they succeed again,
+	// respectively.
+	onFailing   func(path string, err error)
+	onRecovered func(path string)
+
+	l      sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	failing   bool
+	lastTry   time.Time
+	errsCount uint64
+}
+
+func openFile(path string) (*os.File, int64, error) {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+func openFileSink(path string, rotation LogRotationConfig) (*fileSink, error) {
+
+	f, size, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{
+		path:     path,
+		rotation: rotation,
+		f:        f,
+		size:     size,
+		opened:   time.Now(),
+	}, nil
+}
+
+func (s *fileSink) Write(b []byte) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.failing && time.Since(s.lastTry) < fileSinkRetryInterval {
+		s.writeFallback(b)
+		return len(b), nil
+	}
+
+	if s.shouldRotate(len(b)) {
+		if err := s.rotate(); err != nil {
+			// carry on writing to the current file, it's better than losing
+			// logs entirely.
+			fmt.Fprintf(os.Stderr, "rotating log file %q: %v\n", s.path, err)
+		}
+	}
+
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+
+	if err != nil {
+		s.errsCount++
+		s.lastTry = time.Now()
+
+		if !s.failing {
+			s.failing = true
+			if s.onFailing != nil {
+				go s.onFailing(s.path, err)
+			}
+		}
+
+		s.writeFallback(b[n:])
+		return len(b), nil
+	}
+
+	if s.failing {
+		s.failing = false
+		if s.onRecovered != nil {
+			go s.onRecovered(s.path)
+		}
+	}
+
+	return n, nil
+}
+
+func (s *fileSink) writeFallback(b []byte) {
+	if s.fallback != nil {
+		_, _ = s.fallback.Write(b)
+	}
+}
+
+// writeErrors returns the number of writes to the file which have failed.
+func (s *fileSink) writeErrors() uint64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.errsCount
+}
+
+// shouldRotate returns true if the file should be rotated before the given
+// number of bytes are written to it. It must be called while s.l is held.
+func (s *fileSink) shouldRotate(n int) bool {
+
+	if maxSize := int64(s.rotation.MaxSizeMB) << 20; maxSize > 0 &&
+		s.size > 0 && s.size+int64(n) > maxSize {
+		return true
+	}
+
+	if s.rotation.MaxAge > 0 && time.Since(s.opened) > s.rotation.MaxAge {
+		return true
+	}
+
+	return false
+}
+
+// rotate renames the current file and opens a new one in its place, then
+// compresses and prunes rotated files in the background. It must be called
+// while s.l is held.
+func (s *fileSink) rotate() error {
+
+	rotatedPath := s.path + "." + time.Now().Format(rotatedTimeFormat)
+
+	if err := os.Rename(s.path, rotatedPath); err != nil {
+		return err
+	}
+
+	f, size, err := openFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	_ = s.f.Close()
+	s.f, s.size, s.opened = f, size, time.Now()
+
+	go func() {
+		if s.rotation.Compress {
+			if err := gzipFile(rotatedPath); err != nil {
+				fmt.Fprintf(
+					os.Stderr, "compressing log file %q: %v\n", rotatedPath, err,
+				)
+			}
+		}
+
+		if err := pruneRotated(s.path, s.rotation.Keep); err != nil {
+			fmt.Fprintf(os.Stderr, "pruning log files of %q: %v\n", s.path, err)
+		}
+	}()
+
+	return nil
+}
+
+// gzipFile compresses the file at the given path to a new file with a ".gz"
+// suffix, and then removes the original.
+func gzipFile(path string) error {
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// pruneRotated removes all but the newest keep rotated files of the log file
+// at the given path. If keep is not positive then nothing is removed.
+func pruneRotated(path string, keep int) error {
+
+	if keep <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+
+	// only consider files which were rotated by pmux, and which aren't
+	// currently being compressed.
+	var rotated []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err != nil {
+			continue
+		}
+		if !strings.HasSuffix(match, ".gz") {
+			if _, err := os.Stat(match + ".gz"); err == nil {
+				continue
+			}
+		}
+		rotated = append(rotated, match)
+	}
+
+	if len(rotated) <= keep {
+		return nil
+	}
+
+	// the timestamp format sorts lexically.
+	sort.Strings(rotated)
+
+	for _, old := range rotated[:len(rotated)-keep] {
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reopen closes the file and opens it again at the same path. If the file
+// can't be opened then the old one continues to be used.
+func (s *fileSink) reopen() error {
+	f, size, err := openFile(s.path)
+	if err != nil {
+		return fmt.Errorf("reopening %q: %w", s.path, err)
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	_ = s.f.Close()
+	s.f, s.size, s.opened = f, size, time.Now()
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.f.Close()
+}
+
+// openLogFile opens a fileSink for the given path, which reports failures to
+// write to it via the sysLogger and Events. If fallback is set then it is
+// written to while the file is failing.
+func (p *Pmux) openLogFile(
+	path string, rotation LogRotationConfig, fallback io.Writer,
+) (
+	*fileSink, error,
+) {
+
+	sink, err := openFileSink(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+
+	sink.fallback = fallback
+
+	sink.onFailing = func(path string, err error) {
+		p.l.Lock()
+		defer p.l.Unlock()
+
+		if p.sysLogger != nil {
+			p.sysLogger.Printf("writing to log file %q failed: %v", path, err)
+		}
+
+		p.emitEvent(Event{
+			Event: EventLogFailing, Path: path, Error: err.Error(),
+		})
+	}
+
+	sink.onRecovered = func(path string) {
+		p.l.Lock()
+		defer p.l.Unlock()
+
+		if p.sysLogger != nil {
+			p.sysLogger.Printf("writing to log file %q recovered", path)
+		}
+
+		p.emitEvent(Event{Event: EventLogRecovered, Path: path})
+	}
+
+	return sink, nil
+}
+
+// LogWriteErrors returns the number of writes to log files which have failed,
+// see ReopenLogs.
+func (p *Pmux) LogWriteErrors() uint64 {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	var n uint64
+	for _, sink := range p.sinks {
+		n += sink.writeErrors()
+	}
+	return n
+}
+
+// ReopenLogs closes and reopens every log file which is being written to, so
+// that files which have been moved away (e.g. by logrotate) are recreated.
+//
+// If writing to a log file fails (e.g. because its disk is full) then the file
+// is retried periodically. Lines which would have been written to the SysLog
+// file are written to stderr in the meantime.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) ReopenLogs() error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.ctx == nil {
+		return ErrNotRunning
+	}
+
+	var firstErr error
+	for _, sink := range p.sinks {
+		if err := sink.reopen(); err != nil {
+			p.sysLogger.Printf("reopening logs: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	infof(p.sysLogger, "reopened %d log files", len(p.sinks))
+	return firstErr
+}
+
+// CloseLogs flushes everything which Run has written to stdout, stderr and log
+// files, and causes anything further to be discarded, so that the process can
+// exit (e.g. using os.Exit) without losing or truncating any lines. Lines which
+// are being written when CloseLogs is called are completed first, but only
+// within the given timeout. It returns false if the timeout elapsed first.
+//
+// CloseLogs can be called at any time, including while Run is blocked, and
+// Run will continue without writing any output once it has been.
+func (p *Pmux) CloseLogs(timeout time.Duration) bool {
+
+	p.loggersL.Lock()
+	loggers := p.loggers
+	p.loggersL.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, l := range loggers {
+			wg.Add(1)
+			go func(l *logger) {
+				defer wg.Done()
+				l.Close()
+			}(l)
+		}
+		wg.Wait()
+		close(closed)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-closed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,171 @@
+package pmuxlib
+
+import (
+	"syscall"
+	"time"
+)
+
+// ProcessState describes what a process being run by Pmux is currently doing.
+type ProcessState string
+
+// Enumeration of possible ProcessState values.
+const (
+	// ProcessStateRunning indicates that the process is running, but hasn't
+	// become ready (see ProcessConfig.ReadyCheck).
+	ProcessStateRunning ProcessState = "running"
+
+	// ProcessStateReady indicates that the process is running and ready.
+	ProcessStateReady ProcessState = "ready"
+
+	// ProcessStateFrozen indicates that the process is running, but has been
+	// suspended by FreezeProcess.
+	ProcessStateFrozen ProcessState = "frozen"
+
+	// ProcessStateRestarting indicates that the process isn't running, but
+	// will be started again, e.g. once its restart backoff has elapsed.
+	ProcessStateRestarting ProcessState = "restarting"
+
+	// ProcessStateStopped indicates that the process isn't running, and won't
+	// be started again unless StartProcess is called.
+	ProcessStateStopped ProcessState = "stopped"
+
+	// ProcessStateCompleted is like ProcessStateStopped, but indicates that
+	// the process is OneShot and exited successfully.
+	ProcessStateCompleted ProcessState = "completed"
+
+	// ProcessStateFailed is like ProcessStateStopped, but indicates that pmux
+	// gave up on restarting the process after it exited unsuccessfully.
+	ProcessStateFailed ProcessState = "failed"
+)
+
+// state returns the current ProcessState of the process. It must be called
+// while Pmux.l is held.
+func (proc *process) state() ProcessState {
+	switch {
+	case proc.osProc != nil && proc.frozen:
+		return ProcessStateFrozen
+	case proc.osProc != nil && proc.ready:
+		return ProcessStateReady
+	case proc.osProc != nil:
+		return ProcessStateRunning
+	case proc.cancel != nil:
+		return ProcessStateRestarting
+	case proc.completed():
+		return ProcessStateCompleted
+	case proc.failed():
+		return ProcessStateFailed
+	default:
+		return ProcessStateStopped
+	}
+}
+
+// failed returns whether pmux gave up on restarting the process after it
+// exited unsuccessfully. It must be called while Pmux.l is held.
+func (proc *process) failed() bool {
+	return proc.stopped && proc.lastExit != nil && proc.lastExit.Code != 0 &&
+		proc.lastExit.StopReason == ""
+}
+
+// completed returns whether the process is OneShot and exited successfully. It
+// must be called while Pmux.l is held.
+func (proc *process) completed() bool {
+	return proc.stopped && proc.cfg.OneShot && proc.lastExit != nil &&
+		proc.lastExit.Code == 0 && proc.lastExit.StopReason == ""
+}
+
+// ProcessHandle gives access to a process being run by Pmux, for doing things
+// which pmux doesn't support itself, e.g. writing its PID to a monitoring
+// system. A ProcessHandle refers to the process by name, so continues to
+// refer to it across restarts.
+type ProcessHandle struct {
+	p    *Pmux
+	name string
+}
+
+// Process returns a ProcessHandle for the process of the given name.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) Process(name string) (*ProcessHandle, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if _, err := p.getProcess(name); err != nil {
+		return nil, err
+	}
+
+	return &ProcessHandle{p: p, name: name}, nil
+}
+
+// Name returns the name of the process.
+func (h *ProcessHandle) Name() string { return h.name }
+
+// withProcess calls the callback with the process while Pmux.l is held.
+func (h *ProcessHandle) withProcess(fn func(*process)) error {
+	h.p.l.Lock()
+	defer h.p.l.Unlock()
+
+	proc, err := h.p.getProcess(h.name)
+	if err != nil {
+		return err
+	}
+
+	fn(proc)
+	return nil
+}
+
+// PID returns the PID of the process, or 0 if it isn't currently running.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (h *ProcessHandle) PID() (int, error) {
+	var pid int
+	err := h.withProcess(func(proc *process) {
+		if proc.osProc != nil {
+			pid = proc.osProc.Pid
+		}
+	})
+	return pid, err
+}
+
+// StartedAt returns when the currently running instance of the process was
+// started, or the zero time if it isn't currently running.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (h *ProcessHandle) StartedAt() (time.Time, error) {
+	var startedAt time.Time
+	err := h.withProcess(func(proc *process) {
+		if proc.osProc != nil {
+			startedAt = proc.startedAt
+		}
+	})
+	return startedAt, err
+}
+
+// State returns the current ProcessState of the process.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (h *ProcessHandle) State() (ProcessState, error) {
+	var state ProcessState
+	err := h.withProcess(func(proc *process) {
+		state = proc.state()
+	})
+	return state, err
+}
+
+// Signal sends the signal to the process group of the process, which must be
+// currently running. pmux doesn't track the effect of the signal, so signals
+// which stop or continue the process should be sent using FreezeProcess and
+// ThawProcess instead.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (h *ProcessHandle) Signal(sig syscall.Signal) error {
+	h.p.l.Lock()
+	defer h.p.l.Unlock()
+
+	proc, err := h.p.signalProcess(h.name, sig)
+	if err != nil {
+		return err
+	}
+
+	proc.sysLogger.Printf("sent %s", signalName(sig))
+	return nil
+}
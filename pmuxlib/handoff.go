@@ -0,0 +1,228 @@
+package pmuxlib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Handoff describes the processes of a Pmux which is handing over their
+// supervision to another Pmux, see Pmux.Handoff and Pmux.TakeOver. It can be
+// encoded as JSON, other than the Files and ListenFiles of each process, which
+// must be passed separately (e.g. using SCM_RIGHTS over a unix socket).
+type Handoff struct {
+	Processes []HandoffProcess `json:"processes"`
+}
+
+// HandoffProcess describes a single process of a Handoff.
+type HandoffProcess struct {
+	Name string `json:"name"`
+
+	// PID is the PID of the process, or 0 if it wasn't running.
+	PID int `json:"pid,omitempty"`
+
+	// State is the process's restart state, as would be written to the
+	// StateFile.
+	State processState `json:"state"`
+
+	// Files are the read ends of the pipes which the process's output is read
+	// from, and Outputs are the names of the output of each, either "stdout",
+	// "stderr", or the name of one of the process's Streams.
+	Outputs []string   `json:"outputs,omitempty"`
+	Files   []*os.File `json:"-"`
+
+	// ListenFiles are the sockets described by the process's Listen config,
+	// which the process was started with, in the same order, and Listen is
+	// the number of them.
+	Listen      int        `json:"listen,omitempty"`
+	ListenFiles []*os.File `json:"-"`
+}
+
+// dupFile returns a new file referring to the same open file as the given one.
+func dupFile(f *os.File) (*os.File, error) {
+
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		fd     int
+		dupErr error
+	)
+
+	// the ForkLock prevents the new descriptor from leaking into a process
+	// which is started before it's marked close-on-exec.
+	err = rawConn.Control(func(origFD uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+
+		if fd, dupErr = syscall.Dup(int(origFD)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if dupErr != nil {
+		return nil, dupErr
+	}
+
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// Handoff hands over supervision of the processes to another Pmux, e.g. one
+// using an upgraded binary or config, without stopping them. The Handoff
+// describing the processes is passed to send, which should pass it on to the
+// other Pmux's TakeOver method. The Files and ListenFiles of the Handoff are
+// closed once send returns.
+//
+// If send succeeds then this Pmux won't restart any processes, and its caller
+// should exit without canceling the context given to Run, as doing so would
+// stop the processes.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) Handoff(send func(Handoff) error) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.ctx == nil {
+		return ErrNotRunning
+	} else if p.handedOff {
+		return errors.New("processes have already been handed off")
+	}
+
+	var h Handoff
+	defer func() {
+		for _, hp := range h.Processes {
+			closeFiles(hp.Files)
+			closeFiles(hp.ListenFiles)
+		}
+	}()
+
+	for _, proc := range p.procs {
+
+		h.Processes = append(h.Processes, HandoffProcess{
+			Name: proc.cfg.Name,
+			State: processState{
+				Backoff:  proc.backoff,
+				LastExit: proc.lastExit,
+				Paused:   proc.resumeCh != nil,
+				Stopped:  proc.stopped,
+			},
+		})
+
+		if proc.osProc == nil {
+			continue
+		}
+
+		hp := &h.Processes[len(h.Processes)-1]
+		hp.PID = proc.osProc.Pid
+
+		outputs := make([]string, 0, len(proc.outputs))
+		for name := range proc.outputs {
+			outputs = append(outputs, name)
+		}
+		sort.Strings(outputs)
+
+		for _, name := range outputs {
+			f, err := dupFile(proc.outputs[name])
+			if err != nil {
+				return fmt.Errorf(
+					"duplicating %s pipe of process %q: %w",
+					name, proc.cfg.Name, err,
+				)
+			}
+
+			hp.Outputs = append(hp.Outputs, name)
+			hp.Files = append(hp.Files, f)
+		}
+
+		// without these the other Pmux would try to listen on the same
+		// addresses, which the process is still listening on.
+		for i, lf := range proc.listenFiles {
+			f, err := dupFile(lf)
+			if err != nil {
+				return fmt.Errorf(
+					"duplicating listen socket %d of process %q: %w",
+					i, proc.cfg.Name, err,
+				)
+			}
+
+			hp.ListenFiles = append(hp.ListenFiles, f)
+		}
+		hp.Listen = len(hp.ListenFiles)
+	}
+
+	if err := send(h); err != nil {
+		return err
+	}
+
+	p.handedOff = true
+	p.sysLogger.Println("handed off processes to another pmux")
+	return nil
+}
+
+// TakeOver causes Run to adopt the running processes described by the Handoff,
+// which was produced by another Pmux's Handoff method, rather than starting
+// them afresh, and to restore their restart state. Processes in the Handoff
+// which aren't in this Pmux's Config are sent a SIGINT.
+//
+// The Pmux takes ownership of the Files and ListenFiles of the Handoff.
+// TakeOver must be called before Run.
+func (p *Pmux) TakeOver(h Handoff) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.takeover = &h
+}
+
+// applyTakeover applies the Handoff given to TakeOver, if any, to the
+// processes. It must be called while p.l is held.
+func (p *Pmux) applyTakeover() {
+
+	if p.takeover == nil {
+		return
+	}
+
+	h := p.takeover
+	p.takeover = nil
+
+	procs := make(map[string]*process, len(p.procs))
+	for _, proc := range p.procs {
+		procs[proc.cfg.Name] = proc
+	}
+
+	for i := range h.Processes {
+		hp := &h.Processes[i]
+
+		proc, ok := procs[hp.Name]
+		if !ok {
+			if hp.PID != 0 {
+				p.sysLogger.Printf(
+					"stopping handed off process %q (pid %d), "+
+						"it's no longer configured",
+					hp.Name, hp.PID,
+				)
+				_ = sigAdopted(p.sysLogger, hp.PID, syscall.SIGINT)
+			}
+
+			closeFiles(hp.Files)
+			closeFiles(hp.ListenFiles)
+			continue
+		}
+
+		proc.backoff = hp.State.Backoff
+		proc.lastExit = hp.State.LastExit
+		proc.stopped = hp.State.Stopped
+
+		proc.resumeCh = nil
+		if hp.State.Paused {
+			proc.resumeCh = make(chan struct{})
+		}
+
+		if hp.PID != 0 {
+			proc.handoff = hp
+		}
+	}
+}
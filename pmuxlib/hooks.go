@@ -0,0 +1,160 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HookConfig describes a command which is run at some point in a process's
+// lifecycle.
+type HookConfig struct {
+
+	// Cmd is the shell command to run, using "/bin/sh -c". It is run in the
+	// same directory and with the same environment as the process. If not set
+	// then the hook is disabled.
+	Cmd string `yaml:"cmd,omitempty"`
+
+	// Fatal indicates that a failure of the hook should affect the process,
+	// see HooksConfig for how. If not set then failures are only logged.
+	Fatal bool `yaml:"fatal,omitempty"`
+
+	// Timeout is how long the hook may run for before being killed and
+	// considered failed.
+	//
+	// Defaults to 30 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (cfg HookConfig) withDefaults() HookConfig {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	return cfg
+}
+
+// HooksConfig describes commands which are run at various points in a
+// process's lifecycle. Hooks are run within the process's Chroot, and as its
+// User and Group.
+type HooksConfig struct {
+
+	// PreStart is run before each start of the process. If it fails and is
+	// Fatal then the process is not started, and this is considered a failed
+	// start.
+	PreStart HookConfig `yaml:"preStart,omitempty"`
+
+	// PostStart is run after each start of the process, once the process is
+	// ready (see ReadyCheck). If it fails and is Fatal then the process is
+	// stopped, and restarted as if it had exited.
+	PostStart HookConfig `yaml:"postStart,omitempty"`
+
+	// PreStop is run each time pmux is about to stop the process, before the
+	// process is sent SIGINT, so that it can be drained first (e.g. removed
+	// from a load balancer). It is given the following environment variables:
+	//
+	//	PMUX_PROC  the name of the process
+	//	PMUX_PID   the PID of the process
+	//
+	// The SigKillWait only begins once the hook has completed. If the process
+	// exits while the hook is running then the hook is killed. Failures of
+	// the hook are only logged, the process is stopped regardless.
+	PreStop HookConfig `yaml:"preStop,omitempty"`
+
+	// PostStop is run each time the process exits. If it fails and is Fatal
+	// then the process is not restarted.
+	PostStop HookConfig `yaml:"postStop,omitempty"`
+
+	// OnCrash is run each time the process exits unexpectedly, i.e. of its
+	// own accord and with a non-zero exit code or due to a signal. It is run
+	// after PostStop, and is given the following environment variables:
+	//
+	//	PMUX_PROC           the name of the process
+	//	PMUX_EXIT_CODE      the exit code of the process, or -1 if signaled
+	//	PMUX_SIGNAL         the name of the signal which killed the process,
+	//	                    if any
+	//	PMUX_RESTART_COUNT  the number of times the process has been restarted
+	//
+	// The last OnCrashLines lines of the process's stdout and stderr are
+	// written to its stdin. If it fails and is Fatal then the process is not
+	// restarted.
+	OnCrash HookConfig `yaml:"onCrash,omitempty"`
+
+	// OnCrashLines is the number of lines of output which are given to the
+	// OnCrash hook.
+	//
+	// Defaults to 100.
+	OnCrashLines int `yaml:"onCrashLines,omitempty"`
+}
+
+func (cfg HooksConfig) withDefaults() HooksConfig {
+	cfg.PreStart = cfg.PreStart.withDefaults()
+	cfg.PostStart = cfg.PostStart.withDefaults()
+	cfg.PreStop = cfg.PreStop.withDefaults()
+	cfg.PostStop = cfg.PostStop.withDefaults()
+	cfg.OnCrash = cfg.OnCrash.withDefaults()
+
+	if cfg.OnCrashLines == 0 {
+		cfg.OnCrashLines = 100
+	}
+
+	return cfg
+}
+
+// runHook runs the given hook of the process, if it is enabled, with the
+// given extra environment variables and stdin (which may be nil). The output
+// of the hook is written to the sysLogger.
+func runHook(
+	ctx context.Context,
+	sysLogger Logger,
+	cfg ProcessConfig,
+	hookName string,
+	hookCfg HookConfig,
+	env []string,
+	stdin io.Reader,
+) error {
+
+	if hookCfg.Cmd == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookCfg.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hookCfg.Cmd)
+	cmd.Dir = cfg.Dir
+	cmd.Env = append(cfg.environ(), env...)
+	cmd.Stdin = stdin
+
+	debugf(sysLogger, "running %s hook", hookName)
+
+	var out []byte
+	sysProcAttr, err := cfg.commandSysProcAttr()
+	if err == nil {
+		cmd.SysProcAttr = sysProcAttr
+		out, err = cmd.CombinedOutput()
+	}
+
+	for _, line := range strings.Split(string(bytes.TrimSpace(out)), "\n") {
+		if line != "" {
+			infof(sysLogger, "%s hook: %s", hookName, line)
+		}
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%s hook failed: %w", hookName, err)
+
+		if !hookCfg.Fatal {
+			sysLogger.Printf("%v (ignored)", err)
+			return nil
+		}
+
+		sysLogger.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelKeyRegexp matches valid label keys.
+var labelKeyRegexp = regexp.MustCompile(
+	`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`,
+)
+
+func validateLabels(labels map[string]string) []string {
+
+	keys := sortedLabelKeys(labels)
+
+	var problems []string
+	for _, key := range keys {
+		if !labelKeyRegexp.MatchString(key) {
+			problems = append(problems, fmt.Sprintf(
+				"labels: key %q must consist of letters, digits, '_', '.', "+
+					"'/' and '-', and start and end with a letter or digit",
+				key,
+			))
+		} else if strings.Contains(labels[key], ",") {
+			problems = append(problems, fmt.Sprintf(
+				"labels.%s: value must not contain ','", key,
+			))
+		}
+	}
+
+	return problems
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelRequirement is a single requirement of a LabelSelector.
+type labelRequirement struct {
+	key, value string
+
+	// if hasValue is false then only the presence of the key is checked.
+	hasValue bool
+	negate   bool
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	if r.hasValue {
+		ok = ok && value == r.value
+	}
+	return ok != r.negate
+}
+
+// LabelSelector selects processes by their Labels. The zero value selects
+// all processes.
+type LabelSelector struct {
+	reqs []labelRequirement
+}
+
+// ParseLabelSelector parses a LabelSelector from a comma separated list of
+// requirements, all of which a process's labels must meet for it to be
+// selected. Each requirement is one of:
+//
+//	key=value   the label is set to value
+//	key!=value  the label is not set to value, or is not set
+//	key         the label is set
+//	!key        the label is not set
+func ParseLabelSelector(str string) (LabelSelector, error) {
+
+	var sel LabelSelector
+
+	for _, reqStr := range strings.Split(str, ",") {
+
+		reqStr = strings.TrimSpace(reqStr)
+		if reqStr == "" {
+			return LabelSelector{}, fmt.Errorf(
+				"selector %q has an empty requirement", str,
+			)
+		}
+
+		var req labelRequirement
+
+		if key, value, ok := strings.Cut(reqStr, "!="); ok {
+			req = labelRequirement{
+				key: key, value: value, hasValue: true, negate: true,
+			}
+		} else if key, value, ok := strings.Cut(reqStr, "="); ok {
+			req = labelRequirement{key: key, value: value, hasValue: true}
+		} else if key := strings.TrimPrefix(reqStr, "!"); key != reqStr {
+			req = labelRequirement{key: key, negate: true}
+		} else {
+			req = labelRequirement{key: reqStr}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+
+		if !labelKeyRegexp.MatchString(req.key) {
+			return LabelSelector{}, fmt.Errorf(
+				"selector %q: invalid label key %q", str, req.key,
+			)
+		}
+
+		sel.reqs = append(sel.reqs, req)
+	}
+
+	return sel, nil
+}
+
+// Matches returns whether the given labels meet all of the LabelSelector's
+// requirements.
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range sel.reqs {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectProcesses returns the names of all processes whose Labels match the
+// LabelSelector, in the order they are configured.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) SelectProcesses(sel LabelSelector) ([]string, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.ctx == nil {
+		return nil, ErrNotRunning
+	}
+
+	var names []string
+	for _, proc := range p.procs {
+		if sel.Matches(proc.cfg.Labels) {
+			names = append(names, proc.cfg.Name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,52 @@
+package pmuxlib
+
+import "testing"
+
+func TestLabelSelector(t *testing.T) {
+
+	labels := map[string]string{"tier": "web", "region": "eu"}
+
+	tests := []struct {
+		selector string
+		expErr   bool
+		exp      bool
+	}{
+		{selector: "tier=web", exp: true},
+		{selector: "tier=db", exp: false},
+		{selector: "tier!=db", exp: true},
+		{selector: "tier!=web", exp: false},
+		{selector: "missing!=x", exp: true},
+		{selector: "region", exp: true},
+		{selector: "missing", exp: false},
+		{selector: "!missing", exp: true},
+		{selector: "!region", exp: false},
+		{selector: "tier=web,region=eu", exp: true},
+		{selector: "tier=web, region=us", exp: false},
+		{selector: " tier = web ", exp: true},
+		{selector: "", expErr: true},
+		{selector: "tier=web,", expErr: true},
+		{selector: "-bad=x", expErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			sel, err := ParseLabelSelector(test.selector)
+			if test.expErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sel.Matches(labels); got != test.exp {
+				t.Fatalf("expected %v, got %v", test.exp, got)
+			}
+		})
+	}
+
+	if !(LabelSelector{}).Matches(nil) {
+		t.Fatal("expected the zero LabelSelector to match everything")
+	}
+}
@@ -0,0 +1,187 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// LogLevel is the severity of a line of a process's output, as inferred using
+// its LogLevelsConfig.
+type LogLevel string
+
+// Enumeration of LogLevel values, from least to most severe.
+const (
+	LogLevelDebug LogLevel = "debug"
+	LogLevelInfo  LogLevel = "info"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+// logLevels lists all LogLevels from most to least severe, which is the order
+// in which their patterns are checked.
+var logLevels = []LogLevel{
+	LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelDebug,
+}
+
+func (l LogLevel) valid() bool {
+	return l.rank() >= 0
+}
+
+// rank returns a number which increases with the severity of the LogLevel, or
+// -1 if it isn't a valid LogLevel.
+func (l LogLevel) rank() int {
+	for i, level := range logLevels {
+		if l == level {
+			return len(logLevels) - 1 - i
+		}
+	}
+	return -1
+}
+
+// defaultLogLevelPatterns are used for each LogLevel which doesn't have a
+// pattern in LogLevelsConfig.Patterns.
+var defaultLogLevelPatterns = map[LogLevel]string{
+	LogLevelError: `\b(ERROR|ERR|FATAL|CRITICAL|PANIC)\b|\blevel=(error|fatal|panic)\b`,
+	LogLevelWarn:  `\b(WARN|WARNING)\b|\blevel=warn(ing)?\b`,
+	LogLevelInfo:  `\bINFO\b|\blevel=info\b`,
+	LogLevelDebug: `\b(DEBUG|TRACE)\b|\blevel=(debug|trace)\b`,
+}
+
+// LogLevelsConfig describes how the LogLevel of each line of a process's
+// output is inferred, and which lines are logged as a result.
+type LogLevelsConfig struct {
+
+	// Patterns maps LogLevels to regular expressions. Each line is given the
+	// level of the most severe pattern which it matches. Levels which aren't
+	// given use a default pattern, which matches the level's name in upper
+	// case (e.g. "ERROR", "WARN"), or in logfmt style (e.g. "level=error").
+	Patterns map[LogLevel]string `yaml:"patterns,omitempty"`
+
+	// Default is the level of lines which match none of the patterns.
+	//
+	// Defaults to LogLevelInfo.
+	Default LogLevel `yaml:"default,omitempty"`
+
+	// Min is the least severe level which is logged, lines of a lower level
+	// are dropped. If not set then all lines are logged.
+	Min LogLevel `yaml:"min,omitempty"`
+}
+
+func (cfg LogLevelsConfig) validate() []string {
+
+	var problems []string
+
+	levels := make([]string, 0, len(cfg.Patterns))
+	for level := range cfg.Patterns {
+		levels = append(levels, string(level))
+	}
+	sort.Strings(levels)
+
+	for _, levelStr := range levels {
+		level, pattern := LogLevel(levelStr), cfg.Patterns[LogLevel(levelStr)]
+		if !level.valid() {
+			problems = append(problems, fmt.Sprintf(
+				"logLevels.patterns: unknown level %q", level,
+			))
+		} else if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"logLevels.patterns.%s: %v", level, err,
+			))
+		}
+	}
+
+	for _, field := range []struct {
+		name  string
+		level LogLevel
+	}{
+		{"default", cfg.Default},
+		{"min", cfg.Min},
+	} {
+		if field.level != "" && !field.level.valid() {
+			problems = append(problems, fmt.Sprintf(
+				"logLevels.%s %q is not one of %q, %q, %q, or %q",
+				field.name, field.level,
+				LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError,
+			))
+		}
+	}
+
+	return problems
+}
+
+// levelPattern is a compiled pattern of a LogLevelsConfig.
+type levelPattern struct {
+	level LogLevel
+	re    *regexp.Regexp
+}
+
+// levelLogger is a Logger which infers the LogLevel of each line, drops those
+// below its minimum level, and passes the level on to the wrapped Logger.
+type levelLogger struct {
+	Logger
+	patterns []levelPattern
+	def, min LogLevel
+}
+
+// newLevelLogger returns a levelLogger wrapping the given Logger. The
+// LogLevelsConfig is expected to have been validated.
+func newLevelLogger(l Logger, cfg LogLevelsConfig) Logger {
+
+	ll := levelLogger{Logger: l, def: cfg.Default, min: cfg.Min}
+
+	if ll.def == "" {
+		ll.def = LogLevelInfo
+	}
+
+	for _, level := range logLevels {
+		pattern, ok := cfg.Patterns[level]
+		if !ok {
+			pattern = defaultLogLevelPatterns[level]
+		}
+
+		ll.patterns = append(ll.patterns, levelPattern{
+			level: level,
+			re:    regexp.MustCompile(pattern),
+		})
+	}
+
+	return ll
+}
+
+func (l levelLogger) level(line string) LogLevel {
+	for _, p := range l.patterns {
+		if p.re.MatchString(line) {
+			return p.level
+		}
+	}
+	return l.def
+}
+
+func (l levelLogger) Println(line string) {
+	level := l.level(line)
+	if level.rank() < l.min.rank() {
+		return
+	}
+	printlnLevel(l.Logger, level, line)
+}
+
+func (l levelLogger) Printf(msg string, args ...interface{}) {
+	l.Println(fmt.Sprintf(msg, args...))
+}
+
+// levelPrinter is implemented by Loggers which can make use of the LogLevel
+// of a line.
+type levelPrinter interface {
+	printlnLevel(LogLevel, string)
+}
+
+// printlnLevel writes the line to the Logger, along with its level if the
+// Logger supports it.
+func printlnLevel(l Logger, level LogLevel, line string) {
+	if lp, ok := l.(levelPrinter); ok {
+		lp.printlnLevel(level, line)
+		return
+	}
+	l.Println(line)
+}
@@ -0,0 +1,130 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ListenConfig describes a socket which pmux will listen on on behalf of a
+// process, and pass to the process using the same convention as systemd's
+// socket activation (see sd_listen_fds(3)).
+type ListenConfig struct {
+
+	// Network is the type of socket to listen on, one of "tcp", "tcp4",
+	// "tcp6", or "unix".
+	//
+	// Defaults to "tcp".
+	Network string `yaml:"network,omitempty"`
+
+	// Address is the address to listen on, e.g. "0.0.0.0:80" for tcp or a file
+	// path for unix.
+	Address string `yaml:"address"`
+
+	// Name, if given, is included in the LISTEN_FDNAMES environment variable
+	// passed to the process.
+	Name string `yaml:"name,omitempty"`
+}
+
+func (cfg ListenConfig) withDefaults() ListenConfig {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	return cfg
+}
+
+// listenFile listens on the socket described by the ListenConfig, and returns
+// the socket as a file which can be passed to a child process.
+func listenFile(cfg ListenConfig) (*os.File, error) {
+
+	cfg = cfg.withDefaults()
+
+	if cfg.Network == "unix" {
+		// a socket file left behind by a previous run would prevent listening.
+		if err := os.Remove(cfg.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("removing %q: %w", cfg.Address, err)
+		}
+	}
+
+	l, err := net.Listen(cfg.Network, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	if ul, ok := l.(*net.UnixListener); ok {
+		// the socket file must outlive the listener, which is closed once its
+		// file has been obtained.
+		ul.SetUnlinkOnClose(false)
+	}
+
+	f, err := l.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		return nil, fmt.Errorf("getting file of listener: %w", err)
+	}
+
+	return f, nil
+}
+
+// listenFiles listens on all sockets described by the given ListenConfigs,
+// returning them as files in the same order.
+func listenFiles(cfgs []ListenConfig) ([]*os.File, error) {
+
+	files := make([]*os.File, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		f, err := listenFile(cfg)
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf(
+				"listening on %s %q: %w", cfg.Network, cfg.Address, err,
+			)
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// listenEnv returns the environment variables which describe the passed
+// sockets to the process, other than LISTEN_PID, which must be set by the
+// process itself (see listenCommand).
+func listenEnv(cfgs []ListenConfig) []string {
+
+	env := []string{"LISTEN_FDS=" + strconv.Itoa(len(cfgs))}
+
+	names := make([]string, len(cfgs))
+	var haveNames bool
+	for i, cfg := range cfgs {
+		names[i] = cfg.Name
+		if names[i] == "" {
+			names[i] = "unknown"
+		} else {
+			haveNames = true
+		}
+	}
+
+	if haveNames {
+		env = append(env, "LISTEN_FDNAMES="+strings.Join(names, ":"))
+	}
+
+	return env
+}
+
+// listenCommand wraps the given command such that LISTEN_PID is set to the
+// pid of the process, which is only known once the process has started. This
+// is done by running the command via a shell which sets LISTEN_PID to its own
+// pid and then execs the command, thereby keeping the same pid.
+func listenCommand(name string, args []string) (string, []string) {
+	return "/bin/sh", append(
+		[]string{"-c", `LISTEN_PID=$$ exec "$0" "$@"`, name}, args...,
+	)
+}
@@ -2,11 +2,12 @@ package pmuxlib
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,12 +28,100 @@ type Logger interface {
 	Printf(string, ...interface{})
 }
 
+// Verbosity determines which messages about a process are logged to the
+// sysLogger.
+type Verbosity string
+
+// Enumeration of Verbosity values.
+const (
+	// VerbosityQuiet only logs unexpected events, e.g. crashes and errors.
+	VerbosityQuiet Verbosity = "quiet"
+
+	// VerbosityNormal additionally logs routine events, e.g. processes
+	// starting, exiting cleanly, and being restarted. This is the default.
+	VerbosityNormal Verbosity = "normal"
+
+	// VerbosityVerbose additionally logs debugging detail, e.g. signals being
+	// sent, output pipes closing, and the restart backoff calculation.
+	VerbosityVerbose Verbosity = "verbose"
+)
+
+func (v Verbosity) valid() bool {
+	switch v {
+	case "", VerbosityQuiet, VerbosityNormal, VerbosityVerbose:
+		return true
+	default:
+		return false
+	}
+}
+
+// verbosityLogger wraps a Logger so that it carries a Verbosity, see
+// withVerbosity.
+type verbosityLogger struct {
+	Logger
+	v Verbosity
+}
+
+func (l verbosityLogger) verbosity() Verbosity { return l.v }
+
+// withVerbosity returns a Logger which writes to the given one, and which
+// causes infof and debugf to filter messages according to the Verbosity. If
+// the Verbosity is empty then the Logger is returned as-is.
+func withVerbosity(l Logger, v Verbosity) Logger {
+	if v == "" {
+		return l
+	}
+	return verbosityLogger{l, v}
+}
+
+func loggerVerbosity(l Logger) Verbosity {
+	if vl, ok := l.(interface{ verbosity() Verbosity }); ok {
+		return vl.verbosity()
+	}
+	return VerbosityNormal
+}
+
+// infof logs a message about a routine event, unless the Logger's Verbosity
+// is quiet.
+func infof(l Logger, msg string, args ...interface{}) {
+	if loggerVerbosity(l) != VerbosityQuiet {
+		l.Printf(msg, args...)
+	}
+}
+
+// debugf logs a message containing debugging detail, only if the Logger's
+// Verbosity is verbose.
+func debugf(l Logger, msg string, args ...interface{}) {
+	if loggerVerbosity(l) == VerbosityVerbose {
+		l.Printf(msg, args...)
+	}
+}
+
 // NullLogger is an implementation of Logger which doesn't do anything.
 type NullLogger struct{}
 
 func (*NullLogger) Println(string)                {}
 func (*NullLogger) Printf(string, ...interface{}) {}
 
+// multiLogger implements Logger by writing each line to all of its Loggers.
+type multiLogger []Logger
+
+func (ls multiLogger) Println(line string) {
+	for _, l := range ls {
+		l.Println(line)
+	}
+}
+
+func (ls multiLogger) Printf(str string, args ...interface{}) {
+	ls.Println(fmt.Sprintf(str, args...))
+}
+
+func (ls multiLogger) printlnLevel(level LogLevel, line string) {
+	for _, l := range ls {
+		printlnLevel(l, level, line)
+	}
+}
+
 // PlainLogger implements Logger by writing each line directly to the given
 // io.Writer as-is.
 type PlainLogger struct {
@@ -47,18 +136,100 @@ func (l PlainLogger) Printf(str string, args ...interface{}) {
 	fmt.Fprintf(l, str, args...)
 }
 
+// Formats which may be used for SysLogConfig.Format and Config.LogFormat.
+const (
+	SysLogFormatText = "text"
+	SysLogFormatJSON = "json"
+)
+
+// SysLogConfig is used to send the messages pmux logs about the processes it
+// is running (as opposed to the output of those processes) to a separate
+// destination.
+type SysLogConfig struct {
+
+	// Path is the file which messages are appended to. If not set then
+	// messages are written to stderr, alongside the stderr of the processes.
+	Path string `yaml:"path,omitempty"`
+
+	// Format is either "text", or "json", in which case each message is
+	// written as a JSON object with "time", "process" and "msg" fields. This
+	// applies whether messages are written to Path or to stderr. If not set
+	// then Path is written as text, and stderr uses Config.LogFormat.
+	Format string `yaml:"format,omitempty"`
+
+	// TimeZone overrides Config.TimeZone for pmux's own messages, whether
+	// they're written to Path or to stderr.
+	TimeZone string `yaml:"timeZone,omitempty"`
+}
+
+// timeLocation returns the time.Location of the given time zone, see
+// Config.TimeZone. An empty zone is the local one.
+func timeLocation(zone string) (*time.Location, error) {
+	switch zone {
+	case "", "local":
+		return time.Local, nil
+	case "UTC":
+		return time.UTC, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+// logLocation returns the time.Location of the given time zone, or of TimeZone
+// if it's not set.
+func (cfg Config) logLocation(zone string) (*time.Location, error) {
+	if zone == "" {
+		zone = cfg.TimeZone
+	}
+	return timeLocation(zone)
+}
+
+// logWriter is where a logger writes to. It's shared by every logger derived
+// from the same newLogger call, and guarded by their shared mutex, so that
+// closing any of them causes all of them to stop writing.
+type logWriter struct {
+	out io.Writer
+	buf *bufio.Writer
+}
+
 type logger struct {
 	timeFmt string
 
-	l      *sync.Mutex
-	out    io.Writer
-	outBuf *bufio.Writer
+	// loc, if set, is the time zone which timestamps are written in.
+	loc *time.Location
+
+	l *sync.Mutex
+	w *logWriter
 
 	// maxPNameLen is a pointer because it changes when WithPrefix is called.
 	maxPNameLen *uint64
 
 	pname string
 	sep   rune
+
+	// stream, if set, is the name of the StreamConfig being logged, and is
+	// shown alongside the pname.
+	stream string
+
+	// labels are the Labels of the process being logged, which are included
+	// in JSON output.
+	labels map[string]string
+
+	// lines, if set, is incremented for every line written.
+	lines *uint64
+
+	// subs, if set, is published every line written.
+	subs *broadcaster[LogLine]
+
+	// json indicates that each line should be written as a JSON object.
+	json bool
+
+	// raw indicates that each line should be written as-is, see Config.Raw.
+	raw bool
+
+	// instance is included in JSON output, and in the prefix of each line if
+	// instancePrefix is set, see Config.InstanceTag.
+	instance       string
+	instancePrefix bool
 }
 
 func newLogger(
@@ -74,8 +245,7 @@ func newLogger(
 		timeFmt:     timeFmt,
 		maxPNameLen: &maxPNameLen,
 		l:           new(sync.Mutex),
-		out:         out,
-		outBuf:      bufio.NewWriter(out),
+		w:           &logWriter{out: out, buf: bufio.NewWriter(out)},
 		pname:       pname,
 		sep:         sep,
 	}
@@ -89,18 +259,62 @@ func (l *logger) withSep(sep rune) *logger {
 	return &l2
 }
 
+func (l *logger) withTimeFormat(timeFmt string) *logger {
+	l2 := *l
+	l2.timeFmt = timeFmt
+	return &l2
+}
+
 func (l *logger) withPName(pname string) *logger {
 	l2 := *l
 	l2.pname = pname
+	l2.growMaxPNameLen()
+	return &l2
+}
+
+func (l *logger) withLabels(labels map[string]string) *logger {
+	l2 := *l
+	l2.labels = labels
+	return &l2
+}
 
-	l2.l.Lock()
-	defer l2.l.Unlock()
+func (l *logger) withStream(stream string) *logger {
+	l2 := *l
+	l2.stream = stream
+	l2.growMaxPNameLen()
+	return &l2
+}
 
-	if pnameLen := uint64(len(pname)); pnameLen > *l2.maxPNameLen {
-		*l2.maxPNameLen = pnameLen
+// displayName returns the name which prefixes each line in text output.
+func (l *logger) displayName() string {
+	if l.stream == "" {
+		return l.pname
 	}
+	return l.pname + ":" + l.stream
+}
 
-	return &l2
+// streamName returns the name of the stream being logged, as used in
+// LogLine.Stream.
+func (l *logger) streamName() string {
+	switch {
+	case l.stream != "":
+		return l.stream
+	case l.sep == logSepStderr:
+		return "stderr"
+	case l.sep == logSepSys:
+		return "sys"
+	default:
+		return "stdout"
+	}
+}
+
+func (l *logger) growMaxPNameLen() {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if nameLen := uint64(len(l.displayName())); nameLen > *l.maxPNameLen {
+		*l.maxPNameLen = nameLen
+	}
 }
 
 func (l *logger) Close() {
@@ -108,49 +322,110 @@ func (l *logger) Close() {
 	l.l.Lock()
 	defer l.l.Unlock()
 
-	l.outBuf.Flush()
+	l.w.buf.Flush()
 
-	if syncer, ok := l.out.(interface{ Sync() error }); ok {
+	if syncer, ok := l.w.out.(interface{ Sync() error }); ok {
 		_ = syncer.Sync()
-	} else if flusher, ok := l.out.(interface{ Flush() error }); ok {
+	} else if flusher, ok := l.w.out.(interface{ Flush() error }); ok {
 		_ = flusher.Flush()
 	}
 
-	// this generally shouldn't be necessary, but we could run into cases (e.g.
-	// during a force-kill) where further Prints are called after a Close. These
-	// should just do nothing.
-	l.out = ioutil.Discard
-	l.outBuf = bufio.NewWriter(l.out)
+	// further Prints may be called after a Close, e.g. by processes which are
+	// still being stopped during a force-exit, or by loggers derived from this
+	// one. These should just do nothing. As the logWriter is shared, and only
+	// swapped while holding the lock, no line is ever partially written.
+	*l.w = logWriter{out: io.Discard, buf: bufio.NewWriter(io.Discard)}
+}
+
+// now returns the current time, in the logger's time zone.
+func (l *logger) now() time.Time {
+	if l.loc != nil {
+		return time.Now().In(l.loc)
+	}
+	return time.Now()
 }
 
-func (l *logger) println(line string) {
+func (l *logger) println(level LogLevel, line string) {
+
+	if l.lines != nil {
+		atomic.AddUint64(l.lines, 1)
+	}
+
+	if l.subs != nil {
+		l.subs.publish(LogLine{
+			Time:    time.Now(),
+			Process: l.pname,
+			Stream:  l.streamName(),
+			Level:   level,
+			Line:    line,
+		})
+	}
 
 	l.l.Lock()
 	defer l.l.Unlock()
 
+	if l.json {
+		_ = json.NewEncoder(l.w.buf).Encode(struct {
+			Time     time.Time         `json:"time"`
+			Instance string            `json:"instance,omitempty"`
+			Process  string            `json:"process"`
+			Stream   string            `json:"stream,omitempty"`
+			Labels   map[string]string `json:"labels,omitempty"`
+			Level    LogLevel          `json:"level,omitempty"`
+			Msg      string            `json:"msg"`
+		}{
+			l.now(), l.instance, l.pname, l.stream, l.labels, level, line,
+		})
+		l.w.buf.Flush()
+		return
+	}
+
+	if l.raw {
+		switch {
+		case l.sep != logSepSys:
+			fmt.Fprintln(l.w.buf, line)
+		case l.pname == pmuxPName:
+			fmt.Fprintf(l.w.buf, "%s: %s\n", pmuxPName, line)
+		default:
+			fmt.Fprintf(l.w.buf, "%s: %s: %s\n", pmuxPName, l.pname, line)
+		}
+		l.w.buf.Flush()
+		return
+	}
+
 	if l.timeFmt != "" {
 		fmt.Fprintf(
-			l.outBuf,
+			l.w.buf,
 			"%s %c ",
-			time.Now().Format(l.timeFmt),
+			l.now().Format(l.timeFmt),
 			l.sep,
 		)
 	}
 
+	if l.instancePrefix {
+		fmt.Fprintf(l.w.buf, "%s %c ", l.instance, l.sep)
+	}
+
+	name := l.displayName()
+
 	fmt.Fprintf(
-		l.outBuf,
+		l.w.buf,
 		"%s%s%c %s\n",
-		l.pname,
-		strings.Repeat(" ", int(*l.maxPNameLen+1)-len(l.pname)),
+		name,
+		strings.Repeat(" ", int(*l.maxPNameLen+1)-len(name)),
 		l.sep,
 		line,
 	)
 
-	l.outBuf.Flush()
+	l.w.buf.Flush()
 }
 
 func (l *logger) Println(line string) {
-	l.println(line)
+	l.println("", line)
+}
+
+func (l *logger) printlnLevel(level LogLevel, line string) {
+	l.println(level, line)
 }
 
 func (l *logger) Printf(msg string, args ...interface{}) {
@@ -0,0 +1,183 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MatrixValues are the values of a single key of a ProcessConfig's Matrix.
+// When unmarshaled from YAML they may be given either as a list, or as a
+// single string of the form "<from>..<to>", e.g. "0..9", which gives every
+// integer from from to to inclusive.
+type MatrixValues []string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (v *MatrixValues) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var str string
+	if err := unmarshal(&str); err == nil {
+		values, err := parseMatrixRange(str)
+		if err != nil {
+			return err
+		}
+		*v = values
+		return nil
+	}
+
+	var strs []string
+	if err := unmarshal(&strs); err != nil {
+		return err
+	}
+
+	*v = strs
+	return nil
+}
+
+func parseMatrixRange(str string) (MatrixValues, error) {
+
+	fromStr, toStr, ok := strings.Cut(str, "..")
+	from, fromErr := strconv.Atoi(strings.TrimSpace(fromStr))
+	to, toErr := strconv.Atoi(strings.TrimSpace(toStr))
+	if !ok || fromErr != nil || toErr != nil {
+		return nil, fmt.Errorf(
+			"matrix values %q must be a list, or a range like \"0..9\"", str,
+		)
+	} else if from > to {
+		return nil, fmt.Errorf("matrix range %q is empty", str)
+	}
+
+	values := make(MatrixValues, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		values = append(values, strconv.Itoa(i))
+	}
+
+	return values, nil
+}
+
+// matrixKeyRegexp matches valid matrix keys, which must be usable as a field
+// name within a template, e.g. "{{.Matrix.shard}}".
+var matrixKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateMatrix(matrix map[string]MatrixValues) []string {
+
+	var problems []string
+
+	for _, key := range sortedMatrixKeys(matrix) {
+
+		if !matrixKeyRegexp.MatchString(key) {
+			problems = append(problems, fmt.Sprintf(
+				"matrix: key %q must consist of letters, digits, and '_', "+
+					"and not start with a digit",
+				key,
+			))
+		}
+
+		values := matrix[key]
+		if len(values) == 0 {
+			problems = append(problems, fmt.Sprintf(
+				"matrix.%s: at least one value must be given", key,
+			))
+		}
+
+		seen := map[string]bool{}
+		for _, value := range values {
+			if value == "" || strings.ContainsAny(value, ". \t") {
+				problems = append(problems, fmt.Sprintf(
+					"matrix.%s: value %q must be non-empty, and not contain "+
+						"'.' or whitespace",
+					key, value,
+				))
+			} else if seen[value] {
+				problems = append(problems, fmt.Sprintf(
+					"matrix.%s: value %q is given more than once", key, value,
+				))
+			}
+			seen[value] = true
+		}
+	}
+
+	return problems
+}
+
+func sortedMatrixKeys(matrix map[string]MatrixValues) []string {
+	keys := make([]string, 0, len(matrix))
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// matrixCombinations returns every combination of the values of the matrix,
+// each combination giving a value for every key. The combinations are ordered
+// by the values of each key in turn, the keys being sorted.
+func matrixCombinations(matrix map[string]MatrixValues) []map[string]string {
+
+	combos := []map[string]string{{}}
+
+	for _, key := range sortedMatrixKeys(matrix) {
+
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, value := range matrix[key] {
+
+				nextCombo := make(map[string]string, len(combo)+1)
+				for k, v := range combo {
+					nextCombo[k] = v
+				}
+				nextCombo[key] = value
+
+				next = append(next, nextCombo)
+			}
+		}
+		combos = next
+	}
+
+	return combos
+}
+
+// expandMatrix returns a copy of the Config with each ProcessConfig which has
+// a Matrix replaced by a process for each combination of the Matrix's values.
+// Each is named "<name>.<value>..." with the values in the order of their
+// sorted keys, and has a "PMUX_MATRIX_<KEY>" env var set for each key.
+func (cfg Config) expandMatrix() Config {
+
+	var procs []ProcessConfig
+
+	for _, procCfg := range cfg.Processes {
+
+		if len(procCfg.Matrix) == 0 {
+			procs = append(procs, procCfg)
+			continue
+		}
+
+		keys := sortedMatrixKeys(procCfg.Matrix)
+
+		for _, combo := range matrixCombinations(procCfg.Matrix) {
+
+			comboCfg := procCfg
+			comboCfg.Matrix = nil
+			comboCfg.matrix = combo
+
+			comboCfg.Env = make(map[string]string, len(procCfg.Env)+len(keys))
+			for k, v := range procCfg.Env {
+				comboCfg.Env[k] = v
+			}
+
+			name := procCfg.Name
+			for _, key := range keys {
+				name += "." + combo[key]
+				comboCfg.Env["PMUX_MATRIX_"+strings.ToUpper(key)] = combo[key]
+			}
+			comboCfg.Name = name
+
+			procs = append(procs, comboCfg)
+		}
+	}
+
+	cfg.Processes = procs
+	return cfg
+}
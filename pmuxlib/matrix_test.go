@@ -0,0 +1,84 @@
+package pmuxlib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		matrix map[string]MatrixValues
+		exp    []map[string]string
+	}{
+		{
+			name: "empty",
+			exp:  []map[string]string{{}},
+		},
+		{
+			name:   "single key",
+			matrix: map[string]MatrixValues{"shard": {"0", "1"}},
+			exp: []map[string]string{
+				{"shard": "0"},
+				{"shard": "1"},
+			},
+		},
+		{
+			name: "keys sorted",
+			matrix: map[string]MatrixValues{
+				"shard":  {"0", "1"},
+				"region": {"eu", "us"},
+			},
+			exp: []map[string]string{
+				{"region": "eu", "shard": "0"},
+				{"region": "eu", "shard": "1"},
+				{"region": "us", "shard": "0"},
+				{"region": "us", "shard": "1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := matrixCombinations(test.matrix)
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Fatalf("expected %v, got %v", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestParseMatrixRange(t *testing.T) {
+
+	tests := []struct {
+		str    string
+		exp    MatrixValues
+		expErr bool
+	}{
+		{str: "0..2", exp: MatrixValues{"0", "1", "2"}},
+		{str: "5..5", exp: MatrixValues{"5"}},
+		{str: " 1 .. 2 ", exp: MatrixValues{"1", "2"}},
+		{str: "2..1", expErr: true},
+		{str: "a..b", expErr: true},
+		{str: "3", expErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			got, err := parseMatrixRange(test.str)
+			if test.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Fatalf("expected %q, got %q", test.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPConfig is used to configure the export of metrics and traces describing
+// the processes being run, using the OpenTelemetry protocol (OTLP) over HTTP
+// with JSON encoding.
+//
+// The following metrics are exported, each with a process.name attribute and
+// a process.label.<key> attribute for each of the process's Labels:
+//
+//	pmux.process.restarts  number of times the process has been restarted
+//	pmux.process.running   1 if the process is running, otherwise 0
+//	pmux.process.uptime    seconds the current run has been running for
+//	pmux.process.backoff   seconds pmux will wait before the next restart
+//
+// A span is exported for each run of a process, from when it is started until
+// it exits, with an event for when it became ready.
+type OTLPConfig struct {
+
+	// Endpoint is the base URL of the OTLP collector, e.g.
+	// "http://localhost:4318". Metrics and traces are POSTed to the
+	// "/v1/metrics" and "/v1/traces" paths under it. If not set then nothing
+	// is exported.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Headers are added to each request made to the collector, e.g. for
+	// authentication.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Interval is how often metrics and completed spans are exported.
+	//
+	// Defaults to 10 seconds.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// ServiceName is used as the service.name resource attribute.
+	//
+	// Defaults to "pmux".
+	ServiceName string `yaml:"serviceName,omitempty"`
+}
+
+func (cfg OTLPConfig) withDefaults() OTLPConfig {
+
+	if cfg.Interval == 0 {
+		cfg.Interval = 10 * time.Second
+	}
+
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "pmux"
+	}
+
+	return cfg
+}
+
+// The types below implement the subset of the OTLP JSON encoding which is
+// needed. See
+// https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto
+// for the full definitions.
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func otlpString(key, val string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &val}}
+}
+
+func otlpInt(key string, val int) otlpKeyValue {
+	str := strconv.Itoa(val)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &str}}
+}
+
+// otlpTime encodes a time as nanoseconds since the epoch. 64-bit integers are
+// encoded as strings in OTLP JSON.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             *string        `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+// otlpAggregationTemporalityCumulative is the value of
+// AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpAggregationTemporalityCumulative = 2
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Unit  string     `json:"unit,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpSpanEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// values of the otlpStatus Code.
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// otlpSpanKindInternal is the value of SPAN_KIND_INTERNAL.
+const otlpSpanKindInternal = 1
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue  `json:"attributes"`
+	Events            []otlpSpanEvent `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpRandomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlpExporter collects spans and periodically exports them, along with
+// metrics derived from the status of a Pmux, to an OTLP collector.
+type otlpExporter struct {
+	cfg      OTLPConfig
+	client   *http.Client
+	resource otlpResource
+	start    time.Time
+
+	l     sync.Mutex
+	spans []otlpSpan
+}
+
+func newOTLPExporter(cfg OTLPConfig) *otlpExporter {
+
+	cfg = cfg.withDefaults()
+
+	hostname, _ := os.Hostname()
+
+	return &otlpExporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpString("service.name", cfg.ServiceName),
+			otlpString("host.name", hostname),
+		}},
+		start: time.Now(),
+	}
+}
+
+// otlpProcessAttrs returns the attributes describing the process of the given
+// name and labels.
+func otlpProcessAttrs(name string, labels map[string]string) []otlpKeyValue {
+	attrs := []otlpKeyValue{otlpString("process.name", name)}
+	for _, key := range sortedLabelKeys(labels) {
+		attrs = append(attrs, otlpString("process.label."+key, labels[key]))
+	}
+	return attrs
+}
+
+// startSpan begins a span describing a run of the process with the given name
+// and labels, which will be exported once it is passed to endSpan.
+func (e *otlpExporter) startSpan(
+	procName string, labels map[string]string,
+) *otlpSpan {
+	return &otlpSpan{
+		TraceID:           otlpRandomID(16),
+		SpanID:            otlpRandomID(8),
+		Name:              procName,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpTime(time.Now()),
+		Attributes:        otlpProcessAttrs(procName, labels),
+	}
+}
+
+func (e *otlpExporter) endSpan(span *otlpSpan, exit *ExitStatus) {
+
+	span.EndTimeUnixNano = otlpTime(time.Now())
+	span.Status.Code = otlpStatusOK
+
+	if exit != nil {
+		span.Attributes = append(
+			span.Attributes, otlpInt("process.exit_code", exit.Code),
+		)
+
+		if exit.Signal != "" {
+			span.Attributes = append(
+				span.Attributes, otlpString("process.signal", exit.Signal),
+			)
+		}
+
+		if exit.Code != 0 {
+			span.Status = otlpStatus{
+				Code:    otlpStatusError,
+				Message: exit.String(),
+			}
+		}
+	}
+
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.spans = append(e.spans, *span)
+}
+
+func (e *otlpExporter) metrics(statuses []ProcessStatus) []otlpMetric {
+
+	now := otlpTime(time.Now())
+	start := otlpTime(e.start)
+
+	restarts := &otlpSum{
+		AggregationTemporality: otlpAggregationTemporalityCumulative,
+		IsMonotonic:            true,
+	}
+	running := new(otlpGauge)
+	uptime := new(otlpGauge)
+	backoff := new(otlpGauge)
+
+	for _, status := range statuses {
+
+		attrs := otlpProcessAttrs(status.Name, status.Labels)
+
+		restartsStr := strconv.Itoa(status.Restarts)
+		restarts.DataPoints = append(restarts.DataPoints, otlpDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsInt:             &restartsStr,
+		})
+
+		runningStr := "0"
+		if status.Running {
+			runningStr = "1"
+		}
+		running.DataPoints = append(running.DataPoints, otlpDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: now,
+			AsInt:        &runningStr,
+		})
+
+		uptimeSecs := status.Uptime.Seconds()
+		uptime.DataPoints = append(uptime.DataPoints, otlpDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: now,
+			AsDouble:     &uptimeSecs,
+		})
+
+		backoffSecs := status.Backoff.Seconds()
+		backoff.DataPoints = append(backoff.DataPoints, otlpDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: now,
+			AsDouble:     &backoffSecs,
+		})
+	}
+
+	return []otlpMetric{
+		{Name: "pmux.process.restarts", Unit: "1", Sum: restarts},
+		{Name: "pmux.process.running", Unit: "1", Gauge: running},
+		{Name: "pmux.process.uptime", Unit: "s", Gauge: uptime},
+		{Name: "pmux.process.backoff", Unit: "s", Gauge: backoff},
+	}
+}
+
+func (e *otlpExporter) post(ctx context.Context, path string, body interface{}) error {
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(e.cfg.Endpoint, "/") + path
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, url, bytes.NewReader(b),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: unexpected status %q", url, res.Status)
+	}
+
+	return nil
+}
+
+// export sends metrics for the given statuses, if any, and all completed spans
+// to the collector.
+func (e *otlpExporter) export(ctx context.Context, statuses []ProcessStatus) error {
+
+	scope := otlpScope{Name: "github.com/cryptic-io/pmux"}
+
+	if len(statuses) > 0 {
+		err := e.post(ctx, "/v1/metrics", map[string]interface{}{
+			"resourceMetrics": []interface{}{map[string]interface{}{
+				"resource": e.resource,
+				"scopeMetrics": []interface{}{map[string]interface{}{
+					"scope":   scope,
+					"metrics": e.metrics(statuses),
+				}},
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("exporting metrics: %w", err)
+		}
+	}
+
+	e.l.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.l.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err := e.post(ctx, "/v1/traces", map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": e.resource,
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": scope,
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("exporting spans: %w", err)
+	}
+
+	return nil
+}
+
+// run periodically exports the metrics of the given Pmux, and all completed
+// spans, until the context is canceled.
+func (e *otlpExporter) run(ctx context.Context, p *Pmux, sysLogger Logger) {
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		statuses, err := p.Status()
+		if err != nil {
+			return
+		}
+
+		if err := e.export(ctx, statuses); err != nil {
+			sysLogger.Printf("otlp: %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package pmuxlib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// LingeringOutputAction describes what is done when the output of a process
+// is still held open by other processes (usually its descendants) after it
+// has exited, see ProcessConfig.LingeringOutput.
+type LingeringOutputAction string
+
+// Enumeration of possible LingeringOutputAction values.
+const (
+	// LingeringOutputClose causes pmux to stop reading the output, and to
+	// carry on as if the process had closed it.
+	LingeringOutputClose LingeringOutputAction = "close"
+
+	// LingeringOutputWait causes pmux to continue reading the output until
+	// every process holding it has closed it, or pmux is stopping the process.
+	// The process is not restarted until then.
+	LingeringOutputWait LingeringOutputAction = "wait"
+
+	// LingeringOutputKill causes pmux to send SIGKILL to every process holding
+	// the output open, and then read whatever output remains. This is only
+	// supported on Linux, elsewhere it's the same as LingeringOutputClose.
+	LingeringOutputKill LingeringOutputAction = "kill"
+)
+
+func (a LingeringOutputAction) valid() bool {
+	switch a {
+	case "", LingeringOutputClose, LingeringOutputWait, LingeringOutputKill:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitOutput waits for all output of a process which has exited to have been
+// read. If OutputWait elapses first then the processes holding the output
+// open are logged, and it's dealt with according to LingeringOutput.
+func waitOutput(
+	ctx context.Context, sysLogger Logger, cfg ProcessConfig,
+	wg *sync.WaitGroup, outputs map[string]*os.File,
+) {
+
+	readCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(readCh)
+	}()
+
+	afterCh, stop := after(cfg.clock(), cfg.OutputWait)
+	select {
+	case <-readCh:
+		stop()
+		return
+	case <-afterCh:
+	}
+
+	files := make([]*os.File, 0, len(outputs))
+	for _, f := range outputs {
+		files = append(files, f)
+	}
+
+	holders, err := pipeWriters(files)
+	if err != nil {
+		debugf(sysLogger, "finding processes holding output: %v", err)
+		holders = nil
+	}
+
+	heldBy := "likely by a process it started"
+	if len(holders) > 0 {
+		heldBy = fmt.Sprintf("by PIDs %v", holders)
+	}
+
+	closeOutputs := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		<-readCh
+	}
+
+	switch {
+	case cfg.LingeringOutput == LingeringOutputWait:
+		sysLogger.Printf(
+			"output is still open %v after the process exited, held %s, "+
+				"continuing to read it until they exit",
+			cfg.OutputWait, heldBy,
+		)
+
+		select {
+		case <-readCh:
+		case <-ctx.Done():
+			closeOutputs()
+		}
+
+	case cfg.LingeringOutput == LingeringOutputKill && len(holders) > 0:
+		sysLogger.Printf(
+			"output is still open %v after the process exited, held %s, "+
+				"killing them",
+			cfg.OutputWait, heldBy,
+		)
+
+		for _, pid := range holders {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				sysLogger.Printf("killing PID %d: %v", pid, err)
+			}
+		}
+
+		// once killed, the remaining output can be read.
+		afterCh, stop := after(cfg.clock(), cfg.OutputWait)
+		defer stop()
+		select {
+		case <-readCh:
+		case <-afterCh:
+			closeOutputs()
+		}
+
+	default:
+		sysLogger.Printf(
+			"output is still open %v after the process exited, held %s, "+
+				"no longer reading it",
+			cfg.OutputWait, heldBy,
+		)
+		closeOutputs()
+	}
+}
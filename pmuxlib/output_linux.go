@@ -0,0 +1,94 @@
+package pmuxlib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pipeWriters returns the PIDs of the processes, other than this one, which
+// hold the write end of any of the pipes whose read ends are given, by
+// scanning /proc.
+func pipeWriters(readers []*os.File) ([]int, error) {
+
+	links := map[string]bool{}
+	for _, f := range readers {
+		// f.Fd isn't used, as it would put the file into blocking mode.
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat'ing %q: %w", f.Name(), err)
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			links[fmt.Sprintf("pipe:[%d]", stat.Ino)] = true
+		}
+	}
+
+	procDirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+
+	var pids []int
+	for _, procDir := range procDirs {
+		pid, err := strconv.Atoi(procDir.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		// processes may exit, or belong to other users, while being scanned,
+		// so errors are ignored.
+		fdDir := filepath.Join("/proc", procDir.Name(), "fd")
+		fds, _ := os.ReadDir(fdDir)
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !links[link] {
+				continue
+			}
+
+			if isWriteFD(pid, fd.Name()) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// isWriteFD returns whether the given file descriptor of the given process
+// was opened for writing, according to its fdinfo.
+func isWriteFD(pid int, fd string) bool {
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		flagsStr, ok := strings.CutPrefix(scanner.Text(), "flags:")
+		if !ok {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(strings.TrimSpace(flagsStr), 8, 64)
+		if err != nil {
+			return false
+		}
+
+		accMode := flags & syscall.O_ACCMODE
+		return accMode == syscall.O_WRONLY || accMode == syscall.O_RDWR
+	}
+
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+import (
+	"errors"
+	"os"
+)
+
+// pipeWriters always returns an error, as there's no portable way to find the
+// processes holding a pipe.
+func pipeWriters(readers []*os.File) ([]int, error) {
+	return nil, errors.New("not supported on this platform")
+}
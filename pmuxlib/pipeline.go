@@ -0,0 +1,154 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pipelineScript is the shell script which runs a ProcessTypePipeline
+// process. It's preceded by the setting of keepgoing to 1 if ContinueOnError
+// is set (or 0 otherwise), and followed by a call to step for each of its
+// steps, and then by "exit $status".
+const pipelineScript = `status=0
+step() {
+	name=$1
+	shift
+	printf 'pipeline: running step %s\n' "$name" >&2
+	"$@"
+	code=$?
+	if [ $code -ne 0 ]; then
+		printf 'pipeline: step %s failed with exit code %d\n' "$name" $code >&2
+		[ "$keepgoing" = 1 ] || exit $code
+		status=$code
+	fi
+}
+`
+
+// PipelineConfig describes the steps which a ProcessTypePipeline process runs.
+//
+// The steps are run one after another by a single shell, which is the process
+// that pmux supervises, so the pipeline is started, stopped and restarted as a
+// whole, and each step inherits the process's Env, Dir, User, etc. The name of
+// each step is written to stderr as it's run, as are any failures.
+//
+// The pipeline exits with the exit code of the step which failed, if any, or
+// 0 once every step has succeeded. Pipelines are generally also OneShot.
+type PipelineConfig struct {
+
+	// Steps are the commands to run, in order.
+	Steps []PipelineStep `yaml:"steps,omitempty"`
+
+	// ContinueOnError causes the remaining steps to be run after a step
+	// fails, rather than the pipeline exiting immediately. The pipeline then
+	// exits with the exit code of the last step to fail.
+	ContinueOnError bool `yaml:"continueOnError,omitempty"`
+}
+
+// PipelineStep describes a single step of a PipelineConfig.
+type PipelineStep struct {
+
+	// Name identifies the step in the process's output. Defaults to Cmd.
+	Name string `yaml:"name,omitempty"`
+
+	// Cmd, Args and Shell describe the command which the step runs, in the
+	// same way as the fields of ProcessConfig of the same names, with $0 of
+	// a Shell step being set to the step's Name.
+	Cmd   string `yaml:"cmd,omitempty"`
+	Args  Args   `yaml:"args,omitempty"`
+	Shell bool   `yaml:"shell,omitempty"`
+}
+
+func (step PipelineStep) withDefaults() PipelineStep {
+	if step.Name == "" {
+		step.Name = step.Cmd
+	}
+	return step
+}
+
+func (cfg ProcessConfig) validatePipeline() []string {
+
+	var problems []string
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(str, args...))
+	}
+
+	if cfg.Type != ProcessTypePipeline {
+		if len(cfg.Pipeline.Steps) > 0 {
+			problemf("pipeline is only used when type is %q", ProcessTypePipeline)
+		}
+		return problems
+	}
+
+	if len(cfg.Pipeline.Steps) == 0 {
+		problemf("pipeline.steps is required")
+	}
+
+	for i, step := range cfg.Pipeline.Steps {
+		if step.Cmd == "" {
+			problemf("pipeline.steps[%d]: cmd is required", i)
+		}
+	}
+
+	for _, unsupported := range []struct {
+		field string
+		set   bool
+	}{
+		{"cmd", cfg.Cmd != ""},
+		{"args", len(cfg.Args) > 0},
+		{"shell", cfg.Shell},
+		{"fallbackCmd", cfg.FallbackCmd != ""},
+		{"listen", len(cfg.Listen) > 0},
+	} {
+		if unsupported.set {
+			problemf(
+				"%s cannot be used when type is %q",
+				unsupported.field, ProcessTypePipeline,
+			)
+		}
+	}
+
+	return problems
+}
+
+// shellQuote quotes the string such that a POSIX shell will interpret it as a
+// single word, with no expansion.
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+// pipelineCommand returns the executable and arguments which should be used to
+// run a ProcessTypePipeline process.
+func (cfg ProcessConfig) pipelineCommand() (string, []string) {
+
+	keepGoing := 0
+	if cfg.Pipeline.ContinueOnError {
+		keepGoing = 1
+	}
+
+	script := new(strings.Builder)
+	fmt.Fprintf(script, "keepgoing=%d\n", keepGoing)
+	script.WriteString(pipelineScript)
+
+	for _, step := range cfg.Pipeline.Steps {
+		step = step.withDefaults()
+
+		words := []string{"step", shellQuote(step.Name)}
+		if step.Shell {
+			words = append(
+				words, "/bin/sh", "-c", shellQuote(step.Cmd), shellQuote(step.Name),
+			)
+		} else {
+			words = append(words, shellQuote(cfg.lookPath(step.Cmd)))
+		}
+
+		for _, arg := range step.Args {
+			words = append(words, shellQuote(arg))
+		}
+
+		script.WriteString(strings.Join(words, " ") + "\n")
+	}
+
+	script.WriteString("exit $status\n")
+
+	return "/bin/sh", []string{"-c", script.String(), cfg.Name}
+}
@@ -0,0 +1,441 @@
+package pmuxlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PluginEvent is a point in the lifecycle of pmux or of a process at which
+// plugins are called.
+type PluginEvent string
+
+// Enumeration of possible PluginEvent values.
+const (
+	// PluginEventConfigLoad plugins are called by the pmux binary once the
+	// config has been loaded and validated, and are given the whole config.
+	// They may return a modified config, which replaces it.
+	PluginEventConfigLoad PluginEvent = "configLoad"
+
+	// PluginEventPreStart plugins are called before each start of a process,
+	// prior to its preStart hook. They may return env vars, which are added
+	// to the process's environment, or an error, which fails the start.
+	PluginEventPreStart PluginEvent = "preStart"
+
+	// PluginEventPostExit plugins are called after each exit of a process,
+	// once its postStop hook has run. Their response is ignored.
+	PluginEventPostExit PluginEvent = "postExit"
+
+	// PluginEventRestart plugins are called whenever a process exits of its
+	// own accord, and may override the decision of whether it's restarted
+	// and how long to wait before doing so, in the same way as a
+	// RestartDecider.
+	PluginEventRestart PluginEvent = "restart"
+)
+
+// PluginConfig describes a plugin, which is an executable that is run at each
+// of the lifecycle points given by Events. Plugins allow site-specific
+// behavior to be added to pmux without modifying it.
+//
+// Each time it's called the plugin is given a JSON PluginRequest on its stdin,
+// and must write a JSON PluginResponse to its stdout, or nothing, and exit
+// with a zero exit code. Anything it writes to stderr is logged by pmux.
+type PluginConfig struct {
+	Name string `yaml:"name"`
+
+	// Cmd and Args are the plugin's executable and its arguments.
+	Cmd  string `yaml:"cmd"`
+	Args Args   `yaml:"args,omitempty"`
+
+	// Events are the points at which the plugin is called. Plugins are called
+	// in the order they're defined.
+	Events []PluginEvent `yaml:"events"`
+
+	// Timeout is how long each call of the plugin may take, after which it's
+	// killed and the call is considered to have failed.
+	//
+	// Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (cfg PluginConfig) withDefaults() PluginConfig {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return cfg
+}
+
+func (cfg PluginConfig) validate() error {
+
+	if cfg.Name == "" {
+		return fmt.Errorf("name is required")
+	} else if cfg.Cmd == "" {
+		return fmt.Errorf("cmd is required")
+	} else if len(cfg.Events) == 0 {
+		return fmt.Errorf("at least one event must be given")
+	} else if cfg.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+
+	for _, event := range cfg.Events {
+		switch event {
+		case PluginEventConfigLoad, PluginEventPreStart, PluginEventPostExit,
+			PluginEventRestart:
+		default:
+			return fmt.Errorf(
+				"event %q is not one of %q, %q, %q, or %q",
+				event,
+				PluginEventConfigLoad, PluginEventPreStart,
+				PluginEventPostExit, PluginEventRestart,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (cfg PluginConfig) handles(event PluginEvent) bool {
+	for _, e := range cfg.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// PluginExit describes an exit of a process to a plugin. It's the JSON form of
+// an ExitInfo, with durations given in seconds.
+type PluginExit struct {
+	ExitCode     int       `json:"exitCode"`
+	Signal       string    `json:"signal,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Class        ExitClass `json:"class"`
+	Ran          float64   `json:"ran"`
+	Restarts     int       `json:"restarts"`
+	FailedStarts int       `json:"failedStarts"`
+
+	// Restart and Wait are the current decision of whether the process will
+	// be restarted, and how long will be waited before doing so. They're only
+	// given to PluginEventRestart plugins.
+	Restart *bool    `json:"restart,omitempty"`
+	Wait    *float64 `json:"wait,omitempty"`
+}
+
+// newPluginExit returns the PluginExit describing the ExitInfo, including its
+// restart decision if withDecision is set.
+func newPluginExit(info ExitInfo, withDecision bool) *PluginExit {
+
+	exit := &PluginExit{
+		ExitCode:     info.ExitCode,
+		Class:        info.Class,
+		Ran:          info.Ran.Seconds(),
+		Restarts:     info.Restarts,
+		FailedStarts: info.FailedStarts,
+	}
+
+	if withDecision {
+		wait := info.Wait.Seconds()
+		exit.Restart, exit.Wait = &info.Restart, &wait
+	}
+
+	if info.Signal != 0 {
+		exit.Signal = signalName(info.Signal)
+	}
+
+	if info.Err != nil {
+		exit.Error = info.Err.Error()
+	}
+
+	return exit
+}
+
+// PluginRequest is written as JSON to the stdin of a plugin each time it's
+// called.
+type PluginRequest struct {
+	Event PluginEvent `json:"event"`
+
+	// Process is the name of the process which the event is for. It's not
+	// given for PluginEventConfigLoad.
+	Process string `json:"process,omitempty"`
+
+	// Config is the whole config, in the same form as a JSON config file. It's
+	// only given for PluginEventConfigLoad.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// Exit describes the exit of the process. It's only given for
+	// PluginEventPostExit and PluginEventRestart.
+	Exit *PluginExit `json:"exit,omitempty"`
+}
+
+// PluginResponse is read as JSON from the stdout of a plugin each time it's
+// called. All fields are optional.
+type PluginResponse struct {
+
+	// Error, if set, causes the call to be considered to have failed. For
+	// PluginEventConfigLoad this causes pmux to fail to start, and for
+	// PluginEventPreStart it causes the start of the process to fail.
+	Error string `json:"error,omitempty"`
+
+	// Config, if set, replaces the config. It's only used for
+	// PluginEventConfigLoad.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// Env vars are added to the environment of the process. It's only used
+	// for PluginEventPreStart.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Restart and Wait, if set, override whether the process is restarted,
+	// and how long is waited before doing so. Wait is a duration string, e.g.
+	// "5s". They're only used for PluginEventRestart.
+	Restart *bool  `json:"restart,omitempty"`
+	Wait    string `json:"wait,omitempty"`
+}
+
+// call runs the plugin with the given request, returning its response.
+func (cfg PluginConfig) call(
+	ctx context.Context, sysLogger Logger, req PluginRequest,
+) (
+	PluginResponse, error,
+) {
+
+	cfg = cfg.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	reqB, err := json.Marshal(req)
+	if err != nil {
+		return PluginResponse{}, fmt.Errorf("encoding request: %w", err)
+	}
+
+	var (
+		stdout = new(bytes.Buffer)
+		stderr = new(bytes.Buffer)
+	)
+
+	cmd := exec.CommandContext(ctx, cfg.Cmd, cfg.Args...)
+	cmd.Stdin = bytes.NewReader(reqB)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+
+	for scanner := bufio.NewScanner(stderr); scanner.Scan(); {
+		sysLogger.Println(
+			fmt.Sprintf("plugin %q (%s): %s", cfg.Name, req.Event, scanner.Text()),
+		)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return PluginResponse{}, fmt.Errorf("timed out after %v", cfg.Timeout)
+	} else if err != nil {
+		return PluginResponse{}, err
+	}
+
+	var res PluginResponse
+	if len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+			return PluginResponse{}, fmt.Errorf("decoding response: %w", err)
+		}
+	}
+
+	if res.Error != "" {
+		return PluginResponse{}, fmt.Errorf("plugin returned error: %s", res.Error)
+	}
+
+	return res, nil
+}
+
+// jsonCompatible converts a value decoded from YAML into one which can be
+// encoded as JSON, whose objects must have string keys.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// configJSON encodes the Config as JSON, in the same form as a JSON config
+// file.
+func configJSON(cfg Config) (json.RawMessage, error) {
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonCompatible(generic))
+}
+
+// RunConfigPlugins calls each of the Config's PluginEventConfigLoad plugins in
+// turn, each being given the Config as returned by the previous one, and
+// returns the final Config. The returned Config is validated.
+func (cfg Config) RunConfigPlugins(
+	ctx context.Context, sysLogger Logger,
+) (
+	Config, error,
+) {
+
+	for _, pluginCfg := range cfg.Plugins {
+
+		if !pluginCfg.handles(PluginEventConfigLoad) {
+			continue
+		}
+
+		cfgJSON, err := configJSON(cfg)
+		if err != nil {
+			return Config{}, fmt.Errorf("encoding config: %w", err)
+		}
+
+		res, err := pluginCfg.call(ctx, sysLogger, PluginRequest{
+			Event:  PluginEventConfigLoad,
+			Config: cfgJSON,
+		})
+		if err != nil {
+			return Config{}, fmt.Errorf("plugin %q: %w", pluginCfg.Name, err)
+		} else if len(res.Config) == 0 {
+			continue
+		}
+
+		// JSON is a subset of YAML, so the config can be decoded in the same
+		// way as a YAML config file.
+		var newCfg Config
+		if err := yaml.UnmarshalStrict(res.Config, &newCfg); err != nil {
+			return Config{}, fmt.Errorf(
+				"plugin %q: decoding config: %w", pluginCfg.Name, err,
+			)
+		}
+
+		if err := newCfg.Validate(); err != nil {
+			return Config{}, fmt.Errorf(
+				"plugin %q: returned config: %w", pluginCfg.Name, err,
+			)
+		}
+
+		cfg = newCfg
+	}
+
+	return cfg, nil
+}
+
+// runPreStartPlugins calls each PluginEventPreStart plugin in turn, returning
+// the env vars they've returned, later plugins taking precedence.
+func runPreStartPlugins(
+	ctx context.Context, sysLogger Logger, plugins []PluginConfig, procName string,
+) (
+	map[string]string, error,
+) {
+
+	env := map[string]string{}
+
+	for _, pluginCfg := range plugins {
+
+		if !pluginCfg.handles(PluginEventPreStart) {
+			continue
+		}
+
+		res, err := pluginCfg.call(ctx, sysLogger, PluginRequest{
+			Event:   PluginEventPreStart,
+			Process: procName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("plugin %q: %w", pluginCfg.Name, err)
+		}
+
+		for k, v := range res.Env {
+			env[k] = v
+		}
+	}
+
+	return env, nil
+}
+
+// runPostExitPlugins calls each PluginEventPostExit plugin in turn. Failures
+// are only logged.
+func runPostExitPlugins(
+	sysLogger Logger, plugins []PluginConfig, info ExitInfo,
+) {
+
+	for _, pluginCfg := range plugins {
+
+		if !pluginCfg.handles(PluginEventPostExit) {
+			continue
+		}
+
+		_, err := pluginCfg.call(context.Background(), sysLogger, PluginRequest{
+			Event:   PluginEventPostExit,
+			Process: info.Name,
+			Exit:    newPluginExit(info, false),
+		})
+		if err != nil {
+			sysLogger.Printf("plugin %q (postExit): %v", pluginCfg.Name, err)
+		}
+	}
+}
+
+// runRestartPlugins calls each PluginEventRestart plugin in turn, each being
+// given the decision of the previous one, and returns the final decision of
+// whether to restart the process and how long to wait before doing so. If a
+// plugin fails then the decision is left as it was.
+func runRestartPlugins(
+	sysLogger Logger, plugins []PluginConfig, info ExitInfo,
+) (
+	bool, time.Duration,
+) {
+
+	for _, pluginCfg := range plugins {
+
+		if !pluginCfg.handles(PluginEventRestart) {
+			continue
+		}
+
+		res, err := pluginCfg.call(context.Background(), sysLogger, PluginRequest{
+			Event:   PluginEventRestart,
+			Process: info.Name,
+			Exit:    newPluginExit(info, true),
+		})
+		if err != nil {
+			sysLogger.Printf("plugin %q (restart): %v", pluginCfg.Name, err)
+			continue
+		}
+
+		if res.Restart != nil {
+			info.Restart = *res.Restart
+		}
+
+		if res.Wait != "" {
+			wait, err := time.ParseDuration(res.Wait)
+			if err != nil || wait < 0 {
+				sysLogger.Printf(
+					"plugin %q (restart): invalid wait %q", pluginCfg.Name, res.Wait,
+				)
+				continue
+			}
+			info.Wait = wait
+		}
+	}
+
+	return info.Restart, info.Wait
+}
@@ -0,0 +1,1300 @@
+package pmuxlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNotRunning is returned from Pmux methods which require that Run is
+// currently running, when it is not.
+var ErrNotRunning = errors.New("pmux is not running")
+
+// process tracks the runtime state of a single process being managed by Pmux.
+type process struct {
+	cfg ProcessConfig
+
+	// replicaOf is the name of the ProcessConfig which this process is a
+	// replica of, or its own name if it isn't a replica.
+	replicaOf string
+
+	stdoutLogger, stderrLogger, sysLogger Logger
+
+	// streamLoggers holds the Logger of each of the process's Streams.
+	streamLoggers map[string]Logger
+
+	// cancel is set only while the process's handler is running, and doneCh
+	// is closed once the handler has returned.
+	cancel context.CancelCauseFunc
+	doneCh chan struct{}
+
+	// resumeCh is set while restarts of the process are paused, and is closed
+	// when they are resumed.
+	resumeCh chan struct{}
+
+	// osProc is set while the process itself is running, as are outputs,
+	// which holds the pipes its output is read from (see
+	// runProcessOpts.onStart).
+	osProc    *os.Process
+	outputs   map[string]*os.File
+	startedAt time.Time
+	frozen    bool
+
+	// handoff is set if the process was handed off by another Pmux while
+	// running, until it's adopted.
+	handoff *HandoffProcess
+
+	// listenFiles are the sockets described by the process's Listen config,
+	// which are set while its handler is running, so that they can be handed
+	// off along with it.
+	listenFiles []*os.File
+
+	// restartCh is written to in order to restart the running process.
+	restartCh chan *StopError
+
+	// instance is incremented each time the process is started, and ready is
+	// set once the current instance passes its ready check, timeToReady
+	// being how long after starting that was.
+	instance    int
+	ready       bool
+	timeToReady time.Duration
+	cancelReady context.CancelFunc
+
+	// releaseStart, if set, frees the MaxConcurrentStarts slot taken by
+	// waitToStart. It's called once the process first becomes ready or exits.
+	releaseStart func()
+
+	// lastUsage and lastExit describe the most recently exited instance.
+	lastUsage *ResourceUsage
+	lastExit  *ExitStatus
+
+	// runExit is like lastExit, but is only set by exits during the current
+	// call to Run, whereas lastExit may have been restored from the StateFile
+	// or a Handoff.
+	runExit *ExitStatus
+
+	// spans holds the in-progress OTLP span of each running instance of the
+	// process, if OTLP export is enabled.
+	spans map[*os.Process]*otlpSpan
+
+	// backoff is the latest restart backoff state of the process's handler.
+	backoff backoffState
+
+	// stopped is set if the process's handler returned of its own accord, or
+	// was stopped by StopProcess, rather than due to pmux stopping.
+	stopped bool
+
+	// stoppedBeforeRestart is set if pmux stopped while the process was
+	// waiting to be restarted, i.e. while it was down.
+	stoppedBeforeRestart bool
+}
+
+// Pmux runs all processes described by a Config, and allows for controlling
+// those processes while it is running.
+type Pmux struct {
+	cfg Config
+
+	l sync.Mutex
+
+	// fields which are only set while Run is running.
+	ctx         context.Context
+	sysLogger   *logger
+	procs       []*process
+	otlp        *otlpExporter
+	vault       *vaultClient
+	registry    *registryClient
+	sinks       []*fileSink
+	events      *eventWriter
+	stateWriter *stateWriter
+	wg          sync.WaitGroup
+	stoppedCh   chan struct{}
+
+	// instanceTag is set by Run, see Config.InstanceTag.
+	instanceTag string
+
+	// logSubs and eventSubs are sent every line logged, and every Event
+	// emitted, by Run.
+	logSubs   *broadcaster[LogLine]
+	eventSubs *broadcaster[Event]
+
+	// logLines counts every line logged by Run, it must be accessed
+	// atomically.
+	logLines uint64
+
+	// startup is set once all processes have finished starting.
+	startup StartupSummary
+
+	// stopRequested is set once StopProcess has stopped a process, which may
+	// then be started again, so Run won't return until its context is
+	// canceled.
+	stopRequested bool
+
+	// shutdown is set once Run returns, see LastShutdown.
+	shutdown *Shutdown
+
+	// takeover is set by TakeOver, and handedOff is set once Handoff has
+	// succeeded.
+	takeover  *Handoff
+	handedOff bool
+
+	// loggers are the loggers which Run writes to, see CloseLogs. They're
+	// guarded by loggersL rather than l, so that closing them never has to wait
+	// on anything else.
+	loggersL sync.Mutex
+	loggers  []*logger
+
+	// startSem limits the number of processes which can be starting at once,
+	// it will be nil if there is no limit.
+	startSem chan struct{}
+}
+
+// NewPmux initializes and returns a Pmux which will run the given Config once
+// its Run method is called.
+func NewPmux(cfg Config) *Pmux {
+	return &Pmux{
+		cfg:       cfg,
+		logSubs:   newBroadcaster[LogLine](),
+		eventSubs: newBroadcaster[Event](),
+	}
+}
+
+// Run runs all processes in the Config, other than those which have Autostart
+// disabled. It will block until the context is canceled and all child
+// processes have been cleaned up, or until all processes have stopped of their
+// own accord and none can be started via StartProcess.
+//
+// If the templates within the Config fail to expand then the error is logged
+// and Run returns immediately, without starting any processes.
+func (p *Pmux) Run(ctx context.Context) {
+
+	stdoutLogger := newLogger(os.Stdout, logSepStdout, p.cfg.TimeFormat)
+	defer stdoutLogger.Close()
+
+	stderrLogger := newLogger(os.Stderr, logSepStderr, p.cfg.TimeFormat)
+	defer stderrLogger.Close()
+
+	// all loggers share the same maximum pname length, so that the lines of
+	// every process and stream are aligned with each other.
+	stderrLogger.maxPNameLen = stdoutLogger.maxPNameLen
+
+	stdoutLogger.lines = &p.logLines
+	stderrLogger.lines = &p.logLines
+
+	stdoutLogger.subs = p.logSubs
+	stderrLogger.subs = p.logSubs
+
+	stdoutLogger.json = p.cfg.LogFormat == SysLogFormatJSON
+	stderrLogger.json = p.cfg.LogFormat == SysLogFormatJSON
+
+	raw := p.cfg.raw()
+	stdoutLogger.raw = raw
+	stderrLogger.raw = raw
+
+	instanceTag := p.cfg.instanceTag()
+	for _, l := range []*logger{stdoutLogger, stderrLogger} {
+		l.instance = instanceTag
+		l.instancePrefix = p.cfg.InstanceTagPrefix
+	}
+
+	loc, locErr := p.cfg.logLocation("")
+	stdoutLogger.loc = loc
+	stderrLogger.loc = loc
+
+	sysLogger := stderrLogger.withSep(logSepSys)
+
+	if locErr != nil {
+		sysLogger.Printf("loading timeZone: %v", locErr)
+	}
+
+	if p.cfg.SysLog.Path == "" {
+		if format := p.cfg.SysLog.Format; format != "" {
+			sysLogger.json = format == SysLogFormatJSON
+		}
+
+		if zone := p.cfg.SysLog.TimeZone; zone != "" {
+			if sysLoc, err := p.cfg.logLocation(zone); err != nil {
+				sysLogger.Printf("loading sysLog timeZone: %v", err)
+			} else {
+				sysLogger.loc = sysLoc
+			}
+		}
+	}
+
+	p.addLoggers(stdoutLogger, stderrLogger)
+
+	var sinks []*fileSink
+	defer func() {
+		for _, sink := range sinks {
+			_ = sink.Close()
+		}
+	}()
+
+	if path := p.cfg.SysLog.Path; path != "" {
+		sink, err := p.openLogFile(path, p.cfg.LogRotation, os.Stderr)
+		if err != nil {
+			err = fmt.Errorf("opening sysLog path %q: %w", path, err)
+			sysLogger.Println(err.Error())
+			p.setShutdown(Shutdown{Reason: ShutdownReasonConfigError, Err: err})
+			return
+		}
+		sinks = append(sinks, sink)
+
+		sysLogger = newLogger(sink, logSepSys, p.cfg.TimeFormat)
+		sysLogger.maxPNameLen = stdoutLogger.maxPNameLen
+
+		sysLogger.loc, err = p.cfg.logLocation(p.cfg.SysLog.TimeZone)
+		if err != nil {
+			sysLogger.Printf("loading sysLog timeZone: %v", err)
+		}
+
+		sysLogger.json = p.cfg.SysLog.Format == SysLogFormatJSON
+		sysLogger.instance = instanceTag
+		sysLogger.instancePrefix = p.cfg.InstanceTagPrefix
+		sysLogger.lines = &p.logLines
+		sysLogger.subs = p.logSubs
+		defer sysLogger.Close()
+		p.addLoggers(sysLogger)
+	}
+
+	if !raw {
+		sysLogger.Printf("starting pmux %s", GetBuildInfo())
+	}
+
+	cfg, err := p.cfg.ExpandProcesses().ExpandTemplates()
+	if err != nil {
+		err = fmt.Errorf("expanding config templates: %w", err)
+		sysLogger.Println(err.Error())
+		p.setShutdown(Shutdown{Reason: ShutdownReasonConfigError, Err: err})
+		return
+	}
+
+	// shutdown is set once all processes have stopped.
+	var shutdown Shutdown
+
+	if !raw {
+		defer func() {
+			switch shutdown.Reason {
+			case ShutdownReasonFailed, ShutdownReasonConfigError:
+				sysLogger.Printf("exiting: %v", shutdown)
+			default:
+				sysLogger.Printf("exited gracefully (%v), ciao!", shutdown)
+			}
+		}()
+	}
+
+	p.l.Lock()
+
+	p.ctx = ctx
+	p.sysLogger = sysLogger
+	p.instanceTag = instanceTag
+	p.procs = make([]*process, len(cfg.Processes))
+	p.stoppedCh = make(chan struct{}, 1)
+	p.startup = nil
+	p.shutdown = nil
+
+	if cfg.MaxConcurrentStarts > 0 {
+		p.startSem = make(chan struct{}, cfg.MaxConcurrentStarts)
+	}
+
+	var canStartLater bool
+
+	// fileLoggers holds a logger for each distinct LogFile, so that processes
+	// can share a file.
+	fileLoggers := map[string]*logger{}
+	defer func() {
+		for _, fileLogger := range fileLoggers {
+			if fileLogger != nil {
+				fileLogger.Close()
+			}
+		}
+	}()
+
+	// fileLogger returns the logger for the given LogFile path, or nil if it
+	// couldn't be opened.
+	fileLogger := func(path string) *logger {
+		fileLogger, ok := fileLoggers[path]
+		if !ok {
+			// the output is already written to stdout/stderr, so there's no
+			// need for a fallback.
+			sink, err := p.openLogFile(path, cfg.LogRotation, nil)
+			if err != nil {
+				sysLogger.Printf("opening logFile %q: %v", path, err)
+			} else {
+				sinks = append(sinks, sink)
+				fileLogger = newLogger(sink, logSepStdout, cfg.TimeFormat)
+				fileLogger.maxPNameLen = stdoutLogger.maxPNameLen
+
+				fileLogger.loc, err = cfg.logLocation(cfg.LogFileTimeZone)
+				if err != nil {
+					sysLogger.Printf("loading logFileTimeZone: %v", err)
+				}
+
+				fileLogger.json = cfg.LogFormat == SysLogFormatJSON
+				fileLogger.instance = instanceTag
+				fileLogger.instancePrefix = cfg.InstanceTagPrefix
+				p.addLoggers(fileLogger)
+			}
+			fileLoggers[path] = fileLogger
+		}
+		return fileLogger
+	}
+
+	for i, procCfg := range cfg.Processes {
+		procCfg.instance = instanceTag
+
+		replicaOf := procCfg.Name
+		if procCfg.Replicas > 1 {
+			replicaOf = strings.TrimSuffix(
+				procCfg.Name, "."+strconv.Itoa(procCfg.replica),
+			)
+		}
+
+		if procCfg.Verbosity == "" {
+			procCfg.Verbosity = cfg.Verbosity
+		}
+
+		procLogger := func(l *logger) *logger {
+			l = l.withPName(procCfg.Name).withLabels(procCfg.Labels)
+			if procCfg.TimeFormat != nil {
+				l = l.withTimeFormat(*procCfg.TimeFormat)
+			}
+			return l
+		}
+
+		var (
+			procStdoutLogger Logger = procLogger(stdoutLogger)
+			procStderrLogger Logger = procLogger(stderrLogger)
+			procSysLogger    Logger = procLogger(sysLogger)
+		)
+
+		if path := procCfg.LogFile; path != "" {
+			if fileLogger := fileLogger(path); fileLogger != nil {
+				fileLogger = procLogger(fileLogger)
+				procStdoutLogger = multiLogger{procStdoutLogger, fileLogger}
+				procStderrLogger = multiLogger{
+					procStderrLogger, fileLogger.withSep(logSepStderr),
+				}
+				procSysLogger = multiLogger{
+					procSysLogger, fileLogger.withSep(logSepSys),
+				}
+			}
+		}
+
+		streamLoggers := map[string]Logger{}
+		for _, stream := range procCfg.Streams {
+			stream = stream.withDefaults()
+
+			var streamLogger multiLogger
+
+			switch stream.To {
+			case OutputStreamStdout:
+				streamLogger = append(
+					streamLogger,
+					procLogger(stdoutLogger).withStream(stream.Name),
+				)
+			case OutputStreamStderr:
+				streamLogger = append(
+					streamLogger,
+					procLogger(stderrLogger).withStream(stream.Name),
+				)
+			}
+
+			if stream.LogFile != "" {
+				if fileLogger := fileLogger(stream.LogFile); fileLogger != nil {
+					streamLogger = append(
+						streamLogger,
+						procLogger(fileLogger).withStream(stream.Name),
+					)
+				}
+			}
+
+			streamLoggers[stream.Name] = streamLogger
+		}
+
+		p.procs[i] = &process{
+			cfg:           procCfg,
+			streamLoggers: streamLoggers,
+			replicaOf:     replicaOf,
+			restartCh:     make(chan *StopError, 1),
+			stdoutLogger:  procStdoutLogger,
+			stderrLogger:  procStderrLogger,
+			sysLogger:     withVerbosity(procSysLogger, procCfg.Verbosity),
+		}
+
+		if procCfg.Autostart != nil && !*procCfg.Autostart {
+			canStartLater = true
+		}
+	}
+
+	p.sinks = sinks
+	p.restoreState()
+	p.applyTakeover()
+
+	if cfg.StateFile != "" {
+		p.stateWriter = newStateWriter(cfg.StateFile, sysLogger)
+	}
+
+	if cfg.Events != "" {
+		if p.events, err = openEventWriter(cfg.Events); err != nil {
+			sysLogger.Printf("not writing events: %v", err)
+		}
+	}
+
+	if cfg.OTLP.Endpoint != "" {
+		p.otlp = newOTLPExporter(cfg.OTLP)
+	}
+
+	for _, proc := range p.procs {
+		if len(proc.cfg.Secrets) > 0 {
+			p.vault = newVaultClient(cfg.Vault, sysLogger)
+			defer p.vault.close()
+			break
+		}
+	}
+
+	for _, proc := range p.procs {
+		if proc.cfg.Register != nil && cfg.Registry.enabled() {
+			p.registry = newRegistryClient(cfg.Registry)
+			break
+		}
+	}
+
+	autostarted := map[*process]bool{}
+	for _, proc := range p.procs {
+		if proc.handoff != nil {
+			autostarted[proc] = true
+			p.startProcess(proc)
+		} else if proc.stopped {
+			proc.sysLogger.Println(
+				"not starting process, it had stopped when pmux last ran",
+			)
+			canStartLater = true
+		} else if proc.cfg.Autostart == nil || *proc.cfg.Autostart {
+			autostarted[proc] = true
+			p.startProcess(proc)
+		}
+	}
+
+	p.l.Unlock()
+
+	startupCtx, cancelStartup := context.WithCancel(ctx)
+	defer cancelStartup()
+	var summaryLogger Logger = new(NullLogger)
+	if !raw {
+		summaryLogger = withVerbosity(sysLogger, cfg.Verbosity)
+	}
+	go p.logStartupSummary(startupCtx, autostarted, summaryLogger)
+
+	if cfg.OTLP.Endpoint != "" {
+		otlpCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go p.otlp.run(otlpCtx, p, sysLogger)
+	}
+
+	if p.vault != nil && cfg.Vault.RotationInterval > 0 {
+		vaultCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go p.vault.run(vaultCtx, p)
+	}
+
+	if cfg.Heartbeat > 0 {
+		heartbeatCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go p.logHeartbeat(heartbeatCtx, cfg.Heartbeat)
+	}
+
+	if cfg.StatusFile != "" {
+		statusCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go p.writeStatusFile(
+			statusCtx, cfg.StatusFile, cfg.WithDefaults().StatusInterval,
+		)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+		case <-p.stoppedCh:
+			p.l.Lock()
+			stopRequested := p.stopRequested
+			p.l.Unlock()
+
+			if canStartLater || stopRequested || p.numRunning() > 0 {
+				continue
+			}
+		}
+		break
+	}
+
+	canceled := ctx.Err() != nil
+
+	// Once ctx is unset no further processes can be started, so it's safe to
+	// wait on the WaitGroup.
+	p.l.Lock()
+	p.ctx = nil
+	p.l.Unlock()
+
+	p.wg.Wait()
+
+	if canceled {
+		shutdown = Shutdown{
+			Reason: ShutdownReasonCanceled, Err: context.Cause(ctx),
+		}
+
+		p.l.Lock()
+		for _, proc := range p.procs {
+			if proc.stoppedBeforeRestart {
+				shutdown.StoppedBeforeRestart = append(
+					shutdown.StoppedBeforeRestart, proc.cfg.Name,
+				)
+			}
+		}
+		p.l.Unlock()
+	} else {
+		p.l.Lock()
+		shutdown = p.stoppedShutdown()
+		p.l.Unlock()
+	}
+
+	p.setShutdown(shutdown)
+
+	// processes are deregistered in the background as they exit.
+	if p.registry != nil {
+		p.registry.wait()
+	}
+
+	p.l.Lock()
+	events, stateWriter := p.events, p.stateWriter
+	p.events, p.stateWriter = nil, nil
+	p.l.Unlock()
+
+	if stateWriter != nil {
+		stateWriter.close()
+	}
+
+	if events != nil {
+		if dropped := events.close(); dropped > 0 {
+			sysLogger.Printf("dropped %d events which couldn't be written", dropped)
+		}
+	}
+
+	if p.otlp != nil {
+		exportCtx, cancel := context.WithTimeout(
+			context.Background(), 5*time.Second,
+		)
+		defer cancel()
+
+		// export the spans of the processes which were just stopped.
+		if err := p.otlp.export(exportCtx, nil); err != nil {
+			sysLogger.Printf("otlp: %v", err)
+		}
+	}
+}
+
+func (p *Pmux) addLoggers(loggers ...*logger) {
+	p.loggersL.Lock()
+	defer p.loggersL.Unlock()
+	p.loggers = append(p.loggers, loggers...)
+}
+
+func (p *Pmux) numRunning() int {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	var n int
+	for _, proc := range p.procs {
+		if proc.cancel != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// startProcess starts the handler for the given process in the background. It
+// must be called while p.l is held.
+func (p *Pmux) startProcess(proc *process) {
+
+	parentCtx := p.ctx
+	ctx, cancel := context.WithCancelCause(parentCtx)
+	doneCh := make(chan struct{})
+	proc.cancel, proc.doneCh = cancel, doneCh
+	proc.stopped = false
+	proc.stoppedBeforeRestart = false
+
+	handoff := proc.handoff
+	proc.handoff = nil
+
+	var (
+		adoptPID    int
+		adoptFiles  map[string]*os.File
+		adoptListen []*os.File
+	)
+	if handoff != nil {
+		adoptPID = handoff.PID
+		adoptFiles = make(map[string]*os.File, len(handoff.Outputs))
+		for i, name := range handoff.Outputs {
+			adoptFiles[name] = handoff.Files[i]
+		}
+
+		// the Listen config may have changed along with the rest of it, in
+		// which case the sockets are listened on afresh.
+		if len(handoff.ListenFiles) == len(proc.cfg.Listen) {
+			adoptListen = handoff.ListenFiles
+		} else {
+			closeFiles(handoff.ListenFiles)
+		}
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		defer func() {
+			gaveUp := ctx.Err() == nil
+			cancel(nil)
+
+			p.l.Lock()
+			proc.cancel = nil
+			proc.stopped = parentCtx.Err() == nil
+			p.saveState()
+			if gaveUp {
+				p.emitEvent(Event{Event: EventGiveUp, Process: proc.cfg.Name})
+			} else if proc.stopped {
+				p.emitEvent(Event{Event: EventStop, Process: proc.cfg.Name})
+			}
+			close(doneCh)
+			p.l.Unlock()
+
+			select {
+			case p.stoppedCh <- struct{}{}:
+			default:
+			}
+		}()
+
+		// a handed off process is already running, so adopting it mustn't be
+		// delayed.
+		if handoff == nil {
+			release, ok := p.waitToStart(ctx, proc)
+			if !ok {
+				return
+			}
+			defer release()
+		}
+
+		infof(proc.sysLogger, "starting process")
+		defer infof(proc.sysLogger, "stopped process handler")
+
+		// the sockets are listened on here, rather than by runProcess, so
+		// that they can be handed off while the process is using them.
+		listen := adoptListen
+		if len(proc.cfg.Listen) > 0 && listen == nil {
+			var err error
+			if listen, err = listenFiles(proc.cfg.Listen); err != nil {
+				proc.sysLogger.Printf("not starting process: %v", err)
+				return
+			}
+		}
+
+		p.l.Lock()
+		proc.listenFiles = listen
+		p.l.Unlock()
+
+		defer func() {
+			p.l.Lock()
+			proc.listenFiles = nil
+			p.l.Unlock()
+			closeFiles(listen)
+		}()
+
+		var secretEnv func(context.Context) (map[string]string, error)
+		if p.vault != nil && len(proc.cfg.Secrets) > 0 {
+			secretEnv = func(ctx context.Context) (map[string]string, error) {
+				return p.vault.secretEnv(ctx, proc.cfg)
+			}
+		}
+
+		runProcess(
+			ctx,
+			proc.stdoutLogger, proc.stderrLogger, proc.sysLogger,
+			proc.cfg,
+			runProcessOpts{
+				secretEnv:     secretEnv,
+				streamLoggers: proc.streamLoggers,
+				plugins:       p.cfg.Plugins,
+				waitRestart: func(ctx context.Context) bool {
+					return p.waitResumed(ctx, proc)
+				},
+				onStoppedBeforeRestart: func() {
+					p.l.Lock()
+					defer p.l.Unlock()
+					proc.stoppedBeforeRestart = parentCtx.Err() != nil
+				},
+				onStart: func(
+					osProc *os.Process, outputs map[string]*os.File,
+				) {
+					p.processStarted(proc, osProc, outputs)
+				},
+				onReady: func(osProc *os.Process) {
+					p.l.Lock()
+					defer p.l.Unlock()
+
+					// the instance has already passed its ready check, so
+					// there's no need to wait for processStarted's.
+					if proc.osProc == osProc {
+						proc.cancelReady()
+						p.processReady(proc, osProc, proc.instance)
+					}
+				},
+				onExit: func(
+					osProc *os.Process, state *os.ProcessState, stopCause error,
+				) {
+					p.processExited(proc, osProc, state, stopCause)
+				},
+				onSignalErr: func(osProc *os.Process, err error) {
+					p.l.Lock()
+					defer p.l.Unlock()
+					p.emitEvent(Event{
+						Event:   EventSignalFailed,
+						Process: proc.cfg.Name,
+						PID:     osProc.Pid,
+						Error:   err.Error(),
+					})
+				},
+				restartCh:   proc.restartCh,
+				backoff:     proc.backoff,
+				adoptPID:    adoptPID,
+				adoptFiles:  adoptFiles,
+				listenFiles: listen,
+				onBackoff: func(backoff backoffState) {
+					p.l.Lock()
+					defer p.l.Unlock()
+
+					if backoff.Restarts > proc.backoff.Restarts {
+						p.emitEvent(Event{
+							Event:    EventRestart,
+							Process:  proc.cfg.Name,
+							Restarts: backoff.Restarts,
+						})
+					}
+
+					proc.backoff = backoff
+					p.saveState()
+				},
+			},
+		)
+	}()
+}
+
+// waitToStart blocks until the given process may be started, taking into
+// account its StartDelay and the Config's MaxConcurrentStarts. It returns false
+// if the context was canceled while waiting.
+//
+// The returned function frees the start slot which was taken, if any. It's
+// also called by processReady or processExited, whichever comes first, and
+// may be called any number of times.
+func (p *Pmux) waitToStart(ctx context.Context, proc *process) (func(), bool) {
+
+	if d := proc.cfg.StartDelay; d > 0 {
+		infof(proc.sysLogger, "waiting %v before starting process", d)
+		afterCh, stop := after(proc.cfg.clock(), d)
+		defer stop()
+		select {
+		case <-afterCh:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	if p.startSem == nil {
+		return func() {}, true
+	}
+
+	select {
+	case p.startSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-p.startSem }) }
+
+	p.l.Lock()
+	proc.releaseStart = release
+	p.l.Unlock()
+
+	return release, true
+}
+
+func (p *Pmux) getProcess(name string) (*process, error) {
+
+	if p.ctx == nil {
+		return nil, ErrNotRunning
+	}
+
+	for _, proc := range p.procs {
+		if proc.cfg.Name == name {
+			return proc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no process named %q", name)
+}
+
+// StartProcess starts the process of the given name, if it is not already
+// running. This is generally used to start processes which have Autostart
+// disabled, or which have stopped of their own accord.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) StartProcess(name string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		return err
+	}
+
+	if proc.cancel != nil {
+		return fmt.Errorf("process %q is already running", name)
+	}
+
+	p.startProcess(proc)
+	return nil
+}
+
+// StopProcess stops the process of the given name without affecting any other
+// processes, and blocks until it has stopped. It won't be started again until
+// StartProcess is called, including by future runs of pmux if there's a
+// StateFile.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) StopProcess(name string) error {
+	p.l.Lock()
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		p.l.Unlock()
+		return err
+	}
+
+	if proc.cancel == nil {
+		p.l.Unlock()
+		return fmt.Errorf("process %q is not running", name)
+	}
+
+	proc.sysLogger.Println("stop requested, stopping process")
+	proc.cancel(stopErrorf("stop requested"))
+	p.stopRequested = true
+	doneCh := proc.doneCh
+
+	p.l.Unlock()
+
+	<-doneCh
+	return nil
+}
+
+// waitResumed blocks until restarts of the given process are not paused,
+// returning false if the context is canceled first.
+func (p *Pmux) waitResumed(ctx context.Context, proc *process) bool {
+
+	p.l.Lock()
+	resumeCh, handedOff := proc.resumeCh, p.handedOff
+	p.l.Unlock()
+
+	// once the processes have been handed off to another Pmux it's
+	// responsible for restarting them.
+	if handedOff {
+		<-ctx.Done()
+		return false
+	}
+
+	if resumeCh == nil {
+		return true
+	}
+
+	proc.sysLogger.Println("restarts are paused, waiting to be resumed")
+
+	select {
+	case <-resumeCh:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ProcessNames returns the names of all processes in the Config, in the order
+// they are defined. Processes with Replicas have the name of each replica
+// returned.
+func (p *Pmux) ProcessNames() []string {
+	procCfgs := p.cfg.ExpandProcesses().Processes
+	names := make([]string, len(procCfgs))
+	for i := range procCfgs {
+		names[i] = procCfgs[i].Name
+	}
+	return names
+}
+
+// PauseRestarts stops the process of the given name from being restarted if
+// it exits, until ResumeRestarts is called. If the process is currently
+// running it is not affected.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) PauseRestarts(name string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		return err
+	}
+
+	if proc.resumeCh == nil {
+		proc.resumeCh = make(chan struct{})
+		proc.sysLogger.Println("restarts paused")
+		p.saveState()
+	}
+
+	return nil
+}
+
+// ResumeRestarts undoes the effect of PauseRestarts for the process of the
+// given name. If the process was waiting to be restarted it will be restarted
+// immediately.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) ResumeRestarts(name string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		return err
+	}
+
+	if proc.resumeCh != nil {
+		close(proc.resumeCh)
+		proc.resumeCh = nil
+		proc.sysLogger.Println("restarts resumed")
+		p.saveState()
+	}
+
+	return nil
+}
+
+// signalProcess sends the given signal to the process group of the running
+// process of the given name. It must be called while p.l is held.
+func (p *Pmux) signalProcess(name string, sig syscall.Signal) (*process, error) {
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if proc.osProc == nil {
+		return nil, fmt.Errorf("process %q is not currently running", name)
+	}
+
+	// see sigProcessGroup for why the pid is negated.
+	if err := syscall.Kill(-proc.osProc.Pid, sig); err != nil {
+		return nil, fmt.Errorf(
+			"sending %v signal to process %q: %w", sig, name, err,
+		)
+	}
+
+	return proc, nil
+}
+
+// FreezeProcess sends a SIGSTOP to the process group of the process of the
+// given name, suspending it in place until ThawProcess is called.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) FreezeProcess(name string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.signalProcess(name, syscall.SIGSTOP)
+	if err != nil {
+		return err
+	}
+
+	proc.frozen = true
+	proc.sysLogger.Println("process frozen")
+	return nil
+}
+
+// ThawProcess sends a SIGCONT to the process group of the process of the given
+// name, undoing the effect of FreezeProcess.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) ThawProcess(name string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.signalProcess(name, syscall.SIGCONT)
+	if err != nil {
+		return err
+	}
+
+	proc.frozen = false
+	proc.sysLogger.Println("process thawed")
+	return nil
+}
+
+// processStarted is called when an instance of the process starts. It updates
+// the process's state and begins waiting for the instance to become ready in
+// the background.
+func (p *Pmux) processStarted(
+	proc *process, osProc *os.Process, outputs map[string]*os.File,
+) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if proc.cancelReady != nil {
+		proc.cancelReady()
+	}
+
+	proc.osProc, proc.frozen, proc.ready = osProc, false, false
+	proc.outputs = outputs
+	proc.startedAt, proc.timeToReady = proc.cfg.clock().Now(), 0
+	proc.instance++
+
+	p.emitEvent(Event{
+		Event: EventStart, Process: proc.cfg.Name, PID: osProc.Pid,
+	})
+
+	if p.otlp != nil {
+		if proc.spans == nil {
+			proc.spans = map[*os.Process]*otlpSpan{}
+		}
+		proc.spans[osProc] = p.otlp.startSpan(proc.cfg.Name, proc.cfg.Labels)
+	}
+	instance := proc.instance
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc.cancelReady = cancel
+
+	go func() {
+		if !waitReady(ctx, proc.cfg) {
+			return
+		}
+
+		p.l.Lock()
+		defer p.l.Unlock()
+		p.processReady(proc, osProc, instance)
+	}()
+}
+
+// processReady is called when an instance of the process becomes ready, see
+// processStarted. It must be called while p.l is held.
+func (p *Pmux) processReady(proc *process, osProc *os.Process, instance int) {
+
+	p.emitEvent(Event{
+		Event: EventReady, Process: proc.cfg.Name, PID: osProc.Pid,
+	})
+
+	if span := proc.spans[osProc]; span != nil {
+		span.Events = append(span.Events, otlpSpanEvent{
+			TimeUnixNano: otlpTime(time.Now()),
+			Name:         "ready",
+		})
+	}
+
+	if proc.instance == instance && proc.osProc != nil {
+		proc.ready = true
+		proc.timeToReady = proc.cfg.clock().Now().Sub(proc.startedAt)
+		infof(proc.sysLogger, "process is ready")
+		proc.releaseStartSlot()
+
+		if p.registry != nil && proc.cfg.Register != nil {
+			reg := proc.cfg.Register.withDefaults(
+				proc.cfg.Name, proc.replicaOf,
+			)
+			p.registry.set(proc.cfg.Name, proc.sysLogger, &reg)
+		}
+	}
+}
+
+// releaseStartSlot frees the process's start slot, if it still holds one, see
+// waitToStart. It must be called while p.l is held.
+func (proc *process) releaseStartSlot() {
+	if proc.releaseStart != nil {
+		proc.releaseStart()
+		proc.releaseStart = nil
+	}
+}
+
+// processExited is called when an instance of the process exits, stopCause
+// being the reason pmux stopped it, if it did. Its resource usage and exit
+// status are recorded, but if that instance has already been replaced by
+// another then nothing else is done.
+func (p *Pmux) processExited(
+	proc *process, osProc *os.Process, state *os.ProcessState, stopCause error,
+) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if state != nil {
+		usage := newResourceUsage(state)
+		proc.lastUsage = &usage
+
+		exit := newExitStatus(state)
+		exit.StopReason = stopReason(stopCause)
+		proc.lastExit, proc.runExit = &exit, &exit
+		p.saveState()
+	}
+
+	exitEvent := Event{
+		Event: EventExit, Process: proc.cfg.Name, PID: osProc.Pid,
+	}
+	if state != nil {
+		exitEvent.Exit = proc.lastExit
+	}
+	p.emitEvent(exitEvent)
+
+	if span := proc.spans[osProc]; span != nil {
+		var exit *ExitStatus
+		if state != nil {
+			exit = proc.lastExit
+		}
+		p.otlp.endSpan(span, exit)
+		delete(proc.spans, osProc)
+	}
+
+	if proc.osProc != osProc {
+		return
+	}
+
+	proc.cancelReady()
+	proc.releaseStartSlot()
+	proc.osProc, proc.frozen, proc.ready = nil, false, false
+	proc.outputs = nil
+
+	if p.registry != nil && proc.cfg.Register != nil {
+		p.registry.set(proc.cfg.Name, proc.sysLogger, nil)
+	}
+}
+
+// RestartProcess stops the running process of the given name and immediately
+// starts it again.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) RestartProcess(name string) error {
+	return p.restartProcess(name, stopErrorf("restart requested"))
+}
+
+// restartProcess is like RestartProcess, but gives the reason for the restart.
+func (p *Pmux) restartProcess(name string, reason *StopError) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	proc, err := p.getProcess(name)
+	if err != nil {
+		return err
+	}
+
+	if proc.osProc == nil {
+		return fmt.Errorf("process %q is not currently running", name)
+	}
+
+	select {
+	case proc.restartCh <- reason:
+	default:
+	}
+
+	return nil
+}
+
+// rollingRestartPollInterval is how often RollingRestart checks whether a
+// restarted replica has become ready.
+const rollingRestartPollInterval = 100 * time.Millisecond
+
+// rollingRestartReason is the reason given for restarting each replica during
+// a RollingRestart.
+var rollingRestartReason = stopErrorf("rolling restart requested")
+
+// RollingRestart restarts each replica of the process of the given name, one
+// at a time, waiting for each restarted replica to become ready (see
+// ReadyCheck) before moving on to the next. If the process doesn't have
+// replicas then this is equivalent to RestartProcess, but blocks until the
+// process is ready.
+//
+// If the context is canceled then RollingRestart returns its error, and no
+// further replicas are restarted.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) RollingRestart(ctx context.Context, name string) error {
+
+	p.l.Lock()
+
+	if p.ctx == nil {
+		p.l.Unlock()
+		return ErrNotRunning
+	}
+
+	var replicas []*process
+	for _, proc := range p.procs {
+		if proc.replicaOf == name {
+			replicas = append(replicas, proc)
+		}
+	}
+
+	p.l.Unlock()
+
+	if len(replicas) == 0 {
+		return fmt.Errorf("no process named %q", name)
+	}
+
+	for _, proc := range replicas {
+
+		p.l.Lock()
+		prevInstance := proc.instance
+		p.l.Unlock()
+
+		proc.sysLogger.Println("rolling restart: restarting replica")
+
+		if err := p.restartProcess(proc.cfg.Name, rollingRestartReason); err != nil {
+			return err
+		}
+
+		if err := p.waitRestartedReady(ctx, proc, prevInstance); err != nil {
+			return fmt.Errorf("restarting %q: %w", proc.cfg.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// waitRestartedReady blocks until the given process has been started since
+// the given instance, and that new instance is ready.
+func (p *Pmux) waitRestartedReady(
+	ctx context.Context, proc *process, prevInstance int,
+) error {
+
+	ticker := time.NewTicker(rollingRestartPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		p.l.Lock()
+		ready := proc.instance > prevInstance && proc.ready
+		stopped := proc.cancel == nil
+		p.l.Unlock()
+
+		if ready {
+			return nil
+		} else if stopped {
+			return errors.New("process stopped")
+		}
+	}
+}
@@ -4,48 +4,384 @@ package pmuxlib
 
 import (
 	"context"
+	"fmt"
 	"os"
-	"sync"
+	"time"
 )
 
 type Config struct {
-	TimeFormat string          `yaml:"timeFormat"`
-	Processes  []ProcessConfig `yaml:"processes"`
+	TimeFormat string          `yaml:"timeFormat,omitempty"`
+	Processes  []ProcessConfig `yaml:"processes,omitempty"`
+
+	// TimeZone is the time zone which timestamps written to stdout and stderr
+	// are in. It is either "local" (the default), "UTC", or the name of a
+	// zone in the IANA Time Zone database, e.g. "Europe/Berlin".
+	// LogFileTimeZone and SysLog.TimeZone override it for log files.
+	TimeZone        string `yaml:"timeZone,omitempty"`
+	LogFileTimeZone string `yaml:"logFileTimeZone,omitempty"`
+
+	// InstanceTag identifies this pmux, so that the logs of many hosts running
+	// the same config remain distinguishable once aggregated. It's included
+	// as the "instance" field of JSON output (see LogFormat), Events and the
+	// StatusFile, and, if InstanceTagPrefix is set, in the prefix of each
+	// line of text output, after the timestamp.
+	//
+	// InstanceTag defaults to the hostname.
+	InstanceTag       string `yaml:"instanceTag,omitempty"`
+	InstanceTagPrefix bool   `yaml:"instanceTagPrefix,omitempty"`
+
+	// Vars are made available to the templates within each ProcessConfig, see
+	// ExpandTemplates.
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Include lists glob patterns of further config files which should be
+	// merged into this one. Relative patterns are resolved relative to the
+	// directory of the file they are in. This is only used by the pmux binary
+	// when loading config files.
+	Include []string `yaml:"include,omitempty"`
+
+	// ControlSocket is the path of a unix socket which the pmux binary will
+	// listen on for commands (e.g. `pmux start <name>`) while it is running.
+	// If not set then no control socket is used.
+	ControlSocket string `yaml:"controlSocket,omitempty"`
+
+	// MaxConcurrentStarts limits the number of processes which may be starting
+	// at the same time. A process is considered to be starting until it first
+	// becomes ready (see ProcessConfig.ReadyCheck, which defaults to StartSecs
+	// having passed) or exits, whichever is sooner. If not set then there is
+	// no limit.
+	MaxConcurrentStarts int `yaml:"maxConcurrentStarts,omitempty"`
+
+	// StateFile is the path of a file which pmux will record the state of
+	// each process in (restart counts, backoff, last exit status, and whether
+	// restarts are paused or the process has stopped), and restore that state
+	// from when it starts. If not set then no state is persisted.
+	StateFile string `yaml:"stateFile,omitempty"`
+
+	// StatusFile is the path of a file which pmux will periodically write a
+	// JSON snapshot of the status of each process to, every StatusInterval.
+	// If not set then no status file is written.
+	//
+	// StatusInterval defaults to 5 seconds.
+	StatusFile     string        `yaml:"statusFile,omitempty"`
+	StatusInterval time.Duration `yaml:"statusInterval,omitempty"`
+
+	// Heartbeat, if set, causes pmux to log a summary of the state of all
+	// processes, including the uptime of each running process, this often.
+	// This shows that pmux itself is alive to anyone tailing its output.
+	Heartbeat time.Duration `yaml:"heartbeat,omitempty"`
+
+	// HealthAddr is a TCP address which the pmux binary will serve the health
+	// of each process on, at /procs/<name>/healthz (running and ready) and
+	// /procs/<name>/livez (running). If not set then no health endpoint is
+	// served.
+	HealthAddr string `yaml:"healthAddr,omitempty"`
+
+	// DebugAddr is a TCP address which the pmux binary will serve expvar
+	// counters (at /debug/vars) and pprof profiles (at /debug/pprof/) of
+	// pmux itself on. If not set then no debug endpoint is served.
+	DebugAddr string `yaml:"debugAddr,omitempty"`
+
+	// GRPCAddr is a TCP address which the pmux binary will serve its gRPC API
+	// on (see pmux.proto in the pmuxpb package), which provides the same
+	// operations as the control socket, as well as streams of process output
+	// and lifecycle events. Unless APIAuth is configured it is
+	// unauthenticated, so should only be bound to a trusted interface. If not
+	// set then no gRPC API is served.
+	GRPCAddr string `yaml:"grpcAddr,omitempty"`
+
+	// DashboardAddr is a TCP address which the pmux binary will serve a web
+	// dashboard on, showing the state and restart history of each process and
+	// their live output, with buttons for starting, restarting, etc. each
+	// process. Its API requires one of the APIAuth Tokens, which must be
+	// given. It's served over TLS if APIAuth.TLS is given, which is required
+	// unless its host is "localhost" or a loopback address, so that tokens
+	// aren't sent over the network in plaintext. If not set then no dashboard
+	// is served.
+	DashboardAddr string `yaml:"dashboardAddr,omitempty"`
+
+	// DashboardHosts lists the host names, besides IP addresses, "localhost"
+	// and the host of DashboardAddr, which the dashboard may be reached by.
+	// Requests whose Host header names any other host are rejected, so that
+	// other sites can't reach the dashboard by rebinding their DNS names to
+	// its address.
+	DashboardHosts []string `yaml:"dashboardHosts,omitempty"`
+
+	// APIAuth configures how clients of the control socket and gRPC API are
+	// authenticated and authorized.
+	APIAuth APIAuthConfig `yaml:"apiAuth,omitempty"`
+
+	// Verbosity determines which messages about each process are logged, see
+	// the Verbosity type. It can be overridden per process.
+	//
+	// Defaults to VerbosityNormal.
+	Verbosity Verbosity `yaml:"verbosity,omitempty"`
+
+	// LogFormat is either "text" (the default), or "json", in which case each
+	// line of output of the processes, and each message pmux logs about them,
+	// is written as a JSON object with "time", "instance", "process", "msg",
+	// and, if the process has LogLevels, "level" fields. This also applies to
+	// LogFiles.
+	LogFormat string `yaml:"logFormat,omitempty"`
+
+	// Raw determines whether the output of processes is written as-is, without
+	// being prefixed by a timestamp and process name, and without the banners
+	// pmux logs when starting and exiting. This allows pmux to wrap a single
+	// process, e.g. within a container, without altering its log format.
+	// Messages which pmux logs about processes are still written to stderr,
+	// prefixed by "pmux:", unless SysLog sends them elsewhere.
+	//
+	// Defaults to being enabled when there is exactly one process to run, and
+	// LogFormat isn't "json".
+	Raw *bool `yaml:"raw,omitempty"`
+
+	// SysLog can be used to send the messages pmux logs about processes to a
+	// different destination, and in a different format, than their output.
+	SysLog SysLogConfig `yaml:"sysLog,omitempty"`
+
+	// LogRotation configures the rotation of all log files which pmux writes
+	// (see SysLog and ProcessConfig.LogFile). If not set then log files are not
+	// rotated by pmux.
+	LogRotation LogRotationConfig `yaml:"logRotation,omitempty"`
+
+	// Events is where newline-delimited JSON Events describing the lifecycle
+	// of each process are written to. It is either "fd:<n>", to write to an
+	// already open file descriptor (e.g. "fd:3"), or the path of a file or
+	// named pipe. If not set then no events are written.
+	Events string `yaml:"events,omitempty"`
+
+	// OTLP configures the export of metrics and traces describing the
+	// processes to an OpenTelemetry collector.
+	OTLP OTLPConfig `yaml:"otlp,omitempty"`
+
+	// Vault configures how the Secrets of each process are fetched. It is
+	// only used if at least one process has Secrets.
+	Vault VaultConfig `yaml:"vault,omitempty"`
+
+	// Registry configures the service registry which processes are
+	// registered in, see ProcessConfig.Register.
+	Registry RegistryConfig `yaml:"registry,omitempty"`
+
+	// Plugins are executables which are called at points in the lifecycle of
+	// pmux and its processes, see PluginConfig.
+	Plugins []PluginConfig `yaml:"plugins,omitempty"`
 }
 
-// Run runs the given configuration as if this was a real pmux process. It will
-// block until the context is canceled and all child processes have been cleaned
-// up.
-func Run(ctx context.Context, cfg Config) {
+// WithDefaults returns a copy of the Config with the default value filled in
+// for each unset field which has one.
+func (cfg Config) WithDefaults() Config {
+	procs := make([]ProcessConfig, len(cfg.Processes))
+	for i := range cfg.Processes {
+		procs[i] = cfg.Processes[i].withDefaults()
+	}
+	cfg.Processes = procs
+
+	if cfg.StatusInterval == 0 {
+		cfg.StatusInterval = 5 * time.Second
+	}
+
+	cfg.OTLP = cfg.OTLP.withDefaults()
+
+	return cfg
+}
+
+// ExpandProcesses returns a copy of the Config with its processes expanded in
+// the same way as when they're run: those with a Matrix are expanded (see
+// ProcessConfig.Matrix), and then each ProcessConfig which has Replicas
+// greater than 1 is replaced by that many replicas of itself.
+func (cfg Config) ExpandProcesses() Config {
+
+	cfg = cfg.expandMatrix()
+
+	var procs []ProcessConfig
+
+	for _, procCfg := range cfg.Processes {
+
+		if procCfg.Replicas <= 1 {
+			procs = append(procs, procCfg)
+			continue
+		}
+
+		for i := 0; i < procCfg.Replicas; i++ {
+			replicaCfg := procCfg
+			replicaCfg.Name = fmt.Sprintf("%s.%d", procCfg.Name, i)
+			replicaCfg.replica = i
+
+			procs = append(procs, replicaCfg)
+		}
+	}
+
+	cfg.Processes = procs
+	return cfg
+}
+
+// raw returns whether output should be written as-is, see Raw.
+func (cfg Config) raw() bool {
+	if cfg.Raw != nil {
+		return *cfg.Raw
+	}
+	return cfg.LogFormat != SysLogFormatJSON &&
+		len(cfg.ExpandProcesses().Processes) == 1
+}
+
+// instanceTag returns the InstanceTag, or the hostname if it's not set.
+func (cfg Config) instanceTag() string {
+	if cfg.InstanceTag != "" {
+		return cfg.InstanceTag
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// Merge returns a Config which is the result of merging the given Config on
+// top of this one. Processes and Plugins are appended, Vars are merged key-wise, and all
+// other fields of the given Config override those of this one if set.
+func (cfg Config) Merge(o Config) Config {
+
+	if o.TimeFormat != "" {
+		cfg.TimeFormat = o.TimeFormat
+	}
+
+	if o.TimeZone != "" {
+		cfg.TimeZone = o.TimeZone
+	}
+
+	if o.LogFileTimeZone != "" {
+		cfg.LogFileTimeZone = o.LogFileTimeZone
+	}
+
+	if o.InstanceTag != "" {
+		cfg.InstanceTag = o.InstanceTag
+	}
+
+	if o.InstanceTagPrefix {
+		cfg.InstanceTagPrefix = o.InstanceTagPrefix
+	}
+
+	if o.ControlSocket != "" {
+		cfg.ControlSocket = o.ControlSocket
+	}
+
+	if o.MaxConcurrentStarts != 0 {
+		cfg.MaxConcurrentStarts = o.MaxConcurrentStarts
+	}
+
+	if o.StateFile != "" {
+		cfg.StateFile = o.StateFile
+	}
+
+	if o.StatusFile != "" {
+		cfg.StatusFile = o.StatusFile
+	}
+
+	if o.StatusInterval != 0 {
+		cfg.StatusInterval = o.StatusInterval
+	}
 
-	stdoutLogger := newLogger(os.Stdout, logSepStdout, cfg.TimeFormat)
-	defer stdoutLogger.Close()
+	if o.Heartbeat != 0 {
+		cfg.Heartbeat = o.Heartbeat
+	}
 
-	stderrLogger := newLogger(os.Stderr, logSepStderr, cfg.TimeFormat)
-	defer stderrLogger.Close()
+	if o.HealthAddr != "" {
+		cfg.HealthAddr = o.HealthAddr
+	}
+
+	if o.DebugAddr != "" {
+		cfg.DebugAddr = o.DebugAddr
+	}
 
-	sysLogger := stderrLogger.withSep(logSepSys)
-	defer sysLogger.Println("exited gracefully, ciao!")
+	if o.GRPCAddr != "" {
+		cfg.GRPCAddr = o.GRPCAddr
+	}
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	if o.DashboardAddr != "" {
+		cfg.DashboardAddr = o.DashboardAddr
+	}
 
-	for _, cfgProc := range cfg.Processes {
-		wg.Add(1)
-		go func(procCfg ProcessConfig) {
-			defer wg.Done()
+	if len(o.DashboardHosts) > 0 {
+		cfg.DashboardHosts = o.DashboardHosts
+	}
 
-			stdoutLogger := stdoutLogger.withPName(procCfg.Name)
-			stderrLogger := stderrLogger.withPName(procCfg.Name)
-			sysLogger := sysLogger.withPName(procCfg.Name)
+	if len(o.APIAuth.Tokens) > 0 || o.APIAuth.TLS != nil {
+		cfg.APIAuth = o.APIAuth
+	}
 
-			sysLogger.Println("starting process")
-			defer sysLogger.Println("stopped process handler")
+	if o.Verbosity != "" {
+		cfg.Verbosity = o.Verbosity
+	}
 
-			RunProcess(
-				ctx, stdoutLogger, stderrLogger, sysLogger, procCfg,
-			)
+	if o.LogFormat != "" {
+		cfg.LogFormat = o.LogFormat
+	}
 
-		}(cfgProc)
+	if o.Raw != nil {
+		cfg.Raw = o.Raw
 	}
+
+	if o.SysLog.Path != "" {
+		cfg.SysLog.Path = o.SysLog.Path
+	}
+
+	if o.SysLog.Format != "" {
+		cfg.SysLog.Format = o.SysLog.Format
+	}
+
+	if o.SysLog.TimeZone != "" {
+		cfg.SysLog.TimeZone = o.SysLog.TimeZone
+	}
+
+	if o.LogRotation != (LogRotationConfig{}) {
+		cfg.LogRotation = o.LogRotation
+	}
+
+	if o.Events != "" {
+		cfg.Events = o.Events
+	}
+
+	if o.OTLP.Endpoint != "" {
+		cfg.OTLP = o.OTLP
+	}
+
+	if o.Vault != (VaultConfig{}) {
+		cfg.Vault = o.Vault
+	}
+
+	if o.Registry != (RegistryConfig{}) {
+		cfg.Registry = o.Registry
+	}
+
+	procs := make([]ProcessConfig, 0, len(cfg.Processes)+len(o.Processes))
+	procs = append(procs, cfg.Processes...)
+	cfg.Processes = append(procs, o.Processes...)
+
+	plugins := make([]PluginConfig, 0, len(cfg.Plugins)+len(o.Plugins))
+	plugins = append(plugins, cfg.Plugins...)
+	cfg.Plugins = append(plugins, o.Plugins...)
+
+	if len(o.Vars) > 0 {
+		vars := make(map[string]string, len(cfg.Vars)+len(o.Vars))
+		for k, v := range cfg.Vars {
+			vars[k] = v
+		}
+		for k, v := range o.Vars {
+			vars[k] = v
+		}
+		cfg.Vars = vars
+	}
+
+	include := make([]string, 0, len(cfg.Include)+len(o.Include))
+	include = append(include, cfg.Include...)
+	cfg.Include = append(include, o.Include...)
+
+	return cfg
+}
+
+// Run runs the given configuration as if this was a real pmux process. It will
+// block until the context is canceled and all child processes have been cleaned
+// up.
+//
+// If the templates within the Config fail to expand then the error is logged
+// and Run returns immediately, without starting any processes.
+func Run(ctx context.Context, cfg Config) {
+	NewPmux(cfg).Run(ctx)
 }
@@ -0,0 +1,106 @@
+package pmuxlib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigMerge(t *testing.T) {
+
+	tests := []struct {
+		name string
+		a, b Config
+		exp  Config
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "unset fields are kept",
+			a:    Config{TimeFormat: "15:04", Vars: map[string]string{"a": "1"}},
+			b:    Config{},
+			exp:  Config{TimeFormat: "15:04", Vars: map[string]string{"a": "1"}},
+		},
+		{
+			name: "set fields override",
+			a:    Config{TimeFormat: "15:04"},
+			b:    Config{TimeFormat: "15:04:05"},
+			exp:  Config{TimeFormat: "15:04:05"},
+		},
+		{
+			name: "processes, plugins and includes are appended",
+			a: Config{
+				Processes: []ProcessConfig{{Name: "a"}},
+				Plugins:   []PluginConfig{{Name: "p"}},
+				Include:   []string{"a.yml"},
+			},
+			b: Config{
+				Processes: []ProcessConfig{{Name: "b"}},
+				Include:   []string{"b.yml"},
+			},
+			exp: Config{
+				Processes: []ProcessConfig{{Name: "a"}, {Name: "b"}},
+				Plugins:   []PluginConfig{{Name: "p"}},
+				Include:   []string{"a.yml", "b.yml"},
+			},
+		},
+		{
+			name: "sysLog fields are merged individually",
+			a:    Config{SysLog: SysLogConfig{Path: "/var/log/pmux.log"}},
+			b:    Config{SysLog: SysLogConfig{Format: SysLogFormatJSON}},
+			exp: Config{SysLog: SysLogConfig{
+				Path:   "/var/log/pmux.log",
+				Format: SysLogFormatJSON,
+			}},
+		},
+		{
+			name: "vars are merged key-wise",
+			a:    Config{Vars: map[string]string{"a": "1", "b": "2"}},
+			b:    Config{Vars: map[string]string{"b": "3", "c": "4"}},
+			exp:  Config{Vars: map[string]string{"a": "1", "b": "3", "c": "4"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.a.Merge(test.b)
+
+			// empty slices and nil slices are equivalent.
+			for _, pair := range []struct{ got, exp interface{} }{
+				{got.Processes, test.exp.Processes},
+				{got.Plugins, test.exp.Plugins},
+				{got.Include, test.exp.Include},
+			} {
+				if reflect.ValueOf(pair.got).Len() == 0 &&
+					reflect.ValueOf(pair.exp).Len() == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(pair.got, pair.exp) {
+					t.Fatalf("expected %+v, got %+v", pair.exp, pair.got)
+				}
+			}
+
+			got.Processes, got.Plugins, got.Include = nil, nil, nil
+			test.exp.Processes, test.exp.Plugins, test.exp.Include = nil, nil, nil
+
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Fatalf("expected:\n%+v\ngot:\n%+v", test.exp, got)
+			}
+		})
+	}
+
+	t.Run("does not modify the receiver", func(t *testing.T) {
+		a := Config{
+			Processes: make([]ProcessConfig, 1, 2),
+			Vars:      map[string]string{"a": "1"},
+		}
+		_ = a.Merge(Config{
+			Processes: []ProcessConfig{{Name: "b"}},
+			Vars:      map[string]string{"a": "2"},
+		})
+
+		if a.Processes[:2][1].Name != "" || a.Vars["a"] != "1" {
+			t.Fatal("receiver was modified")
+		}
+	})
+}
@@ -8,46 +8,463 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
+// RestartStrategy describes how a running process is restarted.
+type RestartStrategy string
+
+// Enumeration of possible RestartStrategy values.
+const (
+	// RestartStrategyStopFirst stops the running process before starting its
+	// replacement.
+	RestartStrategyStopFirst RestartStrategy = "stopFirst"
+
+	// RestartStrategyBlueGreen starts the replacement process, waits for it to
+	// be ready (see ReadyCheck), and only then stops the old process. This
+	// generally requires the process to support SO_REUSEPORT, or some other
+	// mechanism of sharing its listening sockets.
+	RestartStrategyBlueGreen RestartStrategy = "blueGreen"
+)
+
+// OutputStream describes where a stream of a process's output is logged.
+type OutputStream string
+
+// Enumeration of possible OutputStream values.
+const (
+	OutputStreamStdout  OutputStream = "stdout"
+	OutputStreamStderr  OutputStream = "stderr"
+	OutputStreamDiscard OutputStream = "discard"
+)
+
 // ProcessConfig is used to configure a process via RunProcess.
 type ProcessConfig struct {
 
 	// Name of the process to be run. This only gets used by RunPmux.
-	Name string
+	Name string `yaml:"name,omitempty"`
+
+	// Labels are arbitrary key/value pairs describing the process (e.g.
+	// "tier: web"). They are included in the process's status, its JSON log
+	// lines, and its OTLP metrics and spans, and processes can be selected by
+	// them using a LabelSelector. This only gets used by RunPmux.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// StartDelay is the amount of time pmux will wait before starting the
+	// process for the first time. This only gets used by Pmux.
+	StartDelay time.Duration `yaml:"startDelay,omitempty"`
+
+	// Autostart indicates whether the process should be started as soon as
+	// pmux is. If set to false then the process will only be started when
+	// explicitly requested, see Pmux.StartProcess.
+	//
+	// Defaults to true.
+	Autostart *bool `yaml:"autostart,omitempty"`
+
+	// AdoptPIDFile is the path of a pidfile which, if it names a process which
+	// is running when the process is first started, causes that process to be
+	// adopted rather than a new one started. This eases migrating from init
+	// scripts without downtime. An adopted process is monitored and stopped
+	// like any other, but its output isn't captured, its exit status can't be
+	// known, and its preStart and postStart hooks aren't run. Once it exits it
+	// is restarted as normal, by starting a new process.
+	//
+	// On linux, a process which was started after the pidfile was last
+	// written isn't adopted, as its PID has likely been reused.
+	AdoptPIDFile string `yaml:"adoptPIDFile,omitempty"`
+
+	// Profiles, if given, causes the process to only be run by the pmux binary
+	// when one of these profiles is activated using the -profile flag.
+	Profiles []string `yaml:"profiles,omitempty"`
 
 	// Cmd and Args describe the actual process to run.
-	Cmd  string   `yaml:"cmd"`
-	Args []string `yaml:"args"`
+	Cmd  string `yaml:"cmd,omitempty"`
+	Args Args   `yaml:"args,omitempty"`
+
+	// Type determines how the process is run. If it's ProcessTypeContainer
+	// then the process is run within the container described by Container,
+	// and Cmd is optional. If it's ProcessTypePipeline then the process runs
+	// the steps described by Pipeline, in place of Cmd.
+	//
+	// Defaults to ProcessTypeExec.
+	Type      ProcessType     `yaml:"type,omitempty"`
+	Container ContainerConfig `yaml:"container,omitempty"`
+	Pipeline  PipelineConfig  `yaml:"pipeline,omitempty"`
+
+	// FallbackCmd and FallbackArgs, if set, are run in place of Cmd and Args
+	// once the process has failed to start FallbackAfter times in a row (see
+	// StartSecs), e.g. to serve a maintenance page while an app won't boot.
+	// While the fallback is running, Cmd is tried again every FallbackRetry,
+	// and if it fails to start then the fallback is returned to.
+	//
+	// FallbackAfter defaults to 3, and FallbackRetry to 5 minutes.
+	FallbackCmd   string        `yaml:"fallbackCmd,omitempty"`
+	FallbackArgs  Args          `yaml:"fallbackArgs,omitempty"`
+	FallbackAfter int           `yaml:"fallbackAfter,omitempty"`
+	FallbackRetry time.Duration `yaml:"fallbackRetry,omitempty"`
+
+	// CmdNotFoundFatal causes the process to not be restarted if its Cmd
+	// can't be found when it's started, rather than pmux retrying the start
+	// with the usual backoff, in case the command is installed later.
+	CmdNotFoundFatal bool `yaml:"cmdNotFoundFatal,omitempty"`
+
+	// Shell indicates that Cmd is a shell script rather than a path to an
+	// executable, and should be run using "/bin/sh -c". In this case Args, if
+	// any, are passed to the script as its positional parameters ($1, $2, ...)
+	// and $0 is set to the process Name.
+	Shell bool `yaml:"shell,omitempty"`
 
 	// Env describes the environment variables to set on the process.
-	Env map[string]string `yaml:"env"`
+	//
+	// Regardless of Env and ClearEnv, the process is also given PMUX_NAME (its
+	// Name), PMUX_RESTART_COUNT, PMUX_START_TIME (in RFC 3339 format), and, if
+	// it's one of a process's Replicas, PMUX_REPLICA_INDEX.
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// EnvFrom describes further environment variables to set on the process,
+	// whose values are sourced from files, commands, or secret managers each
+	// time the process is started, see EnvValue. These are only given to the
+	// process itself and its preStart and postStart hooks, and take
+	// precedence over Env.
+	EnvFrom map[string]EnvValue `yaml:"envFrom,omitempty"`
+
+	// ClearEnv causes the process to not inherit the environment of pmux,
+	// other than the variables named in PassEnv. Env is applied regardless.
+	ClearEnv bool     `yaml:"clearEnv,omitempty"`
+	PassEnv  []string `yaml:"passEnv,omitempty"`
+
+	// TZ and Lang, if set, are the TZ and LANG environment variables of the
+	// process, e.g. "Europe/Berlin" and "en_US.UTF-8". Path lists directories
+	// which are prepended to the process's PATH, in order. These are applied
+	// on top of Env.
+	TZ   string   `yaml:"tz,omitempty"`
+	Lang string   `yaml:"lang,omitempty"`
+	Path []string `yaml:"path,omitempty"`
+
+	// Secrets are fetched from Vault (see Config.Vault) each time the process
+	// is started, and given to it as environment variables or files. They are
+	// only used when the process is run by Pmux.
+	Secrets []SecretConfig `yaml:"secrets,omitempty"`
 
 	// Dir is the directory the process will be run in. If not set then the
-	// process is run in the same directory as this parent process.
-	Dir string `yaml:"dir"`
+	// process is run in the same directory as this parent process. If Chroot
+	// is set then Dir is interpreted relative to the new root.
+	Dir string `yaml:"dir,omitempty"`
+
+	// CreateDir causes Dir, and any of its parents, to be created before each
+	// start of the process if they don't already exist. DirMode is the octal
+	// mode they're created with (e.g. "0750"), and DirOwner is the
+	// "user[:group]" which owns them.
+	//
+	// DirMode defaults to "0755", and DirOwner to the process's User and
+	// Group.
+	CreateDir bool   `yaml:"createDir,omitempty"`
+	DirMode   string `yaml:"dirMode,omitempty"`
+	DirOwner  string `yaml:"dirOwner,omitempty"`
+
+	// Chroot, if set, is the directory which the process will use as its root
+	// directory. Using this generally requires that pmux be run as root.
+	// Cmd is resolved within it, see ResolveCmd.
+	//
+	// There's no separate rootDir option: Chroot is the root directory (what
+	// systemd calls RootDirectory), and Dir is the working directory within
+	// it, so a rootDir would only duplicate one or the other.
+	Chroot string `yaml:"chroot,omitempty"`
+
+	// Setsid causes the process to be started in a new session, detached from
+	// the controlling terminal of pmux, rather than only in a new process
+	// group within pmux's session. This is needed by some daemons which
+	// misbehave when they share a session with their parent.
+	//
+	// Either way the process leads its own process group, whose ID is its PID,
+	// and it's that process group which pmux signals when stopping the
+	// process, so that descendants which remain in it are stopped too.
+	Setsid bool `yaml:"setsid,omitempty"`
+
+	// User and Group, if set, are the user and group (either names or numeric
+	// ids) which the process will be run as. If User is set but Group is not
+	// then the primary group of the User is used. Using these generally
+	// requires that pmux be run as root.
+	User  string `yaml:"user,omitempty"`
+	Group string `yaml:"group,omitempty"`
+
+	// AmbientCaps lists linux capabilities (e.g. "NET_BIND_SERVICE") which the
+	// process should retain. This is only useful when pmux is run as root and
+	// User is set to a non-root user, in which case all capabilities not listed
+	// here are dropped.
+	AmbientCaps []string `yaml:"ambientCaps,omitempty"`
+
+	// DropCaps lists linux capabilities which are removed from the process's
+	// bounding set, so that it can never hold them, even when it's run as
+	// root. A capability can't be in both AmbientCaps and DropCaps.
+	DropCaps []string `yaml:"dropCaps,omitempty"`
 
 	// MinWait and MaxWait are the minimum and maximum amount of time between
 	// restarts that RunProcess will wait.
 	//
 	// MinWait defaults to 1 second.
 	// MaxWait defaults to 64 seconds.
-	MinWait time.Duration `yaml:"minWait"`
-	MaxWait time.Duration `yaml:"maxWait"`
+	MinWait time.Duration `yaml:"minWait,omitempty"`
+	MaxWait time.Duration `yaml:"maxWait,omitempty"`
+
+	// StartSecs is the amount of time the process must stay running for its
+	// start to be considered successful. If it exits any sooner then this is
+	// considered a failed start, and the wait time until the next restart is
+	// doubled (up to MaxWait). If it exits after StartSecs then the wait time is
+	// reset to MinWait.
+	//
+	// Defaults to 1 second.
+	StartSecs time.Duration `yaml:"startSecs,omitempty"`
+
+	// MaxRestarts, if set, is the number of consecutive failed starts (see
+	// StartSecs) after which RunProcess gives up on restarting the process.
+	MaxRestarts int `yaml:"maxRestarts,omitempty"`
+
+	// Backoff overrides MinWait and MaxWait depending on why the process
+	// exited, e.g. so that clean exits are restarted immediately while
+	// crashes are backed off for longer. Each ExitClass given here has its own
+	// wait time which is doubled upon failed starts, while all other classes
+	// share one.
+	Backoff map[ExitClass]BackoffConfig `yaml:"backoff,omitempty"`
+
+	// ReadyCheck configures how pmux determines that the process has finished
+	// starting, which is used when performing a rolling restart. This only
+	// gets used by Pmux.
+	ReadyCheck ReadyCheckConfig `yaml:"readyCheck,omitempty"`
+
+	// WaitFor lists conditions which must each be met, in order, before each
+	// start of the process, e.g. a database port accepting connections.
+	WaitFor []WaitForConfig `yaml:"waitFor,omitempty"`
+
+	// Hooks describes commands which should be run at various points in the
+	// process's lifecycle.
+	Hooks HooksConfig `yaml:"hooks,omitempty"`
+
+	// Register, if set, causes the process to be registered as a service in
+	// the registry given by Config.Registry while it's ready. This only gets
+	// used by Pmux.
+	Register *ServiceRegistration `yaml:"register,omitempty"`
+
+	// Listen describes sockets which pmux will listen on and pass to the
+	// process, using the same environment variables as systemd's socket
+	// activation (LISTEN_FDS, LISTEN_PID, LISTEN_FDNAMES). The sockets are kept
+	// open across restarts of the process, and can be bound to privileged
+	// ports even if the process is run as a non-root User.
+	//
+	// Passing sockets requires that "/bin/sh" be available to the process.
+	Listen []ListenConfig `yaml:"listen,omitempty"`
+
+	// Watch lists files and directories which, if changed, will cause the
+	// process to be restarted. Directories are watched recursively. Paths
+	// matching any of the glob patterns in WatchIgnore, either by their full
+	// path or their base name, are ignored.
+	//
+	// The restart happens once WatchDebounce has elapsed without any further
+	// changes being detected, which defaults to 500 milliseconds.
+	Watch         []string      `yaml:"watch,omitempty"`
+	WatchIgnore   []string      `yaml:"watchIgnore,omitempty"`
+	WatchDebounce time.Duration `yaml:"watchDebounce,omitempty"`
+
+	// MaxRunTime, if set, causes the process to be restarted (according to
+	// its RestartStrategy) once it has been running for this long, e.g. to
+	// work around a memory leak.
+	MaxRunTime time.Duration `yaml:"maxRunTime,omitempty"`
+
+	// RestartWindow and NoRestartDuring constrain when non-urgent restarts,
+	// those due to MaxRunTime or to rotated Vault secrets, may happen. If
+	// RestartWindow is set then they only happen within it, and they never
+	// happen within NoRestartDuring. Restarts due to the process exiting, or
+	// which are explicitly requested, always happen immediately.
+	RestartWindow   TimeWindow `yaml:"restartWindow,omitempty"`
+	NoRestartDuring TimeWindow `yaml:"noRestartDuring,omitempty"`
+
+	// RestartStrategy determines how the process is restarted when a restart
+	// is explicitly requested (e.g. via Pmux.RestartProcess).
+	//
+	// Defaults to RestartStrategyStopFirst.
+	RestartStrategy RestartStrategy `yaml:"restartStrategy,omitempty"`
+
+	// Replicas, if greater than 1, causes Pmux to run that many copies of the
+	// process. Each replica is named "<name>.<n>", where n starts at 0, and
+	// has the PMUX_REPLICA_INDEX environment variable set to its n.
+	Replicas int `yaml:"replicas,omitempty"`
+
+	// replica is the n of the replica, if this ProcessConfig is a replica.
+	replica int
+
+	// Matrix, if set, causes the process to be replaced by one process for
+	// each combination of the values of its keys, e.g. a Matrix of
+	// {shard: 0..1, region: [us, eu]} gives four processes. Each is named
+	// "<name>.<value>...", with the values in the order of their sorted keys
+	// (e.g. "<name>.eu.0"), and has the "PMUX_MATRIX_<KEY>" environment
+	// variable set to its value of each key. The values are also available to
+	// templates, see TemplateData.Matrix. Replicas, if set, applies to each of
+	// the processes.
+	Matrix map[string]MatrixValues `yaml:"matrix,omitempty"`
+
+	// matrix holds the value of each key of the Matrix, if this ProcessConfig
+	// is one of a Matrix's processes.
+	matrix map[string]string
+
+	// instance is the Config.InstanceTag of the Pmux running the process, if
+	// any, see ContainerConfig.Name.
+	instance string
+
+	// CrashReport can be used to have a report file written each time the
+	// process crashes.
+	CrashReport CrashReportConfig `yaml:"crashReport,omitempty"`
+
+	// CircuitBreaker can be used to stop the process from being restarted for
+	// a cooldown period when it is caught in a crash loop.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker,omitempty"`
 
 	// SigKillWait is the amount of time after the process is sent a SIGINT
 	// before RunProcess sends it a SIGKILL.
 	//
 	// Defalts to 10 seconds.
-	SigKillWait time.Duration `yaml:"sigKillWait"`
+	SigKillWait time.Duration `yaml:"sigKillWait,omitempty"`
+
+	// OutputWait is the longest that pmux will continue reading the output of
+	// the process (its stdout, stderr, and Streams) once the process has
+	// exited. Descendants of the process (e.g. daemons which it forks) inherit
+	// its output, and may otherwise prevent the process from being restarted
+	// for as long as they run. Once OutputWait has elapsed their further
+	// output is discarded, and they may be sent SIGPIPE if they write any.
+	//
+	// Defaults to 2 seconds.
+	OutputWait time.Duration `yaml:"outputWait,omitempty"`
+
+	// KillTree causes every descendant of the process to be signalled when
+	// the process is stopped, rather than only those in its process group,
+	// which descendants can leave (e.g. using setsid). Descendants which are
+	// still running once the process has exited are sent SIGKILL.
+	//
+	// Where pmux is able to create cgroups (cgroup v2, with pmux being allowed
+	// to write to its own cgroup, e.g. as root or using systemd's
+	// Delegate=yes), the process is started in a cgroup of its own, so that
+	// all of its descendants are found, including those which were orphaned
+	// (e.g. double-forked daemons). Otherwise descendants are found each time
+	// the process is signalled, so those which were orphaned before it was
+	// stopped aren't. This is only supported on Linux.
+	KillTree bool `yaml:"killTree,omitempty"`
+
+	// LingeringOutput determines what is done when output of the process is
+	// still open once OutputWait has elapsed, see LingeringOutputAction. The
+	// PIDs of the processes holding it open are logged, where supported.
+	//
+	// Defaults to LingeringOutputClose.
+	LingeringOutput LingeringOutputAction `yaml:"lingeringOutput,omitempty"`
+
+	// OneShot indicates that the process is expected to exit once it has done
+	// its work. If it exits with exit code 0 then it has completed, and isn't
+	// restarted (regardless of RestartDecider, Scripts, or plugins), while
+	// other exits are subject to the restart policy as usual.
+	OneShot bool `yaml:"oneShot,omitempty"`
+
+	// Retries, if set, is the number of times that a OneShot process is
+	// retried after failing, RetryWait apart, after which it's given up on.
+	// This replaces the backoff (MinWait, MaxWait, StartSecs, Backoff and
+	// MaxRestarts) and CircuitBreaker, which are intended for long-running
+	// processes.
+	//
+	// RetryWait defaults to 1 second.
+	Retries   int           `yaml:"retries,omitempty"`
+	RetryWait time.Duration `yaml:"retryWait,omitempty"`
 
 	// NoRestartOn indicates which exit codes should result in the process not
 	// being restarted any further.
-	NoRestartOn []int `yaml:"noRestartOn"`
+	NoRestartOn []int `yaml:"noRestartOn,omitempty"`
+
+	// NoRestartOnExit is like NoRestartOn, but each may also be a range of
+	// exit codes, the name of a signal, or a keyword, see ExitMatcher.
+	NoRestartOnExit []ExitMatcher `yaml:"noRestartOnExit,omitempty"`
+
+	// Scripts customize the decisions made about the process, such as whether
+	// it's restarted, see ScriptsConfig.
+	Scripts ScriptsConfig `yaml:"scripts,omitempty"`
+
+	// RestartDecider, if set, overrides the built-in restart policy, see the
+	// RestartDecider type. It can't be given in a config file.
+	RestartDecider RestartDecider `yaml:"-"`
+
+	// ModifyCmd, if set, is called with the exec.Cmd of each run of the
+	// process right before it is started, and may set fields of it which
+	// pmux doesn't otherwise configure, e.g. ExtraFiles or SysProcAttr. If it
+	// returns an error then the process is not started.
+	//
+	// Files which pmux passes to the process (see Listen and Streams) are
+	// already in ExtraFiles, so further files should be appended to them.
+	// SysProcAttr should be modified rather than replaced, as pmux relies on
+	// the process having its own process group. Stdout, Stderr, Cancel, and
+	// WaitDelay must not be changed. It can't be given in a config file.
+	ModifyCmd func(*exec.Cmd) error `yaml:"-"`
+
+	// Clock, if set, is used for timing the process (e.g. backoff waits and
+	// SigKillWait) rather than the system clock, see the pmuxtest package. It
+	// can't be given in a config file.
+	Clock Clock `yaml:"-"`
+
+	// LogFile is the path of a file which the process's stdout, stderr, and
+	// the messages pmux logs about it are appended to, in addition to being
+	// written to pmux's own stdout and stderr. Multiple processes may share a
+	// LogFile.
+	LogFile string `yaml:"logFile,omitempty"`
+
+	// TimeFormat, if set, overrides Config.TimeFormat for the output of the
+	// process and the messages pmux logs about it, e.g. setting it to "" for
+	// a process which timestamps its own output.
+	TimeFormat *string `yaml:"timeFormat,omitempty"`
+
+	// Verbosity determines which messages about the process are logged, see
+	// the Verbosity type. If not set then the Verbosity of the Config is used.
+	Verbosity Verbosity `yaml:"verbosity,omitempty"`
+
+	// LogLevels, if set, causes the LogLevel of each line of the process's
+	// output to be inferred, so that lines can be filtered by level, and so
+	// that the level is included in JSON output (see Config.LogFormat).
+	LogLevels *LogLevelsConfig `yaml:"logLevels,omitempty"`
+
+	// StdoutTo and StderrTo determine which Logger the stdout and stderr of
+	// the process are logged to, or whether they are discarded, e.g. for
+	// processes which log to stdout and write noise to stderr.
+	//
+	// StdoutTo defaults to OutputStreamStdout, and StderrTo to
+	// OutputStreamStderr.
+	StdoutTo OutputStream `yaml:"stdoutTo,omitempty"`
+	StderrTo OutputStream `yaml:"stderrTo,omitempty"`
+
+	// CombineOutput is shorthand for setting StderrTo to OutputStreamStdout.
+	//
+	// Whenever both streams are logged to the same Logger, the process is
+	// given a single pipe for both, so that the order of lines across the two
+	// streams is kept.
+	CombineOutput bool `yaml:"combineOutput,omitempty"`
+
+	// InheritStdio causes the process to write directly to the stdout and
+	// stderr of this parent process (according to StdoutTo and StderrTo),
+	// rather than its output being read and logged line by line. This avoids
+	// any overhead for processes with very high output throughput, at the
+	// cost of their output not being prefixed, formatted, written to their
+	// LogFile, nor included in crash reports and onCrash hooks.
+	InheritStdio bool `yaml:"inheritStdio,omitempty"`
+
+	// Streams are additional output streams of the process, each of which is
+	// given to it on its own file descriptor, see StreamConfig.
+	Streams []StreamConfig `yaml:"streams,omitempty"`
+
+	// Umask is the file mode creation mask the process will be started with,
+	// given as an octal string (e.g. "0027"). It's set by running the process
+	// via "/bin/sh", which must therefore exist within the Chroot, if any. If
+	// not set then the process inherits the umask of this parent process.
+	//
+	// Umask can't be used when Type is ProcessTypeContainer, as it would only
+	// apply to the container runtime's client, not to the container.
+	Umask string `yaml:"umask,omitempty"`
 }
 
 func (cfg ProcessConfig) withDefaults() ProcessConfig {
@@ -64,196 +481,1759 @@ func (cfg ProcessConfig) withDefaults() ProcessConfig {
 		cfg.SigKillWait = 10 * time.Second
 	}
 
+	if cfg.OutputWait == 0 {
+		cfg.OutputWait = 2 * time.Second
+	}
+
+	if cfg.StartSecs == 0 {
+		cfg.StartSecs = 1 * time.Second
+	}
+
+	if cfg.Retries > 0 && cfg.RetryWait == 0 {
+		cfg.RetryWait = 1 * time.Second
+	}
+
+	if cfg.FallbackCmd != "" && cfg.FallbackAfter == 0 {
+		cfg.FallbackAfter = 3
+	}
+
+	if cfg.FallbackCmd != "" && cfg.FallbackRetry == 0 {
+		cfg.FallbackRetry = 5 * time.Minute
+	}
+
+	cfg.CircuitBreaker = cfg.CircuitBreaker.withDefaults()
+	cfg.CrashReport = cfg.CrashReport.withDefaults()
+	cfg.ReadyCheck = cfg.ReadyCheck.withDefaults()
+
+	cfg.Hooks = cfg.Hooks.withDefaults()
+
+	if cfg.WatchDebounce == 0 {
+		cfg.WatchDebounce = 500 * time.Millisecond
+	}
+
+	if cfg.RestartStrategy == "" {
+		cfg.RestartStrategy = RestartStrategyStopFirst
+	}
+
+	if cfg.StdoutTo == "" {
+		cfg.StdoutTo = OutputStreamStdout
+	}
+
+	if cfg.StderrTo == "" && cfg.CombineOutput {
+		cfg.StderrTo = OutputStreamStdout
+	} else if cfg.StderrTo == "" {
+		cfg.StderrTo = OutputStreamStderr
+	}
+
 	return cfg
 }
 
-func sigProcessGroup(sysLogger Logger, proc *os.Process, sig syscall.Signal) {
-	sysLogger.Printf("sending %v signal", sig)
+// environ returns the environment which the process should be run with.
+func (cfg ProcessConfig) environ() []string {
 
-	// Because we use Setpgid when starting child processes, child processes
-	// will have the same PGID as their PID. To send a signal to all processes
-	// in a group, you send the signal to the negation of the PGID, which in
-	// this case is equivalent to -PID.
-	//
-	// POSIX is a fucking joke.
-	if err := syscall.Kill(-proc.Pid, sig); err != nil {
+	env := os.Environ()
 
-		panic(fmt.Errorf(
-			"failed to send %v signal to %d: %w",
-			sig, -proc.Pid, err,
-		))
+	if cfg.ClearEnv {
+		env = nil
+		for _, k := range cfg.PassEnv {
+			if v, ok := os.LookupEnv(k); ok {
+				env = append(env, k+"="+v)
+			}
+		}
 	}
-}
 
-// RunProcessOnce runs the process described by the ProcessConfig (though it
-// doesn't use all fields from the ProcessConfig).
-//
-// The process is killed if-and-only-if the context is canceled, returning -1
-// and context.Canceled. Otherwise the exit status of the process is returned,
-// or -1 and an error.
-//
-// The stdout and stderr of the process will be written to the corresponding
-// Loggers. Various runtime events will be written to the sysLogger.
-func RunProcessOnce(
-	ctx context.Context,
-	stdoutLogger, stderrLogger, sysLogger Logger,
-	cfg ProcessConfig,
-) (
-	int, error,
-) {
+	for k, v := range cfg.Env {
+		env = append(env, k+"="+v)
+	}
 
-	cfg = cfg.withDefaults()
+	if cfg.TZ != "" {
+		env = append(env, "TZ="+cfg.TZ)
+	}
 
-	var wg sync.WaitGroup
+	if cfg.Lang != "" {
+		env = append(env, "LANG="+cfg.Lang)
+	}
 
-	fwdOutPipe := func(logger Logger, r io.Reader) {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			bufR := bufio.NewReader(r)
-			for {
-				line, err := bufR.ReadString('\n')
-				if errors.Is(err, io.EOF) {
-					return
-				} else if err != nil {
-					logger.Printf("reading output: %v", err)
-					return
-				}
+	if len(cfg.Path) > 0 {
+		path := strings.Join(cfg.Path, string(os.PathListSeparator))
 
-				logger.Println(strings.TrimSuffix(line, "\n"))
+		// the last value of a variable is the one which is used.
+		for i := len(env) - 1; i >= 0; i-- {
+			if v, ok := strings.CutPrefix(env[i], "PATH="); ok {
+				if v != "" {
+					path += string(os.PathListSeparator) + v
+				}
+				break
 			}
-		}()
+		}
+
+		env = append(env, "PATH="+path)
 	}
 
-	cmd := exec.Command(cfg.Cmd, cfg.Args...)
+	return env
+}
 
-	cmd.Dir = cfg.Dir
+// metadataEnv returns the environment variables describing the process which
+// pmux gives to every process it runs:
+//
+//	PMUX_NAME            the name of the process
+//	PMUX_RESTART_COUNT   the number of times it has been restarted
+//	PMUX_START_TIME      when it was started, in RFC 3339 format
+//	PMUX_REPLICA_INDEX   its index, if it's one of a process's Replicas
+func (cfg ProcessConfig) metadataEnv(restarts int, start time.Time) []string {
 
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		// Indicates that the child process should be a part of a separate
-		// process group than the parent, so that it does not receive signals
-		// that the parent receives. This is what ensures that context
-		// cancellation is the only way to interrupt the child processes.
-		Setpgid: true,
+	env := []string{
+		"PMUX_NAME=" + cfg.Name,
+		"PMUX_RESTART_COUNT=" + strconv.Itoa(restarts),
+		"PMUX_START_TIME=" + start.Format(time.RFC3339),
 	}
 
-	cmd.Env = os.Environ()
-	for k, v := range cfg.Env {
-		cmd.Env = append(cmd.Env, k+"="+v)
+	if cfg.Replicas > 1 {
+		env = append(env, "PMUX_REPLICA_INDEX="+strconv.Itoa(cfg.replica))
 	}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return -1, fmt.Errorf("getting stdout pipe: %w", err)
+	return env
+}
+
+// command returns the executable and arguments which should be used to run the
+// process.
+func (cfg ProcessConfig) command() (string, []string) {
+
+	if cfg.Type == ProcessTypePipeline {
+		return cfg.pipelineCommand()
 	}
-	defer stdout.Close()
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return -1, fmt.Errorf("getting stderr pipe: %w", err)
+	if !cfg.Shell {
+		return cfg.lookPath(cfg.Cmd), cfg.Args
 	}
-	defer stderr.Close()
 
-	fwdOutPipe(stdoutLogger, stdout)
-	fwdOutPipe(stderrLogger, stderr)
+	args := append([]string{"-c", cfg.Cmd, cfg.Name}, cfg.Args...)
+	return "/bin/sh", args
+}
 
-	if err := cmd.Start(); err != nil {
-		return -1, fmt.Errorf("starting process: %w", err)
+// lookPath returns the path of the named executable within the directories of
+// the process's Path, if it's found there, so that those directories are
+// searched in the same way as they will be by the process itself. Otherwise
+// the name is returned as-is, to be searched for in pmux's own PATH.
+//
+// If Chroot is set then the whole of the process's PATH is searched within
+// it instead, as pmux's own PATH would find executables outside of it.
+func (cfg ProcessConfig) lookPath(name string) string {
+
+	if strings.Contains(name, "/") {
+		return name
 	}
 
-	stopCh := make(chan struct{})
+	if cfg.Chroot != "" {
+		for _, dir := range filepath.SplitList(cfg.chrootPATH()) {
+			if !filepath.IsAbs(dir) {
+				continue
+			}
 
-	go func(proc *os.Process) {
+			path := filepath.Join(dir, name)
+			if isExecutable(filepath.Join(cfg.Chroot, path)) {
+				return path
+			}
+		}
 
-		select {
-		case <-ctx.Done():
-			sigProcessGroup(sysLogger, proc, syscall.SIGINT)
-		case <-stopCh:
-			return
+		return name
+	}
+
+	for _, dir := range cfg.Path {
+		path := filepath.Join(dir, name)
+		if isExecutable(path) {
+			return path
 		}
+	}
 
-		select {
-		case <-time.After(cfg.SigKillWait):
-			sigProcessGroup(sysLogger, proc, syscall.SIGKILL)
-		case <-stopCh:
+	return name
+}
+
+// chrootPATH returns the PATH which executables are searched for in within
+// the Chroot, i.e. the PATH of the process itself.
+func (cfg ProcessConfig) chrootPATH() string {
+
+	env := cfg.environ()
+
+	// the last value of a variable is the one which is used.
+	for i := len(env) - 1; i >= 0; i-- {
+		if v, ok := strings.CutPrefix(env[i], "PATH="); ok {
+			return v
 		}
+	}
 
-	}(cmd.Process)
+	return "/usr/local/bin:/usr/bin:/bin"
+}
 
-	wg.Wait()
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
 
-	err = cmd.Wait()
-	close(stopCh)
+// CmdNotFoundError is returned by RunProcessOnce and ResolveCmd when the
+// executable which would be run for a process can't be found.
+type CmdNotFoundError struct {
+	Cmd string
+	Err error
+}
 
-	if err := ctx.Err(); err != nil {
-		return -1, err
+func (e *CmdNotFoundError) Error() string {
+	return fmt.Sprintf("command not found: %v", e.Err)
+}
+
+func (e *CmdNotFoundError) Unwrap() error { return e.Err }
+
+// ResolveCmd returns the path of the executable which will be run for the
+// process, i.e. Cmd resolved against the Path directories and PATH, or a
+// *CmdNotFoundError if it can't be found. For ProcessTypeContainer processes
+// this is the path of the container runtime.
+//
+// If Chroot is set then the executable is resolved within it, and the path
+// returned is relative to it.
+func (cfg ProcessConfig) ResolveCmd() (string, error) {
+
+	name, _ := cfg.command()
+
+	if cfg.Type == ProcessTypeContainer {
+		var err error
+		if name, err = cfg.Container.containerRuntime(); err != nil {
+			return "", &CmdNotFoundError{Err: err}
+		}
+	}
+
+	if cfg.Chroot != "" {
+		return cfg.resolveChrootCmd(name)
+	}
+
+	// exec.Cmd resolves a relative path containing a separator relative to
+	// its Dir.
+	path := name
+	if !filepath.IsAbs(path) && filepath.Base(path) != path {
+		path = filepath.Join(cfg.Dir, path)
 	}
 
+	resolved, err := exec.LookPath(path)
 	if err != nil {
-		return -1, fmt.Errorf("process exited: %w", err)
+		return "", &CmdNotFoundError{Cmd: name, Err: err}
 	}
 
-	return cmd.ProcessState.ExitCode(), nil
+	return resolved, nil
 }
 
-// RunProcess runs a process (configured by ProcessConfig) until the context is
-// canceled, at which point the process is killed and RunProcess returns.
-//
-// The process will be restarted if it exits of its own accord. There will be a
-// brief wait time between each restart, with an exponential backoff mechanism
-// so that the wait time increases upon repeated restarts.
-//
-// The stdout and stderr of the process will be written to the corresponding
-// Loggers. Various runtime events will be written to the sysLogger.
-func RunProcess(
-	ctx context.Context,
-	stdoutLogger, stderrLogger, sysLogger Logger,
-	cfg ProcessConfig,
-) {
+// resolveChrootCmd is ResolveCmd for processes with a Chroot, where name has
+// already been searched for within the Chroot by lookPath.
+func (cfg ProcessConfig) resolveChrootCmd(name string) (string, error) {
 
-	cfg = cfg.withDefaults()
+	if !strings.Contains(name, "/") {
+		return "", &CmdNotFoundError{
+			Cmd: name,
+			Err: fmt.Errorf(
+				"%q: executable file not found in $PATH within chroot %q",
+				name, cfg.Chroot,
+			),
+		}
+	}
+
+	// the process's Dir is itself relative to the Chroot.
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.Dir, path)
+	}
 
-	var wait time.Duration
+	if !isExecutable(filepath.Join(cfg.Chroot, path)) {
+		return "", &CmdNotFoundError{
+			Cmd: name,
+			Err: fmt.Errorf(
+				"%q: no executable file at %q within chroot %q",
+				name, path, cfg.Chroot,
+			),
+		}
+	}
 
-	for {
-		start := time.Now()
-		exitCode, err := RunProcessOnce(
-			ctx,
-			stdoutLogger, stderrLogger, sysLogger,
-			cfg,
-		)
-		took := time.Since(start)
+	return path, nil
+}
+
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+
+	uid, gid := uint64(os.Getuid()), uint64(os.Getgid())
+
+	if userName != "" {
+
+		u, err := user.Lookup(userName)
+		if errors.As(err, new(user.UnknownUserError)) {
+			u, err = user.LookupId(userName)
+		}
 
 		if err != nil {
-			sysLogger.Printf("exited: %v", err)
-		} else {
-			sysLogger.Printf("exit code: %d", exitCode)
+			return nil, fmt.Errorf("looking up user %q: %w", userName, err)
 		}
 
-		if err := ctx.Err(); err != nil {
-			return
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+			return nil, fmt.Errorf("parsing uid %q: %w", u.Uid, err)
 		}
 
-		for i := range cfg.NoRestartOn {
-			if cfg.NoRestartOn[i] == exitCode {
-				return
-			}
+		if gid, err = strconv.ParseUint(u.Gid, 10, 32); err != nil {
+			return nil, fmt.Errorf("parsing gid %q: %w", u.Gid, err)
 		}
+	}
 
-		wait = ((wait * 2) - took).Truncate(time.Millisecond)
+	if groupName != "" {
 
-		if wait < cfg.MinWait {
-			wait = cfg.MinWait
-		} else if wait > cfg.MaxWait {
-			wait = cfg.MaxWait
+		g, err := user.LookupGroup(groupName)
+		if errors.As(err, new(user.UnknownGroupError)) {
+			g, err = user.LookupGroupId(groupName)
 		}
 
-		sysLogger.Printf("will restart process in %v", wait)
+		if err != nil {
+			return nil, fmt.Errorf("looking up group %q: %w", groupName, err)
+		}
 
-		select {
-		case <-time.After(wait):
-		case <-ctx.Done():
-			return
+		if gid, err = strconv.ParseUint(g.Gid, 10, 32); err != nil {
+			return nil, fmt.Errorf("parsing gid %q: %w", g.Gid, err)
+		}
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+func (cfg ProcessConfig) sysProcAttr() (*syscall.SysProcAttr, error) {
+
+	attr := &syscall.SysProcAttr{
+		// Indicates that the child process should be a part of a separate
+		// process group than the parent, so that it does not receive signals
+		// that the parent receives. This is what ensures that context
+		// cancellation is the only way to interrupt the child processes.
+		//
+		// A new session also has a new process group, which the leader of
+		// the session can't then change, so only one of these is set.
+		Setpgid: !cfg.Setsid,
+		Setsid:  cfg.Setsid,
+
+		Chroot: cfg.Chroot,
+	}
+
+	if cfg.User != "" || cfg.Group != "" {
+
+		cred, err := lookupCredential(cfg.User, cfg.Group)
+		if err != nil {
+			return nil, err
 		}
+
+		attr.Credential = cred
+	}
+
+	if err := setAmbientCaps(attr, cfg.AmbientCaps); err != nil {
+		return nil, err
+	}
+
+	return attr, nil
+}
+
+// commandSysProcAttr returns the SysProcAttr of commands which are run on
+// behalf of the process, such as its hooks, which are run within its Chroot
+// and as its User and Group, but are otherwise run in the same way as any
+// other command which pmux runs.
+func (cfg ProcessConfig) commandSysProcAttr() (*syscall.SysProcAttr, error) {
+
+	attr := &syscall.SysProcAttr{Chroot: cfg.Chroot}
+
+	if cfg.User != "" || cfg.Group != "" {
+
+		cred, err := lookupCredential(cfg.User, cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+
+		attr.Credential = cred
+	}
+
+	return attr, nil
+}
+
+// sigProcessGroup sends the signal to the process group of the process. The
+// process group no longer existing is not considered an error, as it may have
+// exited just before the signal was sent. Any other error is logged and
+// returned.
+func sigProcessGroup(
+	sysLogger Logger, proc *os.Process, sig syscall.Signal,
+) error {
+	debugf(sysLogger, "sending %v signal", sig)
+
+	// Because we use Setpgid (or Setsid) when starting child processes, child
+	// processes will have the same PGID as their PID. To send a signal to all processes
+	// in a group, you send the signal to the negation of the PGID, which in
+	// this case is equivalent to -PID.
+	//
+	// POSIX is a fucking joke.
+	err := syscall.Kill(-proc.Pid, sig)
+	if err == nil || errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+
+	err = fmt.Errorf("sending %v signal to %d: %w", sig, -proc.Pid, err)
+	sysLogger.Printf("failed %v", err)
+	return err
+}
+
+// umaskCommand wraps the given command such that it's run with the given
+// umask. The umask of pmux itself can't be changed in order to start the
+// process, as it's shared by all goroutines, so this is done by running the
+// command via a shell which sets the umask and then execs the command.
+func umaskCommand(umask string, name string, args []string) (string, []string, error) {
+
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing umask %q: %w", umask, err)
+	}
+
+	script := fmt.Sprintf(`umask %04o && exec "$0" "$@"`, mask)
+	return "/bin/sh", append([]string{"-c", script, name}, args...), nil
+}
+
+// outputStreamLogger returns the Logger which output should be written to in
+// order to end up at the given OutputStream.
+func outputStreamLogger(
+	stdoutLogger, stderrLogger Logger, to OutputStream,
+) Logger {
+	switch to {
+	case OutputStreamStderr:
+		return stderrLogger
+	case OutputStreamDiscard:
+		return new(NullLogger)
+	default:
+		return stdoutLogger
+	}
+}
+
+// forwardOutput reads lines from the reader in the background, until EOF, and
+// writes each to the Logger. The WaitGroup is done once the reader is
+// exhausted.
+func forwardOutput(
+	wg *sync.WaitGroup, sysLogger Logger, name string, logger Logger, r io.Reader,
+) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bufR := bufio.NewReader(r)
+		for {
+			line, err := bufR.ReadString('\n')
+			if errors.Is(err, io.EOF) {
+				debugf(sysLogger, "%s pipe closed", name)
+				return
+			} else if errors.Is(err, os.ErrClosed) {
+				// pmux closed the pipe itself, see OutputWait.
+				return
+			} else if err != nil {
+				logger.Printf("reading output: %v", err)
+				return
+			}
+
+			logger.Println(strings.TrimSuffix(line, "\n"))
+		}
+	}()
+}
+
+// RunProcessOnce runs the process described by the ProcessConfig (though it
+// doesn't use all fields from the ProcessConfig).
+//
+// The process is killed if-and-only-if the context is canceled, returning -1
+// and an error for which errors.Is(err, context.Canceled) is true, which
+// includes the context's cause, if any (see StopError). Otherwise the exit
+// status of the process is returned, or -1 and an error. If the process was
+// terminated by a signal then the error will be a *SignalError.
+//
+// The stdout and stderr of the process will be written to the corresponding
+// Loggers. Various runtime events will be written to the sysLogger.
+//
+// RunProcessOnceInfo describes the run in more detail.
+func RunProcessOnce(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+) (
+	int, error,
+) {
+	info := RunProcessOnceInfo(ctx, stdoutLogger, stderrLogger, sysLogger, cfg)
+	return info.ExitCode, info.Err
+}
+
+// RunProcessOnceInfo is like RunProcessOnce, but returns an ExitInfo
+// describing the run, whose ExitCode and Err are what RunProcessOnce would
+// have returned.
+func RunProcessOnceInfo(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+) ExitInfo {
+	inst := startInstance(
+		ctx, stdoutLogger, stderrLogger, sysLogger, cfg, runProcessOpts{},
+	)
+	<-inst.doneCh
+	return inst.exitInfo(cfg.Name)
+}
+
+func runProcessOnce(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+	opts runProcessOpts,
+) (
+	int, error,
+) {
+
+	cfg = cfg.withDefaults()
+	sysLogger = withVerbosity(sysLogger, cfg.Verbosity)
+
+	if cfg.LogLevels != nil {
+		stdoutLogger = newLevelLogger(stdoutLogger, *cfg.LogLevels)
+		stderrLogger = newLevelLogger(stderrLogger, *cfg.LogLevels)
+	}
+
+	if opts.adoptPID != 0 {
+		return runAdopted(
+			ctx, stdoutLogger, stderrLogger, sysLogger, cfg, opts,
+		)
+	}
+
+	var wg sync.WaitGroup
+
+	routeOutput, err := newRouteLoggers(sysLogger, cfg, stdoutLogger, stderrLogger)
+	if err != nil {
+		return -1, err
+	}
+
+	fwdOutPipe := func(name string, logger Logger, r io.Reader) {
+		forwardOutput(&wg, sysLogger, name, routeOutput(name, logger), r)
+	}
+
+	// outputs holds the read end of each pipe which the process's output is
+	// read from.
+	outputs := map[string]*os.File{}
+
+	if len(cfg.Listen) > 0 && opts.listenFiles == nil {
+		files, err := listenFiles(cfg.Listen)
+		if err != nil {
+			return -1, err
+		}
+		defer closeFiles(files)
+		opts.listenFiles = files
+	}
+
+	// this is checked first, as it's the most likely reason for a process to
+	// never start, and is otherwise reported obscurely.
+	if _, err := cfg.ResolveCmd(); err != nil {
+		return -1, err
+	}
+
+	if err := waitFor(ctx, sysLogger, cfg); err != nil {
+		return -1, err
+	}
+
+	if err := cfg.ensureDir(sysLogger); err != nil {
+		return -1, err
+	}
+
+	if cfg, err = cfg.resolveEnv(ctx); err != nil {
+		return -1, err
+	}
+
+	if opts.secretEnv != nil {
+		secretEnv, err := opts.secretEnv(ctx)
+		if err != nil {
+			return -1, fmt.Errorf("fetching secrets: %w", err)
+		}
+
+		for k, v := range secretEnv {
+			cfg.Env[k] = v
+		}
+	}
+
+	pluginEnv, err := runPreStartPlugins(ctx, sysLogger, opts.plugins, cfg.Name)
+	if err != nil {
+		return -1, err
+	}
+
+	for k, v := range pluginEnv {
+		cfg.Env[k] = v
+	}
+
+	err = runHook(ctx, sysLogger, cfg, "preStart", cfg.Hooks.PreStart, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	name, args := cfg.command()
+	if len(cfg.Listen) > 0 {
+		name, args = listenCommand(name, args)
+	}
+
+	if cfg.Type == ProcessTypeContainer {
+		if name, args, err = cfg.containerCommand(); err != nil {
+			return -1, err
+		}
+
+		// a container may have been left behind if the runtime's client was
+		// killed, including by the SIGKILL which follows SigKillWait.
+		cfg.removeContainer(sysLogger)
+		defer cfg.removeContainer(sysLogger)
+	}
+
+	if cfg.Umask != "" {
+		if name, args, err = umaskCommand(cfg.Umask, name, args); err != nil {
+			return -1, err
+		}
+	}
+
+	// the process is stopped by cmd.Cancel when the context is canceled, see
+	// below.
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	cmd.Dir = cfg.Dir
+
+	sysProcAttr, err := cfg.sysProcAttr()
+	if err != nil {
+		return -1, err
+	}
+
+	cmd.SysProcAttr = sysProcAttr
+
+	cmd.Env = append(
+		cfg.environ(), cfg.metadataEnv(opts.restarts, cfg.clock().Now())...,
+	)
+
+	if len(cfg.Listen) > 0 {
+		cmd.Env = append(cmd.Env, listenEnv(cfg.Listen)...)
+		cmd.ExtraFiles = opts.listenFiles
+	}
+
+	outputLogger := func(to OutputStream) Logger {
+		return outputStreamLogger(stdoutLogger, stderrLogger, to)
+	}
+
+	inheritedOutput := func(to OutputStream) io.Writer {
+		switch to {
+		case OutputStreamStdout:
+			return os.Stdout
+		case OutputStreamStderr:
+			return os.Stderr
+		default:
+			return nil
+		}
+	}
+
+	// pipeWriters holds the write end of each pipe which the process's output
+	// is read from. They are closed once the process has been started, so that
+	// the read ends see EOF once the process (and its descendants) close them
+	// too. The defer covers the process not being started.
+	var pipeWriters []*os.File
+	defer func() { closeFiles(pipeWriters) }()
+
+	// pmux creates the pipes for stdout and stderr itself, rather than using
+	// cmd.StdoutPipe, as cmd.Wait closes those as soon as the process exits,
+	// whereas output may remain to be read (see OutputWait).
+	outputPipe := func(name string, logger Logger) (*os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("creating %s pipe: %w", name, err)
+		}
+		pipeWriters = append(pipeWriters, w)
+		fwdOutPipe(name, logger, r)
+		outputs[name] = r
+		return w, nil
+	}
+
+	if len(cfg.Streams) > 0 {
+		readers, extraFiles, err := streamPipes(cfg.Streams, cmd.ExtraFiles)
+		if err != nil {
+			return -1, err
+		}
+
+		pipeWriters = append(pipeWriters, extraFiles[len(cmd.ExtraFiles):]...)
+		cmd.ExtraFiles = extraFiles
+
+		for i, stream := range cfg.Streams {
+			stream = stream.withDefaults()
+
+			logger := opts.streamLoggers[stream.Name]
+			if logger == nil {
+				logger = outputLogger(stream.To)
+			}
+
+			defer readers[i].Close()
+			fwdOutPipe(stream.Name, logger, readers[i])
+			outputs[stream.Name] = readers[i]
+		}
+	}
+
+	// streams which are discarded are left unset, and so are connected to
+	// the null device.
+	if cfg.InheritStdio {
+		cmd.Stdout = inheritedOutput(cfg.StdoutTo)
+
+	} else if cfg.StdoutTo != OutputStreamDiscard {
+		stdout, err := outputPipe("stdout", outputLogger(cfg.StdoutTo))
+		if err != nil {
+			return -1, err
+		}
+		defer outputs["stdout"].Close()
+
+		cmd.Stdout = stdout
+	}
+
+	switch {
+	case cfg.InheritStdio:
+		cmd.Stderr = inheritedOutput(cfg.StderrTo)
+
+	case cfg.StderrTo == OutputStreamDiscard:
+
+	case cfg.StderrTo == cfg.StdoutTo:
+		// sharing the stdout pipe keeps the order of lines across the two
+		// streams.
+		cmd.Stderr = cmd.Stdout
+
+	default:
+		stderr, err := outputPipe("stderr", outputLogger(cfg.StderrTo))
+		if err != nil {
+			return -1, err
+		}
+		defer outputs["stderr"].Close()
+
+		cmd.Stderr = stderr
+	}
+
+	if cfg.ModifyCmd != nil {
+		if err := cfg.ModifyCmd(cmd); err != nil {
+			return -1, fmt.Errorf("modifying command: %w", err)
+		}
+	}
+
+	stopCh := make(chan struct{})
+
+	// tree is given the PID of the process once it has started.
+	var (
+		tree           *processTree
+		closeTreeSetup = func() {}
+	)
+	if cfg.KillTree {
+		tree = newProcessTree(sysLogger)
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = new(syscall.SysProcAttr)
+		}
+		closeTreeSetup = tree.useCgroup(cmd.SysProcAttr)
+		defer tree.close()
+	}
+
+	signal := func(sig syscall.Signal) {
+
+		// descendants are found first, as signalling the process group may
+		// cause the process to exit, orphaning them.
+		if tree != nil {
+			tree.find()
+		}
+
+		err := sigProcessGroup(sysLogger, cmd.Process, sig)
+		if err != nil && opts.onSignalErr != nil {
+			opts.onSignalErr(cmd.Process, err)
+		}
+
+		if tree != nil {
+			tree.signal(sig, true)
+		}
+	}
+
+	// canceledCh is closed once cmd.Cancel has asked the process to stop, at
+	// which point the wait for SigKillWait begins.
+	canceledCh := make(chan struct{})
+
+	cmd.Cancel = func() error {
+		// cmd.Wait doesn't return until Cancel has, so stopCh can't be used to
+		// tell whether the process exits while the hook is running.
+		runPreStopHook(
+			sysLogger, cfg, cmd.Process.Pid, exitedCh(cmd.Process.Pid),
+		)
+		signal(syscall.SIGINT)
+
+		// If the process has been stopped (e.g. by SIGSTOP) it needs to be
+		// continued in order to handle the SIGINT.
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGCONT)
+
+		close(canceledCh)
+		return nil
+	}
+
+	// The whole process group is sent SIGKILL after SigKillWait (see below),
+	// this is a fallback in case that fails.
+	cmd.WaitDelay = cfg.SigKillWait
+
+	err = startCmd(cmd, cfg.DropCaps)
+	closeTreeSetup()
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctxErr(ctx)
+		}
+		return -1, fmt.Errorf("starting process: %w", err)
+	}
+
+	closeFiles(pipeWriters)
+
+	if tree != nil {
+		tree.setPID(cmd.Process.Pid)
+	}
+
+	if opts.onStart != nil {
+		opts.onStart(cmd.Process, outputs)
+	}
+
+	if opts.onExit != nil {
+		defer func() {
+			opts.onExit(cmd.Process, cmd.ProcessState, context.Cause(ctx))
+		}()
+	}
+
+	// postStartErr is set if the postStart hook fails fatally, in which case
+	// the process is stopped.
+	var postStartErr error
+	postStartFailedCh := make(chan struct{})
+
+	if cfg.Hooks.PostStart.Cmd != "" {
+		go func() {
+			readyCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			go func() {
+				select {
+				case <-stopCh:
+					cancel()
+				case <-readyCtx.Done():
+				}
+			}()
+
+			if !waitReady(readyCtx, cfg) {
+				return
+			}
+
+			err := runHook(
+				readyCtx, sysLogger, cfg,
+				"postStart", cfg.Hooks.PostStart, nil, nil,
+			)
+			if err != nil {
+				postStartErr = err
+				close(postStartFailedCh)
+			}
+		}()
+	}
+
+	go func() {
+
+		select {
+		case <-postStartFailedCh:
+			runPreStopHook(sysLogger, cfg, cmd.Process.Pid, stopCh)
+			signal(syscall.SIGINT)
+
+		case <-canceledCh:
+
+		case <-stopCh:
+			return
+		}
+
+		// SIGKILL is sent again every SigKillWait until the process exits, in
+		// case sending it fails.
+		for {
+			afterCh, stop := after(cfg.clock(), cfg.SigKillWait)
+			select {
+			case <-afterCh:
+				signal(syscall.SIGKILL)
+			case <-stopCh:
+				stop()
+				return
+			}
+		}
+
+	}()
+
+	err = cmd.Wait()
+	close(stopCh)
+
+	if tree != nil && (ctx.Err() != nil || isDone(postStartFailedCh)) {
+		tree.signal(syscall.SIGKILL, false)
+	}
+
+	waitOutput(ctx, sysLogger, cfg, &wg, outputs)
+
+	if cmd.ProcessState != nil {
+		infof(
+			sysLogger, "resource usage: %v", newResourceUsage(cmd.ProcessState),
+		)
+	}
+
+	if ctx.Err() != nil {
+		return -1, ctxErr(ctx)
+	}
+
+	if isDone(postStartFailedCh) {
+		// the hook's error is not wrapped, so that it can't be mistaken for
+		// the process's own exit status.
+		return -1, fmt.Errorf("stopped process: %v", postStartErr)
+	}
+
+	if exitErr := new(exec.ExitError); errors.As(err, &exitErr) {
+		ws, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() {
+			return -1, &SignalError{
+				Signal:     ws.Signal(),
+				CoreDumped: ws.CoreDump(),
+			}
+		}
+		return exitErr.ExitCode(), nil
+
+	} else if err != nil {
+		return -1, fmt.Errorf("process exited: %w", err)
+	}
+
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+// RunProcess runs a process (configured by ProcessConfig) until the context is
+// canceled, at which point the process is killed and RunProcess returns.
+//
+// The process will be restarted if it exits of its own accord. There will be a
+// brief wait time between each restart, with an exponential backoff mechanism
+// so that the wait time increases upon repeated failed starts (see StartSecs).
+//
+// The stdout and stderr of the process will be written to the corresponding
+// Loggers. Various runtime events will be written to the sysLogger.
+func RunProcess(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+) {
+	runProcess(
+		ctx, stdoutLogger, stderrLogger, sysLogger, cfg, runProcessOpts{},
+	)
+}
+
+// runProcessOpts are extra options to runProcess which are used by Pmux in
+// order to control a process while it's running.
+type runProcessOpts struct {
+
+	// waitRestart, if set, is called prior to each restart of the process,
+	// and blocks until the restart may proceed. It returns false if the
+	// context was canceled while waiting.
+	waitRestart func(context.Context) bool
+
+	// onStart and onExit, if set, are called with the os.Process of the
+	// process once it has been started and once it has exited, respectively.
+	// onStart is also given the read end of each pipe which the process's
+	// output is read from, keyed by "stdout", "stderr", or the name of the
+	// stream. onExit is also given the ProcessState, if the process was
+	// waited on, and the cause of the context being canceled if it was
+	// stopped by pmux (see StopError).
+	// When using RestartStrategyBlueGreen there may be two instances of the
+	// process running at once, but onStart isn't called for the new instance
+	// until it has become ready and replaced the old one (see deferStart).
+	onStart func(*os.Process, map[string]*os.File)
+	onExit  func(*os.Process, *os.ProcessState, error)
+
+	// onReady, if set, is called with the os.Process of a RestartStrategyBlueGreen
+	// instance once it has replaced the old one, having already been found to
+	// be ready, just after onStart.
+	onReady func(*os.Process)
+
+	// deferStart causes startInstance to hold back the calls to onStart and
+	// onExit until the instance is committed, see instance.commit. If the
+	// instance is never committed then they aren't called at all.
+	deferStart bool
+
+	// onSignalErr, if set, is called whenever sending a signal to the process
+	// in order to stop it fails.
+	onSignalErr func(*os.Process, error)
+
+	// onStoppedBeforeRestart, if set, is called if the context is canceled
+	// while runProcess is waiting to restart the process, i.e. while the
+	// process is down.
+	onStoppedBeforeRestart func()
+
+	// restartCh, if set, causes the process to be restarted, according to its
+	// RestartStrategy, whenever the reason for doing so is written to it.
+	restartCh <-chan *StopError
+
+	// backoff is the state of the restart backoff which runProcess starts
+	// with, and onBackoff, if set, is called whenever that state changes.
+	backoff   backoffState
+	onBackoff func(backoffState)
+
+	// secretEnv, if set, is called before each run of the process, and
+	// returns environment variables which are added to its Env.
+	secretEnv func(context.Context) (map[string]string, error)
+
+	// streamLoggers, if set, holds the Logger which each of the process's
+	// Streams is logged to, keyed by name. Streams which don't have a Logger
+	// are logged according to their To field.
+	streamLoggers map[string]Logger
+
+	// adoptPID, if set, is the PID of an already running process which
+	// runProcessOnce adopts rather than starting a new process, see
+	// ProcessConfig.AdoptPIDFile. adoptFiles, if set, are the read ends of
+	// the pipes which its output can be read from, keyed in the same way as
+	// the outputs given to onStart.
+	adoptPID   int
+	adoptFiles map[string]*os.File
+
+	// listenFiles are the sockets described by the Listen field of the
+	// ProcessConfig. If not set then runProcess will listen on them itself,
+	// for as long as it runs, or runProcessOnce for the duration of the run.
+	listenFiles []*os.File
+
+	// plugins are called at each start and exit of the process, see
+	// PluginConfig.
+	plugins []PluginConfig
+
+	// restarts is the number of times the process has been restarted prior
+	// to this run, which is given to it in PMUX_RESTART_COUNT.
+	restarts int
+}
+
+// backoffState is the state of the restart backoff used by runProcess.
+type backoffState struct {
+	Restarts     int           `json:"restarts"`
+	FailedStarts int           `json:"failedStarts"`
+	Wait         time.Duration `json:"wait"`
+
+	// Waits holds the wait time of each ExitClass which has its own backoff
+	// parameters, see ProcessConfig.backoffKey. Wait is the most recent of
+	// these.
+	Waits map[ExitClass]time.Duration `json:"waits,omitempty"`
+}
+
+// instance is a single run of a process, as started by startInstance.
+type instance struct {
+	cancel context.CancelCauseFunc
+	start  time.Time
+
+	// end is the time the run completed, and is set along with exitCode and
+	// err.
+	end time.Time
+
+	// doneCh is closed once the run has completed, at which point exitCode
+	// and err are set to the return values of runProcessOnce.
+	doneCh   chan struct{}
+	exitCode int
+	err      error
+
+	// started is set once the process has actually been started, and is safe
+	// to read once doneCh is closed.
+	started bool
+
+	// output holds the most recent lines of the instance's stdout and stderr.
+	output *lineRing
+
+	// state is the ProcessState of the instance's process, if it was waited
+	// on, and is safe to read once doneCh is closed.
+	state *os.ProcessState
+
+	// mu guards the fields below, which are used to hold back the calls to
+	// onStart and onExit when runProcessOpts.deferStart is set.
+	mu                  sync.Mutex
+	committed, reported bool
+	osProc              *os.Process
+	outputs             map[string]*os.File
+	exited              bool
+	exitState           *os.ProcessState
+	exitCause           error
+}
+
+// commit causes the held back onStart and onExit calls of an instance started
+// with runProcessOpts.deferStart to be made, followed by onReady. onExit is
+// only called if the instance has already exited, otherwise it's called when
+// it does.
+func (inst *instance) commit(opts runProcessOpts) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	inst.committed = true
+	if inst.osProc == nil || inst.reported {
+		return
+	}
+	inst.reported = true
+
+	if opts.onStart != nil {
+		opts.onStart(inst.osProc, inst.outputs)
+	}
+
+	if opts.onReady != nil {
+		opts.onReady(inst.osProc)
+	}
+
+	if inst.exited && opts.onExit != nil {
+		opts.onExit(inst.osProc, inst.exitState, inst.exitCause)
+	}
+}
+
+func startInstance(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+	opts runProcessOpts,
+) *instance {
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	// the output is kept for the onCrash hook and crash reports.
+	outputLines := cfg.Hooks.OnCrashLines
+	if cfg.CrashReport.Dir != "" && cfg.CrashReport.Lines > outputLines {
+		outputLines = cfg.CrashReport.Lines
+	}
+
+	inst := &instance{
+		cancel: cancel,
+		start:  cfg.clock().Now(),
+		doneCh: make(chan struct{}),
+		output: newLineRing(outputLines),
+	}
+
+	stdoutLogger = ringLogger{stdoutLogger, inst.output}
+	stderrLogger = ringLogger{stderrLogger, inst.output}
+
+	onStart := opts.onStart
+	opts.onStart = func(osProc *os.Process, outputs map[string]*os.File) {
+		inst.started = true
+
+		inst.mu.Lock()
+		defer inst.mu.Unlock()
+
+		inst.osProc, inst.outputs = osProc, outputs
+		if opts.deferStart && !inst.committed {
+			return
+		}
+
+		inst.reported = true
+		if onStart != nil {
+			onStart(osProc, outputs)
+		}
+	}
+
+	onExit := opts.onExit
+	opts.onExit = func(
+		osProc *os.Process, state *os.ProcessState, stopCause error,
+	) {
+		inst.state = state
+
+		inst.mu.Lock()
+		defer inst.mu.Unlock()
+
+		inst.exited = true
+		inst.exitState, inst.exitCause = state, stopCause
+		if !inst.reported {
+			return
+		}
+
+		if onExit != nil {
+			onExit(osProc, state, stopCause)
+		}
+	}
+
+	go func() {
+		defer close(inst.doneCh)
+		defer cancel(nil)
+		inst.exitCode, inst.err = runProcessOnce(
+			ctx, stdoutLogger, stderrLogger, sysLogger, cfg, opts,
+		)
+		inst.end = cfg.clock().Now()
+	}()
+
+	return inst
+}
+
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func logInstanceExit(sysLogger Logger, inst *instance) {
+	if sigErr := new(SignalError); errors.As(inst.err, &sigErr) {
+		sysLogger.Println(sigErr.Error())
+	} else if errors.Is(inst.err, context.Canceled) {
+		infof(sysLogger, "exited: %v", inst.err)
+	} else if inst.err != nil {
+		sysLogger.Printf("exited: %v", inst.err)
+	} else {
+		if inst.exitCode == 0 {
+			infof(sysLogger, "exit code: %d", inst.exitCode)
+		} else {
+			sysLogger.Printf("exit code: %d", inst.exitCode)
+		}
+	}
+}
+
+// exitStatus returns the exit code of an instance which has exited, or -1 if it
+// was terminated by a signal, in which case the signal is returned as well.
+func (inst *instance) exitStatus() (int, syscall.Signal) {
+	if sigErr := new(SignalError); errors.As(inst.err, &sigErr) {
+		return -1, sigErr.Signal
+	}
+	return inst.exitCode, 0
+}
+
+// exitInfo returns an ExitInfo describing the instance, which must be done.
+// Fields which are only set by runProcess are left empty.
+func (inst *instance) exitInfo(name string) ExitInfo {
+	exitCode, sig := inst.exitStatus()
+
+	stopped := errors.Is(inst.err, context.Canceled) ||
+		errors.Is(inst.err, context.DeadlineExceeded)
+
+	info := ExitInfo{
+		Name:     name,
+		ExitCode: exitCode,
+		Signal:   sig,
+		Err:      inst.err,
+		Class:    classifyExit(exitCode, sig),
+		Stopped:  stopped,
+		Started:  inst.start,
+		Ended:    inst.end,
+		Ran:      inst.end.Sub(inst.start),
+	}
+
+	if sigErr := new(SignalError); errors.As(inst.err, &sigErr) {
+		info.CoreDumped = sigErr.CoreDumped
+	}
+
+	if inst.state != nil {
+		usage := newResourceUsage(inst.state)
+		info.Usage = &usage
+	}
+
+	return info
+}
+
+// crashed returns true if the instance was started and then exited of its own
+// accord, either with a non-zero exit code or due to a signal.
+func (inst *instance) crashed() bool {
+	if !inst.started || errors.Is(inst.err, context.Canceled) {
+		return false
+	}
+
+	exitCode, sig := inst.exitStatus()
+	return exitCode != 0 || sig != 0
+}
+
+// runPreStopHook runs the preStop hook of a process which is about to be
+// stopped. The hook is not bound to the process's context, which will already
+// have been canceled, but is killed if exitedCh is closed before it completes.
+func runPreStopHook(
+	sysLogger Logger, cfg ProcessConfig, pid int, exitedCh <-chan struct{},
+) {
+	if cfg.Hooks.PreStop.Cmd == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-exitedCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	env := []string{
+		"PMUX_PROC=" + cfg.Name,
+		"PMUX_PID=" + strconv.Itoa(pid),
+	}
+
+	hookCfg := cfg.Hooks.PreStop
+	hookCfg.Fatal = false
+
+	_ = runHook(ctx, sysLogger, cfg, "preStop", hookCfg, env, nil)
+}
+
+// runPostStopHook runs the postStop hook for an instance which has exited, if
+// the instance was actually started. The hook is not bound to the process's
+// context, so that it still runs when pmux is shutting down.
+func runPostStopHook(sysLogger Logger, cfg ProcessConfig, inst *instance) error {
+	if !inst.started {
+		return nil
+	}
+
+	exitCode, _ := inst.exitStatus()
+
+	env := []string{"PMUX_EXIT_CODE=" + strconv.Itoa(exitCode)}
+	return runHook(
+		context.Background(), sysLogger, cfg,
+		"postStop", cfg.Hooks.PostStop, env, nil,
+	)
+}
+
+// runOnCrashHook runs the onCrash hook for an instance which has exited, if
+// the instance crashed.
+func runOnCrashHook(
+	sysLogger Logger, cfg ProcessConfig, inst *instance, restarts int,
+) error {
+	if !inst.crashed() {
+		return nil
+	}
+
+	exitCode, sig := inst.exitStatus()
+
+	var sigName string
+	if sig != 0 {
+		sigName = signalName(sig)
+	}
+
+	env := []string{
+		"PMUX_PROC=" + cfg.Name,
+		"PMUX_EXIT_CODE=" + strconv.Itoa(exitCode),
+		"PMUX_SIGNAL=" + sigName,
+		"PMUX_RESTART_COUNT=" + strconv.Itoa(restarts),
+	}
+
+	var stdin strings.Builder
+	for _, line := range inst.output.get() {
+		stdin.WriteString(line)
+		stdin.WriteString("\n")
+	}
+
+	return runHook(
+		context.Background(), sysLogger, cfg,
+		"onCrash", cfg.Hooks.OnCrash, env, strings.NewReader(stdin.String()),
+	)
+}
+
+// restartInstance handles a request to restart the given running instance for
+// the given reason, according to the RestartStrategy, and returns the instance
+// which should be considered the running one afterwards. The returned bool is
+// false if the restart didn't happen, i.e. a blue-green restart's new instance
+// didn't become ready, in which case the old instance is returned.
+func restartInstance(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+	opts runProcessOpts,
+	oldInst *instance,
+	reason *StopError,
+) (
+	*instance, bool,
+) {
+
+	if cfg.RestartStrategy != RestartStrategyBlueGreen {
+		infof(sysLogger, "%s, stopping process", reason.Reason)
+		oldInst.cancel(reason)
+		<-oldInst.doneCh
+		logInstanceExit(sysLogger, oldInst)
+		runPostStopHook(sysLogger, cfg, oldInst)
+
+		newInst := startInstance(
+			ctx, stdoutLogger, stderrLogger, sysLogger, cfg, opts,
+		)
+		return newInst, true
+	}
+
+	// the new instance only replaces the old one, as far as onStart and
+	// onExit are concerned, once it's ready.
+	newOpts := opts
+	newOpts.deferStart = true
+
+	infof(sysLogger, "%s, starting new instance", reason.Reason)
+	newInst := startInstance(
+		ctx, stdoutLogger, stderrLogger, sysLogger, cfg, newOpts,
+	)
+
+	// stop waiting for readiness if the new instance exits.
+	readyCtx, readyCancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-newInst.doneCh:
+			readyCancel()
+		case <-readyCtx.Done():
+		}
+	}()
+
+	ready := waitReady(readyCtx, cfg)
+	readyCancel()
+
+	if !ready {
+		sysLogger.Println("new instance did not become ready, keeping old instance")
+		newInst.cancel(stopErrorf("new instance did not become ready"))
+		<-newInst.doneCh
+		logInstanceExit(sysLogger, newInst)
+		runPostStopHook(sysLogger, cfg, newInst)
+		return oldInst, false
+	}
+
+	newInst.commit(opts)
+
+	infof(sysLogger, "new instance is ready, stopping old instance")
+	oldInst.cancel(reason)
+	<-oldInst.doneCh
+	logInstanceExit(sysLogger, oldInst)
+	runPostStopHook(sysLogger, cfg, oldInst)
+
+	return newInst, true
+}
+
+func runProcess(
+	ctx context.Context,
+	stdoutLogger, stderrLogger, sysLogger Logger,
+	cfg ProcessConfig,
+	opts runProcessOpts,
+) {
+
+	cfg = cfg.withDefaults()
+	sysLogger = withVerbosity(sysLogger, cfg.Verbosity)
+
+	if len(cfg.Listen) > 0 && opts.listenFiles == nil {
+		files, err := listenFiles(cfg.Listen)
+		if err != nil {
+			sysLogger.Printf("not starting process: %v", err)
+			return
+		}
+		defer closeFiles(files)
+		opts.listenFiles = files
+	}
+
+	var watchCh <-chan struct{}
+	if len(cfg.Watch) > 0 {
+		var err error
+		if watchCh, err = watchFiles(ctx, sysLogger, cfg); err != nil {
+			sysLogger.Printf("not starting process: %v", err)
+			return
+		}
+	}
+
+	var (
+		wait         = opts.backoff.Wait
+		failedStarts = opts.backoff.FailedStarts
+		restarts     = opts.backoff.Restarts
+		waits        = map[ExitClass]time.Duration{}
+		breaker      = &circuitBreaker{cfg: cfg.CircuitBreaker}
+
+		// retried is the number of times a OneShot process has been retried,
+		// see ProcessConfig.Retries.
+		retried int
+	)
+
+	for class, classWait := range opts.backoff.Waits {
+		waits[class] = classWait
+	}
+
+	// states saved before waits were keyed by ExitClass only have the one.
+	if opts.backoff.Waits == nil {
+		waits[""] = wait
+	}
+
+	resetBackoff := func() {
+		wait, failedStarts = 0, 0
+		waits = map[ExitClass]time.Duration{}
+	}
+
+	backoffChanged := func() {
+		if opts.onBackoff != nil {
+			classWaits := make(map[ExitClass]time.Duration, len(waits))
+			for class, classWait := range waits {
+				classWaits[class] = classWait
+			}
+
+			opts.onBackoff(backoffState{
+				Restarts:     restarts,
+				FailedStarts: failedStarts,
+				Wait:         wait,
+				Waits:        classWaits,
+			})
+		}
+	}
+
+	if opts.adoptPID == 0 && cfg.AdoptPIDFile != "" {
+		pid, err := readPIDFile(cfg.AdoptPIDFile)
+		if err != nil {
+			sysLogger.Printf("not adopting process: %v", err)
+		}
+		opts.adoptPID = pid
+	}
+
+	// instCfg is the config which instances are started with, which differs
+	// from cfg while the FallbackCmd is being run. primaryCh fires when it's
+	// time to try Cmd again, and tryingPrimary is set while doing so.
+	var (
+		instCfg       = cfg
+		primaryCh     <-chan time.Time
+		stopPrimary   = func() {}
+		tryingPrimary bool
+	)
+	defer func() { stopPrimary() }()
+
+	opts.restarts = restarts
+	inst := startInstance(ctx, stdoutLogger, stderrLogger, sysLogger, instCfg, opts)
+	recycleCh := recycleAfter(ctx, sysLogger, instCfg, inst)
+
+	// only the first instance may be adopted, restarts start a new process.
+	opts.adoptPID, opts.adoptFiles = 0, nil
+
+	for {
+		var reason *StopError
+		select {
+		case <-inst.doneCh:
+		case reason = <-opts.restartCh:
+		case <-recycleCh:
+			reason = stopErrorf("exceeded maxRunTime of %v", cfg.MaxRunTime)
+		case <-watchCh:
+			reason = stopErrorf("watched files changed")
+		case <-primaryCh:
+			reason = stopErrorf("retrying primary command")
+			instCfg, primaryCh, tryingPrimary = cfg, nil, true
+		}
+
+		if !isDone(inst.doneCh) {
+			opts.restarts = restarts + 1
+
+			var restarted bool
+			inst, restarted = restartInstance(
+				ctx, stdoutLogger, stderrLogger, sysLogger, instCfg, opts, inst,
+				reason,
+			)
+
+			if !restarted {
+				// if it was due to be recycled then the old instance is
+				// recycled again after another MaxRunTime.
+				if isDone(recycleCh) {
+					recycleCh = recycleAfter(ctx, sysLogger, instCfg, inst)
+				}
+				opts.restarts = restarts
+				continue
+			}
+
+			recycleCh = recycleAfter(ctx, sysLogger, instCfg, inst)
+			resetBackoff()
+			restarts++
+			backoffChanged()
+			continue
+		}
+
+		took := cfg.clock().Now().Sub(inst.start)
+		exitCode, sig := inst.exitStatus()
+		logInstanceExit(sysLogger, inst)
+
+		if err := runPostStopHook(sysLogger, cfg, inst); err != nil {
+			sysLogger.Println("not restarting process")
+			return
+		}
+
+		if path, err := writeCrashReport(cfg, inst, restarts); err != nil {
+			sysLogger.Printf("failed to write crash report: %v", err)
+		} else if path != "" {
+			sysLogger.Printf("crash report written to %q", path)
+		}
+
+		if err := runOnCrashHook(sysLogger, cfg, inst, restarts); err != nil {
+			sysLogger.Println("not restarting process")
+			return
+		}
+
+		exitInfo := inst.exitInfo(cfg.Name)
+		exitInfo.Restarts, exitInfo.FailedStarts = restarts, failedStarts
+		runPostExitPlugins(sysLogger, opts.plugins, exitInfo)
+
+		if err := ctx.Err(); err != nil {
+			return
+		}
+
+		if cfg.OneShot && inst.err == nil && exitCode == 0 {
+			sysLogger.Println("process completed")
+			return
+		}
+
+		// noRestartMsg is set if the built-in policy won't restart the
+		// process, explaining why.
+		var noRestartMsg string
+
+		if cmdErr := new(CmdNotFoundError); cfg.CmdNotFoundFatal &&
+			errors.As(inst.err, &cmdErr) {
+			noRestartMsg = "not restarting process, as its command wasn't found"
+		}
+
+		for _, code := range cfg.NoRestartOn {
+			if code == exitCode {
+				noRestartMsg = fmt.Sprintf(
+					"not restarting process, matched noRestartOn %d", code,
+				)
+				break
+			}
+		}
+
+		for _, m := range cfg.NoRestartOnExit {
+			if m.matches(exitCode, sig) {
+				noRestartMsg = fmt.Sprintf(
+					"not restarting process, matched noRestartOnExit %q", m,
+				)
+				break
+			}
+		}
+
+		// sleep is how long the built-in policy would wait before restarting
+		// the process.
+		var sleep time.Duration
+
+		if cfg.Retries > 0 {
+			retried++
+			switch {
+			case noRestartMsg != "":
+			case retried > cfg.Retries:
+				noRestartMsg = fmt.Sprintf("giving up after %d retries", cfg.Retries)
+			default:
+				sysLogger.Printf("process failed, retry %d of %d", retried, cfg.Retries)
+			}
+			sleep = cfg.RetryWait
+		} else {
+			class := classifyExit(exitCode, sig)
+			key := cfg.backoffKey(class)
+
+			if took < cfg.StartSecs {
+				failedStarts++
+				sysLogger.Printf(
+					"process exited within %v of starting, failed starts: %d",
+					cfg.StartSecs, failedStarts,
+				)
+				wait = waits[key] * 2
+			} else {
+				resetBackoff()
+			}
+
+			if cfg.FallbackCmd != "" && primaryCh == nil && took < cfg.StartSecs &&
+				(tryingPrimary || failedStarts >= cfg.FallbackAfter) {
+
+				sysLogger.Printf(
+					"switching to fallback command, will retry primary command in %v",
+					cfg.FallbackRetry,
+				)
+
+				instCfg = cfg
+				instCfg.Cmd, instCfg.Args = cfg.FallbackCmd, cfg.FallbackArgs
+				primaryCh, stopPrimary = after(cfg.clock(), cfg.FallbackRetry)
+
+				// the fallback gets a fresh start.
+				resetBackoff()
+			}
+			tryingPrimary = false
+
+			minWait, maxWait := cfg.backoffLimits(class)
+			if wait < minWait {
+				wait = minWait
+			} else if wait > maxWait {
+				wait = maxWait
+			}
+
+			waits[key] = wait
+			backoffChanged()
+
+			if noRestartMsg == "" && cfg.MaxRestarts > 0 &&
+				failedStarts > cfg.MaxRestarts {
+				noRestartMsg = fmt.Sprintf(
+					"giving up after %d consecutive failed starts", failedStarts,
+				)
+			}
+
+			sleep = wait
+
+			debugf(
+				sysLogger,
+				"backoff: %s exit, failed starts %d, wait %v (minWait %v, maxWait %v)",
+				class, failedStarts, wait, minWait, maxWait,
+			)
+
+			// only crashes count towards tripping the breaker, not clean exits
+			// or stops made by pmux.
+			crashed := !exitInfo.Stopped && exitInfo.Class != ExitClassClean
+
+			if noRestartMsg == "" && crashed &&
+				breaker.recordFailure(cfg.clock().Now()) {
+				sysLogger.Printf(
+					"circuit breaker tripped, process crashed %d times within %v, will restart in %v",
+					cfg.CircuitBreaker.Failures,
+					cfg.CircuitBreaker.Window,
+					cfg.CircuitBreaker.Cooldown,
+				)
+
+				go breaker.notify(sysLogger, cfg.Name)
+
+				// once the cooldown is over the process gets a fresh start.
+				sleep = cfg.CircuitBreaker.Cooldown
+				resetBackoff()
+				backoffChanged()
+			}
+		}
+
+		exitInfo.Restarts, exitInfo.FailedStarts = restarts, failedStarts
+		exitInfo.Restart, exitInfo.Wait = noRestartMsg == "", sleep
+
+		if cfg.RestartDecider != nil {
+			exitInfo.Restart, exitInfo.Wait = cfg.RestartDecider(exitInfo)
+			noRestartMsg = "not restarting process, as decided by restartDecider"
+		}
+
+		restart := exitInfo.Restart
+		exitInfo.Restart, exitInfo.Wait = runRestartScript(sysLogger, cfg, exitInfo)
+		if restart && !exitInfo.Restart {
+			noRestartMsg = "not restarting process, as decided by the restart script"
+		}
+
+		restart = exitInfo.Restart
+		exitInfo.Restart, exitInfo.Wait = runRestartPlugins(
+			sysLogger, opts.plugins, exitInfo,
+		)
+		if restart && !exitInfo.Restart {
+			noRestartMsg = "not restarting process, as decided by a plugin"
+		}
+
+		if !exitInfo.Restart {
+			sysLogger.Println(noRestartMsg)
+			return
+		}
+
+		sleep = exitInfo.Wait
+
+		infof(sysLogger, "will restart process in %v", sleep)
+
+		stoppedBeforeRestart := func() {
+			sysLogger.Println("stopped while waiting to restart process")
+			if opts.onStoppedBeforeRestart != nil {
+				opts.onStoppedBeforeRestart()
+			}
+		}
+
+		afterCh, stop := after(cfg.clock(), sleep)
+		select {
+		case <-afterCh:
+		case <-ctx.Done():
+			stop()
+			stoppedBeforeRestart()
+			return
+		}
+
+		if opts.waitRestart != nil && !opts.waitRestart(ctx) {
+			stoppedBeforeRestart()
+			return
+		}
+
+		// drain any restart request which was made while the process wasn't
+		// running, as it no longer applies.
+		select {
+		case <-opts.restartCh:
+		case <-watchCh:
+		default:
+		}
+
+		restarts++
+		backoffChanged()
+
+		opts.restarts = restarts
+		inst = startInstance(
+			ctx, stdoutLogger, stderrLogger, sysLogger, instCfg, opts,
+		)
+		recycleCh = recycleAfter(ctx, sysLogger, instCfg, inst)
 	}
 }
@@ -0,0 +1,78 @@
+package pmuxlib
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// ReadyCheckConfig is used to configure how pmux determines that a process
+// has finished starting and is ready to do work.
+type ReadyCheckConfig struct {
+
+	// Cmd is a shell command which is run repeatedly, using "/bin/sh -c",
+	// after the process is started. Once it exits with a zero exit code the
+	// process is considered to be ready. Like the process, it's run within
+	// the Chroot, and as the User and Group, of the process.
+	//
+	// If not set then the process is considered ready once it has been running
+	// for StartSecs.
+	Cmd string `yaml:"cmd,omitempty"`
+
+	// Interval is how long to wait between each run of Cmd.
+	//
+	// Defaults to 1 second.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+func (cfg ReadyCheckConfig) withDefaults() ReadyCheckConfig {
+	if cfg.Interval == 0 {
+		cfg.Interval = 1 * time.Second
+	}
+	return cfg
+}
+
+// waitReady blocks until the process described by the ProcessConfig, which has
+// just been started, is ready. It returns false if the context is canceled
+// first.
+func waitReady(ctx context.Context, cfg ProcessConfig) bool {
+
+	cfg = cfg.withDefaults()
+	checkCfg := cfg.ReadyCheck
+
+	if checkCfg.Cmd == "" {
+		afterCh, stop := after(cfg.clock(), cfg.StartSecs)
+		defer stop()
+		select {
+		case <-afterCh:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// the process itself won't have started if this fails.
+	sysProcAttr, err := cfg.commandSysProcAttr()
+	if err != nil {
+		return false
+	}
+
+	for {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", checkCfg.Cmd)
+		cmd.Dir = cfg.Dir
+		cmd.Env = cfg.environ()
+		cmd.SysProcAttr = sysProcAttr
+
+		if err := cmd.Run(); err == nil {
+			return true
+		}
+
+		afterCh, stop := after(cfg.clock(), checkCfg.Interval)
+		select {
+		case <-afterCh:
+		case <-ctx.Done():
+			stop()
+			return false
+		}
+	}
+}
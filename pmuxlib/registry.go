@@ -0,0 +1,602 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistryConfig configures the service registry which processes are
+// registered in, see ProcessConfig.Register. Exactly one of Consul or Etcd
+// must be set if any process is to be registered.
+type RegistryConfig struct {
+
+	// Consul is the base URL of the Consul agent which services are
+	// registered with, e.g. "http://localhost:8500".
+	Consul string `yaml:"consul,omitempty"`
+
+	// Token, or the contents of TokenFile, is sent to Consul as the ACL token
+	// of each request.
+	//
+	// Defaults to the CONSUL_HTTP_TOKEN environment variable.
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"tokenFile,omitempty"`
+
+	// Etcd is the base URL of the etcd server (its v3 JSON gateway) which
+	// services are registered in, e.g. "http://localhost:2379". Each service
+	// is written as JSON to the key "<EtcdPrefix><name>/<id>", attached to a
+	// lease with the TTL EtcdTTL which pmux keeps alive while the service is
+	// registered.
+	Etcd string `yaml:"etcd,omitempty"`
+
+	// EtcdPrefix defaults to "/services/".
+	EtcdPrefix string `yaml:"etcdPrefix,omitempty"`
+
+	// EtcdTTL defaults to 30 seconds, and must be at least 1 second, as etcd
+	// leases are given in whole seconds.
+	EtcdTTL time.Duration `yaml:"etcdTTL,omitempty"`
+}
+
+func (cfg RegistryConfig) withDefaults() RegistryConfig {
+
+	if cfg.Token == "" && cfg.TokenFile == "" {
+		cfg.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+
+	if cfg.EtcdPrefix == "" {
+		cfg.EtcdPrefix = "/services/"
+	}
+
+	if cfg.EtcdTTL == 0 {
+		cfg.EtcdTTL = 30 * time.Second
+	}
+
+	return cfg
+}
+
+func (cfg RegistryConfig) enabled() bool {
+	return cfg.Consul != "" || cfg.Etcd != ""
+}
+
+func (cfg RegistryConfig) validate() []string {
+
+	var problems []string
+
+	if cfg.Consul != "" && cfg.Etcd != "" {
+		problems = append(problems, "registry: only one of consul or etcd may be set")
+	}
+
+	if cfg.EtcdTTL < 0 {
+		problems = append(problems, "registry.etcdTTL cannot be negative")
+	} else if cfg.EtcdTTL > 0 && cfg.EtcdTTL < time.Second {
+		problems = append(problems, "registry.etcdTTL must be at least 1s")
+	}
+
+	return problems
+}
+
+// ServiceRegistration describes how a process is registered as a service in
+// the registry given by Config.Registry. The process is registered once it is
+// ready (see ReadyCheck), and deregistered when it exits.
+type ServiceRegistration struct {
+
+	// Name is the name of the service.
+	//
+	// Defaults to the name of the process, or for replicas, to the name of
+	// the process which they are replicas of.
+	Name string `yaml:"name,omitempty"`
+
+	// ID uniquely identifies the process within the service.
+	//
+	// Defaults to "<hostname>:<process name>".
+	ID string `yaml:"id,omitempty"`
+
+	// Address and Port are where the service can be reached. If Address is
+	// not set then Consul uses the address of its agent, and etcd is given
+	// the hostname.
+	Address string `yaml:"address,omitempty"`
+	Port    int    `yaml:"port,omitempty"`
+
+	Tags []string          `yaml:"tags,omitempty"`
+	Meta map[string]string `yaml:"meta,omitempty"`
+
+	// Check is the URL of an HTTP endpoint which reports the health of the
+	// process. Consul polls it every CheckInterval, and it's included in the
+	// service written to etcd.
+	//
+	// CheckInterval defaults to 10 seconds.
+	Check         string        `yaml:"check,omitempty"`
+	CheckInterval time.Duration `yaml:"checkInterval,omitempty"`
+}
+
+func (cfg ServiceRegistration) validate() []string {
+
+	var problems []string
+
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf(
+			"register.port %d is not a valid port", cfg.Port,
+		))
+	}
+
+	if cfg.CheckInterval < 0 {
+		problems = append(problems, "register.checkInterval cannot be negative")
+	}
+
+	// templates aren't expanded until the process is run.
+	if cfg.Check != "" && !strings.Contains(cfg.Check, "{{") {
+		if u, err := url.Parse(cfg.Check); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf(
+				"register.check %q is not an HTTP(S) URL", cfg.Check,
+			))
+		}
+	}
+
+	return problems
+}
+
+// withDefaults fills in the defaults of the ServiceRegistration of the given
+// process, which is a replica of replicaOf (see process.replicaOf).
+func (cfg ServiceRegistration) withDefaults(
+	procName, replicaOf string,
+) ServiceRegistration {
+
+	hostname, _ := os.Hostname()
+
+	if cfg.Name == "" {
+		cfg.Name = replicaOf
+	}
+
+	if cfg.ID == "" {
+		cfg.ID = hostname + ":" + procName
+	}
+
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = 10 * time.Second
+	}
+
+	return cfg
+}
+
+// Registrations which fail are retried after registryRetryMin, doubling on
+// each further failure up to registryRetryMax.
+const (
+	registryRetryMin = 1 * time.Second
+	registryRetryMax = 1 * time.Minute
+)
+
+// registeredService tracks the registration of a single process.
+type registeredService struct {
+
+	// want is the registration which the process should have, or nil if it
+	// should be deregistered. changedCh is closed, and replaced, whenever want
+	// is changed. Both are protected by the registryClient's lock.
+	want      *ServiceRegistration
+	changedCh chan struct{}
+
+	// l is held while the registration is being changed, and protects the
+	// fields below it.
+	l    sync.Mutex
+	have *ServiceRegistration
+
+	// leaseID and cancelKeepAlive are set while the service is registered in
+	// etcd.
+	leaseID         string
+	cancelKeepAlive context.CancelFunc
+}
+
+// registryClient registers and deregisters processes as services in Consul or
+// etcd.
+type registryClient struct {
+	cfg    RegistryConfig
+	client *http.Client
+
+	// wg tracks in-progress changes to registrations.
+	wg sync.WaitGroup
+
+	l        sync.Mutex
+	services map[string]*registeredService
+}
+
+func newRegistryClient(cfg RegistryConfig) *registryClient {
+	return &registryClient{
+		cfg:      cfg.withDefaults(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		services: map[string]*registeredService{},
+	}
+}
+
+// set causes the process of the given name to be registered using the given
+// ServiceRegistration, or deregistered if it's nil. Registration happens in
+// the background, with failures being logged to the sysLogger.
+func (c *registryClient) set(
+	procName string, sysLogger Logger, reg *ServiceRegistration,
+) {
+
+	c.l.Lock()
+	svc, ok := c.services[procName]
+	if !ok {
+		svc = new(registeredService)
+		c.services[procName] = svc
+	}
+	svc.want = reg
+	if svc.changedCh != nil {
+		close(svc.changedCh)
+	}
+	svc.changedCh = make(chan struct{})
+	changedCh := svc.changedCh
+	c.l.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.syncRetrying(svc, sysLogger, changedCh)
+	}()
+}
+
+// syncRetrying calls sync until it succeeds, waiting between each attempt
+// with a backoff, or until the desired registration of the service is changed,
+// i.e. until changedCh is closed, in which case the change's own call to
+// syncRetrying takes over.
+func (c *registryClient) syncRetrying(
+	svc *registeredService, sysLogger Logger, changedCh <-chan struct{},
+) {
+
+	wait := registryRetryMin
+
+	for !c.sync(svc, sysLogger) {
+		infof(sysLogger, "registry: retrying in %v", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changedCh:
+			timer.Stop()
+			return
+		}
+
+		if wait *= 2; wait > registryRetryMax {
+			wait = registryRetryMax
+		}
+	}
+}
+
+// sync brings the registration of the service in line with the one it should
+// have, returning false if registering it failed. As each call to set is
+// followed by a call to sync, the last of them will always see the latest
+// desired registration.
+func (c *registryClient) sync(svc *registeredService, sysLogger Logger) bool {
+
+	svc.l.Lock()
+	defer svc.l.Unlock()
+
+	c.l.Lock()
+	want := svc.want
+	c.l.Unlock()
+
+	if want == svc.have {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if have := svc.have; have != nil {
+		svc.have = nil
+		if err := c.deregister(ctx, svc, *have); err != nil {
+			sysLogger.Printf(
+				"registry: deregistering service %q: %v", have.Name, err,
+			)
+		} else {
+			infof(sysLogger, "registry: deregistered service %q", have.Name)
+		}
+	}
+
+	if want == nil {
+		return true
+	}
+
+	if err := c.register(ctx, svc, *want, sysLogger); err != nil {
+		sysLogger.Printf("registry: registering service %q: %v", want.Name, err)
+		return false
+	}
+
+	svc.have = want
+	infof(sysLogger, "registry: registered service %q", want.Name)
+	return true
+}
+
+// wait blocks until all changes to registrations have completed.
+func (c *registryClient) wait() {
+	c.wg.Wait()
+}
+
+// do makes a request to the registry, JSON encoding the body if it's not nil,
+// and decoding the response into res if that's not nil.
+func (c *registryClient) do(
+	ctx context.Context, method, url string, body, res interface{},
+) error {
+
+	var bodyR io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyR = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyR)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.Consul != "" {
+		token, err := readFileOr(c.cfg.Token, c.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("reading token: %w", err)
+		} else if token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+	}
+
+	httpRes, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(httpRes.Body, 1024))
+		return fmt.Errorf(
+			"%s %s: unexpected status %q: %s",
+			method, req.URL.Path, httpRes.Status, bytes.TrimSpace(b),
+		)
+	}
+
+	if res != nil {
+		if err := json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+			return fmt.Errorf("%s %s: decoding response: %w", method, req.URL.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *registryClient) register(
+	ctx context.Context,
+	svc *registeredService,
+	reg ServiceRegistration,
+	sysLogger Logger,
+) error {
+	if c.cfg.Consul != "" {
+		return c.consulRegister(ctx, reg)
+	}
+	return c.etcdRegister(ctx, svc, reg, sysLogger)
+}
+
+func (c *registryClient) deregister(
+	ctx context.Context, svc *registeredService, reg ServiceRegistration,
+) error {
+	if c.cfg.Consul != "" {
+		return c.consulDeregister(ctx, reg)
+	}
+	return c.etcdDeregister(ctx, svc)
+}
+
+func (c *registryClient) consulURL(path string) string {
+	return strings.TrimSuffix(c.cfg.Consul, "/") + "/v1/" + path
+}
+
+func (c *registryClient) consulRegister(
+	ctx context.Context, reg ServiceRegistration,
+) error {
+
+	type consulCheck struct {
+		HTTP                           string
+		Interval                       string
+		DeregisterCriticalServiceAfter string
+	}
+
+	body := struct {
+		ID      string
+		Name    string
+		Address string            `json:",omitempty"`
+		Port    int               `json:",omitempty"`
+		Tags    []string          `json:",omitempty"`
+		Meta    map[string]string `json:",omitempty"`
+		Check   *consulCheck      `json:",omitempty"`
+	}{
+		ID:      reg.ID,
+		Name:    reg.Name,
+		Address: reg.Address,
+		Port:    reg.Port,
+		Tags:    reg.Tags,
+		Meta:    reg.Meta,
+	}
+
+	if reg.Check != "" {
+		// Consul reaps the service if pmux fails to deregister it, e.g.
+		// because pmux was killed.
+		body.Check = &consulCheck{
+			HTTP:                           reg.Check,
+			Interval:                       reg.CheckInterval.String(),
+			DeregisterCriticalServiceAfter: "1m",
+		}
+	}
+
+	return c.do(
+		ctx, http.MethodPut, c.consulURL("agent/service/register"), body, nil,
+	)
+}
+
+func (c *registryClient) consulDeregister(
+	ctx context.Context, reg ServiceRegistration,
+) error {
+	return c.do(
+		ctx, http.MethodPut,
+		c.consulURL("agent/service/deregister/"+url.PathEscape(reg.ID)),
+		nil, nil,
+	)
+}
+
+func (c *registryClient) etcdURL(path string) string {
+	return strings.TrimSuffix(c.cfg.Etcd, "/") + "/v3/" + path
+}
+
+// etcdLease is the subset of etcd's lease responses which is needed. 64-bit
+// integers are encoded as strings by the JSON gateway.
+type etcdLease struct {
+	ID  string `json:"ID"`
+	TTL string `json:"TTL"`
+}
+
+func (c *registryClient) etcdRegister(
+	ctx context.Context,
+	svc *registeredService,
+	reg ServiceRegistration,
+	sysLogger Logger,
+) error {
+
+	if reg.Address == "" {
+		reg.Address, _ = os.Hostname()
+	}
+
+	value, err := json.Marshal(struct {
+		ID      string            `json:"id"`
+		Name    string            `json:"name"`
+		Address string            `json:"address"`
+		Port    int               `json:"port,omitempty"`
+		Tags    []string          `json:"tags,omitempty"`
+		Meta    map[string]string `json:"meta,omitempty"`
+		Check   string            `json:"check,omitempty"`
+	}{
+		reg.ID, reg.Name, reg.Address, reg.Port, reg.Tags, reg.Meta, reg.Check,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lease etcdLease
+	err = c.do(
+		ctx, http.MethodPost, c.etcdURL("lease/grant"),
+		map[string]int64{"TTL": int64(c.cfg.EtcdTTL / time.Second)},
+		&lease,
+	)
+	if err != nil {
+		return fmt.Errorf("granting lease: %w", err)
+	}
+
+	key := c.cfg.EtcdPrefix + reg.Name + "/" + reg.ID
+
+	err = c.do(
+		ctx, http.MethodPost, c.etcdURL("kv/put"),
+		map[string]string{
+			"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+			"value": base64.StdEncoding.EncodeToString(value),
+			"lease": lease.ID,
+		},
+		nil,
+	)
+	if err != nil {
+		_ = c.etcdRevoke(ctx, lease.ID)
+		return fmt.Errorf("putting %q: %w", key, err)
+	}
+
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	svc.leaseID, svc.cancelKeepAlive = lease.ID, cancel
+
+	go c.etcdKeepAlive(keepAliveCtx, svc, reg, sysLogger)
+
+	return nil
+}
+
+// etcdKeepAlive keeps the lease of the registered service alive until the
+// context is canceled. If the lease is found to have expired then the service
+// is registered again.
+func (c *registryClient) etcdKeepAlive(
+	ctx context.Context,
+	svc *registeredService,
+	reg ServiceRegistration,
+	sysLogger Logger,
+) {
+
+	ticker := time.NewTicker(c.cfg.EtcdTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		svc.l.Lock()
+		if ctx.Err() != nil {
+			svc.l.Unlock()
+			return
+		}
+
+		var res struct {
+			Result etcdLease `json:"result"`
+		}
+
+		err := c.do(
+			ctx, http.MethodPost, c.etcdURL("lease/keepalive"),
+			map[string]string{"ID": svc.leaseID}, &res,
+		)
+		if err != nil {
+			sysLogger.Printf(
+				"registry: keeping service %q alive: %v", reg.Name, err,
+			)
+
+		} else if ttl, _ := strconv.Atoi(res.Result.TTL); ttl <= 0 {
+			sysLogger.Printf(
+				"registry: lease of service %q expired, registering again",
+				reg.Name,
+			)
+
+			// the service is no longer registered, so sync will register it
+			// again, retrying until it succeeds or the registration which
+			// is wanted changes.
+			svc.cancelKeepAlive()
+			svc.have, svc.leaseID, svc.cancelKeepAlive = nil, "", nil
+			svc.l.Unlock()
+
+			c.l.Lock()
+			changedCh := svc.changedCh
+			c.l.Unlock()
+
+			c.syncRetrying(svc, sysLogger, changedCh)
+			return
+		}
+
+		svc.l.Unlock()
+	}
+}
+
+func (c *registryClient) etcdRevoke(ctx context.Context, leaseID string) error {
+	return c.do(
+		ctx, http.MethodPost, c.etcdURL("lease/revoke"),
+		map[string]string{"ID": leaseID}, nil,
+	)
+}
+
+// etcdDeregister revokes the lease of the service, which deletes its key.
+func (c *registryClient) etcdDeregister(
+	ctx context.Context, svc *registeredService,
+) error {
+	svc.cancelKeepAlive()
+	return c.etcdRevoke(ctx, svc.leaseID)
+}
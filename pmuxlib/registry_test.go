@@ -0,0 +1,60 @@
+package pmuxlib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		cfg   RegistryConfig
+		valid bool
+	}{
+		{"default ttl", RegistryConfig{Etcd: "http://etcd"}, true},
+		{"1s ttl", RegistryConfig{Etcd: "http://etcd", EtcdTTL: time.Second}, true},
+		{"short ttl", RegistryConfig{Etcd: "http://etcd", EtcdTTL: 300 * time.Millisecond}, false},
+		{"negative ttl", RegistryConfig{Etcd: "http://etcd", EtcdTTL: -time.Second}, false},
+		{"both", RegistryConfig{Etcd: "http://etcd", Consul: "http://consul"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := test.cfg.validate()
+			if valid := len(problems) == 0; valid != test.valid {
+				t.Fatalf("expected valid %v, got problems %q", test.valid, problems)
+			}
+		})
+	}
+}
+
+func TestRegistryRetry(t *testing.T) {
+
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/service/register" {
+			return
+		} else if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	c := newRegistryClient(RegistryConfig{Consul: srv.URL})
+
+	c.set("a", new(NullLogger), &ServiceRegistration{Name: "a", ID: "a"})
+	c.wait()
+
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+
+	svc := c.services["a"]
+	if svc.have == nil || svc.have != svc.want {
+		t.Fatalf("expected service to be registered")
+	}
+}
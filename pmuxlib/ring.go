@@ -0,0 +1,62 @@
+package pmuxlib
+
+import "sync"
+
+// lineRing holds the most recent lines written to it, up to a fixed size.
+type lineRing struct {
+	l     sync.Mutex
+	size  int
+	next  int
+	full  bool
+	lines []string
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{size: size, lines: make([]string, size)}
+}
+
+func (r *lineRing) add(line string) {
+	if r.size <= 0 {
+		return
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % r.size
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// get returns the lines held by the ring, oldest first.
+func (r *lineRing) get() []string {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+
+	lines := make([]string, 0, r.size)
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+// ringLogger is a Logger which writes each line to a lineRing as well as to
+// the wrapped Logger.
+type ringLogger struct {
+	Logger
+	ring *lineRing
+}
+
+func (l ringLogger) Println(line string) {
+	l.ring.add(line)
+	l.Logger.Println(line)
+}
+
+func (l ringLogger) printlnLevel(level LogLevel, line string) {
+	l.ring.add(line)
+	printlnLevel(l.Logger, level, line)
+}
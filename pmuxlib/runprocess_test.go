@@ -0,0 +1,174 @@
+package pmuxlib_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+	"github.com/cryptic-io/pmux/pmuxtest"
+)
+
+// restartWaits runs the process using a FakeClock until it has logged n
+// restart waits, and returns them.
+func restartWaits(t *testing.T, cfg pmuxlib.ProcessConfig, n int) []string {
+
+	clock := pmuxtest.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg.Clock = clock
+
+	sysLogger := new(pmuxlib.BufferLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		pmuxlib.RunProcess(
+			ctx, new(pmuxlib.NullLogger), new(pmuxlib.NullLogger), sysLogger, cfg,
+		)
+	}()
+	defer func() {
+		cancel()
+		<-doneCh
+	}()
+
+	const prefix = "will restart process in "
+
+	waits := func() []string {
+		var waits []string
+		for _, line := range sysLogger.Lines() {
+			if strings.HasPrefix(line.Line, prefix) {
+				waits = append(waits, strings.TrimPrefix(line.Line, prefix))
+			}
+		}
+		return waits
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := waits()
+		if len(got) >= n {
+			return got[:n]
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out, logged:\n%s", sysLogger)
+		}
+
+		// the restart's timer may not have been created yet, in which case
+		// the clock is advanced again on the next iteration.
+		if len(got) > 0 {
+			d, err := time.ParseDuration(got[len(got)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(d)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunProcessBackoff(t *testing.T) {
+
+	dur := func(d time.Duration) *time.Duration { return &d }
+
+	tests := []struct {
+		name     string
+		cfg      pmuxlib.ProcessConfig
+		expWaits []string
+	}{
+		{
+			name: "failing",
+			cfg: pmuxlib.ProcessConfig{
+				Cmd:     "/bin/sh",
+				Args:    []string{"-c", "exit 1"},
+				MinWait: time.Second,
+				MaxWait: 8 * time.Second,
+			},
+			expWaits: []string{"1s", "2s", "4s", "8s", "8s"},
+		},
+		{
+			name: "clean exit override",
+			cfg: pmuxlib.ProcessConfig{
+				Cmd:     "/bin/sh",
+				Args:    []string{"-c", "exit 0"},
+				MinWait: time.Second,
+				MaxWait: 8 * time.Second,
+				Backoff: map[pmuxlib.ExitClass]pmuxlib.BackoffConfig{
+					pmuxlib.ExitClassClean: {
+						MinWait: dur(3 * time.Second),
+						MaxWait: dur(10 * time.Second),
+					},
+				},
+			},
+			expWaits: []string{"3s", "6s", "10s", "10s"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cfg.Name = "test"
+			got := restartWaits(t, test.cfg, len(test.expWaits))
+			if !reflect.DeepEqual(got, test.expWaits) {
+				t.Fatalf("expected waits %q, got %q", test.expWaits, got)
+			}
+		})
+	}
+}
+
+func TestRunProcessMaxRunTimeWindow(t *testing.T) {
+
+	clock := pmuxtest.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	cfg := pmuxlib.ProcessConfig{
+		Name:          "test",
+		Cmd:           "sleep",
+		Args:          []string{"100"},
+		MaxRunTime:    time.Hour,
+		RestartWindow: "02:00-04:00",
+		Clock:         clock,
+	}
+
+	sysLogger := new(pmuxlib.BufferLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		pmuxlib.RunProcess(
+			ctx, new(pmuxlib.NullLogger), new(pmuxlib.NullLogger), sysLogger, cfg,
+		)
+	}()
+	defer func() {
+		cancel()
+		<-doneCh
+	}()
+
+	logged := func(msg string) bool {
+		for _, line := range sysLogger.Lines() {
+			if line.Line == msg {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the clock is advanced in steps until the process is recycled, which
+	// must not happen until the clock is within the restart window.
+	deadline := time.Now().Add(10 * time.Second)
+	for !logged("process has exceeded maxRunTime of 1h0m0s") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out, logged:\n%s", sysLogger)
+		}
+		clock.Advance(10 * time.Minute)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if now := clock.Now(); now.Hour() < 2 || now.Hour() >= 4 {
+		t.Fatalf("process recycled at %v, outside of its restart window", now)
+	}
+
+	if !logged("process has exceeded maxRunTime of 1h0m0s, waiting for restart window") {
+		t.Fatalf("expected to wait for restart window, logged:\n%s", sysLogger)
+	}
+}
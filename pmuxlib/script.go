@@ -0,0 +1,284 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// scriptShTimeout is the longest that a command run by the "sh" function of a
+// script may take.
+const scriptShTimeout = 30 * time.Second
+
+// ScriptsConfig holds scripts which customize decisions made about a process.
+// Scripts are text/template templates, whose output is the decision. Besides
+// the built-in template functions, scripts may use:
+//
+//   - log <args...>: logs the arguments to the process's system log.
+//   - sh <cmd>: runs cmd using "/bin/sh -c", with PMUX_PROC set to the name of
+//     the process, and logs any output it has, e.g. to page someone.
+//   - duration <str>: parses a duration, e.g. (duration "10s"), for comparing
+//     with other durations.
+//   - contains, hasPrefix, hasSuffix <str> <substr>: as in the strings package.
+//   - matches <regexp> <str>: reports whether str matches the regexp.
+//
+// log and sh output nothing.
+//
+// Scripts are templates, rather than being written in an embedded language
+// such as Starlark or Lua, so that pmux doesn't need to carry an interpreter,
+// and so that they look like the templates which the rest of the config may
+// already use (see TemplateData). The decisions they make are small enough
+// that text/template, with the functions above, is sufficient.
+type ScriptsConfig struct {
+
+	// Restart is evaluated whenever the process exits of its own accord, with
+	// a RestartScriptData as its data, after the built-in restart policy and
+	// any RestartDecider. It may output:
+	//
+	//   - nothing, or "default", to leave the decision as it is.
+	//   - "restart", to restart the process after the usual wait.
+	//   - "restart <duration>", to restart it after the given wait, e.g.
+	//     "restart 30s".
+	//   - "stop", to not restart it.
+	//
+	// For example:
+	//
+	//	{{if and (eq .Signal "SIGKILL") (lt .Ran (duration "10s"))}}
+	//	  {{sh "page-ops oom"}}stop
+	//	{{end}}
+	Restart string `yaml:"restart,omitempty"`
+
+	// Route is evaluated for each line of output of the process, with a
+	// RouteScriptData as its data, and determines where the line is written
+	// to. It may output nothing, or "default", to write the line where it
+	// would otherwise be written, or an OutputStream ("stdout", "stderr", or
+	// "discard"). For example:
+	//
+	//	{{if matches "^DEBUG" .Line}}discard{{end}}
+	Route string `yaml:"route,omitempty"`
+}
+
+// RestartScriptData is the data which ScriptsConfig.Restart is evaluated
+// with. It's an ExitInfo, with the addition of Signal being given by name
+// (e.g. "SIGKILL"), or empty if the process wasn't terminated by a signal,
+// and Error being the string form of Err.
+type RestartScriptData struct {
+	ExitInfo
+	Signal string
+	Error  string
+}
+
+// RouteScriptData is the data which ScriptsConfig.Route is evaluated with.
+type RouteScriptData struct {
+
+	// Process is the name of the process.
+	Process string
+
+	// Stream is the name of the pipe the line was read from, "stdout",
+	// "stderr", or the name of one of the process's Streams. If stderr is
+	// sent to the same place as stdout then both share the "stdout" pipe.
+	Stream string
+
+	// Line is the line of output, without its trailing newline.
+	Line string
+}
+
+// parseScript parses the script, with the given Logger being used by the
+// functions which log. The name of the process is made available to commands
+// run by the script.
+func parseScript(
+	name, script string, sysLogger Logger, procName string,
+) (
+	*template.Template, error,
+) {
+
+	funcs := template.FuncMap{
+		"log": func(args ...interface{}) string {
+			sysLogger.Printf("%s script: %s", name, fmt.Sprint(args...))
+			return ""
+		},
+		"sh": func(cmdStr string) string {
+			ctx, cancel := context.WithTimeout(context.Background(), scriptShTimeout)
+			defer cancel()
+
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", cmdStr)
+			cmd.Env = append(os.Environ(), "PMUX_PROC="+procName)
+
+			out, err := cmd.CombinedOutput()
+			if out = bytes.TrimSpace(out); len(out) > 0 {
+				sysLogger.Printf("%s script: sh %q: %s", name, cmdStr, out)
+			}
+			if err != nil {
+				sysLogger.Printf("%s script: sh %q: %v", name, cmdStr, err)
+			}
+			return ""
+		},
+		"duration":  time.ParseDuration,
+		"contains":  strings.Contains,
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": strings.HasSuffix,
+		"matches":   regexp.MatchString,
+	}
+
+	return template.New(name).Funcs(funcs).Parse(script)
+}
+
+func (cfg ScriptsConfig) validate() []string {
+
+	var problems []string
+
+	for _, script := range []struct {
+		name, src string
+	}{
+		{"restart", cfg.Restart},
+		{"route", cfg.Route},
+	} {
+		if script.src == "" {
+			continue
+		}
+
+		if _, err := parseScript(script.name, script.src, new(NullLogger), ""); err != nil {
+			problems = append(problems, fmt.Sprintf("scripts.%s: %v", script.name, err))
+		}
+	}
+
+	return problems
+}
+
+func runScript(tpl *template.Template, data interface{}) (string, error) {
+	out := new(strings.Builder)
+	if err := tpl.Execute(out, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// runRestartScript evaluates the process's restart script, if it has one,
+// returning the resulting decision of whether to restart the process and how
+// long to wait before doing so. If the script fails then the decision is left
+// as it was.
+func runRestartScript(
+	sysLogger Logger, cfg ProcessConfig, info ExitInfo,
+) (
+	bool, time.Duration,
+) {
+
+	if cfg.Scripts.Restart == "" {
+		return info.Restart, info.Wait
+	}
+
+	tpl, err := parseScript("restart", cfg.Scripts.Restart, sysLogger, cfg.Name)
+	if err != nil {
+		sysLogger.Printf("restart script: %v", err)
+		return info.Restart, info.Wait
+	}
+
+	data := RestartScriptData{ExitInfo: info}
+	if info.Signal != 0 {
+		data.Signal = signalName(info.Signal)
+	}
+	if info.Err != nil {
+		data.Error = info.Err.Error()
+	}
+
+	out, err := runScript(tpl, data)
+	if err != nil {
+		sysLogger.Printf("restart script: %v", err)
+		return info.Restart, info.Wait
+	}
+
+	switch decision, waitStr, _ := strings.Cut(out, " "); decision {
+	case "", "default":
+	case "stop":
+		info.Restart = false
+	case "restart":
+		info.Restart = true
+		if waitStr == "" {
+			break
+		}
+
+		wait, err := time.ParseDuration(strings.TrimSpace(waitStr))
+		if err != nil || wait < 0 {
+			sysLogger.Printf("restart script: invalid wait %q", waitStr)
+			break
+		}
+		info.Wait = wait
+	default:
+		sysLogger.Printf("restart script: unknown decision %q", out)
+	}
+
+	return info.Restart, info.Wait
+}
+
+// routeLogger implements Logger by evaluating a ScriptsConfig.Route script for
+// each line, and writing the line to the Logger it decides on.
+type routeLogger struct {
+	tpl                        *template.Template
+	sysLogger                  Logger
+	procName, stream           string
+	logger                     Logger
+	stdoutLogger, stderrLogger Logger
+}
+
+// newRouteLoggers returns a function which wraps the Logger which output of
+// the given stream is written to, so that it's routed by the process's route
+// script. If the process has no route script then Loggers are returned as-is.
+func newRouteLoggers(
+	sysLogger Logger, cfg ProcessConfig, stdoutLogger, stderrLogger Logger,
+) (
+	func(stream string, logger Logger) Logger, error,
+) {
+
+	if cfg.Scripts.Route == "" {
+		return func(_ string, logger Logger) Logger { return logger }, nil
+	}
+
+	tpl, err := parseScript("route", cfg.Scripts.Route, sysLogger, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing route script: %w", err)
+	}
+
+	return func(stream string, logger Logger) Logger {
+		return routeLogger{
+			tpl:          tpl,
+			sysLogger:    sysLogger,
+			procName:     cfg.Name,
+			stream:       stream,
+			logger:       logger,
+			stdoutLogger: stdoutLogger,
+			stderrLogger: stderrLogger,
+		}
+	}, nil
+}
+
+func (l routeLogger) Println(line string) {
+
+	out, err := runScript(l.tpl, RouteScriptData{
+		Process: l.procName,
+		Stream:  l.stream,
+		Line:    line,
+	})
+
+	switch to := OutputStream(out); {
+	case err != nil:
+		l.sysLogger.Printf("route script: %v", err)
+		l.logger.Println(line)
+	case to == "", to == "default":
+		l.logger.Println(line)
+	case to == OutputStreamStdout, to == OutputStreamStderr, to == OutputStreamDiscard:
+		outputStreamLogger(l.stdoutLogger, l.stderrLogger, to).Println(line)
+	default:
+		l.sysLogger.Printf("route script: unknown destination %q", out)
+		l.logger.Println(line)
+	}
+}
+
+func (l routeLogger) Printf(str string, args ...interface{}) {
+	l.Println(fmt.Sprintf(str, args...))
+}
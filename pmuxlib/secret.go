@@ -0,0 +1,127 @@
+package pmuxlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// secretHTTPClient is used for all requests made to secret managers.
+var secretHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// secretRef is a parsed EnvValue Secret reference, which has the form
+// "<scheme>://<name>[#<key>]".
+type secretRef struct {
+	scheme, name, key string
+}
+
+const (
+	secretSchemeAWS = "aws-sm"
+	secretSchemeGCP = "gcp-sm"
+)
+
+func parseSecretRef(str string) (secretRef, error) {
+
+	scheme, rest, ok := strings.Cut(str, "://")
+	if !ok {
+		return secretRef{}, fmt.Errorf("secret %q is not of the form <scheme>://<name>", str)
+	}
+
+	var ref secretRef
+	ref.scheme = scheme
+	ref.name, ref.key, _ = strings.Cut(rest, "#")
+
+	if ref.name == "" {
+		return secretRef{}, fmt.Errorf("secret %q has no name", str)
+	}
+
+	switch ref.scheme {
+	case secretSchemeAWS:
+	case secretSchemeGCP:
+		if _, err := gcpSecretVersionName(ref.name); err != nil {
+			return secretRef{}, fmt.Errorf("secret %q: %w", str, err)
+		}
+	default:
+		return secretRef{}, fmt.Errorf(
+			"secret %q has unknown scheme, must be one of %q or %q",
+			str, secretSchemeAWS, secretSchemeGCP,
+		)
+	}
+
+	return ref, nil
+}
+
+// fetchSecret returns the value of the secret referenced by the given string,
+// fetching it from the secret manager indicated by its scheme. Fetched secrets
+// are stored in the given cache, keyed by scheme and name, so that secrets
+// referenced more than once (e.g. with different keys) are only fetched once.
+func fetchSecret(
+	ctx context.Context, str string, cache map[string]string,
+) (
+	string, error,
+) {
+
+	ref, err := parseSecretRef(str)
+	if err != nil {
+		return "", err
+	}
+
+	cacheKey := ref.scheme + "://" + ref.name
+
+	val, ok := cache[cacheKey]
+	if !ok {
+		switch ref.scheme {
+		case secretSchemeAWS:
+			val, err = fetchAWSSecret(ctx, ref.name)
+		case secretSchemeGCP:
+			val, err = fetchGCPSecret(ctx, ref.name)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("fetching secret %q: %w", ref.name, err)
+		}
+
+		cache[cacheKey] = val
+	}
+
+	if ref.key == "" {
+		return val, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(val), &fields); err != nil {
+		return "", fmt.Errorf(
+			"secret %q is not a JSON object, can't get key %q: %w",
+			ref.name, ref.key, err,
+		)
+	}
+
+	fieldVal, err := dataField(fields, ref.key)
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", ref.name, err)
+	}
+
+	return fieldVal, nil
+}
+
+// dataField returns the value of the named field of the given secret data. If
+// the value is not a string then it is JSON encoded.
+func dataField(data map[string]interface{}, name string) (string, error) {
+	v, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("field %q not found", name)
+	}
+
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("encoding field %q: %w", name, err)
+	}
+	return string(b), nil
+}
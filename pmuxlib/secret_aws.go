@@ -0,0 +1,424 @@
+package pmuxlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials are the credentials used to sign requests to AWS.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// expired returns true if the credentials expire within the next minute.
+func (c awsCredentials) expired() bool {
+	return !c.Expiration.IsZero() && time.Until(c.Expiration) < time.Minute
+}
+
+var awsCreds struct {
+	sync.Mutex
+	awsCredentials
+}
+
+// getAWSCredentials returns AWS credentials, looking for them in some of the
+// places which the AWS SDKs do, in order: the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables, the static keys of a profile in
+// the shared credentials file, the ECS container credentials endpoint, and the
+// EC2 instance metadata service. Web identity (e.g. IRSA), SSO, assume-role
+// and credential_process profiles, and the shared config file, aren't
+// supported.
+func getAWSCredentials(ctx context.Context) (awsCredentials, error) {
+
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	if creds, ok, err := awsSharedCredentials(); err != nil {
+		return awsCredentials{}, err
+	} else if ok {
+		return creds, nil
+	}
+
+	awsCreds.Lock()
+	defer awsCreds.Unlock()
+
+	if awsCreds.AccessKeyID != "" && !awsCreds.expired() {
+		return awsCreds.awsCredentials, nil
+	}
+
+	var (
+		creds awsCredentials
+		err   error
+	)
+
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" ||
+		os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		creds, err = awsContainerCredentials(ctx)
+	} else {
+		creds, err = awsInstanceCredentials(ctx)
+	}
+
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	awsCreds.awsCredentials = creds
+	return creds, nil
+}
+
+// awsSharedCredentials reads the profile given by AWS_PROFILE (or "default")
+// from the shared credentials file, if there is one.
+func awsSharedCredentials() (awsCredentials, bool, error) {
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, false, nil
+	} else if err != nil {
+		return awsCredentials{}, false, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer f.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	var (
+		creds     awsCredentials
+		inProfile bool
+		scanner   = bufio.NewScanner(f)
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		} else if !inProfile {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			creds.Token = strings.TrimSpace(v)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, false, fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	return creds, creds.AccessKeyID != "", nil
+}
+
+func awsGetJSON(
+	ctx context.Context, url string, header http.Header, into interface{},
+) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s: unexpected status %q", url, res.Status)
+	}
+
+	if s, ok := into.(*string); ok {
+		b, err := io.ReadAll(res.Body)
+		*s = string(b)
+		return err
+	}
+
+	return json.NewDecoder(res.Body).Decode(into)
+}
+
+func awsContainerCredentials(ctx context.Context) (awsCredentials, error) {
+
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relURI != "" {
+		url = "http://169.254.170.2" + relURI
+	}
+
+	header := http.Header{}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		header.Set("Authorization", token)
+	}
+
+	var creds awsCredentials
+	if err := awsGetJSON(ctx, url, header, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("getting container credentials: %w", err)
+	}
+
+	return creds, nil
+}
+
+// awsIMDSURL is the base URL of the EC2 instance metadata service.
+const awsIMDSURL = "http://169.254.169.254/latest"
+
+func awsInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPut, awsIMDSURL+"/api/token", nil,
+	)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf(
+			"no credentials found, and getting instance metadata token: %w", err,
+		)
+	}
+	defer res.Body.Close()
+
+	token, err := io.ReadAll(res.Body)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("reading instance metadata token: %w", err)
+	} else if res.StatusCode/100 != 2 {
+		return awsCredentials{}, fmt.Errorf(
+			"getting instance metadata token: unexpected status %q", res.Status,
+		)
+	}
+
+	header := http.Header{}
+	header.Set("X-aws-ec2-metadata-token", string(token))
+
+	credsURL := awsIMDSURL + "/meta-data/iam/security-credentials/"
+
+	var role string
+	if err := awsGetJSON(ctx, credsURL, header, &role); err != nil {
+		return awsCredentials{}, fmt.Errorf("getting instance role: %w", err)
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+
+	var creds awsCredentials
+	if err := awsGetJSON(ctx, credsURL+role, header, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("getting instance credentials: %w", err)
+	}
+
+	return creds, nil
+}
+
+// awsSecretRegion returns the region which the given secret is in, which is
+// taken from the secret ID if it's an ARN, and otherwise from the
+// AWS_REGION or AWS_DEFAULT_REGION environment variables.
+func awsSecretRegion(secretID string) (string, error) {
+
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if parts := strings.Split(secretID, ":"); len(parts) >= 4 && parts[0] == "arn" {
+		return parts[3], nil
+	}
+
+	for _, k := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(k); region != "" {
+			return region, nil
+		}
+	}
+
+	return "", fmt.Errorf("no region set, set AWS_REGION or use the secret's ARN")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWSRequest signs the request using AWS Signature Version 4. The request
+// must have no query parameters, and body must be its body.
+func signAWSRequest(
+	req *http.Request, body []byte, creds awsCredentials, region, service string,
+	now time.Time,
+) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-date"}
+	if creds.Token != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	signedHeaders = append(signedHeaders, "x-amz-target")
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// fetchAWSSecret returns the current value of the given secret, which may be
+// its name or ARN, from AWS Secrets Manager. The endpoint can be overridden
+// using the AWS_ENDPOINT_URL_SECRETS_MANAGER or AWS_ENDPOINT_URL environment
+// variables.
+func fetchAWSSecret(ctx context.Context, secretID string) (string, error) {
+
+	region, err := awsSecretRegion(secretID)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := getAWSCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := "https://secretsmanager." + region + ".amazonaws.com"
+	for _, k := range []string{"AWS_ENDPOINT_URL_SECRETS_MANAGER", "AWS_ENDPOINT_URL"} {
+		if u := os.Getenv(k); u != "" {
+			endpoint = u
+			break
+		}
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing endpoint %q: %w", endpoint, err)
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, endpointURL.String(), bytes.NewReader(body),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now())
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var resBody struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		SecretString *string
+		SecretBinary string
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return "", fmt.Errorf("decoding response (status %q): %w", res.Status, err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s", resBody.Type, resBody.Message)
+	}
+
+	if resBody.SecretString != nil {
+		return *resBody.SecretString, nil
+	}
+
+	// SecretBinary is base64 encoded, and is left that way so that the value
+	// is safe to put in an env var.
+	return resBody.SecretBinary, nil
+}
@@ -0,0 +1,83 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+
+	// the expected Authorization headers were produced by the v4 signer of
+	// aws-sdk-go-v2, given the same requests.
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+
+	tests := []struct {
+		name          string
+		url, body     string
+		token, region string
+		exp           string
+	}{
+		{
+			name:   "name",
+			url:    "https://secretsmanager.us-east-1.amazonaws.com",
+			body:   `{"SecretId":"prod/db"}`,
+			region: "us-east-1",
+			exp:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target, Signature=eabee390746276231c94d4b6d3fe482aa5b5e66bf755866681a3cbf97b3b9645",
+		},
+		{
+			name:   "arn with session token",
+			url:    "https://secretsmanager.eu-west-2.amazonaws.com/",
+			body:   `{"SecretId":"arn:aws:secretsmanager:eu-west-2:123456789012:secret:prod/db-AbCdEf"}`,
+			token:  "AQoDYXdzEPT//////////wEXAMPLEtc764",
+			region: "eu-west-2",
+			exp:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/eu-west-2/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=dd8d784c2f9fbb10428ac5d54e2a9457eb9b17b0d01173489f2ad365aef0a0cb",
+		},
+		{
+			name:   "endpoint with port",
+			url:    "http://localhost:4566",
+			body:   `{"SecretId":"x"}`,
+			region: "us-east-1",
+			exp:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target, Signature=1af1ab573725dcfd59d8f24db3a14de565703cadd47a3e50021c130dcd55fb86",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := []byte(test.body)
+
+			req, err := http.NewRequest(
+				http.MethodPost, test.url, bytes.NewReader(body),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+			req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+
+			creds := creds
+			creds.Token = test.token
+
+			signAWSRequest(req, body, creds, test.region, "secretsmanager", now)
+
+			if got := req.Header.Get("Authorization"); got != test.exp {
+				t.Fatalf("expected Authorization:\n%s\ngot:\n%s", test.exp, got)
+			}
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Fatalf("unexpected X-Amz-Date %q", got)
+			}
+
+			if got := req.Header.Get("X-Amz-Security-Token"); got != test.token {
+				t.Fatalf("unexpected X-Amz-Security-Token %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package pmuxlib
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpSecretManagerURL is the base URL of the GCP Secret Manager API.
+const gcpSecretManagerURL = "https://secretmanager.googleapis.com/v1/"
+
+// gcpScope is the OAuth scope requested for access tokens.
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpSecretVersionName returns the full resource name of the secret version
+// described by the given name, which is either of the form
+// "projects/<project>/secrets/<secret>[/versions/<version>]" or the short
+// form "<project>/<secret>[/<version>]". The version defaults to "latest".
+func gcpSecretVersionName(name string) (string, error) {
+
+	parts := strings.Split(name, "/")
+
+	var project, secret, version string
+	switch {
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets":
+		project, secret = parts[1], parts[3]
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "secrets" &&
+		parts[4] == "versions":
+		project, secret, version = parts[1], parts[3], parts[5]
+	case len(parts) == 2:
+		project, secret = parts[0], parts[1]
+	case len(parts) == 3:
+		project, secret, version = parts[0], parts[1], parts[2]
+	default:
+		return "", fmt.Errorf(
+			"name must be of the form projects/<project>/secrets/<secret>[/versions/<version>] or <project>/<secret>[/<version>]",
+		)
+	}
+
+	if project == "" || secret == "" {
+		return "", fmt.Errorf("project and secret must not be empty")
+	}
+
+	if version == "" {
+		version = "latest"
+	}
+
+	return "projects/" + project + "/secrets/" + secret + "/versions/" + version, nil
+}
+
+// gcpCredentialsFile is the subset of the fields of a service account key
+// file, or of an authorized user credentials file as written by
+// `gcloud auth application-default login`, which is needed.
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+var gcpAccessToken struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// getGCPAccessToken returns an OAuth access token, using a subset of the
+// application default credentials which the GCP SDKs use: the credentials
+// file pointed to by GOOGLE_APPLICATION_CREDENTIALS, the gcloud application
+// default credentials file, and finally the metadata server. Only
+// service_account and authorized_user credentials files are supported, not
+// e.g. external_account (workload identity federation) or
+// impersonated_service_account ones.
+func getGCPAccessToken(ctx context.Context) (string, error) {
+	gcpAccessToken.Lock()
+	defer gcpAccessToken.Unlock()
+
+	if gcpAccessToken.token != "" &&
+		time.Until(gcpAccessToken.expires) > time.Minute {
+		return gcpAccessToken.token, nil
+	}
+
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(
+				home, ".config", "gcloud", "application_default_credentials.json",
+			)
+			if _, err := os.Stat(path); err != nil {
+				path = ""
+			}
+		}
+	}
+
+	var (
+		token gcpToken
+		err   error
+	)
+
+	if path != "" {
+		token, err = gcpFileToken(ctx, path)
+	} else {
+		token, err = gcpMetadataToken(ctx)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	gcpAccessToken.token = token.AccessToken
+	gcpAccessToken.expires = time.Now().Add(
+		time.Duration(token.ExpiresIn) * time.Second,
+	)
+
+	return token.AccessToken, nil
+}
+
+func gcpPostToken(
+	ctx context.Context, tokenURI string, form url.Values,
+) (
+	gcpToken, error,
+) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return gcpToken{}, fmt.Errorf(
+			"POST %s: unexpected status %q", tokenURI, res.Status,
+		)
+	}
+
+	var token gcpToken
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return gcpToken{}, fmt.Errorf("decoding token: %w", err)
+	}
+
+	return token, nil
+}
+
+func gcpFileToken(ctx context.Context, path string) (gcpToken, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return gcpToken{}, fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	var creds gcpCredentialsFile
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return gcpToken{}, fmt.Errorf("parsing credentials file %q: %w", path, err)
+	}
+
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	switch creds.Type {
+	case "service_account":
+		assertion, err := gcpSignJWT(creds, time.Now())
+		if err != nil {
+			return gcpToken{}, fmt.Errorf("credentials file %q: %w", path, err)
+		}
+
+		return gcpPostToken(ctx, creds.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+
+	case "authorized_user":
+		return gcpPostToken(ctx, creds.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.ClientID},
+			"client_secret": {creds.ClientSecret},
+			"refresh_token": {creds.RefreshToken},
+		})
+
+	default:
+		return gcpToken{}, fmt.Errorf(
+			"credentials file %q has unsupported type %q", path, creds.Type,
+		)
+	}
+}
+
+// gcpSignJWT returns a JWT signed by the service account, which can be
+// exchanged for an access token.
+func gcpSignJWT(creds gcpCredentialsFile, now time.Time) (string, error) {
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("private_key is not PEM encoded")
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing private_key: %w", err)
+	}
+
+	key, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private_key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("signing: %w", err)
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// gcpMetadataToken gets an access token for the default service account from
+// the metadata server. The metadata server's host can be overridden using the
+// GCE_METADATA_HOST environment variable.
+func gcpMetadataToken(ctx context.Context) (gcpToken, error) {
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	url := "http://" + host +
+		"/computeMetadata/v1/instance/service-accounts/default/token"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return gcpToken{}, fmt.Errorf(
+			"no credentials found, and getting token from metadata server: %w", err,
+		)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return gcpToken{}, fmt.Errorf(
+			"getting token from metadata server: unexpected status %q", res.Status,
+		)
+	}
+
+	var token gcpToken
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return gcpToken{}, fmt.Errorf("decoding token: %w", err)
+	}
+
+	return token, nil
+}
+
+// fetchGCPSecret returns the value of the given secret version from GCP
+// Secret Manager. See gcpSecretVersionName for the accepted forms of name.
+func fetchGCPSecret(ctx context.Context, name string) (string, error) {
+
+	versionName, err := gcpSecretVersionName(name)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := getGCPAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, gcpSecretManagerURL+versionName+":access", nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var resBody struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return "", fmt.Errorf("decoding response (status %q): %w", res.Status, err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s", res.Status, resBody.Error.Message)
+	}
+
+	return string(resBody.Payload.Data), nil
+}
@@ -0,0 +1,132 @@
+package pmuxlib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCPSecretVersionName(t *testing.T) {
+	tests := []struct {
+		name, exp string
+		expErr    bool
+	}{
+		{name: "proj/sec", exp: "projects/proj/secrets/sec/versions/latest"},
+		{name: "proj/sec/3", exp: "projects/proj/secrets/sec/versions/3"},
+		{
+			name: "projects/proj/secrets/sec",
+			exp:  "projects/proj/secrets/sec/versions/latest",
+		},
+		{
+			name: "projects/proj/secrets/sec/versions/3",
+			exp:  "projects/proj/secrets/sec/versions/3",
+		},
+		{name: "sec", expErr: true},
+		{name: "/sec", expErr: true},
+		{name: "projects/proj/secret/sec", expErr: true},
+		{name: "a/b/c/d/e", expErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := gcpSecretVersionName(test.name)
+			if test.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got != test.exp {
+				t.Fatalf("expected %q, got %q", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestGCPSignJWT(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := gcpCredentialsFile{
+		Type:         "service_account",
+		ClientEmail:  "pmux@proj.iam.gserviceaccount.com",
+		PrivateKeyID: "abc123",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: keyBytes,
+		})),
+		TokenURI: "https://oauth2.googleapis.com/token",
+	}
+
+	now := time.Unix(1700000000, 0)
+
+	jwt, err := gcpSignJWT(creds, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+
+	enc := base64.RawURLEncoding
+	decode := func(part string, into interface{}) {
+		t.Helper()
+		b, err := enc.DecodeString(part)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(b, into); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var header map[string]string
+	decode(parts[0], &header)
+
+	expHeader := map[string]string{"alg": "RS256", "typ": "JWT", "kid": "abc123"}
+	if !reflect.DeepEqual(header, expHeader) {
+		t.Fatalf("expected header %v, got %v", expHeader, header)
+	}
+
+	var claims map[string]interface{}
+	decode(parts[1], &claims)
+
+	expClaims := map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   creds.TokenURI,
+		"iat":   float64(1700000000),
+		"exp":   float64(1700003600),
+	}
+	if !reflect.DeepEqual(claims, expClaims) {
+		t.Fatalf("expected claims %v, got %v", expClaims, claims)
+	}
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Fatalf("verifying signature: %v", err)
+	}
+}
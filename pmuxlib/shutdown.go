@@ -0,0 +1,120 @@
+package pmuxlib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ShutdownReason describes why Run returned.
+type ShutdownReason string
+
+// Enumeration of possible ShutdownReason values.
+const (
+	// ShutdownReasonCanceled indicates that the context given to Run was
+	// canceled, e.g. because pmux received a signal.
+	ShutdownReasonCanceled ShutdownReason = "canceled"
+
+	// ShutdownReasonCompleted indicates that every process stopped of its own
+	// accord, and none could be started again, without any having failed.
+	ShutdownReasonCompleted ShutdownReason = "completed"
+
+	// ShutdownReasonFailed is like ShutdownReasonCompleted, but indicates that
+	// pmux gave up on restarting at least one of the processes after it exited
+	// unsuccessfully.
+	ShutdownReasonFailed ShutdownReason = "failed"
+
+	// ShutdownReasonConfigError indicates that the Config couldn't be used,
+	// e.g. because its templates failed to expand, and so no processes were
+	// started.
+	ShutdownReasonConfigError ShutdownReason = "config-error"
+)
+
+// Shutdown describes why Run returned, see Pmux.LastShutdown.
+type Shutdown struct {
+	Reason ShutdownReason
+
+	// Err is the cause of the context being canceled, if any, for
+	// ShutdownReasonCanceled (see StopError), or the error with the Config
+	// for ShutdownReasonConfigError.
+	Err error
+
+	// Failed lists the names of the processes which failed, for
+	// ShutdownReasonFailed.
+	Failed []string
+
+	// StoppedBeforeRestart lists the names of the processes which were
+	// waiting to be restarted (e.g. during their restart backoff) when the
+	// context was canceled, for ShutdownReasonCanceled. These processes were
+	// already down at the time of the shutdown, rather than being stopped by
+	// it.
+	StoppedBeforeRestart []string
+}
+
+func (s Shutdown) String() string {
+	switch s.Reason {
+	case ShutdownReasonCanceled:
+		str := "canceled"
+		if stopErr := new(StopError); errors.As(s.Err, &stopErr) {
+			str = stopErr.Error()
+		} else if s.Err != nil {
+			str = "canceled: " + s.Err.Error()
+		}
+
+		if len(s.StoppedBeforeRestart) > 0 {
+			str += "; stopped before restart: " +
+				strings.Join(s.StoppedBeforeRestart, ", ")
+		}
+		return str
+
+	case ShutdownReasonCompleted:
+		return "all processes completed"
+
+	case ShutdownReasonFailed:
+		return fmt.Sprintf(
+			"all processes stopped, %d failed: %s",
+			len(s.Failed), strings.Join(s.Failed, ", "),
+		)
+
+	case ShutdownReasonConfigError:
+		return fmt.Sprintf("config error: %v", s.Err)
+
+	default:
+		return string(s.Reason)
+	}
+}
+
+// LastShutdown returns a description of why the most recent call to Run
+// returned, or nil if Run hasn't yet returned.
+func (p *Pmux) LastShutdown() *Shutdown {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.shutdown
+}
+
+// setShutdown records why Run is returning, and emits an EventShutdown.
+func (p *Pmux) setShutdown(shutdown Shutdown) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.shutdown = &shutdown
+	p.emitEvent(Event{Event: EventShutdown, Reason: shutdown.String()})
+}
+
+// stoppedShutdown returns the Shutdown of a Run whose processes have all
+// stopped of their own accord. It must be called while Pmux.l is held.
+func (p *Pmux) stoppedShutdown() Shutdown {
+
+	var failed []string
+	for _, proc := range p.procs {
+		if proc.failed() {
+			failed = append(failed, proc.cfg.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return Shutdown{Reason: ShutdownReasonFailed, Failed: failed}
+	}
+
+	return Shutdown{Reason: ShutdownReasonCompleted}
+}
@@ -0,0 +1,218 @@
+package pmuxlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// startupSummaryTimeout is the longest that Run waits for all processes to
+// settle before logging the startup summary regardless.
+const startupSummaryTimeout = 5 * time.Minute
+
+// StartupState describes how the starting of a process turned out.
+type StartupState string
+
+// Enumeration of StartupState values.
+const (
+	// StartupStateReady indicates that the process started and became ready.
+	StartupStateReady StartupState = "ready"
+
+	// StartupStateRunning indicates that the process was still running, but
+	// had not become ready, when the startup summary was taken.
+	StartupStateRunning StartupState = "running"
+
+	// StartupStateWaiting indicates that the process had not yet been
+	// started when the startup summary was taken, e.g. because it was waiting
+	// on its dependencies.
+	StartupStateWaiting StartupState = "waiting"
+
+	// StartupStateExited indicates that the process exited successfully
+	// before becoming ready, as is normal for one-shot processes, or was
+	// stopped by pmux (e.g. using StopProcess).
+	StartupStateExited StartupState = "exited"
+
+	// StartupStateFailed indicates that the process exited unsuccessfully
+	// before becoming ready, or could not be started at all.
+	StartupStateFailed StartupState = "failed"
+
+	// StartupStateNotStarted indicates that the process wasn't started
+	// automatically, e.g. because Autostart is disabled.
+	StartupStateNotStarted StartupState = "not started"
+)
+
+// StartupStatus describes how the starting of a single process turned out
+// when Run began.
+type StartupStatus struct {
+	Name  string       `json:"name"`
+	State StartupState `json:"state"`
+
+	// PID is the PID of the process at the time the startup summary was
+	// taken, if it was running.
+	PID int `json:"pid,omitempty"`
+
+	// TimeToReady is how long the process took to become ready, if it did.
+	TimeToReady time.Duration `json:"timeToReady,omitempty"`
+
+	// LastExit is set if the process had exited, since Run began, by the
+	// time the startup summary was taken, and wasn't running again.
+	LastExit *ExitStatus `json:"lastExit,omitempty"`
+}
+
+// StartupSummary describes how the starting of every process turned out when
+// Run began. It is taken once every automatically started process has become
+// ready, or has exited or could not be started and won't be restarted.
+type StartupSummary []StartupStatus
+
+// WriteTable writes the StartupSummary to the io.Writer as a table, with one
+// process per line.
+func (s StartupSummary) WriteTable(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tTIME TO READY")
+
+	for _, status := range s {
+
+		state, pid, timeToReady := string(status.State), "-", "-"
+
+		if status.LastExit != nil {
+			state += " (" + status.LastExit.String() + ")"
+		}
+		if status.PID != 0 {
+			pid = strconv.Itoa(status.PID)
+		}
+		if status.State == StartupStateReady {
+			timeToReady = status.TimeToReady.Round(time.Millisecond).String()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", status.Name, state, pid, timeToReady)
+	}
+
+	return tw.Flush()
+}
+
+// StartupSummary returns the StartupSummary of the current call to Run. It
+// returns nil if not all processes have finished starting yet.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) StartupSummary() (StartupSummary, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.ctx == nil {
+		return nil, ErrNotRunning
+	}
+
+	return p.startup, nil
+}
+
+// startupSummary returns the current StartupSummary, and whether every
+// process which was automatically started has settled, i.e. become ready, or
+// had its handler stop. Only the current instance of each process, and exits
+// since Run began, are taken into account. It must be called while p.l is
+// held.
+func (p *Pmux) startupSummary(
+	autostarted map[*process]bool,
+) (
+	StartupSummary, bool,
+) {
+
+	var (
+		summary = make(StartupSummary, len(p.procs))
+		settled = true
+	)
+
+	for i, proc := range p.procs {
+
+		status := StartupStatus{Name: proc.cfg.Name}
+
+		if proc.osProc != nil {
+			status.PID = proc.osProc.Pid
+		}
+
+		switch {
+		case !autostarted[proc]:
+			status.State = StartupStateNotStarted
+		case proc.osProc != nil && proc.ready:
+			status.State = StartupStateReady
+			status.TimeToReady = proc.timeToReady
+		case proc.osProc != nil:
+			status.State = StartupStateRunning
+			settled = false
+		case proc.runExit == nil && proc.cancel != nil:
+			status.State = StartupStateWaiting
+			settled = false
+		default:
+			status.LastExit = proc.runExit
+			if proc.runExit != nil &&
+				(proc.runExit.Code == 0 || proc.runExit.StopReason != "") {
+				status.State = StartupStateExited
+			} else {
+				status.State = StartupStateFailed
+			}
+
+			// the process may yet be restarted and become ready.
+			if proc.cancel != nil {
+				settled = false
+			}
+		}
+
+		summary[i] = status
+	}
+
+	return summary, settled
+}
+
+// logStartupSummary waits for all automatically started processes to settle,
+// or for startupSummaryTimeout to elapse, and then logs the StartupSummary
+// and makes it available via the StartupSummary method.
+func (p *Pmux) logStartupSummary(
+	ctx context.Context, autostarted map[*process]bool, logger Logger,
+) {
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.After(startupSummaryTimeout)
+
+	var summary StartupSummary
+
+	for {
+		var (
+			settled  bool
+			timedOut bool
+		)
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			timedOut = true
+		case <-ctx.Done():
+			return
+		}
+
+		p.l.Lock()
+		summary, settled = p.startupSummary(autostarted)
+		if settled || timedOut {
+			p.startup = summary
+		}
+		p.l.Unlock()
+
+		if settled || timedOut {
+			break
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	_ = summary.WriteTable(buf)
+
+	infof(logger, "startup summary:")
+	for scanner := bufio.NewScanner(buf); scanner.Scan(); {
+		infof(logger, "%s", scanner.Text())
+	}
+}
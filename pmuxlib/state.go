@@ -0,0 +1,214 @@
+package pmuxlib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// processState is the state of a single process which is persisted to the
+// Config's StateFile.
+type processState struct {
+	Backoff  backoffState `json:"backoff"`
+	LastExit *ExitStatus  `json:"lastExit,omitempty"`
+	Paused   bool         `json:"paused,omitempty"`
+
+	// Stopped indicates that the process stopped of its own accord and won't
+	// be restarted, or was stopped using StopProcess, and so shouldn't be
+	// started again automatically.
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+// readStateFile reads the persisted state of each process, keyed by process
+// name. If the file doesn't exist then an empty map is returned.
+func readStateFile(path string) (map[string]processState, error) {
+
+	states := map[string]processState{}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, fmt.Errorf("decoding %q: %w", path, err)
+	}
+
+	return states, nil
+}
+
+// writeFileAtomic replaces the file at the given path with the given contents,
+// such that readers never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	return writeFileAtomicAs(path, b, nil)
+}
+
+// writeFileAtomicAs is like writeFileAtomic, but if cred is non-nil the file is
+// owned by its uid and gid before being moved into place.
+func writeFileAtomicAs(path string, b []byte, cred *syscall.Credential) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if cred != nil {
+		if err := tmp.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeStateFile atomically replaces the state file at the given path.
+func writeStateFile(path string, states map[string]processState) error {
+
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b)
+}
+
+// restoreState applies the persisted state of each process, if there is a
+// StateFile. It must be called while p.l is held.
+func (p *Pmux) restoreState() {
+
+	if p.cfg.StateFile == "" {
+		return
+	}
+
+	states, err := readStateFile(p.cfg.StateFile)
+	if err != nil {
+		p.sysLogger.Printf("not restoring state: %v", err)
+		return
+	}
+
+	for _, proc := range p.procs {
+		state, ok := states[proc.cfg.Name]
+		if !ok {
+			continue
+		}
+
+		proc.backoff = state.Backoff
+		proc.lastExit = state.LastExit
+		proc.stopped = state.Stopped
+
+		if state.Paused {
+			proc.resumeCh = make(chan struct{})
+		}
+	}
+}
+
+// stateWriter writes the state file in the background, so that the lock of
+// the Pmux isn't held while doing so. Only the most recent state which is yet
+// to be written is kept.
+type stateWriter struct {
+	path      string
+	sysLogger Logger
+
+	l       sync.Mutex
+	pending map[string]processState
+	closed  bool
+
+	wakeCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newStateWriter(path string, sysLogger Logger) *stateWriter {
+	w := &stateWriter{
+		path:      path,
+		sysLogger: sysLogger,
+		wakeCh:    make(chan struct{}, 1),
+		doneCh:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *stateWriter) run() {
+	defer close(w.doneCh)
+
+	for range w.wakeCh {
+		w.l.Lock()
+		states := w.pending
+		w.pending = nil
+		w.l.Unlock()
+
+		if states == nil {
+			continue
+		}
+
+		if err := writeStateFile(w.path, states); err != nil {
+			w.sysLogger.Printf("writing state file: %v", err)
+		}
+	}
+}
+
+// save causes the given states to be written, replacing any which have yet to
+// be. States saved after close are discarded.
+func (w *stateWriter) save(states map[string]processState) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	w.pending = states
+
+	select {
+	case w.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// close blocks until the last state which was saved has been written.
+func (w *stateWriter) close() {
+	w.l.Lock()
+	w.closed = true
+	close(w.wakeCh)
+	w.l.Unlock()
+
+	<-w.doneCh
+}
+
+// saveState causes the state of each process to be written to the StateFile,
+// in the background, if there is one. It must be called while p.l is held.
+func (p *Pmux) saveState() {
+
+	if p.stateWriter == nil {
+		return
+	}
+
+	states := make(map[string]processState, len(p.procs))
+	for _, proc := range p.procs {
+		states[proc.cfg.Name] = processState{
+			Backoff:  proc.backoff,
+			LastExit: proc.lastExit,
+			Paused:   proc.resumeCh != nil,
+			Stopped:  proc.stopped,
+		}
+	}
+
+	p.stateWriter.save(states)
+}
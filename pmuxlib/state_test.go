@@ -0,0 +1,33 @@
+package pmuxlib
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateWriter(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	w := newStateWriter(path, new(NullLogger))
+
+	var last map[string]processState
+	for i := 0; i < 100; i++ {
+		last = map[string]processState{
+			"a": {Backoff: backoffState{Restarts: i}},
+		}
+		w.save(last)
+	}
+
+	w.close()
+
+	// saves after close are discarded.
+	w.save(map[string]processState{"b": {}})
+
+	got, err := readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, last) {
+		t.Fatalf("expected %+v, got %+v", last, got)
+	}
+}
@@ -0,0 +1,321 @@
+package pmuxlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ResourceUsage describes the resources used by a single run of a process.
+type ResourceUsage struct {
+	UserTime   time.Duration `json:"userTime"`
+	SystemTime time.Duration `json:"systemTime"`
+
+	// MaxRSS is the maximum resident set size of the process, in bytes.
+	MaxRSS int64 `json:"maxRSS"`
+
+	// RSS is the current resident set size of the process, in bytes. It is
+	// only set for processes which are still running.
+	RSS int64 `json:"rss,omitempty"`
+}
+
+func newResourceUsage(state *os.ProcessState) ResourceUsage {
+	u := ResourceUsage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+	}
+
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		u.MaxRSS = int64(rusage.Maxrss)
+
+		// darwin reports maxrss in bytes, everything else in KiB.
+		if runtime.GOOS != "darwin" {
+			u.MaxRSS *= 1024
+		}
+	}
+
+	return u
+}
+
+func (u ResourceUsage) String() string {
+	return fmt.Sprintf(
+		"user=%v sys=%v maxrss=%dKiB",
+		u.UserTime, u.SystemTime, u.MaxRSS/1024,
+	)
+}
+
+// ProcessStatus describes the current state of a process being run by Pmux.
+type ProcessStatus struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// State summarizes the fields below.
+	State ProcessState `json:"state"`
+
+	// PID and StartedAt are set only while the process is running.
+	Running   bool      `json:"running"`
+	PID       int       `json:"pid,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+
+	// Uptime is how long the current run of the process has been running
+	// for, and Restarts is the number of times it has been restarted.
+	Uptime   time.Duration `json:"uptime,omitempty"`
+	Restarts int           `json:"restarts"`
+
+	// Backoff is how long pmux will wait before next restarting the process,
+	// were it to exit.
+	Backoff time.Duration `json:"backoff,omitempty"`
+
+	Ready          bool `json:"ready"`
+	Frozen         bool `json:"frozen"`
+	RestartsPaused bool `json:"restartsPaused"`
+
+	// Restarting is set while the process isn't running, but pmux will start
+	// it again, e.g. once its restart backoff has elapsed.
+	Restarting bool `json:"restarting"`
+
+	// TimeToReady is how long the running process took to become ready after
+	// being started, if it has.
+	TimeToReady time.Duration `json:"timeToReady,omitempty"`
+
+	// Failed is set if pmux gave up on restarting the process after it exited
+	// unsuccessfully (e.g. due to its NoRestartOn or CircuitBreaker), until it
+	// is next started.
+	Failed bool `json:"failed"`
+
+	// Completed is set if the process is OneShot and exited successfully,
+	// until it is next started.
+	Completed bool `json:"completed"`
+
+	// Usage describes the resources used so far by the running process,
+	// not including any child processes of its own. It is only available on
+	// linux.
+	Usage *ResourceUsage `json:"usage,omitempty"`
+
+	// LastUsage and LastExit describe the most recent run of the process to
+	// have exited, if any.
+	LastUsage *ResourceUsage `json:"lastUsage,omitempty"`
+	LastExit  *ExitStatus    `json:"lastExit,omitempty"`
+}
+
+// ExitStatus describes how a process exited.
+type ExitStatus struct {
+
+	// Code is the exit code of the process, or -1 if it was terminated by a
+	// signal.
+	Code int `json:"code"`
+
+	// Signal is the name of the signal which terminated the process, if any.
+	Signal     string `json:"signal,omitempty"`
+	CoreDumped bool   `json:"coreDumped,omitempty"`
+
+	// StopReason is the reason pmux stopped the process, if it did, see
+	// StopError.
+	StopReason string `json:"stopReason,omitempty"`
+}
+
+func newExitStatus(state *os.ProcessState) ExitStatus {
+	s := ExitStatus{Code: state.ExitCode()}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		s.Signal = signalName(ws.Signal())
+		s.CoreDumped = ws.CoreDump()
+	}
+	return s
+}
+
+func (s ExitStatus) String() string {
+
+	var str string
+	if s.Signal == "" {
+		str = fmt.Sprintf("exit code %d", s.Code)
+	} else if str = s.Signal; s.CoreDumped {
+		str += " (core dumped)"
+	}
+
+	if s.StopReason != "" {
+		str += " (stopped: " + s.StopReason + ")"
+	}
+	return str
+}
+
+// Status returns the status of every process, in the order they are defined.
+//
+// ErrNotRunning is returned if Run is not currently running.
+func (p *Pmux) Status() ([]ProcessStatus, error) {
+
+	statuses, err := p.statusSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// reading the usage of each process from /proc is comparatively slow, and
+	// so is done without holding the lock.
+	for i := range statuses {
+		if statuses[i].PID == 0 {
+			continue
+		}
+
+		if usage, err := liveResourceUsage(statuses[i].PID); err == nil {
+			statuses[i].Usage = &usage
+		}
+	}
+
+	return statuses, nil
+}
+
+// statusSnapshot returns the status of every process, without their live
+// Usage.
+func (p *Pmux) statusSnapshot() ([]ProcessStatus, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.ctx == nil {
+		return nil, ErrNotRunning
+	}
+
+	statuses := make([]ProcessStatus, len(p.procs))
+	for i, proc := range p.procs {
+		statuses[i] = ProcessStatus{
+			Name:           proc.cfg.Name,
+			Labels:         proc.cfg.Labels,
+			State:          proc.state(),
+			Running:        proc.osProc != nil,
+			Ready:          proc.ready,
+			Frozen:         proc.frozen,
+			RestartsPaused: proc.resumeCh != nil,
+			LastUsage:      proc.lastUsage,
+			LastExit:       proc.lastExit,
+			Restarts:       proc.backoff.Restarts,
+			Backoff:        proc.backoff.Wait,
+			Restarting:     proc.cancel != nil && proc.osProc == nil,
+		}
+
+		statuses[i].Failed = proc.failed()
+		statuses[i].Completed = proc.completed()
+
+		if proc.osProc != nil {
+			statuses[i].PID = proc.osProc.Pid
+			statuses[i].StartedAt = proc.startedAt
+			statuses[i].Uptime = proc.cfg.clock().Now().Sub(proc.startedAt)
+			statuses[i].TimeToReady = proc.timeToReady
+		}
+	}
+
+	return statuses, nil
+}
+
+// LogLines returns the total number of lines which have been logged by Run,
+// including the output of all processes.
+func (p *Pmux) LogLines() uint64 {
+	return atomic.LoadUint64(&p.logLines)
+}
+
+// logHeartbeat periodically logs a summary of the status of every process,
+// until the context is canceled.
+func (p *Pmux) logHeartbeat(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		statuses, err := p.Status()
+		if err != nil {
+			return
+		}
+
+		var (
+			running, restarting, failed, completed, stopped int
+			uptimes                                         []string
+		)
+
+		for _, status := range statuses {
+			switch {
+			case status.Running:
+				running++
+				uptimes = append(uptimes, fmt.Sprintf(
+					"%s up %v", status.Name, status.Uptime.Round(time.Second),
+				))
+			case status.Restarting:
+				restarting++
+			case status.Failed:
+				failed++
+			case status.Completed:
+				completed++
+			default:
+				stopped++
+			}
+		}
+
+		msg := fmt.Sprintf(
+			"heartbeat: %d running, %d restarting, %d failed, %d completed, %d stopped",
+			running, restarting, failed, completed, stopped,
+		)
+
+		if len(uptimes) > 0 {
+			msg += " (" + strings.Join(uptimes, ", ") + ")"
+		}
+
+		p.sysLogger.Println(msg)
+	}
+}
+
+// writeStatusFile periodically writes the status of every process to the given
+// path as JSON, along with the version of pmux, until the context is canceled.
+func (p *Pmux) writeStatusFile(
+	ctx context.Context, path string, interval time.Duration,
+) {
+
+	version := GetBuildInfo().Version
+
+	p.l.Lock()
+	instanceTag := p.instanceTag
+	p.l.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		statuses, err := p.Status()
+		if err != nil {
+			return
+		}
+
+		b, err := json.MarshalIndent(struct {
+			Time      time.Time       `json:"time"`
+			Version   string          `json:"version"`
+			Instance  string          `json:"instance,omitempty"`
+			Processes []ProcessStatus `json:"processes"`
+		}{
+			Time:      time.Now(),
+			Version:   version,
+			Instance:  instanceTag,
+			Processes: statuses,
+		}, "", "  ")
+
+		if err == nil {
+			err = writeFileAtomic(path, b)
+		}
+
+		if err != nil {
+			p.sysLogger.Printf("writing status file: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
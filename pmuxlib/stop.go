@@ -0,0 +1,59 @@
+package pmuxlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StopError is the cause (see context.Cause) with which pmux cancels the
+// context of a process which it's stopping, describing why it was stopped, e.g.
+// because a restart was requested. It is reported in the process's logs and
+// ExitStatus. errors.Is reports a StopError as being context.Canceled.
+//
+// Callers of Run and RunProcess may cancel the context they pass in with a
+// StopError (see context.WithCancelCause) for the same effect.
+type StopError struct {
+	Reason string
+}
+
+func stopErrorf(str string, args ...interface{}) *StopError {
+	return &StopError{Reason: fmt.Sprintf(str, args...)}
+}
+
+func (e *StopError) Error() string {
+	return "stopped: " + e.Reason
+}
+
+// Is returns true for context.Canceled.
+func (e *StopError) Is(target error) bool {
+	return target == context.Canceled
+}
+
+// ctxErr returns the error of a context which is done, wrapping its cause if
+// it has one, so that the reason for it being done is reported rather than
+// just "context canceled".
+func ctxErr(ctx context.Context) error {
+
+	err := ctx.Err()
+	cause := context.Cause(ctx)
+
+	if cause == nil || cause == err {
+		return err
+	} else if errors.Is(cause, err) {
+		return cause
+	}
+
+	return fmt.Errorf("%w: %w", err, cause)
+}
+
+// stopReason returns the reason which a process was stopped for, given the
+// cause of its context being canceled, or "" if it wasn't.
+func stopReason(cause error) string {
+	if cause == nil {
+		return ""
+	} else if stopErr := new(StopError); errors.As(cause, &stopErr) {
+		return stopErr.Reason
+	}
+	return cause.Error()
+}
@@ -0,0 +1,118 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"os"
+)
+
+// StreamConfig describes an additional output stream of a process, which pmux
+// creates as a pipe and passes to the process on a file descriptor other than
+// stdout and stderr. Each line the process writes to the file descriptor is
+// logged under the stream's name.
+type StreamConfig struct {
+
+	// FD is the file descriptor the process writes the stream to. It must be
+	// at least 3, and not be one of the file descriptors used by the
+	// process's Listen sockets, which are given file descriptors from 3
+	// upwards.
+	FD int `yaml:"fd"`
+
+	// Name identifies the stream's lines in pmux's output, e.g. "audit".
+	Name string `yaml:"name"`
+
+	// To determines which Logger the stream is logged to, or whether it's
+	// discarded (e.g. when it only needs to be written to LogFile).
+	//
+	// Defaults to OutputStreamStdout.
+	To OutputStream `yaml:"to,omitempty"`
+
+	// LogFile is the path of a file which the stream is appended to, in
+	// addition to To. This is only used when the process is run by Pmux.
+	LogFile string `yaml:"logFile,omitempty"`
+}
+
+func (cfg StreamConfig) withDefaults() StreamConfig {
+	if cfg.To == "" {
+		cfg.To = OutputStreamStdout
+	}
+	return cfg
+}
+
+func validateStreams(streams []StreamConfig, numListen int) []string {
+
+	var (
+		problems  []string
+		seenFDs   = map[int]bool{}
+		seenNames = map[string]bool{}
+	)
+
+	for i, stream := range streams {
+
+		problemf := func(str string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf(
+				"streams[%d]: %s", i, fmt.Sprintf(str, args...),
+			))
+		}
+
+		if stream.Name == "" {
+			problemf("name is required")
+		} else if seenNames[stream.Name] {
+			problemf("name %q is used by more than one stream", stream.Name)
+		}
+		seenNames[stream.Name] = true
+
+		if stream.FD < 3 {
+			problemf("fd must be at least 3")
+		} else if stream.FD < 3+numListen {
+			problemf("fd %d is used by a listen socket", stream.FD)
+		} else if seenFDs[stream.FD] {
+			problemf("fd %d is used by more than one stream", stream.FD)
+		}
+		seenFDs[stream.FD] = true
+
+		switch stream.To {
+		case "", OutputStreamStdout, OutputStreamStderr, OutputStreamDiscard:
+		default:
+			problemf(
+				"to %q is not one of %q, %q, or %q",
+				stream.To,
+				OutputStreamStdout, OutputStreamStderr, OutputStreamDiscard,
+			)
+		}
+	}
+
+	return problems
+}
+
+// streamPipes creates a pipe for each of the streams. It returns the read end
+// of each pipe, and the ExtraFiles which the process should be given, which
+// are the given listen files followed by the write end of each pipe at the
+// index for its file descriptor.
+func streamPipes(
+	streams []StreamConfig, listenFiles []*os.File,
+) (
+	readers, extraFiles []*os.File, err error,
+) {
+
+	extraFiles = append([]*os.File(nil), listenFiles...)
+
+	for _, stream := range streams {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeFiles(readers)
+			closeFiles(extraFiles[len(listenFiles):])
+			return nil, nil, fmt.Errorf(
+				"creating pipe for stream %q: %w", stream.Name, err,
+			)
+		}
+
+		for len(extraFiles) <= stream.FD-3 {
+			extraFiles = append(extraFiles, nil)
+		}
+
+		readers = append(readers, r)
+		extraFiles[stream.FD-3] = w
+	}
+
+	return readers, extraFiles, nil
+}
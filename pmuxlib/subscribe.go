@@ -0,0 +1,102 @@
+package pmuxlib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// subscriberQueueSize is the number of values which may be waiting to be
+// received by a subscriber before further values are dropped for it.
+const subscriberQueueSize = 1024
+
+// broadcaster sends each value published to it to all of its subscribers.
+// Values are dropped for subscribers which fall too far behind, so that a slow
+// subscriber can't hold up pmux.
+type broadcaster[T any] struct {
+	l    sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func newBroadcaster[T any]() *broadcaster[T] {
+	return &broadcaster[T]{subs: map[chan T]struct{}{}}
+}
+
+// subscribe returns a channel on which all values published from now on are
+// sent, until the context is canceled, at which point the channel is closed.
+func (b *broadcaster[T]) subscribe(ctx context.Context) <-chan T {
+
+	ch := make(chan T, subscriberQueueSize)
+
+	b.l.Lock()
+	b.subs[ch] = struct{}{}
+	b.l.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.l.Lock()
+		delete(b.subs, ch)
+		b.l.Unlock()
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (b *broadcaster[T]) publish(v T) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
+
+// LogLine is a single line logged by Run, either of a process's output or a
+// message logged by pmux itself.
+type LogLine struct {
+	Time time.Time `json:"time"`
+
+	// Process is the name of the process which the line pertains to, or
+	// "pmux" for messages about pmux itself.
+	Process string `json:"process"`
+
+	// Stream is "stdout" or "stderr" for lines of a process's output, "sys"
+	// for messages logged by pmux, or the name of one of the process's
+	// StreamConfigs.
+	Stream string `json:"stream"`
+
+	// Level is set if the process has a LogLevelsConfig.
+	Level LogLevel `json:"level,omitempty"`
+
+	Line string `json:"line"`
+}
+
+// SubscribeLogs returns a channel on which every line subsequently logged by
+// Run is sent, until the context is canceled, at which point the channel is
+// closed. Lines are dropped if the channel's reader falls too far behind.
+func (p *Pmux) SubscribeLogs(ctx context.Context) <-chan LogLine {
+	return p.logSubs.subscribe(ctx)
+}
+
+// SubscribeEvents returns a channel on which every Event subsequently emitted
+// by Run is sent, regardless of whether the Config's Events destination is set,
+// until the context is canceled, at which point the channel is closed. Events
+// are dropped if the channel's reader falls too far behind.
+func (p *Pmux) SubscribeEvents(ctx context.Context) <-chan Event {
+	return p.eventSubs.subscribe(ctx)
+}
+
+// emitEvent writes the Event to the Config's Events destination, if any, and
+// sends it to all subscribers. It must be called while p.l is held.
+func (p *Pmux) emitEvent(event Event) {
+	event.Time = time.Now()
+	event.Instance = p.instanceTag
+	p.events.emit(event)
+	p.eventSubs.publish(event)
+}
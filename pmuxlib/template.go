@@ -0,0 +1,197 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is the data made available to the templates within a
+// ProcessConfig, see Config.ExpandTemplates.
+type TemplateData struct {
+
+	// ProcessName is the Name of the process being expanded.
+	ProcessName string
+
+	// Replica is the index of the replica being expanded, if the process has
+	// Replicas set, otherwise it is 0.
+	Replica int
+
+	// Matrix holds the value of each key of the process's Matrix, if it has
+	// one, e.g. {{.Matrix.shard}}.
+	Matrix map[string]string
+
+	// Hostname is the hostname of the machine pmux is running on.
+	Hostname string
+
+	// Vars is the Vars field of the Config.
+	Vars map[string]string
+}
+
+func expandTemplate(str string, data TemplateData) (string, error) {
+
+	// fast-path, most strings won't contain a template at all.
+	if !strings.Contains(str, "{{") {
+		return str, nil
+	}
+
+	tpl, err := template.New("").Option("missingkey=error").Parse(str)
+	if err != nil {
+		return "", fmt.Errorf("parsing template %q: %w", str, err)
+	}
+
+	out := new(strings.Builder)
+	if err := tpl.Execute(out, data); err != nil {
+		return "", fmt.Errorf("executing template %q: %w", str, err)
+	}
+
+	return out.String(), nil
+}
+
+func (cfg ProcessConfig) expandTemplates(
+	data TemplateData,
+) (
+	ProcessConfig, error,
+) {
+
+	var err error
+
+	if cfg.Cmd, err = expandTemplate(cfg.Cmd, data); err != nil {
+		return ProcessConfig{}, fmt.Errorf("expanding cmd: %w", err)
+	}
+
+	if cfg.FallbackCmd, err = expandTemplate(cfg.FallbackCmd, data); err != nil {
+		return ProcessConfig{}, fmt.Errorf("expanding fallbackCmd: %w", err)
+	}
+
+	if cfg.Dir, err = expandTemplate(cfg.Dir, data); err != nil {
+		return ProcessConfig{}, fmt.Errorf("expanding dir: %w", err)
+	}
+
+	args := make(Args, len(cfg.Args))
+	for i := range cfg.Args {
+		if args[i], err = expandTemplate(cfg.Args[i], data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding args[%d]: %w", i, err)
+		}
+	}
+	cfg.Args = args
+
+	fallbackArgs := make(Args, len(cfg.FallbackArgs))
+	for i := range cfg.FallbackArgs {
+		if fallbackArgs[i], err = expandTemplate(cfg.FallbackArgs[i], data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding fallbackArgs[%d]: %w", i, err)
+		}
+	}
+	cfg.FallbackArgs = fallbackArgs
+
+	steps := make([]PipelineStep, len(cfg.Pipeline.Steps))
+	for i, step := range cfg.Pipeline.Steps {
+		if step.Cmd, err = expandTemplate(step.Cmd, data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding pipeline.steps[%d]: %w", i, err)
+		}
+
+		stepArgs := make(Args, len(step.Args))
+		for j := range step.Args {
+			if stepArgs[j], err = expandTemplate(step.Args[j], data); err != nil {
+				return ProcessConfig{}, fmt.Errorf("expanding pipeline.steps[%d]: %w", i, err)
+			}
+		}
+		step.Args = stepArgs
+
+		steps[i] = step
+	}
+	cfg.Pipeline.Steps = steps
+
+	env := make(map[string]string, len(cfg.Env))
+	for k, v := range cfg.Env {
+		if env[k], err = expandTemplate(v, data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding env %q: %w", k, err)
+		}
+	}
+	cfg.Env = env
+
+	envFrom := make(map[string]EnvValue, len(cfg.EnvFrom))
+	for k, v := range cfg.EnvFrom {
+		for _, field := range []*string{&v.FromFile, &v.FromCommand, &v.Secret} {
+			if *field, err = expandTemplate(*field, data); err != nil {
+				return ProcessConfig{}, fmt.Errorf("expanding envFrom %q: %w", k, err)
+			}
+		}
+		envFrom[k] = v
+	}
+	cfg.EnvFrom = envFrom
+
+	labels := make(map[string]string, len(cfg.Labels))
+	for k, v := range cfg.Labels {
+		if labels[k], err = expandTemplate(v, data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding labels %q: %w", k, err)
+		}
+	}
+	cfg.Labels = labels
+
+	waitFor := make([]WaitForConfig, len(cfg.WaitFor))
+	for i, waitCfg := range cfg.WaitFor {
+		for _, field := range []*string{&waitCfg.TCP, &waitCfg.DNS} {
+			if *field, err = expandTemplate(*field, data); err != nil {
+				return ProcessConfig{}, fmt.Errorf("expanding waitFor[%d]: %w", i, err)
+			}
+		}
+		waitFor[i] = waitCfg
+	}
+	cfg.WaitFor = waitFor
+
+	container := cfg.Container
+	for _, field := range []*string{&container.Image, &container.Name, &container.Workdir} {
+		if *field, err = expandTemplate(*field, data); err != nil {
+			return ProcessConfig{}, fmt.Errorf("expanding container: %w", err)
+		}
+	}
+	cfg.Container = container
+
+	if cfg.Register != nil {
+		reg := *cfg.Register
+		for _, field := range []*string{&reg.Name, &reg.ID, &reg.Address, &reg.Check} {
+			if *field, err = expandTemplate(*field, data); err != nil {
+				return ProcessConfig{}, fmt.Errorf("expanding register: %w", err)
+			}
+		}
+		cfg.Register = &reg
+	}
+
+	return cfg, nil
+}
+
+// ExpandTemplates returns a copy of the Config with the Cmd, Args, FallbackCmd,
+// FallbackArgs, Env values, Labels values, Dir, WaitFor addresses, Container
+// image, name and workdir, and Register name, id, address and check fields of
+// each ProcessConfig expanded as text/template templates, using a TemplateData
+// as the data.
+func (cfg Config) ExpandTemplates() (Config, error) {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Config{}, fmt.Errorf("getting hostname: %w", err)
+	}
+
+	procs := make([]ProcessConfig, len(cfg.Processes))
+	for i, procCfg := range cfg.Processes {
+
+		data := TemplateData{
+			ProcessName: procCfg.Name,
+			Replica:     procCfg.replica,
+			Matrix:      procCfg.matrix,
+			Hostname:    hostname,
+			Vars:        cfg.Vars,
+		}
+
+		if procs[i], err = procCfg.expandTemplates(data); err != nil {
+			return Config{}, fmt.Errorf(
+				"process %q: %w", procCfg.Name, err,
+			)
+		}
+	}
+	cfg.Processes = procs
+
+	return cfg, nil
+}
@@ -0,0 +1,135 @@
+package pmuxlib
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+)
+
+// processTree tracks the descendants of a process, so that they can be
+// signalled along with it even if they have left its process group, see
+// ProcessConfig.KillTree.
+//
+// Where possible the process is started in a cgroup of its own, which all of
+// its descendants remain in even once they've been orphaned. Otherwise
+// descendants are only found while their parent is running, as once it exits
+// they're reparented, but those which have been found continue to be tracked.
+type processTree struct {
+	sysLogger Logger
+
+	l sync.Mutex
+
+	// cgroup is the path of the process's cgroup, if it has one.
+	cgroup string
+
+	// pid is the PID of the process, or 0 if it hasn't been started yet.
+	pid int
+
+	// procs maps the PID of each descendant to its start time, so that a
+	// PID which has been reused by an unrelated process isn't signalled.
+	procs map[int]uint64
+}
+
+func newProcessTree(sysLogger Logger) *processTree {
+	return &processTree{
+		sysLogger: sysLogger,
+		procs:     map[int]uint64{},
+	}
+}
+
+// useCgroup creates a cgroup for the process, and causes it to be started in
+// it by the given SysProcAttr. The returned function should be called once the
+// process has been started. If the cgroup can't be created, e.g. because pmux
+// isn't allowed to, then descendants are found by their parent PIDs instead.
+func (t *processTree) useCgroup(attr *syscall.SysProcAttr) func() {
+
+	path, dir, err := newTreeCgroup()
+	if err != nil {
+		debugf(t.sysLogger, "not using a cgroup to find descendants: %v", err)
+		return func() {}
+	}
+
+	t.l.Lock()
+	t.cgroup = path
+	t.l.Unlock()
+
+	startInCgroup(attr, dir)
+	return func() { dir.Close() }
+}
+
+// close removes the process's cgroup, if it has one and it's empty.
+func (t *processTree) close() {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.cgroup == "" {
+		return
+	}
+
+	if err := removeCgroup(t.cgroup); err != nil {
+		debugf(t.sysLogger, "removing cgroup %q: %v", t.cgroup, err)
+	}
+}
+
+func (t *processTree) setPID(pid int) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.pid = pid
+}
+
+// find finds any further descendants of the process, which must still be
+// running, so that its PID can't have been reused.
+func (t *processTree) find() {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.pid == 0 {
+		return
+	}
+
+	var (
+		found map[int]uint64
+		err   error
+	)
+
+	if t.cgroup != "" {
+		found, err = cgroupDescendants(t.cgroup, t.pid)
+	} else {
+		found, err = findDescendants(t.pid)
+	}
+
+	if err != nil {
+		t.sysLogger.Printf("finding descendants of process: %v", err)
+		return
+	}
+
+	for pid, start := range found {
+		t.procs[pid] = start
+	}
+}
+
+// signal sends the signal to every descendant which has been found and is
+// still running. If skipGroup is set then those which are in the process's
+// own process group are skipped, as they're signalled by sigProcessGroup.
+func (t *processTree) signal(sig syscall.Signal, skipGroup bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	for pid, start := range t.procs {
+		stat, err := readProcStat(pid)
+		if err != nil || stat.start != start {
+			delete(t.procs, pid)
+			continue
+		} else if skipGroup && stat.pgid == t.pid {
+			continue
+		}
+
+		debugf(t.sysLogger, "sending %v signal to descendant %d", sig, pid)
+		err = syscall.Kill(pid, sig)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			t.sysLogger.Printf(
+				"sending %v signal to descendant %d: %v", sig, pid, err,
+			)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package pmuxlib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// procStat holds the fields of /proc/<pid>/stat which pmux uses.
+type procStat struct {
+	// state is the single character state of the process, e.g. 'Z' for a
+	// zombie.
+	state byte
+
+	ppid, pgid int
+
+	// start is the time the process started, in clock ticks since boot.
+	start uint64
+}
+
+func readProcStat(pid int) (procStat, error) {
+
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+
+	// the fields follow the command name, which is in parentheses and may
+	// itself contain spaces or parentheses. The first of them is the state,
+	// which is the third field overall.
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return procStat{}, errors.New("malformed stat")
+	}
+
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return procStat{}, errors.New("malformed stat")
+	}
+
+	stat := procStat{state: fields[0][0]}
+	if stat.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return procStat{}, fmt.Errorf("parsing ppid: %w", err)
+	} else if stat.pgid, err = strconv.Atoi(fields[2]); err != nil {
+		return procStat{}, fmt.Errorf("parsing pgrp: %w", err)
+	} else if stat.start, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return procStat{}, fmt.Errorf("parsing starttime: %w", err)
+	}
+
+	return stat, nil
+}
+
+// findDescendants returns the PIDs of all descendants of the given process,
+// mapped to their start times, by scanning /proc.
+func findDescendants(pid int) (map[int]uint64, error) {
+
+	procDirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]int{}
+	starts := map[int]uint64{}
+
+	for _, procDir := range procDirs {
+		childPID, err := strconv.Atoi(procDir.Name())
+		if err != nil {
+			continue
+		}
+
+		// processes may exit while being scanned.
+		stat, err := readProcStat(childPID)
+		if err != nil {
+			continue
+		}
+
+		children[stat.ppid] = append(children[stat.ppid], childPID)
+		starts[childPID] = stat.start
+	}
+
+	descendants := map[int]uint64{}
+	for queue := children[pid]; len(queue) > 0; queue = queue[1:] {
+		descendant := queue[0]
+		if _, ok := descendants[descendant]; ok {
+			continue
+		}
+		descendants[descendant] = starts[descendant]
+		queue = append(queue, children[descendant]...)
+	}
+
+	return descendants, nil
+}
+
+// cgroupCounter makes the names of the cgroups created by newTreeCgroup
+// unique within pmux.
+var cgroupCounter uint64
+
+// cgroupRoot returns the directory of the cgroup v2 hierarchy which pmux
+// itself is in.
+func cgroupRoot() (string, error) {
+
+	selfB, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	var selfPath string
+	for _, line := range strings.Split(string(selfB), "\n") {
+		if p := strings.TrimPrefix(line, "0::"); p != line {
+			selfPath = p
+			break
+		}
+	}
+
+	if selfPath == "" {
+		return "", errors.New("not in a cgroup v2 hierarchy")
+	}
+
+	mountsB, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+
+	// each line is of the form "<id> <parent> <dev> <root> <mount point>
+	// <options> [<optional fields>...] - <fs type> <source> <options>".
+	for _, line := range strings.Split(string(mountsB), "\n") {
+		fields, fsFields, ok := strings.Cut(line, " - ")
+		if !ok || !strings.HasPrefix(fsFields, "cgroup2 ") {
+			continue
+		}
+
+		if fields := strings.Fields(fields); len(fields) >= 5 {
+			return filepath.Join(fields[4], selfPath), nil
+		}
+	}
+
+	return "", errors.New("no cgroup2 filesystem is mounted")
+}
+
+// newTreeCgroup creates a cgroup within pmux's own, in which a process can be
+// started so that all of its descendants can be found, even once they have
+// been orphaned. The cgroup's path is returned along with the open directory,
+// which should be closed once the process has been started.
+func newTreeCgroup() (string, *os.File, error) {
+
+	if !canCloneIntoCgroup() {
+		return "", nil, errors.New("starting processes in a cgroup requires Linux 5.7")
+	}
+
+	root, err := cgroupRoot()
+	if err != nil {
+		return "", nil, err
+	}
+
+	path := filepath.Join(root, fmt.Sprintf(
+		"pmux-%d-%d", os.Getpid(), atomic.AddUint64(&cgroupCounter, 1),
+	))
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return "", nil, err
+	}
+
+	return path, dir, nil
+}
+
+// canCloneIntoCgroup returns whether the kernel supports starting processes
+// directly in a cgroup, i.e. CLONE_INTO_CGROUP, which was added in Linux 5.7.
+func canCloneIntoCgroup() bool {
+
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+
+	var release strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+
+	var major, minor int
+	if _, err := fmt.Sscanf(release.String(), "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+
+	return major > 5 || (major == 5 && minor >= 7)
+}
+
+// startInCgroup causes the process to be started within the cgroup whose
+// directory is given.
+func startInCgroup(attr *syscall.SysProcAttr, dir *os.File) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(dir.Fd())
+}
+
+// cgroupDescendants returns the PIDs of the processes in the cgroup, other
+// than the given one, mapped to their start times.
+func cgroupDescendants(path string, pid int) (map[int]uint64, error) {
+
+	b, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	descendants := map[int]uint64{}
+	for _, pidStr := range strings.Fields(string(b)) {
+		descendant, err := strconv.Atoi(pidStr)
+		if err != nil || descendant == pid {
+			continue
+		}
+
+		// processes may exit while being read.
+		if stat, err := readProcStat(descendant); err == nil {
+			descendants[descendant] = stat.start
+		}
+	}
+
+	return descendants, nil
+}
+
+// removeCgroup removes the cgroup, which fails if there are still processes
+// within it. Processes which have just been killed may take a moment to leave
+// it, and so removing it is retried briefly.
+func removeCgroup(path string) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
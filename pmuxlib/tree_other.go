@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errTreeNotSupported = errors.New("not supported on this platform")
+
+type procStat struct {
+	ppid, pgid int
+	start      uint64
+}
+
+func readProcStat(pid int) (procStat, error) {
+	return procStat{}, errTreeNotSupported
+}
+
+func findDescendants(pid int) (map[int]uint64, error) {
+	return nil, errTreeNotSupported
+}
+
+func newTreeCgroup() (string, *os.File, error) {
+	return "", nil, errTreeNotSupported
+}
+
+func startInCgroup(attr *syscall.SysProcAttr, dir *os.File) {}
+
+func cgroupDescendants(path string, pid int) (map[int]uint64, error) {
+	return nil, errTreeNotSupported
+}
+
+func removeCgroup(path string) error {
+	return errTreeNotSupported
+}
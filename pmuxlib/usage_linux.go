@@ -0,0 +1,74 @@
+package pmuxlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the number of clock ticks per second used by /proc/<pid>/stat,
+// which is 100 on all supported linux architectures.
+const clockTicks = 100
+
+// liveResourceUsage returns the resources used so far by the running process
+// of the given PID, as read from /proc.
+func liveResourceUsage(pid int) (ResourceUsage, error) {
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	// the command name is in parentheses and may itself contain spaces or
+	// parentheses, so fields are counted from after its closing parenthesis.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return ResourceUsage{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	// fields[0] is the state, the 3rd field of the file.
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 22 {
+		return ResourceUsage{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	var nums [3]int64
+	for j, field := range []string{fields[11], fields[12], fields[21]} {
+		if nums[j], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return ResourceUsage{}, fmt.Errorf(
+				"malformed /proc/%d/stat: %w", pid, err,
+			)
+		}
+	}
+
+	u := ResourceUsage{
+		UserTime:   time.Duration(nums[0]) * time.Second / clockTicks,
+		SystemTime: time.Duration(nums[1]) * time.Second / clockTicks,
+		RSS:        nums[2] * int64(os.Getpagesize()),
+	}
+
+	// the peak RSS is only available from the status file, if it can't be read
+	// then the current RSS is the best available.
+	u.MaxRSS = u.RSS
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid)); err == nil {
+		defer f.Close()
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "VmHWM:") {
+				continue
+			}
+			kb := strings.TrimSuffix(strings.TrimPrefix(line, "VmHWM:"), "kB")
+			kb = strings.TrimSpace(kb)
+			if n, err := strconv.ParseInt(kb, 10, 64); err == nil {
+				u.MaxRSS = n * 1024
+			}
+			break
+		}
+	}
+
+	return u, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package pmuxlib
+
+import "errors"
+
+func liveResourceUsage(pid int) (ResourceUsage, error) {
+	return ResourceUsage{}, errors.New(
+		"resource usage of running processes is only available on linux",
+	)
+}
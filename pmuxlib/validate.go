@@ -0,0 +1,458 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError is returned from Config.Validate, and describes every
+// problem which was found with the Config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func (cfg ProcessConfig) validate() []string {
+
+	var problems []string
+	problemf := func(str string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(str, args...))
+	}
+
+	if cfg.Cmd == "" && cfg.Type != ProcessTypeContainer &&
+		cfg.Type != ProcessTypePipeline {
+		problemf("cmd is required")
+	}
+
+	problems = append(problems, cfg.validateContainer()...)
+	problems = append(problems, cfg.validatePipeline()...)
+
+	problems = append(problems, validateLabels(cfg.Labels)...)
+
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"minWait", cfg.MinWait},
+		{"maxWait", cfg.MaxWait},
+		{"sigKillWait", cfg.SigKillWait},
+		{"outputWait", cfg.OutputWait},
+		{"startDelay", cfg.StartDelay},
+		{"startSecs", cfg.StartSecs},
+		{"retryWait", cfg.RetryWait},
+		{"circuitBreaker.window", cfg.CircuitBreaker.Window},
+		{"circuitBreaker.cooldown", cfg.CircuitBreaker.Cooldown},
+		{"readyCheck.interval", cfg.ReadyCheck.Interval},
+		{"watchDebounce", cfg.WatchDebounce},
+		{"maxRunTime", cfg.MaxRunTime},
+		{"fallbackRetry", cfg.FallbackRetry},
+		{"hooks.preStart.timeout", cfg.Hooks.PreStart.Timeout},
+		{"hooks.postStart.timeout", cfg.Hooks.PostStart.Timeout},
+		{"hooks.preStop.timeout", cfg.Hooks.PreStop.Timeout},
+		{"hooks.postStop.timeout", cfg.Hooks.PostStop.Timeout},
+		{"hooks.onCrash.timeout", cfg.Hooks.OnCrash.Timeout},
+	}
+
+	for _, d := range durations {
+		if d.d < 0 {
+			problemf("%s cannot be negative", d.name)
+		}
+	}
+
+	if cfg.MinWait > 0 && cfg.MaxWait > 0 && cfg.MinWait > cfg.MaxWait {
+		problemf("minWait cannot be greater than maxWait")
+	}
+
+	problems = append(problems, validateBackoff(cfg.Backoff)...)
+
+	for _, stream := range []struct {
+		name string
+		to   OutputStream
+	}{
+		{"stdoutTo", cfg.StdoutTo},
+		{"stderrTo", cfg.StderrTo},
+	} {
+		switch stream.to {
+		case "", OutputStreamStdout, OutputStreamStderr, OutputStreamDiscard:
+		default:
+			problemf(
+				"%s %q is not one of %q, %q, or %q",
+				stream.name, stream.to,
+				OutputStreamStdout, OutputStreamStderr, OutputStreamDiscard,
+			)
+		}
+	}
+
+	if !cfg.LingeringOutput.valid() {
+		problemf(
+			"lingeringOutput %q is not one of %q, %q, or %q",
+			cfg.LingeringOutput,
+			LingeringOutputClose, LingeringOutputWait, LingeringOutputKill,
+		)
+	}
+
+	if cfg.InheritStdio && cfg.LogLevels != nil {
+		problemf("logLevels has no effect when inheritStdio is set")
+	}
+
+	if cfg.CombineOutput && cfg.StderrTo != "" && cfg.StderrTo != OutputStreamStdout {
+		problemf("combineOutput conflicts with stderrTo %q", cfg.StderrTo)
+	}
+
+	switch cfg.RestartStrategy {
+	case "", RestartStrategyStopFirst, RestartStrategyBlueGreen:
+	default:
+		problemf("unknown restartStrategy %q", cfg.RestartStrategy)
+	}
+
+	for i, listenCfg := range cfg.Listen {
+		switch listenCfg.Network {
+		case "", "tcp", "tcp4", "tcp6", "unix":
+		default:
+			problemf("listen[%d]: unknown network %q", i, listenCfg.Network)
+		}
+
+		if listenCfg.Address == "" {
+			problemf("listen[%d]: address is required", i)
+		}
+	}
+
+	for _, window := range []struct {
+		name string
+		w    TimeWindow
+	}{
+		{"restartWindow", cfg.RestartWindow},
+		{"noRestartDuring", cfg.NoRestartDuring},
+	} {
+		if window.w == "" {
+			continue
+		} else if _, err := window.w.parse(); err != nil {
+			problemf("%s: %v", window.name, err)
+		}
+	}
+
+	problems = append(problems, validateStreams(cfg.Streams, len(cfg.Listen))...)
+
+	if cfg.Replicas > 1 && len(cfg.Listen) > 0 {
+		problemf("listen cannot be used with replicas")
+	}
+
+	problems = append(problems, validateMatrix(cfg.Matrix)...)
+
+	if cfg.Replicas < 0 {
+		problemf("replicas cannot be negative")
+	}
+
+	if cfg.MaxRestarts < 0 {
+		problemf("maxRestarts cannot be negative")
+	}
+
+	if cfg.Retries < 0 {
+		problemf("retries cannot be negative")
+	}
+
+	if !cfg.OneShot && (cfg.Retries != 0 || cfg.RetryWait != 0) {
+		problemf("retries and retryWait can only be used when oneShot is set")
+	}
+
+	if cfg.CrashReport.Lines < 0 {
+		problemf("crashReport.lines cannot be negative")
+	}
+
+	if cfg.Hooks.OnCrashLines < 0 {
+		problemf("hooks.onCrashLines cannot be negative")
+	}
+
+	if cfg.CircuitBreaker.Failures < 0 {
+		problemf("circuitBreaker.failures cannot be negative")
+	}
+
+	if !cfg.Verbosity.valid() {
+		problemf(
+			"verbosity %q is not one of %q, %q, or %q",
+			cfg.Verbosity, VerbosityQuiet, VerbosityNormal, VerbosityVerbose,
+		)
+	}
+
+	for k, v := range cfg.EnvFrom {
+		if err := v.validate(); err != nil {
+			problemf("envFrom %q: %v", k, err)
+		}
+	}
+
+	if cfg.LogLevels != nil {
+		problems = append(problems, cfg.LogLevels.validate()...)
+	}
+
+	for i, waitCfg := range cfg.WaitFor {
+		if err := waitCfg.validate(); err != nil {
+			problemf("waitFor[%d]: %v", i, err)
+		}
+	}
+
+	for i, secretCfg := range cfg.Secrets {
+		if err := secretCfg.validate(); err != nil {
+			problemf("secrets[%d]: %v", i, err)
+		}
+	}
+
+	for _, dir := range cfg.Path {
+		if dir == "" || strings.ContainsRune(dir, os.PathListSeparator) {
+			problemf(
+				"path: %q must be non-empty, and not contain %q",
+				dir, os.PathListSeparator,
+			)
+		}
+	}
+
+	if strings.ContainsAny(cfg.TZ, " \t\n") {
+		problemf("tz %q cannot contain whitespace", cfg.TZ)
+	}
+
+	if len(cfg.PassEnv) > 0 && !cfg.ClearEnv {
+		problemf("passEnv has no effect unless clearEnv is set")
+	}
+
+	for _, m := range cfg.NoRestartOnExit {
+		if err := m.validate(); err != nil {
+			problemf("noRestartOnExit: %v", err)
+		}
+	}
+
+	if cfg.Register != nil {
+		problems = append(problems, cfg.Register.validate()...)
+	}
+
+	problems = append(problems, cfg.Scripts.validate()...)
+	problems = append(problems, cfg.validateDir()...)
+
+	if cfg.FallbackAfter < 0 {
+		problemf("fallbackAfter cannot be negative")
+	}
+
+	if cfg.FallbackCmd == "" && (len(cfg.FallbackArgs) > 0 ||
+		cfg.FallbackAfter != 0 || cfg.FallbackRetry != 0) {
+		problemf(
+			"fallbackArgs, fallbackAfter, and fallbackRetry have no effect " +
+				"unless fallbackCmd is set",
+		)
+	}
+
+	if cfg.Umask != "" {
+		if _, err := strconv.ParseUint(cfg.Umask, 8, 32); err != nil {
+			problemf("umask %q is not a valid octal number", cfg.Umask)
+		}
+	}
+
+	normCap := func(capName string) string {
+		return strings.TrimPrefix(strings.ToUpper(capName), "CAP_")
+	}
+
+	for _, dropCap := range cfg.DropCaps {
+		for _, ambientCap := range cfg.AmbientCaps {
+			if normCap(dropCap) == normCap(ambientCap) {
+				problemf("capability %q is in both ambientCaps and dropCaps", dropCap)
+			}
+		}
+	}
+
+	return problems
+}
+
+// isLoopbackAddr returns whether the host of the TCP address is "localhost" or
+// a loopback IP address. An empty host, which listens on every interface, is
+// not.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Validate checks the Config for problems, such as missing or conflicting
+// fields, returning a *ValidationError describing all problems found, or nil.
+func (cfg Config) Validate() error {
+
+	var problems []string
+
+	if len(cfg.Processes) == 0 {
+		problems = append(problems, "at least one process must be defined")
+	}
+
+	if cfg.MaxConcurrentStarts < 0 {
+		problems = append(problems, "maxConcurrentStarts cannot be negative")
+	}
+
+	if cfg.StatusInterval < 0 {
+		problems = append(problems, "statusInterval cannot be negative")
+	}
+
+	if !cfg.Verbosity.valid() {
+		problems = append(problems, fmt.Sprintf(
+			"verbosity %q is not one of %q, %q, or %q",
+			cfg.Verbosity, VerbosityQuiet, VerbosityNormal, VerbosityVerbose,
+		))
+	}
+
+	switch cfg.LogFormat {
+	case "", SysLogFormatText, SysLogFormatJSON:
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"logFormat %q is not one of %q or %q",
+			cfg.LogFormat, SysLogFormatText, SysLogFormatJSON,
+		))
+	}
+
+	if cfg.Raw != nil && *cfg.Raw && cfg.LogFormat == SysLogFormatJSON {
+		problems = append(problems, fmt.Sprintf(
+			"raw cannot be used when logFormat is %q", SysLogFormatJSON,
+		))
+	}
+
+	switch cfg.SysLog.Format {
+	case "", SysLogFormatText, SysLogFormatJSON:
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"sysLog.format %q is not one of %q or %q",
+			cfg.SysLog.Format, SysLogFormatText, SysLogFormatJSON,
+		))
+	}
+
+	for _, zone := range []struct {
+		name, zone string
+	}{
+		{"timeZone", cfg.TimeZone},
+		{"logFileTimeZone", cfg.LogFileTimeZone},
+		{"sysLog.timeZone", cfg.SysLog.TimeZone},
+	} {
+		if _, err := timeLocation(zone.zone); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", zone.name, err))
+		}
+	}
+
+	if cfg.LogRotation.MaxSizeMB < 0 {
+		problems = append(problems, "logRotation.maxSizeMB cannot be negative")
+	}
+
+	if cfg.LogRotation.MaxAge < 0 {
+		problems = append(problems, "logRotation.maxAge cannot be negative")
+	}
+
+	if cfg.LogRotation.Keep < 0 {
+		problems = append(problems, "logRotation.keep cannot be negative")
+	}
+
+	if cfg.OTLP.Interval < 0 {
+		problems = append(problems, "otlp.interval cannot be negative")
+	}
+
+	if cfg.Heartbeat < 0 {
+		problems = append(problems, "heartbeat cannot be negative")
+	}
+
+	problems = append(problems, cfg.APIAuth.validate()...)
+
+	// tokens would be sent to the gRPC API in plaintext, and so are only
+	// accepted by it over TLS.
+	if cfg.GRPCAddr != "" && len(cfg.APIAuth.Tokens) > 0 && cfg.APIAuth.TLS == nil {
+		problems = append(problems, "grpcAddr with apiAuth.tokens requires apiAuth.tls")
+	}
+
+	// the dashboard is reached from a browser, which can't present a client
+	// certificate that TLS.ClientRoles would recognize.
+	if cfg.DashboardAddr != "" && len(cfg.APIAuth.Tokens) == 0 {
+		problems = append(problems, "dashboardAddr requires apiAuth.tokens")
+	}
+
+	// likewise tokens are sent to the dashboard in plaintext unless it's
+	// served over TLS, which is only acceptable if it can't be reached from
+	// other hosts.
+	if cfg.DashboardAddr != "" && cfg.APIAuth.TLS == nil &&
+		!isLoopbackAddr(cfg.DashboardAddr) {
+		problems = append(
+			problems,
+			"dashboardAddr with a non-loopback host requires apiAuth.tls",
+		)
+	}
+
+	if cfg.Vault.RotationInterval < 0 {
+		problems = append(problems, "vault.rotationInterval cannot be negative")
+	}
+
+	problems = append(problems, cfg.Registry.validate()...)
+
+	seenPluginNames := map[string]bool{}
+	for i, pluginCfg := range cfg.Plugins {
+		if err := pluginCfg.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("plugins[%d]: %v", i, err))
+		} else if seenPluginNames[pluginCfg.Name] {
+			problems = append(problems, fmt.Sprintf(
+				"plugins[%d]: name %q is used by more than one plugin",
+				i, pluginCfg.Name,
+			))
+		}
+		seenPluginNames[pluginCfg.Name] = true
+	}
+
+	seenNames := map[string]bool{}
+
+	for i, procCfg := range cfg.Processes {
+
+		desc := fmt.Sprintf("processes[%d]", i)
+
+		if procCfg.Name == "" {
+			problems = append(problems, desc+": name is required")
+		} else if seenNames[procCfg.Name] {
+			problems = append(problems, fmt.Sprintf(
+				"%s: name %q is used by more than one process",
+				desc, procCfg.Name,
+			))
+		} else {
+			desc = fmt.Sprintf("%s (%s)", desc, procCfg.Name)
+		}
+
+		seenNames[procCfg.Name] = true
+
+		for _, problem := range procCfg.validate() {
+			problems = append(problems, desc+": "+problem)
+		}
+
+		if procCfg.Register != nil && !cfg.Registry.enabled() {
+			problems = append(problems, desc+": register requires "+
+				"registry.consul or registry.etcd to be set")
+		}
+	}
+
+	// the names given to replicas and matrix processes mustn't clash with
+	// any others.
+	if len(problems) == 0 {
+		seenNames = map[string]bool{}
+		for _, procCfg := range cfg.ExpandProcesses().Processes {
+			if seenNames[procCfg.Name] {
+				problems = append(problems, fmt.Sprintf(
+					"process name %q is used by more than one process, "+
+						"once replicas and matrices are expanded",
+					procCfg.Name,
+				))
+			}
+			seenNames[procCfg.Name] = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
@@ -0,0 +1,632 @@
+package pmuxlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// VaultConfig is used to configure how pmux fetches the Secrets of processes
+// from HashiCorp Vault.
+type VaultConfig struct {
+
+	// Addr is the base URL of the Vault server, e.g. "https://vault:8200".
+	//
+	// Defaults to the VAULT_ADDR environment variable.
+	Addr string `yaml:"addr,omitempty"`
+
+	// Namespace is sent as the X-Vault-Namespace header, if set.
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// Token, or the contents of TokenFile, is used to authenticate with Vault,
+	// unless AppRole is configured.
+	//
+	// Defaults to the VAULT_TOKEN environment variable.
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"tokenFile,omitempty"`
+
+	// AppRole, if its RoleID is set, is used to log in to Vault in order to
+	// obtain a token.
+	AppRole VaultAppRoleConfig `yaml:"appRole,omitempty"`
+
+	// RenewLeases causes the leases of secrets, and of the token obtained via
+	// AppRole, to be renewed while they are in use.
+	RenewLeases bool `yaml:"renewLeases,omitempty"`
+
+	// RotationInterval, if set, causes the secrets of each running process to
+	// be re-read this often. If any have changed then the process is
+	// restarted, so that it picks up the new values.
+	RotationInterval time.Duration `yaml:"rotationInterval,omitempty"`
+}
+
+// VaultAppRoleConfig describes how to log in to Vault using the AppRole auth
+// method.
+type VaultAppRoleConfig struct {
+
+	// Mount is the path the AppRole auth method is mounted at.
+	//
+	// Defaults to "approle".
+	Mount string `yaml:"mount,omitempty"`
+
+	RoleID string `yaml:"roleID,omitempty"`
+
+	// SecretID, or the contents of SecretIDFile, is used as the secret ID.
+	SecretID     string `yaml:"secretID,omitempty"`
+	SecretIDFile string `yaml:"secretIDFile,omitempty"`
+}
+
+func (cfg VaultConfig) withDefaults() VaultConfig {
+
+	if cfg.Addr == "" {
+		cfg.Addr = os.Getenv("VAULT_ADDR")
+	}
+
+	if cfg.Token == "" && cfg.TokenFile == "" && cfg.AppRole.RoleID == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+
+	if cfg.AppRole.RoleID != "" && cfg.AppRole.Mount == "" {
+		cfg.AppRole.Mount = "approle"
+	}
+
+	return cfg
+}
+
+// SecretConfig describes a single secret which is fetched from Vault and given
+// to a process, either as an environment variable or as a file.
+type SecretConfig struct {
+
+	// Path is the path of the secret within Vault, e.g. "secret/data/db" for
+	// a KV version 2 secrets engine mounted at "secret".
+	Path string `yaml:"path"`
+
+	// Field is the field of the secret's data to use. If the field's value is
+	// not a string then it is JSON encoded.
+	Field string `yaml:"field"`
+
+	// Env is the name of the environment variable to set to the value.
+	Env string `yaml:"env,omitempty"`
+
+	// File is the path of a file to write the value to, with mode 0600, prior
+	// to the process being started. The file, and any directories created to
+	// hold it, are owned by the process's user and group.
+	File string `yaml:"file,omitempty"`
+}
+
+func (cfg SecretConfig) validate() error {
+
+	if cfg.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	if cfg.Field == "" {
+		return fmt.Errorf("field is required")
+	}
+
+	if (cfg.Env == "") == (cfg.File == "") {
+		return fmt.Errorf("exactly one of env and file must be given")
+	}
+
+	return nil
+}
+
+// vaultSecret is a secret as read from Vault.
+type vaultSecret struct {
+	data          map[string]interface{}
+	leaseID       string
+	leaseDuration time.Duration
+	renewable     bool
+}
+
+// vaultClient fetches secrets from Vault on behalf of processes, and keeps
+// track of the leases and values which each process was given.
+type vaultClient struct {
+	cfg       VaultConfig
+	client    *http.Client
+	sysLogger Logger
+
+	// ctx is canceled by close, stopping all renewal.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	l     sync.Mutex
+	token string
+
+	// sums holds a checksum of the secret values last given to each process,
+	// for detecting rotation.
+	sums map[string][32]byte
+
+	// cancelLeases cancels the lease renewal of the secrets last given to
+	// each process.
+	cancelLeases map[string]context.CancelFunc
+}
+
+func newVaultClient(cfg VaultConfig, sysLogger Logger) *vaultClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &vaultClient{
+		cfg:          cfg.withDefaults(),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		sysLogger:    sysLogger,
+		ctx:          ctx,
+		cancel:       cancel,
+		sums:         map[string][32]byte{},
+		cancelLeases: map[string]context.CancelFunc{},
+	}
+}
+
+// vaultResponse is the subset of the response body of Vault's API which is
+// needed.
+type vaultResponse struct {
+	Errors        []string               `json:"errors"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (c *vaultClient) do(
+	ctx context.Context, method, path, token string, body interface{},
+) (
+	vaultResponse, error,
+) {
+
+	var bodyR io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return vaultResponse{}, err
+		}
+		bodyR = bytes.NewReader(b)
+	}
+
+	url := strings.TrimSuffix(c.cfg.Addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyR)
+	if err != nil {
+		return vaultResponse{}, err
+	}
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return vaultResponse{}, err
+	}
+	defer res.Body.Close()
+
+	var vaultRes vaultResponse
+	if err := json.NewDecoder(res.Body).Decode(&vaultRes); err != nil && err != io.EOF {
+		return vaultResponse{}, fmt.Errorf("%s %s: decoding response: %w", method, path, err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		if len(vaultRes.Errors) > 0 {
+			return vaultResponse{}, fmt.Errorf(
+				"%s %s: %s", method, path, strings.Join(vaultRes.Errors, "; "),
+			)
+		}
+		return vaultResponse{}, fmt.Errorf(
+			"%s %s: unexpected status %q", method, path, res.Status,
+		)
+	}
+
+	return vaultRes, nil
+}
+
+func readFileOr(str, path string) (string, error) {
+	if path == "" {
+		return str, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// getToken returns the token to authenticate with, logging in via AppRole if
+// that's configured and hasn't been done yet.
+func (c *vaultClient) getToken(ctx context.Context) (string, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	appRole := c.cfg.AppRole
+
+	if appRole.RoleID == "" {
+		token, err := readFileOr(c.cfg.Token, c.cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading token: %w", err)
+		} else if token == "" {
+			return "", fmt.Errorf("no token configured")
+		}
+		c.token = token
+		return token, nil
+	}
+
+	secretID, err := readFileOr(appRole.SecretID, appRole.SecretIDFile)
+	if err != nil {
+		return "", fmt.Errorf("reading appRole secret ID: %w", err)
+	}
+
+	res, err := c.do(
+		ctx, http.MethodPost, "auth/"+appRole.Mount+"/login", "",
+		map[string]string{"role_id": appRole.RoleID, "secret_id": secretID},
+	)
+	if err != nil {
+		return "", fmt.Errorf("logging in with appRole: %w", err)
+	} else if res.Auth == nil || res.Auth.ClientToken == "" {
+		return "", fmt.Errorf("logging in with appRole: no token returned")
+	}
+
+	c.token = res.Auth.ClientToken
+
+	if c.cfg.RenewLeases && res.Auth.Renewable && res.Auth.LeaseDuration > 0 {
+		go c.renewToken(
+			c.token, time.Duration(res.Auth.LeaseDuration)*time.Second,
+		)
+	}
+
+	return c.token, nil
+}
+
+// renewToken renews the given token at half of its lease duration, until it
+// can no longer be renewed, at which point the next request will log in again.
+func (c *vaultClient) renewToken(token string, leaseDuration time.Duration) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(leaseDuration / 2):
+		}
+
+		res, err := c.do(
+			c.ctx, http.MethodPost, "auth/token/renew-self",
+			token, map[string]interface{}{},
+		)
+		if err != nil || res.Auth == nil || res.Auth.LeaseDuration <= 0 {
+			if err != nil && c.ctx.Err() == nil {
+				c.sysLogger.Printf("vault: renewing token: %v", err)
+			}
+
+			c.l.Lock()
+			if c.token == token {
+				c.token = ""
+			}
+			c.l.Unlock()
+			return
+		}
+
+		leaseDuration = time.Duration(res.Auth.LeaseDuration) * time.Second
+	}
+}
+
+// renewLease renews the lease of the given secret at half of its duration
+// until the context is canceled or the lease can no longer be renewed.
+func (c *vaultClient) renewLease(ctx context.Context, secret vaultSecret) {
+	leaseDuration := secret.leaseDuration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseDuration / 2):
+		}
+
+		token, err := c.getToken(ctx)
+		if err != nil {
+			c.sysLogger.Printf("vault: renewing lease %q: %v", secret.leaseID, err)
+			return
+		}
+
+		res, err := c.do(
+			ctx, http.MethodPut, "sys/leases/renew", token,
+			map[string]string{"lease_id": secret.leaseID},
+		)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.sysLogger.Printf("vault: renewing lease %q: %v", secret.leaseID, err)
+			}
+			return
+		} else if res.LeaseDuration <= 0 {
+			return
+		}
+
+		leaseDuration = time.Duration(res.LeaseDuration) * time.Second
+	}
+}
+
+func (c *vaultClient) read(ctx context.Context, path string) (vaultSecret, error) {
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+
+	res, err := c.do(ctx, http.MethodGet, path, token, nil)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+
+	data := res.Data
+
+	// KV version 2 secrets engines nest the secret's data within the
+	// response's data, alongside its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	return vaultSecret{
+		data:          data,
+		leaseID:       res.LeaseID,
+		leaseDuration: time.Duration(res.LeaseDuration) * time.Second,
+		renewable:     res.Renewable,
+	}, nil
+}
+
+// readSecrets reads each of the given secrets, returning the secrets as read
+// from Vault, keyed by path, and the value of each SecretConfig.
+func (c *vaultClient) readSecrets(
+	ctx context.Context, secretCfgs []SecretConfig,
+) (
+	map[string]vaultSecret, []string, error,
+) {
+	secrets := map[string]vaultSecret{}
+	values := make([]string, len(secretCfgs))
+
+	for i, secretCfg := range secretCfgs {
+		secret, ok := secrets[secretCfg.Path]
+		if !ok {
+			var err error
+			if secret, err = c.read(ctx, secretCfg.Path); err != nil {
+				return nil, nil, fmt.Errorf("reading %q: %w", secretCfg.Path, err)
+			}
+			secrets[secretCfg.Path] = secret
+		}
+
+		val, err := dataField(secret.data, secretCfg.Field)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %q: %w", secretCfg.Path, err)
+		}
+		values[i] = val
+	}
+
+	return secrets, values, nil
+}
+
+func sumValues(values []string) [32]byte {
+	return sha256.Sum256([]byte(strings.Join(values, "\x00")))
+}
+
+// secretEnv reads the Secrets of the given process, writes those which are
+// given as files, and returns the env values of those which are given as env
+// vars. Files, and any directories created for them, are owned by the
+// process's User and Group. Lease renewal of the secrets given to the
+// process's previous run is stopped, and that of these secrets is begun.
+func (c *vaultClient) secretEnv(
+	ctx context.Context, cfg ProcessConfig,
+) (
+	map[string]string, error,
+) {
+	name, secretCfgs := cfg.Name, cfg.Secrets
+
+	secrets, values, err := c.readSecrets(ctx, secretCfgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Credential
+	if cfg.User != "" || cfg.Group != "" {
+		if cred, err = lookupCredential(cfg.User, cfg.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	env := map[string]string{}
+	for i, secretCfg := range secretCfgs {
+		if secretCfg.Env != "" {
+			env[secretCfg.Env] = values[i]
+			continue
+		}
+
+		if err := mkdirAllAs(filepath.Dir(secretCfg.File), cred); err != nil {
+			return nil, fmt.Errorf("creating directory of %q: %w", secretCfg.File, err)
+		}
+
+		err := writeFileAtomicAs(secretCfg.File, []byte(values[i]), cred)
+		if err != nil {
+			return nil, fmt.Errorf("writing %q: %w", secretCfg.File, err)
+		}
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.sums[name] = sumValues(values)
+
+	if cancel := c.cancelLeases[name]; cancel != nil {
+		cancel()
+		delete(c.cancelLeases, name)
+	}
+
+	if c.cfg.RenewLeases {
+		leaseCtx, cancel := context.WithCancel(c.ctx)
+		c.cancelLeases[name] = cancel
+
+		for _, secret := range secrets {
+			if secret.renewable && secret.leaseID != "" && secret.leaseDuration > 0 {
+				go c.renewLease(leaseCtx, secret)
+			}
+		}
+	}
+
+	return env, nil
+}
+
+// mkdirAllAs is like os.MkdirAll with mode 0700, but if cred is non-nil the
+// directories which it creates are owned by its uid and gid.
+func mkdirAllAs(dir string, cred *syscall.Credential) error {
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAllAs(parent, cred); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	if cred == nil {
+		return nil
+	}
+
+	return os.Chown(dir, int(cred.Uid), int(cred.Gid))
+}
+
+// rotated returns true if the values of the given process's secrets differ
+// from those which it was last given.
+func (c *vaultClient) rotated(
+	ctx context.Context, name string, secretCfgs []SecretConfig,
+) (
+	bool, error,
+) {
+	_, values, err := c.readSecrets(ctx, secretCfgs)
+	if err != nil {
+		return false, err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	sum, ok := c.sums[name]
+	return ok && sum != sumValues(values), nil
+}
+
+// close stops all renewal of leases and of the token.
+func (c *vaultClient) close() {
+	c.cancel()
+}
+
+// vaultRotatedReason is the reason given for restarting a process whose secrets
+// have been rotated.
+var vaultRotatedReason = stopErrorf("vault secrets were rotated")
+
+// run re-reads the secrets of each running process every RotationInterval,
+// and restarts those processes whose secrets have changed, until the context
+// is canceled. Restarts are delayed until allowed by the process's restart
+// window, see ProcessConfig.RestartWindow.
+func (c *vaultClient) run(ctx context.Context, p *Pmux) {
+
+	ticker := time.NewTicker(c.cfg.RotationInterval)
+	defer ticker.Stop()
+
+	// pending holds the names of processes which are waiting for their
+	// restart window in order to be restarted.
+	var (
+		pendingL sync.Mutex
+		pending  = map[string]bool{}
+	)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		p.l.Lock()
+		var procs []*process
+		for _, proc := range p.procs {
+			if proc.osProc != nil && len(proc.cfg.Secrets) > 0 {
+				procs = append(procs, proc)
+			}
+		}
+		p.l.Unlock()
+
+		for _, proc := range procs {
+			pendingL.Lock()
+			isPending := pending[proc.cfg.Name]
+			pendingL.Unlock()
+
+			if isPending {
+				continue
+			}
+
+			rotated, err := c.rotated(ctx, proc.cfg.Name, proc.cfg.Secrets)
+			if err != nil {
+				proc.sysLogger.Printf("vault: checking for rotated secrets: %v", err)
+				continue
+			} else if !rotated {
+				continue
+			}
+
+			if proc.cfg.recycleAllowed(proc.cfg.clock().Now()) {
+				proc.sysLogger.Println("vault: secrets have been rotated, restarting process")
+				if err := p.restartProcess(proc.cfg.Name, vaultRotatedReason); err != nil {
+					proc.sysLogger.Printf("vault: %v", err)
+				}
+				continue
+			}
+
+			proc.sysLogger.Println(
+				"vault: secrets have been rotated, " +
+					"will restart process within its restart window",
+			)
+
+			pendingL.Lock()
+			pending[proc.cfg.Name] = true
+			pendingL.Unlock()
+
+			go func(proc *process) {
+				defer func() {
+					pendingL.Lock()
+					delete(pending, proc.cfg.Name)
+					pendingL.Unlock()
+				}()
+
+				if !waitRecycleAllowed(ctx, proc.cfg) {
+					return
+				}
+
+				proc.sysLogger.Println("vault: restarting process for rotated secrets")
+				if err := p.restartProcess(proc.cfg.Name, vaultRotatedReason); err != nil {
+					proc.sysLogger.Printf("vault: %v", err)
+				}
+			}(proc)
+		}
+	}
+}
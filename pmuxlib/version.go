@@ -0,0 +1,97 @@
+package pmuxlib
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// modulePath is the path of the module which pmuxlib is a part of.
+const modulePath = "github.com/cryptic-io/pmux"
+
+// Version, Commit, and Date describe the build of pmux. They may be set at
+// build time using, for example:
+//
+//	go build -ldflags "-X github.com/cryptic-io/pmux/pmuxlib.Version=v1.2.3"
+//
+// Any which aren't set are filled in from the build information embedded by
+// the go toolchain, where possible.
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// BuildInfo describes the build of pmux which is running.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+
+	// Features lists the platform specific features which this build of pmux
+	// supports, e.g. "adopt" for adopting the processes of another pmux which
+	// is being upgraded.
+	Features []string `json:"features"`
+}
+
+// GetBuildInfo returns the BuildInfo of the running pmux.
+func GetBuildInfo() BuildInfo {
+
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  append([]string(nil), platformFeatures...),
+	}
+
+	if goInfo, ok := debug.ReadBuildInfo(); ok {
+
+		if info.Version == "" {
+			if goInfo.Main.Path == modulePath {
+				info.Version = goInfo.Main.Version
+			}
+			for _, dep := range goInfo.Deps {
+				if dep.Path == modulePath {
+					info.Version = dep.Version
+				}
+			}
+		}
+
+		for _, setting := range goInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+
+	return info
+}
+
+// String returns a single line description of the BuildInfo, e.g.
+// "v1.2.3 (commit abc123, built 2024-01-02T03:04:05Z, go1.20 linux/amd64)".
+func (info BuildInfo) String() string {
+
+	details := make([]string, 0, 3)
+	if info.Commit != "" {
+		details = append(details, "commit "+info.Commit)
+	}
+	if info.Date != "" {
+		details = append(details, "built "+info.Date)
+	}
+	details = append(details, info.GoVersion+" "+info.Platform)
+
+	return fmt.Sprintf("%s (%s)", info.Version, strings.Join(details, ", "))
+}
@@ -0,0 +1,145 @@
+package pmuxlib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// waitForAttemptTimeout is the longest a single attempt at meeting a
+// WaitForConfig's condition may take.
+const waitForAttemptTimeout = 5 * time.Second
+
+// WaitForConfig describes a condition which must be met before a process is
+// started, such as a database accepting connections. Exactly one of TCP or
+// DNS must be given.
+type WaitForConfig struct {
+
+	// TCP is an address, e.g. "db:5432", which must accept a TCP connection.
+	TCP string `yaml:"tcp,omitempty"`
+
+	// DNS is a hostname which must resolve to at least one address.
+	DNS string `yaml:"dns,omitempty"`
+
+	// Timeout is how long to wait for the condition to be met. If it isn't
+	// met in time then the start of the process is considered to have
+	// failed, and is retried according to the process's backoff.
+	//
+	// Defaults to 60 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Interval is how long to wait between each check of the condition.
+	//
+	// Defaults to 1 second.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+func (cfg WaitForConfig) withDefaults() WaitForConfig {
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 60 * time.Second
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = 1 * time.Second
+	}
+
+	return cfg
+}
+
+func (cfg WaitForConfig) validate() error {
+
+	if (cfg.TCP == "") == (cfg.DNS == "") {
+		return fmt.Errorf("exactly one of tcp and dns must be given")
+	}
+
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+
+	if cfg.Interval < 0 {
+		return fmt.Errorf("interval cannot be negative")
+	}
+
+	return nil
+}
+
+func (cfg WaitForConfig) String() string {
+	if cfg.TCP != "" {
+		return "tcp " + cfg.TCP
+	}
+	return "dns " + cfg.DNS
+}
+
+// check checks the condition once, returning an error describing why it isn't
+// met.
+func (cfg WaitForConfig) check(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, waitForAttemptTimeout)
+	defer cancel()
+
+	if cfg.TCP != "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", cfg.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, cfg.DNS)
+	if err != nil {
+		return err
+	} else if len(addrs) == 0 {
+		return fmt.Errorf("%q resolved to no addresses", cfg.DNS)
+	}
+
+	return nil
+}
+
+// waitFor blocks until each of the process's WaitFor conditions has been met,
+// in order. An error is returned if any isn't met within its Timeout, or if
+// the context is canceled.
+func waitFor(ctx context.Context, sysLogger Logger, cfg ProcessConfig) error {
+
+	clock := cfg.clock()
+
+	for _, waitCfg := range cfg.WaitFor {
+
+		waitCfg = waitCfg.withDefaults()
+		deadline := clock.Now().Add(waitCfg.Timeout)
+
+		for logged := false; ; logged = true {
+
+			err := waitCfg.check(ctx)
+			if err == nil {
+				debugf(sysLogger, "waitFor %v: ready", waitCfg)
+				break
+			}
+
+			if ctx.Err() != nil {
+				return ctxErr(ctx)
+			} else if !clock.Now().Before(deadline) {
+				return fmt.Errorf(
+					"waitFor %v: not ready after %v: %w",
+					waitCfg, waitCfg.Timeout, err,
+				)
+			}
+
+			if !logged {
+				infof(sysLogger, "waitFor %v: waiting (%v)", waitCfg, err)
+			}
+
+			afterCh, stop := after(clock, waitCfg.Interval)
+			select {
+			case <-afterCh:
+			case <-ctx.Done():
+				stop()
+				return ctxErr(ctx)
+			}
+		}
+	}
+
+	return nil
+}
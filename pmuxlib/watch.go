@@ -0,0 +1,124 @@
+package pmuxlib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchIgnored returns true if the given path matches any of the given glob
+// patterns. Patterns are matched against both the full path and its base name.
+func watchIgnored(path string, ignore []string) bool {
+	for _, pattern := range ignore {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		} else if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addWatchPath adds the given path to the watcher. If the path is a directory
+// then all directories beneath it are added as well.
+func addWatchPath(w *fsnotify.Watcher, root string, ignore []string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if watchIgnored(path, ignore) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// files within a watched directory are watched implicitly.
+		if info.IsDir() || path == root {
+			if err := w.Add(path); err != nil {
+				return fmt.Errorf("watching %q: %w", path, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// watchFiles watches the Watch paths of the ProcessConfig, and writes to the
+// returned channel whenever a change is detected, after WatchDebounce has
+// elapsed without any further changes. The watch stops once the context is
+// canceled.
+func watchFiles(
+	ctx context.Context, sysLogger Logger, cfg ProcessConfig,
+) (
+	<-chan struct{}, error,
+) {
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+
+	for _, path := range cfg.Watch {
+		if err := addWatchPath(w, path, cfg.WatchIgnore); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	ch := make(chan struct{}, 1)
+
+	go func() {
+		defer w.Close()
+
+		var (
+			debounceCh   <-chan time.Time
+			stopDebounce = func() {}
+		)
+		defer func() { stopDebounce() }()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case err := <-w.Errors:
+				sysLogger.Printf("watching files: %v", err)
+
+			case ev := <-w.Events:
+				if watchIgnored(ev.Name, cfg.WatchIgnore) {
+					continue
+				}
+
+				// newly created directories need to be watched too.
+				if ev.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+						if err := addWatchPath(w, ev.Name, cfg.WatchIgnore); err != nil {
+							sysLogger.Printf("watching files: %v", err)
+						}
+					}
+				}
+
+				if debounceCh == nil {
+					debugf(sysLogger, "detected change to %q", ev.Name)
+				}
+				stopDebounce()
+				debounceCh, stopDebounce = after(cfg.clock(), cfg.WatchDebounce)
+
+			case <-debounceCh:
+				debounceCh = nil
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,218 @@
+package pmuxlib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a recurring period of time, given as "HH:MM-HH:MM", optionally
+// followed by the days of the week on which it applies, e.g. "02:00-04:00",
+// "09:00-17:00 Mon-Fri" or "22:00-06:00 Sat,Sun". A window whose end is not
+// after its start spans midnight, and applies on the days on which it starts.
+// Times are in the local time zone.
+type TimeWindow string
+
+// parsedTimeWindow is the parsed form of a TimeWindow, with start and end given
+// in minutes since midnight.
+type parsedTimeWindow struct {
+	start, end int
+	days       [7]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseClock(str string) (int, error) {
+	hStr, mStr, ok := strings.Cut(str, ":")
+	h, hErr := strconv.Atoi(hStr)
+	m, mErr := strconv.Atoi(mStr)
+	if !ok || hErr != nil || mErr != nil || h < 0 || h > 24 || m < 0 ||
+		m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", str)
+	}
+	return h*60 + m, nil
+}
+
+func parseWeekday(str string) (time.Weekday, error) {
+	day, ok := weekdays[strings.ToLower(str)]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q, expected e.g. Mon", str)
+	}
+	return day, nil
+}
+
+func (w TimeWindow) parse() (parsedTimeWindow, error) {
+
+	var parsed parsedTimeWindow
+
+	fields := strings.Fields(string(w))
+	if len(fields) == 0 || len(fields) > 2 {
+		return parsed, fmt.Errorf(
+			"%q is not of the form \"HH:MM-HH:MM [days]\"", w,
+		)
+	}
+
+	startStr, endStr, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return parsed, fmt.Errorf("%q has no end time", w)
+	}
+
+	var err error
+	if parsed.start, err = parseClock(startStr); err != nil {
+		return parsed, err
+	} else if parsed.end, err = parseClock(endStr); err != nil {
+		return parsed, err
+	}
+
+	if len(fields) == 1 {
+		for i := range parsed.days {
+			parsed.days[i] = true
+		}
+		return parsed, nil
+	}
+
+	for _, daysStr := range strings.Split(fields[1], ",") {
+
+		fromStr, toStr, isRange := strings.Cut(daysStr, "-")
+
+		from, err := parseWeekday(fromStr)
+		if err != nil {
+			return parsed, err
+		}
+
+		to := from
+		if isRange {
+			if to, err = parseWeekday(toStr); err != nil {
+				return parsed, err
+			}
+		}
+
+		// ranges may wrap around the end of the week, e.g. Fri-Mon.
+		for day := from; ; day = (day + 1) % 7 {
+			parsed.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+// contains returns whether the given time falls within the TimeWindow, which
+// is expected to be valid.
+func (w TimeWindow) contains(t time.Time) bool {
+
+	parsed, err := w.parse()
+	if err != nil {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if parsed.start < parsed.end {
+		return parsed.days[day] && minute >= parsed.start && minute < parsed.end
+	}
+
+	// the window spans midnight, so the time may fall within the part of it
+	// which started the previous day.
+	return (minute >= parsed.start && parsed.days[day]) ||
+		(minute < parsed.end && parsed.days[(day+6)%7])
+}
+
+// recycleWindowPollInterval is how often a process which is due to be recycled
+// checks whether its restart window has opened.
+const recycleWindowPollInterval = 30 * time.Second
+
+// recycleAllowed returns whether a non-urgent restart of the process may
+// happen at the given time, according to its RestartWindow and
+// NoRestartDuring.
+func (cfg ProcessConfig) recycleAllowed(t time.Time) bool {
+	if cfg.RestartWindow != "" && !cfg.RestartWindow.contains(t) {
+		return false
+	}
+	return cfg.NoRestartDuring == "" || !cfg.NoRestartDuring.contains(t)
+}
+
+// waitRecycleAllowed blocks until a non-urgent restart of the process is
+// allowed (see recycleAllowed), returning false if the context is canceled
+// first.
+func waitRecycleAllowed(ctx context.Context, cfg ProcessConfig) bool {
+
+	clock := cfg.clock()
+
+	for !cfg.recycleAllowed(clock.Now()) {
+		timer := clock.NewTimer(recycleWindowPollInterval)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+
+	return true
+}
+
+// recycleAfter returns a channel which is closed once the instance has been
+// running for the process's MaxRunTime, and a restart is allowed by its
+// restart window. It returns nil if there is no MaxRunTime.
+func recycleAfter(
+	ctx context.Context, sysLogger Logger, cfg ProcessConfig, inst *instance,
+) <-chan struct{} {
+
+	if cfg.MaxRunTime == 0 {
+		return nil
+	}
+
+	ch := make(chan struct{})
+
+	go func() {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-inst.doneCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		timer := cfg.clock().NewTimer(cfg.MaxRunTime)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			return
+		}
+
+		if !cfg.recycleAllowed(cfg.clock().Now()) {
+			infof(
+				sysLogger,
+				"process has exceeded maxRunTime of %v, waiting for restart window",
+				cfg.MaxRunTime,
+			)
+			if !waitRecycleAllowed(ctx, cfg) {
+				return
+			}
+		}
+
+		infof(sysLogger, "process has exceeded maxRunTime of %v", cfg.MaxRunTime)
+		close(ch)
+	}()
+
+	return ch
+}
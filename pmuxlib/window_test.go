@@ -0,0 +1,67 @@
+package pmuxlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+
+	// 2026-10-12 is a Monday.
+	at := func(day int, hour, minute int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, minute, 0, 0, time.Local)
+	}
+
+	var (
+		mon = 0
+		fri = 4
+		sat = 5
+		sun = 6
+	)
+
+	tests := []struct {
+		window  TimeWindow
+		invalid bool
+		t       time.Time
+		exp     bool
+	}{
+		{window: "02:00-04:00", t: at(mon, 2, 0), exp: true},
+		{window: "02:00-04:00", t: at(mon, 3, 59), exp: true},
+		{window: "02:00-04:00", t: at(mon, 4, 0), exp: false},
+		{window: "02:00-04:00", t: at(mon, 1, 59), exp: false},
+		{window: "09:00-17:00 Mon-Fri", t: at(fri, 12, 0), exp: true},
+		{window: "09:00-17:00 Mon-Fri", t: at(sat, 12, 0), exp: false},
+		{window: "09:00-17:00 sat,SUN", t: at(sun, 12, 0), exp: true},
+		{window: "09:00-17:00 Fri-Mon", t: at(sun, 12, 0), exp: true},
+		{window: "09:00-17:00 Fri-Mon", t: at(mon+1, 12, 0), exp: false},
+
+		// windows spanning midnight apply on the days on which they start.
+		{window: "22:00-06:00 Sat", t: at(sat, 23, 0), exp: true},
+		{window: "22:00-06:00 Sat", t: at(sun, 5, 0), exp: true},
+		{window: "22:00-06:00 Sat", t: at(sat, 5, 0), exp: false},
+		{window: "22:00-06:00 Sat", t: at(sun, 23, 0), exp: false},
+		{window: "00:00-24:00", t: at(mon, 23, 59), exp: true},
+
+		{window: "", invalid: true},
+		{window: "02:00", invalid: true},
+		{window: "25:00-26:00", invalid: true},
+		{window: "02:60-03:00", invalid: true},
+		{window: "02:00-03:00 Someday", invalid: true},
+		{window: "02:00-03:00 Mon extra", invalid: true},
+	}
+
+	for _, test := range tests {
+		name := string(test.window) + " " + test.t.Format("Mon 15:04")
+		t.Run(name, func(t *testing.T) {
+			if _, err := test.window.parse(); (err != nil) != test.invalid {
+				t.Fatalf("expected invalid %v, got error %v", test.invalid, err)
+			} else if test.invalid {
+				return
+			}
+
+			if got := test.window.contains(test.t); got != test.exp {
+				t.Fatalf("expected %v, got %v", test.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+// Package pmuxpb contains the protobuf messages and gRPC service served by
+// pmux when grpcAddr is set in its config. The generated code can be
+// regenerated using `go generate` with protoc, protoc-gen-go and
+// protoc-gen-go-grpc installed.
+package pmuxpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pmux.proto
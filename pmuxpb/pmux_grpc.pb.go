@@ -0,0 +1,652 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pmux.proto
+
+package pmuxpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Pmux_Status_FullMethodName          = "/pmux.v1.Pmux/Status"
+	Pmux_StartupSummary_FullMethodName  = "/pmux.v1.Pmux/StartupSummary"
+	Pmux_Start_FullMethodName           = "/pmux.v1.Pmux/Start"
+	Pmux_Stop_FullMethodName            = "/pmux.v1.Pmux/Stop"
+	Pmux_Pause_FullMethodName           = "/pmux.v1.Pmux/Pause"
+	Pmux_Resume_FullMethodName          = "/pmux.v1.Pmux/Resume"
+	Pmux_Freeze_FullMethodName          = "/pmux.v1.Pmux/Freeze"
+	Pmux_Thaw_FullMethodName            = "/pmux.v1.Pmux/Thaw"
+	Pmux_Restart_FullMethodName         = "/pmux.v1.Pmux/Restart"
+	Pmux_RollingRestart_FullMethodName  = "/pmux.v1.Pmux/RollingRestart"
+	Pmux_ReopenLogs_FullMethodName      = "/pmux.v1.Pmux/ReopenLogs"
+	Pmux_TailLogs_FullMethodName        = "/pmux.v1.Pmux/TailLogs"
+	Pmux_SubscribeEvents_FullMethodName = "/pmux.v1.Pmux/SubscribeEvents"
+)
+
+// PmuxClient is the client API for Pmux service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PmuxClient interface {
+	// Status returns the current state of each process.
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// StartupSummary returns how the starting of each process turned out when
+	// pmux began. It fails with UNAVAILABLE while processes are still starting.
+	StartupSummary(ctx context.Context, in *StartupSummaryRequest, opts ...grpc.CallOption) (*StartupSummaryResponse, error)
+	// Start starts a process which isn't running.
+	Start(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Stop stops a running process without affecting any others, and returns
+	// once it has stopped. It isn't started again until Start is called.
+	Stop(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Pause stops pmux from restarting a process when it exits. The name "all"
+	// may be used to pause every process.
+	Pause(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Resume undoes Pause. The name "all" may be used to resume every process.
+	Resume(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Freeze suspends a running process by sending SIGSTOP to its process
+	// group.
+	Freeze(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Thaw undoes Freeze by sending SIGCONT.
+	Thaw(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Restart stops a running process and immediately starts it again.
+	Restart(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// RollingRestart restarts each replica of a process one at a time, waiting
+	// for each to become ready before moving on to the next.
+	RollingRestart(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// ReopenLogs closes and reopens all log files.
+	ReopenLogs(ctx context.Context, in *ReopenLogsRequest, opts ...grpc.CallOption) (*ReopenLogsResponse, error)
+	// TailLogs streams every line logged by pmux from the time of the call,
+	// until the call is canceled. Lines are dropped if the client falls too far
+	// behind.
+	TailLogs(ctx context.Context, in *TailLogsRequest, opts ...grpc.CallOption) (Pmux_TailLogsClient, error)
+	// SubscribeEvents streams every lifecycle event from the time of the call,
+	// until the call is canceled. Events are dropped if the client falls too far
+	// behind.
+	SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (Pmux_SubscribeEventsClient, error)
+}
+
+type pmuxClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPmuxClient(cc grpc.ClientConnInterface) PmuxClient {
+	return &pmuxClient{cc}
+}
+
+func (c *pmuxClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, Pmux_Status_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) StartupSummary(ctx context.Context, in *StartupSummaryRequest, opts ...grpc.CallOption) (*StartupSummaryResponse, error) {
+	out := new(StartupSummaryResponse)
+	err := c.cc.Invoke(ctx, Pmux_StartupSummary_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Start(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Start_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Stop(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Stop_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Pause(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Pause_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Resume(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Resume_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Freeze(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Freeze_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Thaw(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Thaw_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) Restart(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_Restart_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) RollingRestart(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, Pmux_RollingRestart_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) ReopenLogs(ctx context.Context, in *ReopenLogsRequest, opts ...grpc.CallOption) (*ReopenLogsResponse, error) {
+	out := new(ReopenLogsResponse)
+	err := c.cc.Invoke(ctx, Pmux_ReopenLogs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pmuxClient) TailLogs(ctx context.Context, in *TailLogsRequest, opts ...grpc.CallOption) (Pmux_TailLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Pmux_ServiceDesc.Streams[0], Pmux_TailLogs_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pmuxTailLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pmux_TailLogsClient interface {
+	Recv() (*LogLine, error)
+	grpc.ClientStream
+}
+
+type pmuxTailLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *pmuxTailLogsClient) Recv() (*LogLine, error) {
+	m := new(LogLine)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pmuxClient) SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (Pmux_SubscribeEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Pmux_ServiceDesc.Streams[1], Pmux_SubscribeEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pmuxSubscribeEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pmux_SubscribeEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type pmuxSubscribeEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *pmuxSubscribeEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PmuxServer is the server API for Pmux service.
+// All implementations must embed UnimplementedPmuxServer
+// for forward compatibility
+type PmuxServer interface {
+	// Status returns the current state of each process.
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	// StartupSummary returns how the starting of each process turned out when
+	// pmux began. It fails with UNAVAILABLE while processes are still starting.
+	StartupSummary(context.Context, *StartupSummaryRequest) (*StartupSummaryResponse, error)
+	// Start starts a process which isn't running.
+	Start(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Stop stops a running process without affecting any others, and returns
+	// once it has stopped. It isn't started again until Start is called.
+	Stop(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Pause stops pmux from restarting a process when it exits. The name "all"
+	// may be used to pause every process.
+	Pause(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Resume undoes Pause. The name "all" may be used to resume every process.
+	Resume(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Freeze suspends a running process by sending SIGSTOP to its process
+	// group.
+	Freeze(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Thaw undoes Freeze by sending SIGCONT.
+	Thaw(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Restart stops a running process and immediately starts it again.
+	Restart(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// RollingRestart restarts each replica of a process one at a time, waiting
+	// for each to become ready before moving on to the next.
+	RollingRestart(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// ReopenLogs closes and reopens all log files.
+	ReopenLogs(context.Context, *ReopenLogsRequest) (*ReopenLogsResponse, error)
+	// TailLogs streams every line logged by pmux from the time of the call,
+	// until the call is canceled. Lines are dropped if the client falls too far
+	// behind.
+	TailLogs(*TailLogsRequest, Pmux_TailLogsServer) error
+	// SubscribeEvents streams every lifecycle event from the time of the call,
+	// until the call is canceled. Events are dropped if the client falls too far
+	// behind.
+	SubscribeEvents(*SubscribeEventsRequest, Pmux_SubscribeEventsServer) error
+	mustEmbedUnimplementedPmuxServer()
+}
+
+// UnimplementedPmuxServer must be embedded to have forward compatible implementations.
+type UnimplementedPmuxServer struct {
+}
+
+func (UnimplementedPmuxServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedPmuxServer) StartupSummary(context.Context, *StartupSummaryRequest) (*StartupSummaryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartupSummary not implemented")
+}
+func (UnimplementedPmuxServer) Start(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Start not implemented")
+}
+func (UnimplementedPmuxServer) Stop(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stop not implemented")
+}
+func (UnimplementedPmuxServer) Pause(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pause not implemented")
+}
+func (UnimplementedPmuxServer) Resume(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resume not implemented")
+}
+func (UnimplementedPmuxServer) Freeze(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Freeze not implemented")
+}
+func (UnimplementedPmuxServer) Thaw(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Thaw not implemented")
+}
+func (UnimplementedPmuxServer) Restart(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restart not implemented")
+}
+func (UnimplementedPmuxServer) RollingRestart(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RollingRestart not implemented")
+}
+func (UnimplementedPmuxServer) ReopenLogs(context.Context, *ReopenLogsRequest) (*ReopenLogsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReopenLogs not implemented")
+}
+func (UnimplementedPmuxServer) TailLogs(*TailLogsRequest, Pmux_TailLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method TailLogs not implemented")
+}
+func (UnimplementedPmuxServer) SubscribeEvents(*SubscribeEventsRequest, Pmux_SubscribeEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeEvents not implemented")
+}
+func (UnimplementedPmuxServer) mustEmbedUnimplementedPmuxServer() {}
+
+// UnsafePmuxServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PmuxServer will
+// result in compilation errors.
+type UnsafePmuxServer interface {
+	mustEmbedUnimplementedPmuxServer()
+}
+
+func RegisterPmuxServer(s grpc.ServiceRegistrar, srv PmuxServer) {
+	s.RegisterService(&Pmux_ServiceDesc, srv)
+}
+
+func _Pmux_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Status_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_StartupSummary_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartupSummaryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).StartupSummary(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_StartupSummary_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).StartupSummary(ctx, req.(*StartupSummaryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Start_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Start(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Start_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Start(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Stop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Stop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Stop_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Stop(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Pause_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Pause(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Pause_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Pause(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Resume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Resume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Resume_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Resume(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Freeze_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Freeze(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Freeze_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Freeze(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Thaw_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Thaw(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Thaw_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Thaw(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_Restart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).Restart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_Restart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).Restart(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_RollingRestart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).RollingRestart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_RollingRestart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).RollingRestart(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_ReopenLogs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReopenLogsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PmuxServer).ReopenLogs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pmux_ReopenLogs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PmuxServer).ReopenLogs(ctx, req.(*ReopenLogsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pmux_TailLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TailLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PmuxServer).TailLogs(m, &pmuxTailLogsServer{stream})
+}
+
+type Pmux_TailLogsServer interface {
+	Send(*LogLine) error
+	grpc.ServerStream
+}
+
+type pmuxTailLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *pmuxTailLogsServer) Send(m *LogLine) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Pmux_SubscribeEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PmuxServer).SubscribeEvents(m, &pmuxSubscribeEventsServer{stream})
+}
+
+type Pmux_SubscribeEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type pmuxSubscribeEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *pmuxSubscribeEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Pmux_ServiceDesc is the grpc.ServiceDesc for Pmux service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Pmux_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pmux.v1.Pmux",
+	HandlerType: (*PmuxServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Status",
+			Handler:    _Pmux_Status_Handler,
+		},
+		{
+			MethodName: "StartupSummary",
+			Handler:    _Pmux_StartupSummary_Handler,
+		},
+		{
+			MethodName: "Start",
+			Handler:    _Pmux_Start_Handler,
+		},
+		{
+			MethodName: "Stop",
+			Handler:    _Pmux_Stop_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _Pmux_Pause_Handler,
+		},
+		{
+			MethodName: "Resume",
+			Handler:    _Pmux_Resume_Handler,
+		},
+		{
+			MethodName: "Freeze",
+			Handler:    _Pmux_Freeze_Handler,
+		},
+		{
+			MethodName: "Thaw",
+			Handler:    _Pmux_Thaw_Handler,
+		},
+		{
+			MethodName: "Restart",
+			Handler:    _Pmux_Restart_Handler,
+		},
+		{
+			MethodName: "RollingRestart",
+			Handler:    _Pmux_RollingRestart_Handler,
+		},
+		{
+			MethodName: "ReopenLogs",
+			Handler:    _Pmux_ReopenLogs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TailLogs",
+			Handler:       _Pmux_TailLogs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeEvents",
+			Handler:       _Pmux_SubscribeEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pmux.proto",
+}
@@ -0,0 +1,134 @@
+package pmuxtest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// FakeClock implements pmuxlib.Clock using a time which only changes when
+// Advance is called, so that tests needn't wait for backoffs, SigKillWait,
+// etc. to actually pass.
+//
+// Tests will usually want to call WaitForTimers before calling Advance, so
+// that they don't advance the clock before the code under test has started
+// waiting on it.
+type FakeClock struct {
+	l      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+
+	// changedCh is closed, and replaced, whenever a timer is created.
+	changedCh chan struct{}
+}
+
+var _ pmuxlib.Clock = new(FakeClock)
+
+// NewFakeClock returns a FakeClock whose time starts at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, changedCh: make(chan struct{})}
+}
+
+// Now implements the pmuxlib.Clock interface.
+func (c *FakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+// NewTimer implements the pmuxlib.Clock interface. Timers of zero or negative
+// durations fire immediately.
+func (c *FakeClock) NewTimer(d time.Duration) pmuxlib.Timer {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	t := &fakeTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		ch:    make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+
+	c.timers = append(c.timers, t)
+	close(c.changedCh)
+	c.changedCh = make(chan struct{})
+
+	return t
+}
+
+// Advance moves the time of the FakeClock forward by the given duration,
+// firing every timer which is due by the new time, in the order they're due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+
+	var i int
+	for ; i < len(c.timers) && !c.timers[i].at.After(c.now); i++ {
+		c.timers[i].ch <- c.now
+	}
+	c.timers = c.timers[i:]
+}
+
+// Timers returns the number of timers which have yet to fire, and haven't been
+// stopped.
+func (c *FakeClock) Timers() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until there are at least n timers which have yet to
+// fire, returning the context's error if it's canceled first.
+func (c *FakeClock) WaitForTimers(ctx context.Context, n int) error {
+	for {
+		c.l.Lock()
+		pending, changedCh := len(c.timers), c.changedCh
+		c.l.Unlock()
+
+		if pending >= n {
+			return nil
+		}
+
+		select {
+		case <-changedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
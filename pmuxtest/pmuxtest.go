@@ -0,0 +1,19 @@
+// Package pmuxtest provides helpers for writing fast, deterministic tests of
+// code which uses pmuxlib to run processes, e.g. of how processes are
+// restarted. pmuxlib.BufferLogger can be used to capture the output of those
+// processes, and what pmux logs about them.
+package pmuxtest
+
+import "github.com/cryptic-io/pmux/pmuxlib"
+
+// WithClock returns a copy of the Config in which every process uses the given
+// Clock, which will usually be a FakeClock.
+func WithClock(cfg pmuxlib.Config, clock pmuxlib.Clock) pmuxlib.Config {
+	procs := make([]pmuxlib.ProcessConfig, len(cfg.Processes))
+	for i, procCfg := range cfg.Processes {
+		procCfg.Clock = clock
+		procs[i] = procCfg
+	}
+	cfg.Processes = procs
+	return cfg
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+// secretKeyRegexp matches env and var keys whose values are likely to be
+// secrets, and so shouldn't be printed.
+var secretKeyRegexp = regexp.MustCompile(
+	`(?i)(secret|passw|token|key|credential|auth|private)`,
+)
+
+func redactMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	redactedM := make(map[string]string, len(m))
+	for k, v := range m {
+		if secretKeyRegexp.MatchString(k) {
+			v = redacted
+		}
+		redactedM[k] = v
+	}
+	return redactedM
+}
+
+// redactConfig returns a copy of the Config with the values of any env vars or
+// vars which look like secrets, and any Vault credentials, registry token or
+// API tokens, replaced.
+func redactConfig(cfg pmuxlib.Config) pmuxlib.Config {
+
+	cfg.Vars = redactMap(cfg.Vars)
+
+	if cfg.Vault.Token != "" {
+		cfg.Vault.Token = redacted
+	}
+
+	if cfg.Vault.AppRole.SecretID != "" {
+		cfg.Vault.AppRole.SecretID = redacted
+	}
+
+	if cfg.Registry.Token != "" {
+		cfg.Registry.Token = redacted
+	}
+
+	tokens := make([]pmuxlib.APITokenConfig, len(cfg.APIAuth.Tokens))
+	for i, token := range cfg.APIAuth.Tokens {
+		if token.Token != "" {
+			token.Token = redacted
+		}
+		tokens[i] = token
+	}
+	cfg.APIAuth.Tokens = tokens
+
+	procs := make([]pmuxlib.ProcessConfig, len(cfg.Processes))
+	for i, procCfg := range cfg.Processes {
+		procCfg.Env = redactMap(procCfg.Env)
+		procs[i] = procCfg
+	}
+	cfg.Processes = procs
+
+	return cfg
+}
+
+// printConfig writes the given Config as YAML to the io.Writer, with defaults
+// applied and secrets redacted. The Config is expected to have already had its
+// templates expanded.
+func printConfig(w io.Writer, cfg pmuxlib.Config) error {
+
+	cfg = redactConfig(cfg.WithDefaults())
+
+	cfgB, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+
+	_, err = w.Write(cfgB)
+	return err
+}
+
+// printVersion writes the BuildInfo in a human readable form.
+func printVersion(w io.Writer, info pmuxlib.BuildInfo) {
+
+	features := strings.Join(info.Features, ", ")
+	if features == "" {
+		features = "none"
+	}
+
+	fmt.Fprintf(w, "pmux %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Fprintf(w, "commit:   %s\n", info.Commit)
+	}
+	if info.Date != "" {
+		fmt.Fprintf(w, "built:    %s\n", info.Date)
+	}
+	fmt.Fprintf(w, "go:       %s\n", info.GoVersion)
+	fmt.Fprintf(w, "platform: %s\n", info.Platform)
+	fmt.Fprintf(w, "features: %s\n", features)
+}
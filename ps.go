@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// psEntry is the JSON representation of a process output by `pmux ps -o json`.
+// Durations are given in seconds, so that they're easy to work with in tools
+// like jq.
+type psEntry struct {
+	Name          string  `json:"name"`
+	State         string  `json:"state"`
+	PID           int     `json:"pid,omitempty"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+	Restarts      int     `json:"restarts"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// LastExitCode is null if the process hasn't exited yet, and -1 if it was
+	// terminated by a signal.
+	LastExitCode *int `json:"lastExitCode"`
+}
+
+// runPsCommand prints each process in the running pmux, along with its state,
+// PID, uptime, restart count and last exit code. args are the arguments given
+// after "ps".
+func runPsCommand(cfg pmuxlib.Config, args []string, w io.Writer) error {
+
+	flags := flag.NewFlagSet("ps", flag.ContinueOnError)
+	output := flags.String("o", "table", `Output format, either "table" or "json"`)
+	selector := flags.String("l", "", "Only list processes matching the label selector")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf(`-o must be "table" or "json", not %q`, *output)
+	}
+
+	var sel pmuxlib.LabelSelector
+	if *selector != "" {
+		var err error
+		if sel, err = pmuxlib.ParseLabelSelector(*selector); err != nil {
+			return err
+		}
+	}
+
+	statuses, err := getStatuses(cfg)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]psEntry, 0, len(statuses))
+	for _, status := range statuses {
+		if !sel.Matches(status.Labels) {
+			continue
+		}
+
+		entry := psEntry{
+			Name:          status.Name,
+			State:         string(status.State),
+			PID:           status.PID,
+			UptimeSeconds: status.Uptime.Seconds(),
+			Restarts:      status.Restarts,
+			Labels:        status.Labels,
+		}
+
+		if status.LastExit != nil {
+			entry.LastExitCode = &status.LastExit.Code
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tLAST EXIT")
+
+	for _, entry := range entries {
+
+		pid, uptime, exit := "-", "-", "-"
+		if entry.PID != 0 {
+			pid = strconv.Itoa(entry.PID)
+			uptime = (time.Duration(entry.UptimeSeconds) * time.Second).String()
+		}
+		if entry.LastExitCode != nil {
+			exit = strconv.Itoa(*entry.LastExitCode)
+		}
+
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			entry.Name, entry.State, pid, uptime, entry.Restarts, exit,
+		)
+	}
+
+	return tw.Flush()
+}
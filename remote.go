@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// isURL returns true if the given config path is an HTTP(S) URL rather than a
+// path on the filesystem.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") ||
+		strings.HasPrefix(path, "https://")
+}
+
+// urlPath returns the path component of the given URL.
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// resolveURL resolves a possibly relative reference against a base URL.
+func resolveURL(baseURL, ref string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	refURL, err := base.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return refURL.String(), nil
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchURL GETs the body at the given URL. If etag is given then it is sent as
+// If-None-Match, and a nil body is returned if the server indicates that the
+// body hasn't changed.
+//
+// Along with the body the version of the body is returned, which is its ETag
+// if the server gave one, or otherwise a hash of the body.
+func fetchURL(
+	ctx context.Context, rawURL, etag string,
+) (
+	[]byte, string, error,
+) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected response status %q", res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading response body: %w", err)
+	}
+
+	version := res.Header.Get("ETag")
+	if version == "" {
+		h := sha256.Sum256(body)
+		version = hex.EncodeToString(h[:])
+	}
+
+	return body, version, nil
+}
+
+// remoteBody is the contents of a URL, along with their version (see
+// fetchURL).
+type remoteBody struct {
+	body    []byte
+	version string
+}
+
+// remoteConfigPoller periodically polls the URLs which a config was loaded
+// from, i.e. the config URL itself and any URLs it includes, and reports when
+// any of them have changed.
+type remoteConfigPoller struct {
+	interval time.Duration
+
+	// versions holds the version of the contents of each URL, as returned by
+	// fetchURL, which was last seen.
+	versions map[string]string
+}
+
+// newRemoteConfigPoller returns a remoteConfigPoller for the URLs which
+// versions is keyed by, the contents of each having last been seen at the
+// given version.
+func newRemoteConfigPoller(
+	interval time.Duration, versions map[string]string,
+) *remoteConfigPoller {
+	return &remoteConfigPoller{
+		interval: interval,
+		versions: versions,
+	}
+}
+
+// wait blocks until the contents of any of the URLs have changed, returning
+// the changed contents keyed by URL, or until the context is canceled,
+// returning its error. Errors encountered while polling are passed to onErr,
+// and polling continues.
+//
+// The returned contents should be used as-is, rather than being fetched again,
+// as they may have changed again in the meantime, and that change would then
+// be missed.
+func (p *remoteConfigPoller) wait(
+	ctx context.Context, onErr func(error),
+) (
+	map[string]remoteBody, error,
+) {
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	urls := make([]string, 0, len(p.versions))
+	for url := range p.versions {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		changed := map[string]remoteBody{}
+
+		for _, url := range urls {
+
+			// The ETag is only sent if the server gave one, otherwise the
+			// version is a hash of the body, which must be compared against
+			// directly.
+			etag := p.versions[url]
+			if !strings.Contains(etag, `"`) {
+				etag = ""
+			}
+
+			body, version, err := fetchURL(ctx, url, etag)
+			if err != nil {
+				onErr(fmt.Errorf("polling %q: %w", url, err))
+				continue
+			}
+
+			if body == nil || version == p.versions[url] {
+				continue
+			}
+
+			changed[url] = remoteBody{body: body, version: version}
+		}
+
+		if len(changed) == 0 {
+			continue
+		}
+
+		for url, body := range changed {
+			p.versions[url] = body.version
+		}
+
+		return changed, nil
+	}
+}
+
+// runRemoteConfig runs the given Config, which was loaded from the given
+// configSource with the given URL versions (see configSource.loadVersions),
+// until the context is canceled. Each of those URLs is polled at the given
+// interval, and if any of them change then the config is reloaded, and all
+// processes are stopped and restarted using the new config.
+func runRemoteConfig(
+	ctx context.Context,
+	cfg pmuxlib.Config,
+	versions map[string]string,
+	cfgSrc configSource,
+	interval time.Duration,
+) *pmuxlib.Shutdown {
+
+	logErr := func(err error) {
+		fmt.Fprintf(os.Stderr, "remote config: %v\n", err)
+	}
+
+	poller := newRemoteConfigPoller(interval, versions)
+
+	for {
+		runCtx, cancel := context.WithCancelCause(ctx)
+		newCfgCh := make(chan pmuxlib.Config, 1)
+
+		go func() {
+			for {
+				bodies, err := poller.wait(runCtx, logErr)
+				if err != nil {
+					return
+				}
+
+				newCfgSrc := cfgSrc
+				newCfgSrc.bodies = bodies
+
+				newCfg, newVersions, err := newCfgSrc.loadVersions()
+				if err != nil {
+					logErr(fmt.Errorf("loading changed config: %w", err))
+					continue
+				}
+
+				// the changed config may include different URLs than
+				// before.
+				poller = newRemoteConfigPoller(interval, newVersions)
+
+				newCfgCh <- newCfg
+				cancel(&pmuxlib.StopError{Reason: "remote config changed"})
+				return
+			}
+		}()
+
+		shutdown := runPmux(runCtx, cfg, nil)
+		cancel(nil)
+
+		select {
+		case cfg = <-newCfgCh:
+			fmt.Fprintln(os.Stderr, "remote config changed, reloading")
+		default:
+			return shutdown
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteConfigPoller(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		withETag bool
+	}{
+		{name: "etag", withETag: true},
+		{name: "hash"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var (
+				mu          sync.Mutex
+				bodies      = []string{"a", "a", "b", "c"}
+				gets        int
+				ifNoneMatch []string
+			)
+
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					body := bodies[len(bodies)-1]
+					if gets < len(bodies) {
+						body = bodies[gets]
+					}
+					gets++
+
+					ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+
+					if test.withETag {
+						etag := `"` + body + `"`
+						if r.Header.Get("If-None-Match") == etag {
+							rw.WriteHeader(http.StatusNotModified)
+							return
+						}
+						rw.Header().Set("ETag", etag)
+					}
+
+					rw.Write([]byte(body))
+				},
+			))
+			defer srv.Close()
+
+			ctx := context.Background()
+
+			// the first fetch is that of the initial config load.
+			_, version, err := fetchURL(ctx, srv.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			poller := newRemoteConfigPoller(
+				time.Millisecond, map[string]string{srv.URL: version},
+			)
+			onErr := func(err error) { t.Fatal(err) }
+
+			// each change is returned exactly once, with the body of the
+			// response which it was detected in.
+			for _, exp := range []string{"b", "c"} {
+				bodies, err := poller.wait(ctx, onErr)
+				if err != nil {
+					t.Fatal(err)
+				} else if body := bodies[srv.URL].body; string(body) != exp {
+					t.Fatalf("expected %q, got %q", exp, body)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			expIfNoneMatch := []string{"", "", "", ""}
+			if test.withETag {
+				expIfNoneMatch = []string{"", `"a"`, `"a"`, `"b"`}
+			}
+
+			for i, exp := range expIfNoneMatch {
+				if ifNoneMatch[i] != exp {
+					t.Fatalf(
+						"expected If-None-Match %q on request %d, got %q",
+						exp, i, ifNoneMatch[i],
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteConfigPollerIncludes(t *testing.T) {
+
+	var (
+		mu      sync.Mutex
+		include = "processes: [{name: a, cmd: a}]"
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch r.URL.Path {
+			case "/pmux.yml":
+				rw.Write([]byte("include: [include.yml]"))
+			case "/include.yml":
+				rw.Write([]byte(include))
+			default:
+				http.NotFound(rw, r)
+			}
+		},
+	))
+	defer srv.Close()
+
+	cfgURL, includeURL := srv.URL+"/pmux.yml", srv.URL+"/include.yml"
+
+	_, versions, err := loadConfig(cfgURL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 2 {
+		t.Fatalf("expected versions of both URLs, got %v", versions)
+	}
+
+	mu.Lock()
+	include = "processes: [{name: b, cmd: b}]"
+	mu.Unlock()
+
+	poller := newRemoteConfigPoller(time.Millisecond, versions)
+	bodies, err := poller.wait(context.Background(), func(err error) {
+		t.Fatal(err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(bodies) != 1 || bodies[includeURL].body == nil {
+		t.Fatalf("expected only %q to have changed, got %v", includeURL, bodies)
+	}
+
+	// the changed include is used as polled, rather than being fetched again.
+	mu.Lock()
+	include = "processes: [{name: c, cmd: c}]"
+	mu.Unlock()
+
+	cfg, _, err := loadConfig(cfgURL, "", bodies)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cfg.Processes) != 1 || cfg.Processes[0].Name != "b" {
+		t.Fatalf("expected process b, got %+v", cfg.Processes)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// `pmux export systemd` writes a systemd service unit for each process, which
+// runs it in as close a way to pmux as systemd allows. Settings which have no
+// systemd equivalent are listed in a comment at the top of the unit.
+
+// systemdUnitNameRegexp matches process names which can be used as the name
+// of a unit.
+var systemdUnitNameRegexp = regexp.MustCompile(`^[A-Za-z0-9:_.\\-]+$`)
+
+// systemdEscape escapes the specifiers which systemd would otherwise expand
+// within a setting's value. Settings which take a single value, such as
+// WorkingDirectory= and User=, are used as-is, and so need nothing more.
+func systemdEscape(str string) string {
+	return strings.ReplaceAll(str, "%", "%%")
+}
+
+// systemdQuote quotes the string for use as a single word within a setting
+// which takes a list of words, such as Environment=, if necessary, and escapes
+// the specifiers which systemd would otherwise expand.
+func systemdQuote(str string) string {
+
+	str = systemdEscape(str)
+
+	if str != "" && !strings.ContainsAny(str, " \t\n\"'\\;") {
+		return str
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range str {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// systemdCommand returns the command line for use in ExecStart= and the like,
+// which, unlike other settings, also expand environment variables.
+func systemdCommand(name string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{name}, args...) {
+		words = append(words, systemdQuote(strings.ReplaceAll(word, "$", "$$")))
+	}
+	return strings.Join(words, " ")
+}
+
+func systemdSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// systemdRestartPrevent returns the RestartPreventExitStatus values matching
+// the same exits as the ExitMatcher, or false if there are none.
+func systemdRestartPrevent(m pmuxlib.ExitMatcher) ([]string, bool) {
+
+	str := string(m)
+
+	if _, err := strconv.Atoi(str); err == nil {
+		return []string{str}, true
+	}
+
+	if strings.HasPrefix(str, "SIG") {
+		return []string{str}, true
+	}
+
+	if minStr, maxStr, ok := strings.Cut(str, "-"); ok {
+		min, minErr := strconv.Atoi(minStr)
+		max, maxErr := strconv.Atoi(maxStr)
+		if minErr == nil && maxErr == nil {
+			var codes []string
+			for code := min; code <= max && code <= 255; code++ {
+				codes = append(codes, strconv.Itoa(code))
+			}
+			return codes, true
+		}
+	}
+
+	return nil, false
+}
+
+// writeSystemdUnit writes a systemd service unit which runs the process, which
+// should have had its templates expanded and defaults filled in.
+func writeSystemdUnit(w io.Writer, cfg pmuxlib.ProcessConfig) {
+
+	var (
+		unsupported []string
+		unit        = new(bytes.Buffer)
+		service     = new(bytes.Buffer)
+	)
+
+	unsupportedIf := func(cond bool, field string) {
+		if cond {
+			unsupported = append(unsupported, field)
+		}
+	}
+
+	unsupportedIf(len(cfg.Secrets) > 0, "secrets")
+	unsupportedIf(cfg.ReadyCheck.Cmd != "", "readyCheck")
+	unsupportedIf(len(cfg.WaitFor) > 0, "waitFor")
+	unsupportedIf(len(cfg.Listen) > 0, "listen")
+	unsupportedIf(len(cfg.Streams) > 0, "streams")
+	unsupportedIf(len(cfg.Watch) > 0, "watch")
+	unsupportedIf(cfg.Register != nil, "register")
+	unsupportedIf(cfg.Hooks.OnCrash.Cmd != "", "hooks.onCrash")
+	unsupportedIf(cfg.CrashReport.Dir != "", "crashReport")
+	unsupportedIf(cfg.CircuitBreaker.Failures > 0, "circuitBreaker")
+	unsupportedIf(cfg.RestartWindow != "", "restartWindow")
+	unsupportedIf(cfg.NoRestartDuring != "", "noRestartDuring")
+	unsupportedIf(cfg.AdoptPIDFile != "", "adoptPIDFile")
+	unsupportedIf(cfg.LogLevels != nil, "logLevels")
+	unsupportedIf(len(cfg.Path) > 0, "path")
+	unsupportedIf(cfg.FallbackCmd != "", "fallbackCmd")
+	unsupportedIf(cfg.Retries > 0, "retries")
+	unsupportedIf(cfg.LingeringOutput != "", "lingeringOutput")
+	unsupportedIf(cfg.Scripts != (pmuxlib.ScriptsConfig{}), "scripts")
+
+	fmt.Fprintf(unit, "Description=pmux process %s\n", cfg.Name)
+	fmt.Fprintln(unit, "After=network.target")
+
+	fmt.Fprintln(service, "Type=simple")
+
+	name, args := cfg.Cmd, []string(cfg.Args)
+	if cfg.Shell {
+		// the same as pmux does, see ProcessConfig.Shell.
+		name, args = "/bin/sh", append([]string{"-c", cfg.Cmd, cfg.Name}, args...)
+	}
+	fmt.Fprintf(service, "ExecStart=%s\n", systemdCommand(name, args...))
+
+	if cfg.Dir != "" {
+		fmt.Fprintf(service, "WorkingDirectory=%s\n", systemdEscape(cfg.Dir))
+	}
+
+	if cfg.Chroot != "" {
+		fmt.Fprintf(service, "RootDirectory=%s\n", systemdEscape(cfg.Chroot))
+	}
+
+	if cfg.User != "" {
+		fmt.Fprintf(service, "User=%s\n", systemdEscape(cfg.User))
+	}
+
+	if cfg.Group != "" {
+		fmt.Fprintf(service, "Group=%s\n", systemdEscape(cfg.Group))
+	}
+
+	if len(cfg.AmbientCaps) > 0 {
+		fmt.Fprintf(
+			service, "AmbientCapabilities=%s\n", strings.Join(cfg.AmbientCaps, " "),
+		)
+	}
+
+	if len(cfg.DropCaps) > 0 {
+		dropCaps := make([]string, len(cfg.DropCaps))
+		for i, dropCap := range cfg.DropCaps {
+			dropCaps[i] = "CAP_" + strings.TrimPrefix(strings.ToUpper(dropCap), "CAP_")
+		}
+		fmt.Fprintf(
+			service, "CapabilityBoundingSet=~%s\n", strings.Join(dropCaps, " "),
+		)
+	}
+
+	if cfg.Umask != "" {
+		fmt.Fprintf(service, "UMask=%s\n", cfg.Umask)
+	}
+
+	// systemd doesn't pass its own environment to services, so only PassEnv
+	// is relevant, regardless of ClearEnv.
+	if len(cfg.PassEnv) > 0 {
+		fmt.Fprintf(
+			service, "PassEnvironment=%s\n", strings.Join(cfg.PassEnv, " "),
+		)
+	}
+
+	envKeys := make([]string, 0, len(cfg.Env))
+	for k := range cfg.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+
+	for _, k := range envKeys {
+		fmt.Fprintf(
+			service, "Environment=%s\n", systemdQuote(k+"="+cfg.Env[k]),
+		)
+	}
+
+	envFromKeys := make([]string, 0, len(cfg.EnvFrom))
+	for k := range cfg.EnvFrom {
+		envFromKeys = append(envFromKeys, "envFrom."+k)
+	}
+	sort.Strings(envFromKeys)
+	unsupported = append(unsupported, envFromKeys...)
+
+	for _, v := range []struct{ k, v string }{{"TZ", cfg.TZ}, {"LANG", cfg.Lang}} {
+		if v.v != "" {
+			fmt.Fprintf(service, "Environment=%s\n", systemdQuote(v.k+"="+v.v))
+		}
+	}
+
+	for _, hook := range []struct {
+		directive string
+		cfg       pmuxlib.HookConfig
+	}{
+		{"ExecStartPre", cfg.Hooks.PreStart},
+		{"ExecStartPost", cfg.Hooks.PostStart},
+		{"ExecStop", cfg.Hooks.PreStop},
+		{"ExecStopPost", cfg.Hooks.PostStop},
+	} {
+		if hook.cfg.Cmd == "" {
+			continue
+		}
+
+		// a "-" prefix causes failures of the command to be ignored.
+		prefix := "-"
+		if hook.cfg.Fatal {
+			prefix = ""
+		}
+
+		fmt.Fprintf(
+			service, "%s=%s%s\n",
+			hook.directive, prefix, systemdCommand("/bin/sh", "-c", hook.cfg.Cmd),
+		)
+	}
+
+	// pmux stops processes by sending SIGINT to their process group, and
+	// sends SIGKILL after SigKillWait.
+	fmt.Fprintln(service, "KillSignal=SIGINT")
+	fmt.Fprintf(service, "TimeoutStopSec=%s\n", systemdSeconds(cfg.SigKillWait))
+
+	restart := "always"
+	var preventStatus []string
+	for _, code := range cfg.NoRestartOn {
+		preventStatus = append(preventStatus, strconv.Itoa(code))
+	}
+
+	for _, m := range cfg.NoRestartOnExit {
+		if m == "any" {
+			restart = "no"
+			continue
+		}
+
+		statuses, ok := systemdRestartPrevent(m)
+		if !ok {
+			unsupported = append(unsupported, fmt.Sprintf("noRestartOnExit %q", m))
+		}
+		preventStatus = append(preventStatus, statuses...)
+	}
+
+	// systemd's on-failure doesn't restart after a clean exit, as with
+	// OneShot.
+	if cfg.OneShot && restart == "always" {
+		restart = "on-failure"
+	}
+
+	fmt.Fprintf(service, "Restart=%s\n", restart)
+	if len(preventStatus) > 0 {
+		fmt.Fprintf(
+			service, "RestartPreventExitStatus=%s\n",
+			strings.Join(preventStatus, " "),
+		)
+	}
+
+	// pmux doubles the wait between restarts after each failed start, from
+	// MinWait up to MaxWait, which systemd approximates with RestartSteps.
+	fmt.Fprintf(service, "RestartSec=%s\n", systemdSeconds(cfg.MinWait))
+	if cfg.MaxWait > cfg.MinWait && cfg.MinWait > 0 {
+		steps := math.Ceil(math.Log2(float64(cfg.MaxWait) / float64(cfg.MinWait)))
+		fmt.Fprintf(service, "RestartSteps=%d\n", int(steps))
+		fmt.Fprintf(
+			service, "RestartMaxDelaySec=%s\n", systemdSeconds(cfg.MaxWait),
+		)
+	}
+
+	unsupportedIf(cfg.MaxRestarts > 0, "maxRestarts")
+
+	if cfg.MaxRunTime > 0 {
+		fmt.Fprintf(service, "RuntimeMaxSec=%s\n", systemdSeconds(cfg.MaxRunTime))
+	}
+
+	switch {
+	case cfg.StdoutTo == pmuxlib.OutputStreamDiscard:
+		fmt.Fprintln(service, "StandardOutput=null")
+	case cfg.LogFile != "":
+		fmt.Fprintf(service, "StandardOutput=append:%s\n", cfg.LogFile)
+	}
+
+	switch {
+	case cfg.StderrTo == pmuxlib.OutputStreamDiscard:
+		fmt.Fprintln(service, "StandardError=null")
+	case cfg.LogFile != "":
+		fmt.Fprintf(service, "StandardError=append:%s\n", cfg.LogFile)
+	}
+
+	fmt.Fprintf(w, "# Generated by `pmux export systemd` from process %q.\n", cfg.Name)
+	if len(unsupported) > 0 {
+		fmt.Fprintf(
+			w, "# These settings have no systemd equivalent, and were omitted:\n# %s\n",
+			strings.Join(unsupported, ", "),
+		)
+	}
+
+	fmt.Fprintf(w, "\n[Unit]\n%s\n[Service]\n%s", unit, service)
+
+	// processes which aren't autostarted are only started when asked to be.
+	if cfg.Autostart == nil || *cfg.Autostart {
+		fmt.Fprint(w, "\n[Install]\nWantedBy=multi-user.target\n")
+	}
+}
+
+// runExportCommand runs `pmux export systemd`, writing a unit file for each
+// process in the Config.
+func runExportCommand(cfg pmuxlib.Config, args []string) error {
+
+	if len(args) < 2 || args[1] != "systemd" {
+		return errors.New("usage: pmux export systemd [-o <dir>]")
+	}
+
+	flags := flag.NewFlagSet("export systemd", flag.ContinueOnError)
+	outDir := flags.String(
+		"o", ".", "Directory to write the unit files to.",
+	)
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	cfg, err := cfg.ExpandProcesses().ExpandTemplates()
+	if err != nil {
+		return err
+	}
+	cfg = cfg.WithDefaults()
+
+	for _, procCfg := range cfg.Processes {
+
+		if procCfg.Type == pmuxlib.ProcessTypeContainer {
+			return fmt.Errorf(
+				"process %q is run in a container, which can't be exported",
+				procCfg.Name,
+			)
+		}
+
+		if procCfg.Type == pmuxlib.ProcessTypePipeline {
+			return fmt.Errorf(
+				"process %q is a pipeline, which can't be exported",
+				procCfg.Name,
+			)
+		}
+
+		if !systemdUnitNameRegexp.MatchString(procCfg.Name) {
+			return fmt.Errorf(
+				"process name %q can't be used as the name of a unit",
+				procCfg.Name,
+			)
+		}
+
+		buf := new(bytes.Buffer)
+		writeSystemdUnit(buf, procCfg)
+
+		path := filepath.Join(*outDir, procCfg.Name+".service")
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("writing %q: %w", path, err)
+		}
+
+		fmt.Fprintln(os.Stderr, "wrote", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestSystemdQuoting(t *testing.T) {
+
+	tests := []struct {
+		str                 string
+		expEscape, expQuote string
+		expCommand          string
+	}{
+		{
+			str:        "plain",
+			expEscape:  "plain",
+			expQuote:   "plain",
+			expCommand: "plain",
+		},
+		{
+			str:        "100%",
+			expEscape:  "100%%",
+			expQuote:   "100%%",
+			expCommand: "100%%",
+		},
+		{
+			str:        "$HOME",
+			expEscape:  "$HOME",
+			expQuote:   "$HOME",
+			expCommand: "$$HOME",
+		},
+		{
+			str:        `/srv/my app`,
+			expEscape:  `/srv/my app`,
+			expQuote:   `"/srv/my app"`,
+			expCommand: `"/srv/my app"`,
+		},
+		{
+			str:        "a \"b\"\n$c",
+			expEscape:  "a \"b\"\n$c",
+			expQuote:   `"a \"b\"\n$c"`,
+			expCommand: `"a \"b\"\n$$c"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			if got := systemdEscape(test.str); got != test.expEscape {
+				t.Errorf("systemdEscape: expected %q, got %q", test.expEscape, got)
+			}
+			if got := systemdQuote(test.str); got != test.expQuote {
+				t.Errorf("systemdQuote: expected %q, got %q", test.expQuote, got)
+			}
+			if got := systemdCommand(test.str); got != test.expCommand {
+				t.Errorf("systemdCommand: expected %q, got %q", test.expCommand, got)
+			}
+		})
+	}
+}
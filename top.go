@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// topInterval is how often `pmux top` refreshes its table.
+const topInterval = 2 * time.Second
+
+// topSample is the CPU time used by a process at a point in time, from which
+// its CPU usage between two samples is calculated.
+type topSample struct {
+	pid     int
+	cpu     time.Duration
+	sampled time.Time
+}
+
+// formatBytes formats the number of bytes using the largest binary unit which
+// keeps it at or above 1.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// writeTopTable writes a table describing the resource usage of each process
+// to the io.Writer. The CPU usage of each process is calculated relative to its
+// entry in samples, which are then replaced with new ones.
+func writeTopTable(
+	w io.Writer,
+	statuses []pmuxlib.ProcessStatus,
+	samples map[string]topSample,
+	now time.Time,
+) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPID\tCPU%\tRSS\tUPTIME\tRESTARTS")
+
+	for _, status := range statuses {
+
+		pid, cpu, rss, uptime := "-", "-", "-", "-"
+
+		if status.Running {
+			pid = strconv.Itoa(status.PID)
+			uptime = status.Uptime.Round(time.Second).String()
+		}
+
+		if status.Usage != nil {
+			rss = formatBytes(status.Usage.RSS)
+
+			sample := topSample{
+				pid:     status.PID,
+				cpu:     status.Usage.UserTime + status.Usage.SystemTime,
+				sampled: now,
+			}
+
+			if prev, ok := samples[status.Name]; ok && prev.pid == sample.pid {
+				elapsed := sample.sampled.Sub(prev.sampled)
+				if elapsed > 0 {
+					cpu = fmt.Sprintf(
+						"%.1f", 100*float64(sample.cpu-prev.cpu)/float64(elapsed),
+					)
+				}
+			}
+
+			samples[status.Name] = sample
+
+		} else {
+			delete(samples, status.Name)
+		}
+
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%d\n",
+			status.Name, pid, cpu, rss, uptime, status.Restarts,
+		)
+	}
+
+	return tw.Flush()
+}
+
+// runTopCommand renders a table describing the resource usage of each process
+// in the running pmux to the io.Writer, refreshing it every topInterval, until
+// pmux receives SIGINT or SIGTERM.
+func runTopCommand(cfg pmuxlib.Config, w io.Writer) error {
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	samples := map[string]topSample{}
+
+	for {
+		statuses, err := getStatuses(cfg)
+		if err != nil {
+			return err
+		}
+
+		// the table is rendered into a buffer first, so that the screen is
+		// cleared and redrawn in a single write, avoiding flicker.
+		now := time.Now()
+		buf := new(bytes.Buffer)
+		buf.WriteString("\033[H\033[2J")
+		fmt.Fprintf(buf, "pmux top - %s\n\n", now.Format("15:04:05"))
+
+		if err := writeTopTable(buf, statuses, samples, now); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
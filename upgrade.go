@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cryptic-io/pmux/pmuxlib"
+)
+
+// `pmux upgrade` hands supervision of the processes of a running pmux over to
+// a new one, without stopping them. The new pmux listens on a temporary unix
+// socket and asks the running one, via its control socket, to connect to it.
+// The running pmux then sends a JSON encoded pmuxlib.Handoff over that
+// connection, along with the pipes which its processes' output is read from
+// and their listen sockets (as SCM_RIGHTS). Once the new pmux acknowledges
+// the handoff the running one exits, and until then it carries on supervising
+// the processes. The new pmux knows that the old one has exited once the
+// connection is closed.
+//
+// Only a pmux running as the same user may request a handoff, and the socket
+// must be in a private directory of the kind which `pmux upgrade` creates.
+
+const (
+	// handoffTimeout is how long `pmux upgrade` waits for the running pmux to
+	// hand off its processes and exit.
+	handoffTimeout = 30 * time.Second
+
+	// handoffMaxFiles is the most files which can be handed off, as that's
+	// the most which a single SCM_RIGHTS message may hold.
+	handoffMaxFiles = 253
+
+	// handoffDirPrefix is the prefix of the name of the temporary directory
+	// which `pmux upgrade` creates its socket in.
+	handoffDirPrefix = "pmux-upgrade-"
+
+	// handoffAck is sent by the new pmux once it has received the handoff.
+	handoffAck = "ok\n"
+)
+
+// checkHandoffSocket returns an error if the unix socket at the given path
+// isn't in a directory created by `pmux upgrade` running as the same user as
+// this pmux, i.e. one which no other user could have placed it in.
+func checkHandoffSocket(socketPath string) error {
+
+	dir := filepath.Dir(socketPath)
+	if !strings.HasPrefix(filepath.Base(dir), handoffDirPrefix) {
+		return fmt.Errorf("%q is not a pmux upgrade socket", socketPath)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("checking dir of %q: %w", socketPath, err)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok {
+		return fmt.Errorf("%q is not a directory", dir)
+	} else if int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%q is not a private directory owned by pmux's user", dir)
+	}
+
+	return nil
+}
+
+// checkPeerUID returns an error if the process at the other end of the unix
+// socket connection isn't running as the same user as this pmux.
+func checkPeerUID(conn syscall.Conn) error {
+	if uid, err := peerUID(conn); err != nil {
+		return fmt.Errorf("getting peer credentials: %w", err)
+	} else if uid != os.Getuid() {
+		return fmt.Errorf("peer is running as uid %d, not %d", uid, os.Getuid())
+	}
+	return nil
+}
+
+// sendHandoff connects to the unix socket at the given path, sends the Handoff
+// over it, and waits for the receiving pmux to acknowledge it. The returned
+// connection should be left open until this pmux exits.
+func sendHandoff(socketPath string, h pmuxlib.Handoff) (*net.UnixConn, error) {
+
+	if err := checkHandoffSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for _, hp := range h.Processes {
+		for _, f := range hp.Files {
+			fds = append(fds, int(f.Fd()))
+		}
+		for _, f := range hp.ListenFiles {
+			fds = append(fds, int(f.Fd()))
+		}
+	}
+
+	if len(fds) > handoffMaxFiles {
+		return nil, fmt.Errorf(
+			"%d files would need to be handed off, but at most %d can be",
+			len(fds), handoffMaxFiles,
+		)
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("encoding handoff: %w", err)
+	}
+
+	conn, err := net.DialUnix(
+		"unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %q: %w", socketPath, err)
+	}
+
+	if err := checkPeerUID(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to %q: %w", socketPath, err)
+	}
+
+	n, _, err := conn.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+	if err == nil && n < len(b) {
+		_, err = conn.Write(b[n:])
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending handoff: %w", err)
+	}
+
+	// if the receiving pmux fails to take the handoff then this one must
+	// carry on supervising the processes.
+	_ = conn.SetReadDeadline(time.Now().Add(handoffTimeout))
+
+	ack := make([]byte, len(handoffAck))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("waiting for handoff to be acknowledged: %w", err)
+	} else if string(ack) != handoffAck {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected handoff acknowledgement %q", ack)
+	}
+
+	return conn, nil
+}
+
+// handoffHandler returns a handler for the control API endpoint which hands
+// off the Pmux's processes to the pmux listening on the unix socket given by
+// the "socket" query parameter. Once the processes have been handed off exit
+// is called, which should exit this pmux without stopping them.
+//
+// Only clients running as the same user as this pmux may use the endpoint,
+// regardless of their APIRole, see controlConnKey.
+func handoffHandler(p *pmuxlib.Pmux, exit func()) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		peer, ok := r.Context().Value(controlConnKey{}).(syscall.Conn)
+		if !ok {
+			http.Error(rw, "peer credentials are unavailable", http.StatusForbidden)
+			return
+		} else if err := checkPeerUID(peer); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		socketPath := r.FormValue("socket")
+		if socketPath == "" {
+			http.Error(rw, "socket is required", http.StatusBadRequest)
+			return
+		}
+
+		var conn *net.UnixConn
+		err := p.Handoff(func(h pmuxlib.Handoff) error {
+			var err error
+			conn, err = sendHandoff(socketPath, h)
+			return err
+		})
+		if err != nil {
+			http.Error(rw, err.Error(), controlErrStatus(err))
+			return
+		}
+		defer conn.Close()
+
+		// the response must be sent in full before exiting, so its length is
+		// given up front rather than it being chunked.
+		const body = "ok\n"
+		rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = io.WriteString(rw, body)
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		exit()
+	}
+}
+
+// receiveHandoff accepts a connection from a pmux handing off its processes,
+// acknowledges the Handoff it sends, and returns it once that pmux has exited.
+func receiveHandoff(l *net.UnixListener) (pmuxlib.Handoff, error) {
+
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf("accepting connection: %w", err)
+	}
+	defer conn.Close()
+
+	if err := checkPeerUID(conn); err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf("accepting connection: %w", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(handoffTimeout))
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(handoffMaxFiles*4))
+
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf("reading handoff: %w", err)
+	} else if flags&syscall.MSG_CTRUNC != 0 {
+		return pmuxlib.Handoff{}, errors.New("handed off pipes were truncated")
+	}
+
+	var files []*os.File
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf("parsing handed off pipes: %w", err)
+	}
+
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return pmuxlib.Handoff{}, fmt.Errorf(
+				"parsing handed off pipes: %w", err,
+			)
+		}
+
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+
+	var h pmuxlib.Handoff
+
+	err = json.NewDecoder(io.MultiReader(bytes.NewReader(buf[:n]), conn)).
+		Decode(&h)
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return pmuxlib.Handoff{}, fmt.Errorf("decoding handoff: %w", err)
+	}
+
+	take := func(k int) []*os.File {
+		if k > len(files) {
+			k = len(files)
+		}
+		taken := files[:k]
+		files = files[k:]
+		return taken
+	}
+
+	for i := range h.Processes {
+		hp := &h.Processes[i]
+		hp.Files = take(len(hp.Outputs))
+		hp.ListenFiles = take(hp.Listen)
+	}
+
+	if _, err := io.WriteString(conn, handoffAck); err != nil {
+		for _, hp := range h.Processes {
+			closeHandoffFiles(hp)
+		}
+		return pmuxlib.Handoff{}, fmt.Errorf("acknowledging handoff: %w", err)
+	}
+
+	// the old pmux closes the connection by exiting, after which it's no
+	// longer listening on any addresses which this one may need.
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		fmt.Fprintf(
+			os.Stderr, "old pmux did not exit after handing off: %v\n", err,
+		)
+	}
+
+	return h, nil
+}
+
+// requestHandoff asks the pmux listening on the Config's control socket to hand
+// off its processes, and returns the Handoff once it has done so and exited.
+func requestHandoff(cfg pmuxlib.Config) (pmuxlib.Handoff, error) {
+
+	if cfg.ControlSocket == "" {
+		return pmuxlib.Handoff{}, errors.New(
+			"controlSocket is not set in the config",
+		)
+	}
+
+	dir, err := os.MkdirTemp("", handoffDirPrefix)
+	if err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "handoff.sock")
+
+	l, err := net.ListenUnix(
+		"unix", &net.UnixAddr{Name: socketPath, Net: "unix"},
+	)
+	if err != nil {
+		return pmuxlib.Handoff{}, fmt.Errorf(
+			"listening on %q: %w", socketPath, err,
+		)
+	}
+	defer l.Close()
+
+	_ = l.SetDeadline(time.Now().Add(handoffTimeout))
+
+	type result struct {
+		h   pmuxlib.Handoff
+		err error
+	}
+
+	resCh := make(chan result, 1)
+	go func() {
+		h, err := receiveHandoff(l)
+		resCh <- result{h, err}
+	}()
+
+	_, err = controlRequest(
+		cfg.ControlSocket, http.MethodPost, "/handoff",
+		url.Values{"socket": {socketPath}},
+	)
+	if err != nil {
+		l.Close()
+		if res := <-resCh; res.err == nil {
+			for _, hp := range res.h.Processes {
+				closeHandoffFiles(hp)
+			}
+		}
+		return pmuxlib.Handoff{}, fmt.Errorf("requesting handoff: %w", err)
+	}
+
+	res := <-resCh
+	return res.h, res.err
+}
+
+// closeHandoffFiles closes the Files and ListenFiles of the HandoffProcess.
+func closeHandoffFiles(hp pmuxlib.HandoffProcess) {
+	for _, f := range hp.Files {
+		f.Close()
+	}
+	for _, f := range hp.ListenFiles {
+		f.Close()
+	}
+}